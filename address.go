@@ -0,0 +1,115 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"net/mail"
+	re "regexp"
+	"strings"
+
+	"github.com/husobee/vestigo"
+)
+
+// localpartPattern matches the dot-atom local parts relay messages can be
+// addressed to, up to the RFC 5321 limit of 64 characters.
+var localpartPattern *re.Regexp = re.MustCompile("^[A-Za-z0-9!#$%&'*+/=?^_`{|}~.-]{1,64}$")
+
+// RequireLocalpart rejects requests whose localpart parameter is empty or
+// couldn't be a local part, with a 400, rather than querying for it.
+func RequireLocalpart(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		localpart := vestigo.Param(r, "localpart")
+		if localpart == "" {
+			writeJSONError(w, r, http.StatusBadRequest, "bad_request", "localpart must not be empty")
+			return
+		} else if !localpartPattern.MatchString(localpart) {
+			writeJSONError(w, r, http.StatusBadRequest, "bad_request", "localpart is not a valid email local part")
+			return
+		}
+		h(w, r)
+	}
+}
+
+// addressParser decodes RFC 2047 encoded display names.
+var addressParser = &mail.AddressParser{WordDecoder: &mime.WordDecoder{}}
+
+// DisplayNames returns the display names of the sender, from the From
+// header, and of the recipient rcpt, from whichever of To or Cc lists it,
+// or the first To address when neither does. Names which are missing, or
+// headers which can't be parsed, give "".
+func DisplayNames(headers []map[string]string, rcpt string) (fromName, toName string) {
+	if addrs, err := addressParser.ParseList(headerValue(headers, "From")); err == nil && len(addrs) > 0 {
+		fromName = addrs[0].Name
+	}
+	first := true
+	for _, name := range []string{"To", "Cc"} {
+		addrs, err := addressParser.ParseList(headerValue(headers, name))
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if strings.EqualFold(addr.Address, rcpt) {
+				return fromName, addr.Name
+			}
+			if first && name == "To" {
+				toName, first = addr.Name, false
+			}
+		}
+	}
+	return fromName, toName
+}
+
+// NormalizeAddress lowercases the domain of an email address, which is
+// case-insensitive. The local part is only lowercased when lowerLocal is
+// set, since strictly speaking it's up to the receiving server.
+func NormalizeAddress(addr string, lowerLocal bool) string {
+	if lowerLocal {
+		return strings.ToLower(addr)
+	}
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		return addr
+	}
+	return addr[:at+1] + strings.ToLower(addr[at+1:])
+}
+
+// addressDomain returns the lowercased domain of an email address, or ""
+// when it has none.
+func addressDomain(addr string) string {
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSuffix(addr[at+1:], "."))
+}
+
+// normalizeLocalpart prepares a localpart from a request for matching
+// against stored recipients, which were normalized with NormalizeAddress.
+func (p *RelayMsgParser) normalizeLocalpart(localpart string) string {
+	if p.LowercaseLocalpart {
+		return strings.ToLower(localpart)
+	}
+	return localpart
+}
+
+// BaseAddress removes a +tag subaddress from the local part of addr, so
+// user+tag@example.com becomes user@example.com.
+func BaseAddress(addr string) string {
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		return addr
+	}
+	plus := strings.Index(addr[:at], "+")
+	if plus < 0 {
+		return addr
+	}
+	return addr[:plus] + addr[at:]
+}
+
+// recipientColumn is the column summaries match a recipient against.
+func (p *RelayMsgParser) recipientColumn() string {
+	if p.Subaddressing {
+		return "smtp_to_base"
+	}
+	return "smtp_to"
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeAddress(t *testing.T) {
+	tests := []struct {
+		addr       string
+		lowerLocal bool
+		want       string
+	}{
+		{"User@Example.COM", false, "User@example.com"},
+		{"User@Example.COM", true, "user@example.com"},
+		{"User+News@Example.COM", false, "User+News@example.com"},
+		{"User+News@Example.COM", true, "user+news@example.com"},
+		{`"A@B"@Example.com`, false, `"A@B"@example.com`},
+		{"NoDomain", false, "NoDomain"},
+		{"NoDomain", true, "nodomain"},
+	}
+	for _, tt := range tests {
+		if got := NormalizeAddress(tt.addr, tt.lowerLocal); got != tt.want {
+			t.Errorf("NormalizeAddress(%q, %t) = %q, want %q", tt.addr, tt.lowerLocal, got, tt.want)
+		}
+	}
+}
+
+func TestBaseAddress(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"user@example.com", "user@example.com"},
+		{"user+news@example.com", "user@example.com"},
+		{"User+News+2024@example.com", "User@example.com"},
+		{"+news@example.com", "@example.com"},
+		{"user@ex+ample.com", "user@ex+ample.com"},
+		{"user+news", "user+news"},
+	}
+	for _, tt := range tests {
+		if got := BaseAddress(tt.addr); got != tt.want {
+			t.Errorf("BaseAddress(%q) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
+
+// TestRecipientCase stores a message and asks for a summary, checking
+// whether the summary's query matches the stored recipient.
+func TestRecipientCase(t *testing.T) {
+	tests := []struct {
+		name       string
+		lowerLocal bool
+		subaddress bool
+		to         string
+		localpart  string
+		match      bool
+	}{
+		{"domain case", false, false, "user@Example.COM", "user", true},
+		{"localpart case kept", false, false, "User@example.com", "User", true},
+		{"localpart case differs", false, false, "User@example.com", "user", false},
+		{"lowercase localpart", true, false, "User@Example.COM", "user", true},
+		{"lowercase localpart query", true, false, "user@example.com", "USER", true},
+		{"subaddress domain case", false, true, "user+news@EXAMPLE.com", "user", true},
+		{"subaddress localpart case differs", false, true, "User+News@example.com", "user", false},
+		{"subaddress lowercase localpart", true, true, "User+News@EXAMPLE.com", "uSeR", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &RelayMsgParser{LowercaseLocalpart: tt.lowerLocal, Subaddressing: tt.subaddress}
+			ts := newTestServer(t, p, nil, anyRows(storeRows, summaryRows))
+			event := relayEvent(t, "sender@example.org", tt.to, "hi", "Subject: hi\r\n\r\nhi\r\n")
+			if err := p.ParseEvent(context.Background(), event, "req"); err != nil {
+				t.Fatal(err)
+			}
+			col := "smtp_to"
+			if tt.subaddress {
+				col = "smtp_to_base"
+			}
+			stored := storedColumn(t, ts.DB, col)
+			if len(stored) != 1 {
+				t.Fatalf("%d messages stored", len(stored))
+			}
+
+			if status, body := get(t, ts, "/summary/"+tt.localpart, nil); status != 200 {
+				t.Fatalf("status %d: %s", status, body)
+			}
+			queries := ts.DB.Queries("count(distinct(smtp_from))")
+			if len(queries) != 1 {
+				t.Fatalf("%d summary queries", len(queries))
+			}
+			// The query matches $1 ||'@'|| $2.
+			args := queries[0].Args
+			queried := fmt.Sprintf("%v@%v", args[0], args[1])
+			if match := queried == stored[0]; match != tt.match {
+				t.Errorf("stored %q, queried %q: match = %t, want %t", stored[0], queried, match, tt.match)
+			}
+		})
+	}
+}
+
+func TestRequireLocalpart(t *testing.T) {
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/summary/user", http.StatusOK},
+		{"/summary/first.last", http.StatusOK},
+		{"/summary/", http.StatusBadRequest},
+		{"/summary//senders", http.StatusBadRequest},
+		{"/summary/%20", http.StatusBadRequest},
+		{"/summary/user@example.com", http.StatusBadRequest},
+		{"/summary/us%22er", http.StatusBadRequest},
+		{"/summary/" + strings.Repeat("a", 65), http.StatusBadRequest},
+		{"/summary/" + strings.Repeat("a", 64), http.StatusOK},
+		{"/threads/%3Bdrop", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		ts := newTestServer(t, &RelayMsgParser{}, nil, summaryRows)
+		status, body := get(t, ts, tt.path, nil)
+		if status != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.path, status, tt.status, body)
+		}
+		if n := len(ts.DB.Queries("")); status == http.StatusBadRequest && n != 0 {
+			t.Errorf("%s: %d queries for an invalid localpart", tt.path, n)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// IsAdmin reports whether the request carries the admin token, as
+// "Authorization: Bearer <token>". Admin access is disabled when no token
+// is configured.
+func (p *RelayMsgParser) IsAdmin(r *http.Request) bool {
+	if p.AdminToken == "" {
+		return false
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(p.AdminToken)) == 1
+}
+
+// RequireAdmin wraps a handler so that only admin requests reach it.
+func (p *RelayMsgParser) RequireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !p.IsAdmin(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSONError(w, r, http.StatusUnauthorized, "unauthorized", "Unauthorized")
+			return
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	re "regexp"
+	"strconv"
+	"strings"
+)
+
+// AuthResults holds the spam and sender authentication verdicts found in a
+// relay message's headers. Verdicts are empty when they weren't reported.
+type AuthResults struct {
+	SPF       string   `json:"spf"`
+	DKIM      string   `json:"dkim"`
+	DMARC     string   `json:"dmarc"`
+	SpamScore *float64 `json:"spam_score"`
+	// Raw is the Authentication-Results header as received.
+	Raw string `json:"raw"`
+}
+
+var authMethod *re.Regexp = re.MustCompile(`(?i)^\s*(spf|dkim|dmarc)\s*=\s*([a-z]+)`)
+var authComment *re.Regexp = re.MustCompile(`\([^()]*\)`)
+var spamScore *re.Regexp = re.MustCompile(`(?i)\bscore\s*=\s*(-?[0-9.]+)`)
+
+// ParseAuthResults extracts verdicts from the Authentication-Results and
+// X-Spam-Score or X-Spam-Status headers. Only the first result for each
+// method is used. Comments are skipped, since they may quote other results,
+// as ARC's do.
+func ParseAuthResults(headers []map[string]string) AuthResults {
+	ar := AuthResults{}
+	ar.Raw = headerValue(headers, "Authentication-Results")
+	results := ar.Raw
+	for {
+		// Comments may be nested, so are removed from the inside out.
+		stripped := authComment.ReplaceAllString(results, " ")
+		if stripped == results {
+			break
+		}
+		results = stripped
+	}
+	for _, result := range strings.Split(results, ";") {
+		m := authMethod.FindStringSubmatch(result)
+		if m == nil {
+			continue
+		}
+		verdict := strings.ToLower(m[2])
+		switch strings.ToLower(m[1]) {
+		case "spf":
+			if ar.SPF == "" {
+				ar.SPF = verdict
+			}
+		case "dkim":
+			if ar.DKIM == "" {
+				ar.DKIM = verdict
+			}
+		case "dmarc":
+			if ar.DMARC == "" {
+				ar.DMARC = verdict
+			}
+		}
+	}
+
+	score := strings.TrimSpace(headerValue(headers, "X-Spam-Score"))
+	if score == "" {
+		if m := spamScore.FindStringSubmatch(headerValue(headers, "X-Spam-Status")); m != nil {
+			score = m[1]
+		}
+	}
+	if f, err := strconv.ParseFloat(score, 64); err == nil {
+		ar.SpamScore = &f
+	}
+	return ar
+}
+
+// headerValue returns the first value of the named header, in the format
+// relay webhooks use: a list of single-entry maps.
+func headerValue(headers []map[string]string, name string) string {
+	for _, h := range headers {
+		for k, v := range h {
+			if strings.EqualFold(k, name) {
+				return v
+			}
+		}
+	}
+	return ""
+}
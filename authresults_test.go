@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+)
+
+func TestParseAuthResults(t *testing.T) {
+	tests := []struct {
+		name             string
+		results          string
+		spf, dkim, dmarc string
+	}{
+		{"all pass", "mx.example.com; spf=pass smtp.mailfrom=a.org; dkim=pass header.d=a.org; dmarc=pass header.from=a.org",
+			"pass", "pass", "pass"},
+		{"ARC comment", "mx.google.com; dkim=pass header.i=@a.org header.s=s1 header.b=abc;" +
+			" arc=pass (i=1 spf=pass spfdomain=a.org dkim=pass dkdomain=a.org dmarc=pass fromdomain=a.org);" +
+			" spf=softfail (google.com: domain of b@a.org does not designate 192.0.2.1 as permitted sender) smtp.mailfrom=b@a.org;" +
+			" dmarc=fail (p=NONE sp=NONE dis=NONE) header.from=a.org",
+			"softfail", "pass", "fail"},
+		{"nested comment", "mx.example.com; spf=neutral (checked (dkim=pass) later) smtp.mailfrom=a.org",
+			"neutral", "", ""},
+		{"first result wins", "mx.example.com; dkim=fail header.d=x.org; dkim=pass header.d=a.org",
+			"", "fail", ""},
+		{"case and spacing", "MX.EXAMPLE.COM;\r\n\tSPF=Pass smtp.mailfrom=a.org; DKIM = None",
+			"pass", "none", ""},
+		{"other methods", "mx.example.com; x-dkim=pass; dkim-atps=neutral; iprev=pass policy.iprev=192.0.2.1",
+			"", "", ""},
+		{"no results", "mx.example.com; none", "", "", ""},
+		{"no header", "", "", "", ""},
+	}
+	for _, tt := range tests {
+		headers := []map[string]string{{"Subject": "hi"}}
+		if tt.results != "" {
+			headers = append(headers, map[string]string{"authentication-results": tt.results})
+		}
+		ar := ParseAuthResults(headers)
+		if ar.SPF != tt.spf || ar.DKIM != tt.dkim || ar.DMARC != tt.dmarc || ar.Raw != tt.results {
+			t.Errorf("%s: got spf %q, dkim %q, dmarc %q; want %q, %q, %q", tt.name, ar.SPF, ar.DKIM, ar.DMARC, tt.spf, tt.dkim, tt.dmarc)
+		}
+	}
+}
+
+func TestParseSpamScore(t *testing.T) {
+	score := func(f float64) *float64 { return &f }
+	tests := []struct {
+		name    string
+		headers []map[string]string
+		want    *float64
+	}{
+		{"score", []map[string]string{{"X-Spam-Score": " -1.5 "}}, score(-1.5)},
+		{"status", []map[string]string{{"X-Spam-Status": "No, score=2.3 required=5.0 tests=NONE"}}, score(2.3)},
+		{"score over status", []map[string]string{{"X-Spam-Status": "Yes, score=9"}, {"X-Spam-Score": "0"}}, score(0)},
+		{"not a number", []map[string]string{{"X-Spam-Score": "high"}}, nil},
+		{"status without a score", []map[string]string{{"X-Spam-Status": "No"}}, nil},
+		{"none", nil, nil},
+	}
+	for _, tt := range tests {
+		got := ParseAuthResults(tt.headers).SpamScore
+		if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+			t.Errorf("%s: spam score %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAuthResultsStored(t *testing.T) {
+	const results = "mx.example.com; spf=pass smtp.mailfrom=a.org; dkim=fail header.d=a.org"
+	tests := []struct {
+		name    string
+		headers []map[string]string
+		want    map[string]driver.Value
+	}{
+		{"reported", []map[string]string{{"Authentication-Results": results}, {"X-Spam-Score": "3.5"}},
+			map[string]driver.Value{"auth_spf": "pass", "auth_dkim": "fail", "auth_dmarc": nil, "auth_results": results, "spam_score": 3.5}},
+		{"not reported", []map[string]string{{"Subject": "hi"}},
+			map[string]driver.Value{"auth_spf": nil, "auth_dkim": nil, "auth_dmarc": nil, "auth_results": nil, "spam_score": nil}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &RelayMsgParser{}
+			ts := newTestServer(t, p, nil, storeRows)
+			if err := p.ParseEvent(context.Background(), relayEventWithHeaders(t, tt.headers), "req"); err != nil {
+				t.Fatal(err)
+			}
+			for col, want := range tt.want {
+				got := storedColumn(t, ts.DB, col)[0]
+				if f, ok := got.(*float64); ok {
+					got = nil
+					if f != nil {
+						got = *f
+					}
+				}
+				if got != want {
+					t.Errorf("%s stored as %#v, want %#v", col, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/SparkPost/httpdump/storage"
+	"github.com/SparkPost/httpdump/storage/pg"
+)
+
+// BatchLockKey is the PostgreSQL advisory lock key held while a batch is being
+// processed. A batch holding it exclusively is the only one in progress, on
+// any instance, so it may recover batches left unfinished. Batches processed
+// alongside others hold it shared.
+const BatchLockKey int64 = 0x72656c61796d7367 // "relaymsg"
+
+// BatchRunner periodically turns stored webhook requests into relay messages,
+// using up to Workers goroutines.
+type BatchRunner struct {
+	Batcher   storage.Batcher
+	Processor storage.Processor
+	// Workers is how many batches this instance may process at once; 1 if
+	// unset. With more than one, the Batcher must hand each batch its own
+	// requests, as LimitedBatcher does.
+	Workers int
+	// Dbh is used to take an advisory lock around each batch, so that
+	// several instances can share one database. Locking is skipped when nil.
+	Dbh *sql.DB
+	// Schema holds the raw_requests table, so a batch which fails can be
+	// released to be retried later.
+	Schema string
+	// Timeout limits how long a single batch may take.
+	Timeout time.Duration
+	// MaxRetries is how many batches a request may fail in before it's
+	// parked, so it no longer holds up the requests after it. Requests are
+	// never parked when it's zero.
+	MaxRetries int
+	// MaxInterval caps how far the interval between batches grows while
+	// there's nothing to process. The interval doubles after each empty
+	// batch, and drops back as soon as a batch finds work. There's no
+	// backoff when MaxInterval is no more than the interval given to Start.
+	MaxInterval time.Duration
+
+	ctx context.Context
+
+	jobs chan struct{}
+	// idle carries whether each batch found nothing to do back from the
+	// workers, so the interval can be adjusted.
+	idle chan bool
+	// slots holds a token for each batch in progress, so no more than
+	// Workers run at once however RunBatch is called.
+	slotsOnce sync.Once
+	slots     chan struct{}
+	// running is set while batches are being handed to the workers.
+	running atomic.Bool
+}
+
+func (br *BatchRunner) workers() int {
+	if br.Workers < 1 {
+		return 1
+	}
+	return br.Workers
+}
+
+// Running reports whether the runner has been started and not yet stopped.
+func (br *BatchRunner) Running() bool {
+	return br.running.Load()
+}
+
+// ContextProcessor is a storage.Processor which can be cancelled, and which
+// reports what it did.
+type ContextProcessor interface {
+	ProcessRequestsContext(ctx context.Context, reqs []storage.Request) (*BatchStats, error)
+}
+
+// contextProcessor binds a ContextProcessor to a context, for
+// storage.ProcessBatch, keeping the stats and error it returns.
+type contextProcessor struct {
+	ctx   context.Context
+	p     ContextProcessor
+	stats *BatchStats
+	err   error
+}
+
+func (cp *contextProcessor) ProcessRequests(reqs []storage.Request) error {
+	cp.stats, cp.err = cp.p.ProcessRequestsContext(cp.ctx, reqs)
+	return cp.err
+}
+
+// Start launches the workers and a timer which hands work to them every
+// interval, backing off up to MaxInterval while there's no work. Ticks
+// arriving while every worker is busy are skipped, so a slow batch can't
+// cause goroutines to pile up. Once ctx is done no more batches are started,
+// and any batch in progress is cancelled.
+func (br *BatchRunner) Start(ctx context.Context, interval time.Duration) {
+	br.ctx = ctx
+	workers := br.workers()
+	br.jobs = make(chan struct{})
+	br.idle = make(chan bool, workers)
+	for i := 0; i < workers; i++ {
+		go br.work()
+	}
+
+	delay := interval
+	timer := time.NewTimer(delay)
+	br.running.Store(true)
+	go func() {
+		defer br.running.Store(false)
+		defer timer.Stop()
+		defer close(br.jobs)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case idle := <-br.idle:
+				next := interval
+				if idle && br.MaxInterval > interval {
+					next = delay * 2
+					if next > br.MaxInterval {
+						next = br.MaxInterval
+					}
+				}
+				if next != delay {
+					delay = next
+					Debugf("BatchRunner: next batch in %s\n", delay)
+					if !timer.Stop() {
+						select {
+						case <-timer.C:
+						default:
+						}
+					}
+					timer.Reset(delay)
+				}
+				continue
+			case <-timer.C:
+				timer.Reset(delay)
+			}
+			select {
+			case br.jobs <- struct{}{}:
+			default:
+				log.Printf("BatchRunner: all %d workers busy, skipping tick\n", workers)
+			}
+		}
+	}()
+}
+
+func (br *BatchRunner) work() {
+	for range br.jobs {
+		idle := br.RunBatch()
+		select {
+		case br.idle <- idle:
+		default:
+		}
+	}
+}
+
+// RunBatch processes one batch, unless Workers are already in flight. It
+// returns true when there were no waiting requests to process.
+func (br *BatchRunner) RunBatch() bool {
+	br.slotsOnce.Do(func() { br.slots = make(chan struct{}, br.workers()) })
+	select {
+	case br.slots <- struct{}{}:
+		defer func() { <-br.slots }()
+	default:
+		log.Printf("BatchRunner: skipping, %d batches in progress\n", br.workers())
+		return false
+	}
+
+	ctx := br.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	var cancel context.CancelFunc
+	if br.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, br.Timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+
+	if br.Dbh != nil {
+		unlock, ok, err := br.advisoryLock(ctx)
+		if err != nil {
+			log.Printf("%s\n", err)
+			return false
+		} else if !ok {
+			log.Printf("BatchRunner: skipping, batch in progress on another instance\n")
+			return false
+		}
+		defer unlock()
+	}
+
+	processor := br.Processor
+	var cproc *contextProcessor
+	if cp, ok := processor.(ContextProcessor); ok {
+		cproc = &contextProcessor{ctx: ctx, p: cp}
+		processor = cproc
+	}
+	batcher := &batchRecorder{Batcher: br.Batcher}
+	start := time.Now()
+	_, err := storage.ProcessBatch(batcher, processor)
+	if cproc != nil && cproc.stats != nil {
+		cproc.stats.Duration = time.Since(start)
+		cproc.stats.Record(err)
+	}
+	if err != nil {
+		log.Printf("%s\n", err)
+		if batcher.batchID != 0 && !batcher.done {
+			// Failures which have nothing to do with the requests, like
+			// the database going away or shutting down, aren't counted
+			// against them.
+			counted := cproc == nil || cproc.err != nil &&
+				!errors.Is(cproc.err, ErrTransientDB) && ctx.Err() == nil
+			br.releaseBatch(batcher.batchID, counted, err)
+		}
+		return false
+	}
+	return batcher.batchID == 0
+}
+
+// batchRecorder remembers which batch ProcessBatch marked, and whether it
+// got as far as finishing it.
+type batchRecorder struct {
+	storage.Batcher
+	batchID int64
+	done    bool
+}
+
+func (b *batchRecorder) MarkBatch() (int64, error) {
+	batchID, err := b.Batcher.MarkBatch()
+	b.batchID = batchID
+	return batchID, err
+}
+
+func (b *batchRecorder) BatchDone(batchID int64) error {
+	b.done = true
+	return b.Batcher.BatchDone(batchID)
+}
+
+// releaseBatch unmarks the requests in a batch which couldn't be processed,
+// so they're resumed by a later batch. Requests which were finished before
+// the failure are removed instead. When counted, the failure is added to
+// each request's fail_count, and a request which has failed MaxRetries
+// times is parked instead.
+func (br *BatchRunner) releaseBatch(batchID int64, counted bool, batchErr error) {
+	if br.Dbh == nil || br.Schema == "" {
+		return
+	}
+	_, err := br.Dbh.Exec(fmt.Sprintf(`
+		DELETE FROM %s.raw_requests
+		 WHERE batch_id = $1 AND processed_at IS NOT NULL
+	`, br.Schema), batchID)
+	if err != nil {
+		log.Printf("BatchRunner (release): %s\n", err)
+		return
+	}
+	if !counted {
+		_, err := br.Dbh.Exec(fmt.Sprintf(`
+			UPDATE %s.raw_requests SET batch_id = NULL, resumed = true
+			 WHERE batch_id = $1
+		`, br.Schema), batchID)
+		if err != nil {
+			log.Printf("BatchRunner (release): %s\n", err)
+			return
+		}
+		log.Printf("BatchRunner: released batch %d for retry\n", batchID)
+		return
+	}
+
+	// Only a request which failed in a batch of its own is parked, since
+	// it may otherwise have been failing because of another.
+	rows, err := br.Dbh.Query(fmt.Sprintf(`
+		WITH b AS (
+			SELECT count(*) = 1 AS alone FROM %[1]s.raw_requests WHERE batch_id = $1
+		)
+		UPDATE %[1]s.raw_requests
+		   SET fail_count = fail_count + 1, last_error = $2, resumed = true,
+		       batch_id = CASE WHEN b.alone AND $3 > 0 AND fail_count + 1 >= $3 THEN $4 END,
+		       parked_at = CASE WHEN b.alone AND $3 > 0 AND fail_count + 1 >= $3 THEN now() END
+		  FROM b
+		 WHERE batch_id = $1
+		RETURNING request_id, batch_id IS NOT NULL
+	`, br.Schema), batchID, batchErr.Error(), br.MaxRetries, ParkedBatchID)
+	if err != nil {
+		log.Printf("BatchRunner (release): %s\n", err)
+		return
+	}
+	defer rows.Close()
+	released := 0
+	for rows.Next() {
+		var reqID int64
+		var parked bool
+		if err = rows.Scan(&reqID, &parked); err != nil {
+			log.Printf("BatchRunner (release): %s\n", err)
+			return
+		}
+		if parked {
+			log.Printf("BatchRunner: parked request %d after %d failures\n", reqID, br.MaxRetries)
+			batchMetrics.Add("parked_requests", 1)
+		} else {
+			released++
+		}
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("BatchRunner (release): %s\n", err)
+		return
+	}
+	log.Printf("BatchRunner: released %d requests from batch %d for retry\n", released, batchID)
+}
+
+// advisoryLock tries to take the batch advisory lock. Advisory locks belong to
+// a session, so a single connection is held until the returned func is called.
+//
+// A batch which gets the lock exclusively first recovers any batches left
+// unfinished, since none can be in progress. With one worker it keeps the
+// lock exclusive, so batches are processed one at a time across every
+// instance, as they always have been. With more, it shares the lock, and
+// batches which can't get it exclusively share it too, so they only wait
+// for recovery.
+func (br *BatchRunner) advisoryLock(ctx context.Context) (func(), bool, error) {
+	conn, err := br.Dbh.Conn(ctx)
+	if err != nil {
+		return nil, false, fmt.Errorf("BatchRunner (Conn): %s", err)
+	}
+	unlock := func(fn string) func() {
+		return func() {
+			// Unlock even when ctx was cancelled, so the connection goes
+			// back to the pool without holding the lock.
+			_, err := conn.ExecContext(context.Background(), "SELECT "+fn+"($1)", BatchLockKey)
+			if err != nil {
+				log.Printf("BatchRunner (unlock): %s\n", err)
+			}
+			conn.Close()
+		}
+	}
+
+	var exclusive bool
+	err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", BatchLockKey).Scan(&exclusive)
+	if err != nil {
+		conn.Close()
+		return nil, false, fmt.Errorf("BatchRunner (lock): %s", err)
+	}
+	if exclusive {
+		if br.Schema != "" {
+			br.recoverBatches(ctx)
+		}
+		if br.workers() == 1 {
+			return unlock("pg_advisory_unlock"), true, nil
+		}
+		// The session already holds the lock, so taking it shared as well
+		// doesn't wait.
+		if _, err = conn.ExecContext(ctx, "SELECT pg_advisory_lock_shared($1)", BatchLockKey); err == nil {
+			_, err = conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", BatchLockKey)
+		}
+		if err != nil {
+			unlock("pg_advisory_unlock_all")()
+			return nil, false, fmt.Errorf("BatchRunner (lock): %s", err)
+		}
+		return unlock("pg_advisory_unlock_shared"), true, nil
+	}
+	if br.workers() == 1 {
+		conn.Close()
+		return nil, false, nil
+	}
+
+	var shared bool
+	err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock_shared($1)", BatchLockKey).Scan(&shared)
+	if err != nil || !shared {
+		conn.Close()
+		if err != nil {
+			return nil, false, fmt.Errorf("BatchRunner (lock): %s", err)
+		}
+		return nil, false, nil
+	}
+	return unlock("pg_advisory_unlock_shared"), true, nil
+}
+
+// LimitedBatcher is a pg.PgDumper which puts at most Max requests, the oldest
+// waiting, in each batch, leaving the rest for later batches. This bounds
+// the memory a batch uses while catching up on a backlog. Max <= 0 means
+// no limit.
+//
+// Requests which were in a failed batch are retried in batches of their
+// own, so that one which can't be processed only fails itself.
+//
+// Requests are claimed with FOR UPDATE SKIP LOCKED, so batches marked at the
+// same time, by several workers or instances, never share a request.
+type LimitedBatcher struct {
+	*pg.PgDumper
+	Max int
+}
+
+func (lb *LimitedBatcher) MarkBatch() (int64, error) {
+	tx, err := lb.Dbh.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("MarkBatch (Begin): %s", err)
+	}
+	defer tx.Rollback()
+
+	// Failed requests are older than any which haven't been tried yet, so
+	// they're always first in line.
+	var oldest, failCount int64
+	err = tx.QueryRow(fmt.Sprintf(`
+		SELECT request_id, fail_count FROM %s.raw_requests
+		 WHERE (batch_id = 0 OR batch_id IS NULL)
+		 ORDER BY request_id
+		 LIMIT 1
+		   FOR UPDATE SKIP LOCKED
+	`, lb.Schema)).Scan(&oldest, &failCount)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("MarkBatch (SELECT): %s", err)
+	}
+
+	var batchID int64
+	if failCount > 0 {
+		_, err = tx.Exec(fmt.Sprintf(`
+			UPDATE %s.raw_requests SET batch_id = $1
+			 WHERE request_id = $1
+		`, lb.Schema), oldest)
+		if err != nil {
+			return 0, fmt.Errorf("MarkBatch (UPDATE): %s", err)
+		}
+		batchID = oldest
+	} else {
+		// The batch is named after the newest request in it, which no other
+		// batch can contain.
+		limit := sql.NullInt64{Int64: int64(lb.Max), Valid: lb.Max > 0}
+		var maxID sql.NullInt64
+		err = tx.QueryRow(fmt.Sprintf(`
+			WITH claimed AS (
+				SELECT request_id FROM %[1]s.raw_requests
+				 WHERE (batch_id = 0 OR batch_id IS NULL)
+				 ORDER BY request_id
+				 LIMIT $1
+				   FOR UPDATE SKIP LOCKED
+			), marked AS (
+				UPDATE %[1]s.raw_requests r
+				   SET batch_id = (SELECT max(request_id) FROM claimed)
+				  FROM claimed
+				 WHERE r.request_id = claimed.request_id
+				RETURNING r.batch_id
+			)
+			SELECT max(batch_id) FROM marked
+		`, lb.Schema), limit).Scan(&maxID)
+		if err != nil {
+			return 0, fmt.Errorf("MarkBatch (UPDATE): %s", err)
+		}
+		if !maxID.Valid {
+			return 0, nil
+		}
+		batchID = maxID.Int64
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("MarkBatch (Commit): %s", err)
+	}
+	return batchID, nil
+}
+
+// ReadRequests reads the requests in a batch like pg.PgDumper's, which
+// points every request's ID at the same variable, so they all end up with
+// the last request's. Here each request gets its own, since checkpoints,
+// resumed requests and released batches all go by request ID.
+func (lb *LimitedBatcher) ReadRequests(batchID int64) ([]storage.Request, error) {
+	rows, err := lb.Dbh.Query(fmt.Sprintf(`
+		SELECT request_id, head, data, "when"
+		  FROM %s.raw_requests
+		 WHERE batch_id = $1
+		 ORDER BY "when" ASC
+	`, lb.Schema), batchID)
+	if err != nil {
+		return nil, fmt.Errorf("ReadRequests (SELECT): %s", err)
+	}
+	defer rows.Close()
+
+	reqs := make([]storage.Request, 0, 32)
+	for rows.Next() {
+		var id int64
+		req := storage.Request{}
+		if err = rows.Scan(&id, &req.Head, &req.Data, &req.When); err != nil {
+			return nil, fmt.Errorf("ReadRequests (Scan): %s", err)
+		}
+		req.ID = &id
+		reqs = append(reqs, req)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("ReadRequests (Err): %s", err)
+	}
+	return reqs, nil
+}
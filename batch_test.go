@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/SparkPost/httpdump/storage"
+	"github.com/SparkPost/httpdump/storage/pg"
+)
+
+// fakeBatcher hands out a new batch of one request every time it's asked.
+type fakeBatcher struct {
+	mu      sync.Mutex
+	batchID int64
+	done    []int64
+}
+
+func (b *fakeBatcher) MarkBatch() (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.batchID++
+	return b.batchID, nil
+}
+
+func (b *fakeBatcher) ReadRequests(batchID int64) ([]storage.Request, error) {
+	id := batchID
+	return []storage.Request{{ID: &id, Data: []byte("[]")}}, nil
+}
+
+func (b *fakeBatcher) BatchDone(batchID int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.done = append(b.done, batchID)
+	return nil
+}
+
+// slowProcessor takes delay over each batch, recording how many it was
+// processing at once.
+type slowProcessor struct {
+	delay    time.Duration
+	inFlight atomic.Int32
+	maxSeen  atomic.Int32
+	batches  atomic.Int32
+}
+
+func (p *slowProcessor) ProcessRequests(reqs []storage.Request) error {
+	n := p.inFlight.Add(1)
+	defer p.inFlight.Add(-1)
+	for {
+		max := p.maxSeen.Load()
+		if n <= max || p.maxSeen.CompareAndSwap(max, n) {
+			break
+		}
+	}
+	time.Sleep(p.delay)
+	p.batches.Add(1)
+	return nil
+}
+
+func TestBatchRunnerNoOverlap(t *testing.T) {
+	tests := []struct {
+		name     string
+		workers  int
+		interval time.Duration
+		delay    time.Duration
+	}{
+		{"ticks faster than batches", 1, time.Millisecond, 30 * time.Millisecond},
+		{"ticks much faster than batches", 1, 100 * time.Microsecond, 50 * time.Millisecond},
+		{"default workers", 0, time.Millisecond, 30 * time.Millisecond},
+		{"worker pool", 3, time.Millisecond, 30 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &fakeBatcher{}
+			p := &slowProcessor{delay: tt.delay}
+			br := &BatchRunner{Batcher: b, Processor: p, Workers: tt.workers}
+			ctx, cancel := context.WithCancel(context.Background())
+			br.Start(ctx, tt.interval)
+			time.Sleep(10 * tt.delay)
+			cancel()
+			for br.Running() {
+				time.Sleep(time.Millisecond)
+			}
+			// Let the batches in progress, if any, finish.
+			time.Sleep(2 * tt.delay)
+
+			want := int32(max(tt.workers, 1))
+			if max := p.maxSeen.Load(); max != want {
+				t.Errorf("%d batches were processed at once, want %d", max, want)
+			}
+			if n := p.batches.Load(); n < 2*want {
+				t.Errorf("only %d batches were processed", n)
+			}
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			seen := map[int64]bool{}
+			for _, id := range b.done {
+				if seen[id] {
+					t.Errorf("batch %d was processed twice", id)
+				}
+				seen[id] = true
+			}
+		})
+	}
+}
+
+func TestRunBatchSkipsWhileInProgress(t *testing.T) {
+	for _, workers := range []int{1, 3} {
+		t.Run(fmt.Sprintf("%d workers", workers), func(t *testing.T) {
+			p := &slowProcessor{delay: 50 * time.Millisecond}
+			br := &BatchRunner{Batcher: &fakeBatcher{}, Processor: p, Workers: workers}
+
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					br.RunBatch()
+				}()
+			}
+			wg.Wait()
+
+			if max := p.maxSeen.Load(); max > int32(workers) {
+				t.Errorf("%d batches were processed at once, want at most %d", max, workers)
+			}
+			if n := p.batches.Load(); n < 1 || n == 10 {
+				t.Errorf("%d of 10 concurrent RunBatch calls processed a batch", n)
+			}
+		})
+	}
+}
+
+// lockRows answers the batch advisory lock queries: the lock can be taken
+// exclusively when exclusive, and shared when shared.
+func lockRows(exclusive, shared bool) func(q fakeQuery) (*fakeRows, error) {
+	return func(q fakeQuery) (*fakeRows, error) {
+		switch {
+		case strings.Contains(q.SQL, "pg_try_advisory_lock_shared"):
+			return &fakeRows{Vals: [][]driver.Value{{shared}}}, nil
+		case strings.Contains(q.SQL, "pg_try_advisory_lock"):
+			return &fakeRows{Vals: [][]driver.Value{{exclusive}}}, nil
+		}
+		return nil, nil
+	}
+}
+
+func TestRunBatchLocks(t *testing.T) {
+	tests := []struct {
+		name              string
+		workers           int
+		exclusive, shared bool
+		// processed is whether the batch should run, recovered whether it
+		// should recover unfinished batches first, and unlock the lock it
+		// should release afterwards.
+		processed, recovered bool
+		unlock               string
+	}{
+		{"one worker, free", 1, true, true, true, true, "pg_advisory_unlock($1)"},
+		{"one worker, busy", 1, false, true, false, false, ""},
+		{"pool, free", 3, true, true, true, true, "pg_advisory_unlock_shared($1)"},
+		{"pool, batches in progress", 3, false, true, true, false, "pg_advisory_unlock_shared($1)"},
+		{"pool, recovering", 3, false, false, false, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dbh, db := newFakeDB(t, lockRows(tt.exclusive, tt.shared))
+			p := &slowProcessor{}
+			br := &BatchRunner{Batcher: &fakeBatcher{}, Processor: p, Workers: tt.workers, Dbh: dbh, Schema: "relaymsg"}
+			br.RunBatch()
+
+			if processed := p.batches.Load() == 1; processed != tt.processed {
+				t.Errorf("processed %t, want %t", processed, tt.processed)
+			}
+			if recovered := len(db.Queries("DELETE FROM relaymsg.raw_requests")) > 0; recovered != tt.recovered {
+				t.Errorf("recovered %t, want %t", recovered, tt.recovered)
+			}
+			if tt.workers > 1 && tt.exclusive {
+				// The exclusive lock is traded for a shared one once
+				// recovery is done, so other workers can start.
+				if len(db.Queries("pg_advisory_lock_shared($1)")) != 1 || len(db.Queries("pg_advisory_unlock($1)")) != 1 {
+					t.Errorf("the exclusive lock wasn't traded for a shared one")
+				}
+			}
+			unlocks := db.Queries("_unlock")
+			if tt.unlock == "" {
+				if len(unlocks) != 0 {
+					t.Errorf("unlocked with %s, but the lock wasn't taken", unlocks[0].SQL)
+				}
+			} else if n := len(unlocks); n == 0 || !strings.Contains(unlocks[n-1].SQL, tt.unlock) {
+				t.Errorf("unlocked with %v, want %s", unlocks, tt.unlock)
+			}
+		})
+	}
+}
+
+func TestLimitedBatcherMarkBatch(t *testing.T) {
+	tests := []struct {
+		name string
+		max  int
+		// oldest is the oldest waiting request and its fail count, or nil
+		// when nothing is waiting; claimed is the newest request claimed
+		// along with it.
+		oldest  []driver.Value
+		claimed int64
+		// want is the batch marked, and limit the most requests it should
+		// claim, nil for no limit.
+		want  int64
+		limit driver.Value
+	}{
+		{"nothing waiting", 2, nil, 0, 0, nil},
+		{"limited", 2, []driver.Value{int64(5), int64(0)}, 6, 6, int64(2)},
+		{"unlimited", 0, []driver.Value{int64(5), int64(0)}, 9, 9, nil},
+		{"failed request", 2, []driver.Value{int64(5), int64(1)}, 0, 5, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dbh, db := newFakeDB(t, func(q fakeQuery) (*fakeRows, error) {
+				switch {
+				case strings.Contains(q.SQL, "SELECT request_id, fail_count"):
+					if tt.oldest == nil {
+						return nil, nil
+					}
+					return &fakeRows{Vals: [][]driver.Value{tt.oldest}}, nil
+				case strings.Contains(q.SQL, "WITH claimed"):
+					return &fakeRows{Vals: [][]driver.Value{{tt.claimed}}}, nil
+				}
+				return nil, nil
+			})
+			lb := &LimitedBatcher{PgDumper: &pg.PgDumper{Dbh: dbh, Schema: "relaymsg"}, Max: tt.max}
+			batchID, err := lb.MarkBatch()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if batchID != tt.want {
+				t.Errorf("marked batch %d, want %d", batchID, tt.want)
+			}
+
+			// Batches marked at once, by other workers or instances, must
+			// skip the requests this one is claiming.
+			for _, q := range db.Queries("FOR UPDATE") {
+				if !strings.Contains(q.SQL, "FOR UPDATE SKIP LOCKED") {
+					t.Errorf("requests are locked without skipping those already claimed: %s", q.SQL)
+				}
+			}
+			claims := db.Queries("WITH claimed")
+			switch {
+			case tt.oldest == nil || tt.oldest[1].(int64) > 0:
+				if len(claims) != 0 {
+					t.Errorf("claimed requests: %s", claims[0].SQL)
+				}
+			case len(claims) != 1:
+				t.Errorf("%d claims, want 1", len(claims))
+			case claims[0].Args[0] != tt.limit:
+				t.Errorf("claimed at most %v requests, want %v", claims[0].Args[0], tt.limit)
+			}
+			if tt.oldest != nil && tt.oldest[1].(int64) > 0 {
+				updates := db.Queries("UPDATE relaymsg.raw_requests SET batch_id = $1")
+				if len(updates) != 1 || updates[0].Args[0] != tt.oldest[0] {
+					t.Errorf("failed request wasn't put in a batch of its own: %v", updates)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+)
+
+// MaxLookupIDs is the most message ids a single batch lookup may name.
+const MaxLookupIDs int = 500
+
+// MessageMeta is the metadata of a message needed to show it in a list,
+// without its body.
+type MessageMeta struct {
+	MessageListItem
+	Status int `json:"status"`
+	Size   int `json:"size"`
+}
+
+// LookupRequest is the body of a batch lookup.
+type LookupRequest struct {
+	IDs []int64 `json:"ids"`
+}
+
+// MessageBatchHandler returns the metadata of many messages in one query,
+// so a client showing a list of messages doesn't need a request for each.
+// The JSON request body holds the ids to look up; the results are in the
+// same order, leaving out ids with no message. Bodies are never read.
+func (p *RelayMsgParser) MessageBatchHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var lr LookupRequest
+		err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&lr)
+		if err != nil || lr.IDs == nil {
+			writeJSONError(w, r, http.StatusBadRequest, "bad_request", "Request body must be JSON like {\"ids\": [42, 43]}")
+			return
+		}
+		if len(lr.IDs) > MaxLookupIDs {
+			writeJSONError(w, r, http.StatusBadRequest, "bad_request", fmt.Sprintf("at most %d ids may be looked up at once", MaxLookupIDs))
+			return
+		}
+		results := []MessageMeta{}
+		if len(lr.IDs) == 0 {
+			writeJSON(w, r, map[string][]MessageMeta{"results": results})
+			return
+		}
+
+		ctx, cancel := p.requestContext(r)
+		defer cancel()
+		rows, err := p.ReadDB().QueryContext(ctx, fmt.Sprintf(`
+			SELECT %s, coalesce(status_id, 0), coalesce(size_bytes, 0)
+			  FROM %s
+			 WHERE message_id = ANY($1::bigint[])
+			 ORDER BY array_position($1::bigint[], message_id)
+		`, messageListColumns, p.MsgTable()), int64Array(lr.IDs))
+		if err != nil {
+			log.Printf("MessageBatch (SELECT): %s", err)
+			writeJSONError(w, r, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			m := MessageMeta{}
+			if err = rows.Scan(&m.ID, &m.From, &m.To, &m.ToBase, &m.Subject, &m.Created,
+				&m.FromName, &m.ToName, &m.Thread, &m.Route, &m.Status, &m.Size); err != nil {
+				break
+			}
+			results = append(results, m)
+		}
+		if err == nil {
+			err = rows.Err()
+		}
+		if err != nil {
+			log.Printf("MessageBatch (Scan): %s", err)
+			writeJSONError(w, r, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+		writeJSON(w, r, map[string][]MessageMeta{"results": results})
+	}
+}
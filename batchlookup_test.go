@@ -0,0 +1,70 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// lookupRows answers the batch lookup with a message for each id but 404,
+// in the order asked for.
+func lookupRows(q fakeQuery) (*fakeRows, error) {
+	if !strings.Contains(q.SQL, "message_id = ANY($1::bigint[])") {
+		return nil, nil
+	}
+	ids := strings.Split(strings.Trim(q.Args[0].(string), "{}"), ",")
+	res := &fakeRows{}
+	for _, id := range ids {
+		if id == "404" {
+			continue
+		}
+		res.Vals = append(res.Vals, []driver.Value{id, "from@example.org", "user@example.com", "user@example.com",
+			"subject " + id, time.Now(), "", "", "thread", "", int64(0), int64(100)})
+	}
+	return res, nil
+}
+
+func TestMessageBatch(t *testing.T) {
+	const token = "s3cret"
+	tests := []struct {
+		name   string
+		auth   string
+		body   string
+		status int
+		// ids are the ids of the results expected, in order.
+		ids string
+	}{
+		{"no token", "", `{"ids": [1, 2]}`, http.StatusUnauthorized, ""},
+		{"wrong token", "Bearer nope", `{"ids": [1, 2]}`, http.StatusUnauthorized, ""},
+		{"admin", "Bearer " + token, `{"ids": [2, 1]}`, http.StatusOK, `"id":2,.*"id":1,`},
+		{"missing message", "Bearer " + token, `{"ids": [404, 3]}`, http.StatusOK, `^{"results":\[{"id":3,[^{]*}\]}`},
+		{"no ids", "Bearer " + token, `{"ids": []}`, http.StatusOK, `^{"results":\[\]}`},
+		{"not JSON", "Bearer " + token, `ids=1`, http.StatusBadRequest, ""},
+		{"too many", "Bearer " + token, `{"ids": [` + strings.Repeat("1,", MaxLookupIDs) + `1]}`, http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, &RelayMsgParser{AdminToken: token}, nil, lookupRows)
+			header := http.Header{}
+			if tt.auth != "" {
+				header.Set("Authorization", tt.auth)
+			}
+			status, body := postWith(t, ts, "/messages/batch", []byte(tt.body), header)
+			if status != tt.status {
+				t.Fatalf("status %d, want %d: %s", status, tt.status, body)
+			}
+			if status != http.StatusOK {
+				if n := len(ts.DB.Queries("")); n != 0 {
+					t.Errorf("%d queries run for a refused request", n)
+				}
+				return
+			}
+			if !regexp.MustCompile(tt.ids).MatchString(body) {
+				t.Errorf("got %s, want a match for %s", body, tt.ids)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/SparkPost/httpdump/storage"
+)
+
+// Batches are made crash-safe with checkpoints. Each raw request has its
+// processed_at column set as soon as all of its events are handled, so when
+// a batch stops part way, because it failed or the process died, the
+// requests it finished are removed rather than processed again. The rest
+// are released with resumed set, and messages from them which had already
+// been stored are recognized by their content hash and skipped.
+
+// resumedKey marks the context a resumed request's events are stored with.
+type resumedKey struct{}
+
+func withResumed(ctx context.Context) context.Context {
+	return context.WithValue(ctx, resumedKey{}, true)
+}
+
+func isResumed(ctx context.Context) bool {
+	resumed, _ := ctx.Value(resumedKey{}).(bool)
+	return resumed
+}
+
+// checkpoint records that every event in the raw request with the given id
+// has been handled. Failing to is only logged: if the batch is interrupted
+// later, the request is processed again as a resumed one.
+func (p *RelayMsgParser) checkpoint(ctx context.Context, req *storage.Request) {
+	if req.ID == nil || p.Schema == "" {
+		return
+	}
+	_, err := p.DumpDB().ExecContext(ctx, fmt.Sprintf(`
+		UPDATE %s.raw_requests SET processed_at = now()
+		 WHERE request_id = $1
+	`, p.Schema), *req.ID)
+	if err != nil {
+		log.Printf("ProcessRequests (checkpoint): request %d: %s\n", *req.ID, err)
+	}
+}
+
+// resumedRequests returns the ids of those of reqs which were in a batch
+// that stopped before they were finished.
+func (p *RelayMsgParser) resumedRequests(ctx context.Context, reqs []storage.Request) (map[int64]bool, error) {
+	resumed := map[int64]bool{}
+	ids := []int64{}
+	for _, req := range reqs {
+		if req.ID != nil {
+			ids = append(ids, *req.ID)
+		}
+	}
+	if len(ids) == 0 || p.Schema == "" {
+		return resumed, nil
+	}
+	rows, err := p.DumpDB().QueryContext(ctx, fmt.Sprintf(`
+		SELECT request_id FROM %s.raw_requests
+		 WHERE request_id = ANY($1::bigint[]) AND resumed
+	`, p.Schema), int64Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		resumed[id] = true
+	}
+	return resumed, rows.Err()
+}
+
+// storedBefore reports whether a message with the given content hash was
+// already stored from the webhook request reqID.
+func (p *RelayMsgParser) storedBefore(ctx context.Context, reqID, hash string) (bool, error) {
+	var stored bool
+	err := retry(ctx, "StoreEvent (resume)", p.StoreRetries, func() error {
+		return p.Dbh.QueryRowContext(ctx, fmt.Sprintf(`
+			SELECT EXISTS (
+				SELECT 1 FROM %s WHERE content_hash = $1 AND request_id = $2
+			)
+		`, p.MsgTable()), hash, reqID).Scan(&stored)
+	})
+	return stored, err
+}
+
+// recoverBatches cleans up after batches which stopped part way without
+// being released, like when the process was killed: finished requests are
+// removed, and the rest are released to be resumed. It must only be called
+// with the batch lock held exclusively, so no batch is in progress.
+func (br *BatchRunner) recoverBatches(ctx context.Context) {
+	res, err := br.Dbh.ExecContext(ctx, fmt.Sprintf(`
+		DELETE FROM %s.raw_requests
+		 WHERE batch_id > 0 AND processed_at IS NOT NULL
+	`, br.Schema))
+	if err != nil {
+		log.Printf("BatchRunner (recover): %s\n", err)
+		return
+	}
+	done, _ := res.RowsAffected()
+	res, err = br.Dbh.ExecContext(ctx, fmt.Sprintf(`
+		UPDATE %s.raw_requests SET batch_id = NULL, resumed = true
+		 WHERE batch_id > 0
+	`, br.Schema))
+	if err != nil {
+		log.Printf("BatchRunner (recover): %s\n", err)
+		return
+	}
+	if left, _ := res.RowsAffected(); done > 0 || left > 0 {
+		log.Printf("BatchRunner: recovered an unfinished batch, %d requests done and %d to resume\n", done, left)
+		batchMetrics.Add("recovered_batches", 1)
+	}
+}
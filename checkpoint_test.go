@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SparkPost/httpdump/storage/pg"
+)
+
+// rawRequest is a row of raw_requests in a rawRequests table.
+type rawRequest struct {
+	id        int64
+	to        []string
+	processed bool
+	resumed   bool
+}
+
+// rawRequests stands in for the raw_requests table and the message table
+// while batches of requests are processed, crashed and resumed. crashTo is
+// a recipient whose message fails to store, like the process dying.
+type rawRequests struct {
+	t       testing.TB
+	mu      sync.Mutex
+	reqs    []*rawRequest
+	crashTo string
+	// stored counts the messages stored by request ID and recipient, and
+	// hashes are the content hashes stored by request ID.
+	stored map[string]int
+	hashes map[string]bool
+}
+
+func (rr *rawRequests) handle(q fakeQuery) (*fakeRows, error) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	switch {
+	case strings.Contains(q.SQL, `SELECT request_id, head, data, "when"`):
+		res := &fakeRows{}
+		for _, req := range rr.reqs {
+			head := fmt.Sprintf("POST /incoming HTTP/1.1\r\nHost: relay\r\n%s: req-%d\r\n\r\n", RequestIDHeader, req.id)
+			events := []*json.RawMessage{}
+			for _, to := range req.to {
+				events = append(events, relayEvent(rr.t, "sender@example.org", to, "hi", "Subject: hi\r\n\r\n"+to+"\r\n"))
+			}
+			data, err := json.Marshal(events)
+			if err != nil {
+				return nil, err
+			}
+			res.Vals = append(res.Vals, []driver.Value{req.id, []byte(head), data, time.Now()})
+		}
+		return res, nil
+	case strings.Contains(q.SQL, "AND resumed"):
+		res := &fakeRows{}
+		for _, req := range rr.reqs {
+			if req.resumed {
+				res.Vals = append(res.Vals, []driver.Value{req.id})
+			}
+		}
+		return res, nil
+	case strings.Contains(q.SQL, "SET processed_at"):
+		for _, req := range rr.reqs {
+			if req.id == q.Args[0].(int64) {
+				req.processed = true
+			}
+		}
+		return &fakeRows{Vals: [][]driver.Value{{}}}, nil
+	case strings.Contains(q.SQL, "SELECT EXISTS"):
+		return &fakeRows{Vals: [][]driver.Value{{rr.hashes[fmt.Sprint(q.Args[1], q.Args[0])]}}}, nil
+	case strings.Contains(q.SQL, "RETURNING message_id, created"):
+		to, _ := insertedValue(q, "smtp_to")
+		reqID, _ := insertedValue(q, "request_id")
+		hash, _ := insertedValue(q, "content_hash")
+		if to == rr.crashTo {
+			return nil, io.ErrUnexpectedEOF
+		}
+		rr.stored[fmt.Sprint(reqID, " ", to)]++
+		rr.hashes[fmt.Sprint(reqID, hash)] = true
+		return storeRows(q)
+	}
+	return nil, nil
+}
+
+// restart does what recovering after a crash does to the batch: finished
+// requests are removed, and the rest are released as resumed.
+func (rr *rawRequests) restart() {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	left := []*rawRequest{}
+	for _, req := range rr.reqs {
+		if !req.processed {
+			req.resumed = true
+			left = append(left, req)
+		}
+	}
+	rr.reqs = left
+	rr.crashTo = ""
+}
+
+func TestLimitedBatcherReadRequests(t *testing.T) {
+	rr := &rawRequests{t: t, reqs: []*rawRequest{{id: 7}, {id: 8}, {id: 9}}}
+	db, _ := newFakeDB(t, rr.handle)
+	lb := &LimitedBatcher{PgDumper: &pg.PgDumper{Dbh: db, Schema: "relaymsg"}}
+	reqs, err := lb.ReadRequests(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reqs) != 3 {
+		t.Fatalf("read %d requests", len(reqs))
+	}
+	for i, req := range reqs {
+		if req.ID == nil {
+			t.Fatalf("request %d has no ID", i)
+		}
+		if want := rr.reqs[i].id; *req.ID != want {
+			t.Errorf("request %d has ID %d, want %d", i, *req.ID, want)
+		}
+	}
+}
+
+// TestBatchCrashResume processes a batch which crashes part way through a
+// request, then resumes it, checking every message is stored exactly once.
+func TestBatchCrashResume(t *testing.T) {
+	tests := []struct {
+		name  string
+		crash string
+	}{
+		{"no crash", ""},
+		{"crash in the first request", "a2@example.com"},
+		{"crash after a message in the second", "b2@example.com"},
+		{"crash in the last request", "c1@example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := &rawRequests{
+				t: t,
+				reqs: []*rawRequest{
+					{id: 1, to: []string{"a1@example.com", "a2@example.com"}},
+					{id: 2, to: []string{"b1@example.com", "b2@example.com", "b3@example.com"}},
+					{id: 3, to: []string{"c1@example.com"}},
+				},
+				crashTo: tt.crash,
+				stored:  map[string]int{},
+				hashes:  map[string]bool{},
+			}
+			want := []string{}
+			for _, req := range rr.reqs {
+				for _, to := range req.to {
+					want = append(want, fmt.Sprintf("req-%d %s", req.id, to))
+				}
+			}
+			p := &RelayMsgParser{}
+			newTestServer(t, p, nil, rr.handle)
+			lb := &LimitedBatcher{PgDumper: &pg.PgDumper{Dbh: p.Dbh, Schema: p.Schema}}
+
+			for run := 0; run < 2; run++ {
+				reqs, err := lb.ReadRequests(1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = p.ProcessRequestsContext(context.Background(), reqs)
+				if crashed := run == 0 && tt.crash != ""; (err != nil) != crashed {
+					t.Fatalf("run %d: error %v, want crash %t", run, err, crashed)
+				}
+				rr.restart()
+			}
+
+			for _, key := range want {
+				if n := rr.stored[key]; n != 1 {
+					t.Errorf("%s stored %d times", key, n)
+				}
+			}
+			if len(rr.stored) != len(want) {
+				t.Errorf("stored %v, want %v", rr.stored, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+)
+
+// DefaultCompressMinBytes is the size below which bodies aren't compressed,
+// unless configured otherwise. Each gzip stream has a fixed setup cost and
+// header, which outweigh the savings on small messages.
+const DefaultCompressMinBytes int = 1024
+
+// Compress gzips data.
+func Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// compressBody gzips body if it's at least minBytes long, returning the
+// body to store and whether it was compressed. Bodies which don't get
+// smaller are returned as they are.
+func compressBody(body []byte, minBytes int) ([]byte, bool, error) {
+	if len(body) == 0 || len(body) < minBytes {
+		return body, false, nil
+	}
+	zbody, err := Compress(body)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(zbody) >= len(body) {
+		return body, false, nil
+	}
+	return zbody, true, nil
+}
+
+// Decompress reverses Compress.
+func Decompress(data []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
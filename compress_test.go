@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// corpusWords are mixed into the generated messages, so they compress about
+// as well as real mail rather than as well as repeated text.
+var corpusWords = strings.Fields(`the a to of and in for your you is on
+	with this that our we be are at from by it as have order account team
+	please click here unsubscribe update preferences view browser shipping
+	delivery receipt invoice total payment confirm password reset welcome
+	offer sale today only free new available support help contact reply
+	email message newsletter weekly monday friday customer service thanks`)
+
+// corpusMessage returns an RFC822 message of about size bytes, with text
+// and HTML parts, like a typical relayed notification or newsletter.
+// attachment adds a base64-encoded binary part, which barely compresses.
+func corpusMessage(size int, attachment bool) string {
+	rnd := rand.New(rand.NewSource(int64(size)))
+	sentence := func() string {
+		n := 6 + rnd.Intn(10)
+		words := make([]string, n)
+		for i := range words {
+			words[i] = corpusWords[rnd.Intn(len(corpusWords))]
+		}
+		if rnd.Intn(4) == 0 {
+			words[rnd.Intn(n)] = fmt.Sprintf("#%d", rnd.Intn(1000000))
+		}
+		return strings.Join(words, " ") + "."
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: Example Store <news@store.example.com>\r\n"+
+		"To: user@relay.example.com\r\n"+
+		"Subject: %s\r\n"+
+		"Message-ID: <%d@store.example.com>\r\n"+
+		"MIME-Version: 1.0\r\n"+
+		"Content-Type: multipart/mixed; boundary=\"b1\"\r\n\r\n", sentence(), rnd.Int63())
+	text, html := &strings.Builder{}, &strings.Builder{}
+	for b.Len()+text.Len()+html.Len() < size {
+		s := sentence()
+		text.WriteString(s + "\r\n")
+		fmt.Fprintf(html, "<p style=\"font-family:Arial;color:#333\">%s <a href=\"https://store.example.com/t/%d\">Read more</a></p>\r\n", s, rnd.Intn(100000))
+	}
+	fmt.Fprintf(&b, "--b1\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s", text)
+	fmt.Fprintf(&b, "--b1\r\nContent-Type: text/html; charset=utf-8\r\n\r\n<html><body>%s</body></html>\r\n", html)
+	if attachment {
+		data := make([]byte, size)
+		rnd.Read(data)
+		fmt.Fprintf(&b, "--b1\r\nContent-Type: application/pdf\r\nContent-Transfer-Encoding: base64\r\n\r\n%s\r\n",
+			base64.StdEncoding.EncodeToString(data))
+	}
+	b.WriteString("--b1--\r\n")
+	return b.String()
+}
+
+// corpusSizes are the message sizes compression is measured at.
+var corpusSizes = []int{128, 256, 512, 1024, 2048, 4096, 16384, 65536}
+
+func TestCompressRoundTrip(t *testing.T) {
+	for _, size := range append([]int{0}, corpusSizes...) {
+		for _, attachment := range []bool{false, true} {
+			msg := []byte(corpusMessage(size, attachment))
+			if size == 0 {
+				msg = nil
+			}
+			z, err := Compress(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := Decompress(z)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out, msg) {
+				t.Errorf("size %d, attachment %t: round trip changed the message", size, attachment)
+			}
+		}
+	}
+}
+
+// BenchmarkCompress measures the CPU cost of compressing messages as they're
+// stored, and reports the compressed size as a percentage of the original.
+func BenchmarkCompress(b *testing.B) {
+	for _, attachment := range []bool{false, true} {
+		for _, size := range corpusSizes {
+			msg := []byte(corpusMessage(size, attachment))
+			b.Run(fmt.Sprintf("attachment=%t/size=%d", attachment, size), func(b *testing.B) {
+				b.SetBytes(int64(len(msg)))
+				var z []byte
+				for i := 0; i < b.N; i++ {
+					var err error
+					if z, err = Compress(msg); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(100*float64(len(z))/float64(len(msg)), "%size")
+			})
+		}
+	}
+}
+
+// BenchmarkDecompress measures the CPU cost of reading compressed messages.
+func BenchmarkDecompress(b *testing.B) {
+	for _, size := range corpusSizes {
+		z, err := Compress([]byte(corpusMessage(size, false)))
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := Decompress(z); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestCompressBody(t *testing.T) {
+	text := []byte(corpusMessage(2048, false))
+	// Random bytes don't compress, like an already compressed attachment.
+	random := make([]byte, 2048)
+	rand.New(rand.NewSource(1)).Read(random)
+	tests := []struct {
+		name       string
+		body       []byte
+		minBytes   int
+		compressed bool
+	}{
+		{"empty", nil, 0, false},
+		{"below threshold", text, len(text) + 1, false},
+		{"at threshold", text, len(text), true},
+		{"no threshold", text, 0, true},
+		{"incompressible", random, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, compressed, err := compressBody(tt.body, tt.minBytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if compressed != tt.compressed {
+				t.Fatalf("compressed %t, want %t", compressed, tt.compressed)
+			}
+			if !compressed {
+				if !bytes.Equal(out, tt.body) {
+					t.Error("an uncompressed body was changed")
+				}
+				return
+			}
+			if len(out) >= len(tt.body) {
+				t.Errorf("compressed to %d bytes from %d", len(out), len(tt.body))
+			}
+			if orig, err := Decompress(out); err != nil || !bytes.Equal(orig, tt.body) {
+				t.Errorf("didn't decompress to the body: %v", err)
+			}
+		})
+	}
+}
+
+// BenchmarkCompressThreshold shows where RELAYMSG_COMPRESS_MIN_BYTES should
+// be. The size= runs report the CPU spent per KB saved by compressing text
+// messages of each size, which is what lowering the threshold to that size
+// costs: it falls steeply until about 1KB, and little after. The min= runs
+// store a mix of every corpus size, a tenth with attachments, and report the
+// CPU spent per message and the stored size at each threshold.
+func BenchmarkCompressThreshold(b *testing.B) {
+	bench := func(b *testing.B, msgs [][]byte, threshold int) {
+		var in, out int
+		for i := 0; i < b.N; i++ {
+			msg := msgs[i%len(msgs)]
+			z, _, err := compressBody(msg, threshold)
+			if err != nil {
+				b.Fatal(err)
+			}
+			in += len(msg)
+			out += len(z)
+		}
+		b.ReportMetric(100*float64(out)/float64(in), "%size")
+		if saved := in - out; saved > 0 {
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/(float64(saved)/1024), "ns/KBsaved")
+		}
+	}
+
+	mix := [][]byte{}
+	for _, size := range corpusSizes {
+		msg := []byte(corpusMessage(size, false))
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			bench(b, [][]byte{msg}, 0)
+		})
+		for i := 0; i < 10; i++ {
+			mix = append(mix, []byte(corpusMessage(size+i, i == 0)))
+		}
+	}
+	for _, threshold := range append([]int{0}, corpusSizes...) {
+		b.Run(fmt.Sprintf("min=%d", threshold), func(b *testing.B) {
+			bench(b, mix, threshold)
+		})
+	}
+}
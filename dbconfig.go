@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/SparkPost/httpdump/storage/pg"
+)
+
+// DefaultConnectAttempts is how many times the database is tried at startup
+// before giving up, unless configured otherwise.
+const DefaultConnectAttempts int = 10
+
+// DefaultConnectTimeout limits how long startup waits for the database,
+// across every attempt, unless configured otherwise.
+const DefaultConnectTimeout time.Duration = 60 * time.Second
+
+// ConnectWithRetry opens a connection pool with cfg and waits until the
+// database answers, so a database which comes up a little after the
+// service doesn't stop it. Failures which may pass, like the connection
+// being refused, are retried with a growing delay up to attempts times,
+// within timeout; others, like a wrong password, are returned at once.
+func ConnectWithRetry(ctx context.Context, name string, cfg *pg.PGConfig, attempts int, timeout time.Duration) (*sql.DB, error) {
+	dbh, err := cfg.Connect()
+	if err != nil {
+		return nil, fmt.Errorf("%s (Connect): %s", name, err)
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	err = retry(ctx, name, attempts, func() error {
+		return dbh.PingContext(ctx)
+	})
+	if err != nil {
+		dbh.Close()
+		return nil, fmt.Errorf("%s (Ping): %s", name, err)
+	}
+	return dbh, nil
+}
+
+// NewPGConfig builds database connection settings from cfg. When
+// DATABASE_URL is set it's used as is, and the RELAYMSG_PG_DB,
+// RELAYMSG_PG_USER and RELAYMSG_PG_PASS variables are ignored entirely.
+// Otherwise the connection is composed from those variables.
+func NewPGConfig(cfg map[string]string) (*pg.PGConfig, error) {
+	if dbURL := cfg["DATABASE_URL"]; dbURL != "" {
+		if err := checkDatabaseURL("DATABASE_URL", dbURL); err != nil {
+			return nil, err
+		}
+		for _, k := range []string{"RELAYMSG_PG_DB", "RELAYMSG_PG_USER", "RELAYMSG_PG_PASS"} {
+			if cfg[k] != "" {
+				log.Printf("NewPGConfig: DATABASE_URL is set, ignoring %s\n", k)
+			}
+		}
+		return &pg.PGConfig{Url: dbURL}, nil
+	}
+
+	return &pg.PGConfig{
+		Db:   cfg["RELAYMSG_PG_DB"],
+		User: cfg["RELAYMSG_PG_USER"],
+		Pass: cfg["RELAYMSG_PG_PASS"],
+		Opts: map[string]string{
+			"sslmode": "disable",
+		},
+	}, nil
+}
+
+// NewMsgPGConfig returns connection settings for the database messages are
+// stored in, when RELAYMSG_MSG_DATABASE_URL puts them somewhere other than
+// the raw requests. It returns nil when they share a database.
+func NewMsgPGConfig(cfg map[string]string) (*pg.PGConfig, error) {
+	dbURL := cfg["RELAYMSG_MSG_DATABASE_URL"]
+	if dbURL == "" {
+		return nil, nil
+	}
+	if err := checkDatabaseURL("RELAYMSG_MSG_DATABASE_URL", dbURL); err != nil {
+		return nil, err
+	}
+	return &pg.PGConfig{Url: dbURL}, nil
+}
+
+// checkDatabaseURL makes sure the URL in the named variable is one PostgreSQL
+// will accept.
+func checkDatabaseURL(name, dbURL string) error {
+	u, err := url.Parse(dbURL)
+	if err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+	if u.Scheme != "postgres" && u.Scheme != "postgresql" {
+		return fmt.Errorf("%s: scheme must be postgres or postgresql, not %q", name, u.Scheme)
+	}
+	return nil
+}
+
+// DSN returns the connection string PGConfig.Connect would use, for
+// connections made outside database/sql.
+func DSN(cfg *pg.PGConfig) string {
+	if cfg.Url != "" {
+		return cfg.Url
+	}
+	opts := []string{}
+	if cfg.Db != "" {
+		opts = append(opts, "dbname="+cfg.Db)
+	}
+	if cfg.User != "" {
+		opts = append(opts, "user="+cfg.User)
+	}
+	if cfg.Pass != "" {
+		opts = append(opts, "password="+cfg.Pass)
+	}
+	for k, v := range cfg.Opts {
+		opts = append(opts, k+"="+v)
+	}
+	return strings.Join(opts, " ")
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/husobee/vestigo"
+)
+
+const DeadLetterTable string = "relay_dead_letter"
+
+type DeadLetter struct {
+	ID        int64     `json:"id"`
+	RequestID string    `json:"request_id"`
+	Payload   string    `json:"payload"`
+	Error     string    `json:"error"`
+	Created   time.Time `json:"created"`
+}
+
+// shouldDeadLetter reports whether an event which failed with err should be
+// set aside so the rest of the batch can proceed. Transient errors, and
+// errors from the batch being cancelled, fail the batch instead so it's
+// retried as a whole.
+func shouldDeadLetter(ctx context.Context, err error) bool {
+	return ctx.Err() == nil && !errors.Is(err, ErrTransientDB) && !IsTransient(err)
+}
+
+// DeadLetter stores an event which couldn't be stored, along with the reason.
+// An error is returned if that isn't possible either, since the event would
+// otherwise be lost.
+func (p *RelayMsgParser) DeadLetter(ctx context.Context, j *json.RawMessage, reqID string, derr error) error {
+	_, err := p.Dbh.ExecContext(ctx, fmt.Sprintf(`
+		INSERT INTO %s.%s (request_id, payload, error)
+		VALUES ($1, $2, $3)
+	`, p.Schema, DeadLetterTable), nullString(reqID), []byte(*j), derr.Error())
+	if err != nil {
+		return fmt.Errorf("DeadLetter (INSERT): %s", err)
+	}
+	log.Printf("DeadLetter: set aside event [req %s]: %s\n", reqID, derr)
+	return nil
+}
+
+// DeadLettersHandler lists the most recently dead-lettered events, newest
+// first. The number returned may be set with limit, up to 500.
+func (p *RelayMsgParser) DeadLettersHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit, err := limitParam(r, 50, 500)
+		if err != nil {
+			writeJSONError(w, r, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+
+		ctx, cancel := p.requestContext(r)
+		defer cancel()
+		rows, err := p.ReadDB().QueryContext(ctx, fmt.Sprintf(`
+			SELECT dead_letter_id, coalesce(request_id, ''), payload, error, created
+			  FROM %s.%s
+			 ORDER BY dead_letter_id DESC
+			 LIMIT $1
+		`, p.Schema, DeadLetterTable), limit)
+		if err != nil {
+			log.Printf("ListDeadLetters (SELECT): %s", err)
+			writeJSONError(w, r, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+		defer rows.Close()
+
+		list := []DeadLetter{}
+		for rows.Next() {
+			d := DeadLetter{}
+			var payload []byte
+			if err = rows.Scan(&d.ID, &d.RequestID, &payload, &d.Error, &d.Created); err != nil {
+				log.Printf("ListDeadLetters (Scan): %s", err)
+				writeJSONError(w, r, http.StatusInternalServerError, "database_error", "Database error")
+				return
+			}
+			d.Payload = string(payload)
+			list = append(list, d)
+		}
+		if err = rows.Err(); err != nil {
+			log.Printf("ListDeadLetters (Err): %s", err)
+			writeJSONError(w, r, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+		writeJSON(w, r, map[string][]DeadLetter{"results": list})
+	}
+}
+
+// RequeueHandler tries to store a dead-lettered event again. On success the
+// event is removed from the dead-letter table; otherwise its error is
+// updated and returned.
+func (p *RelayMsgParser) RequeueHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(vestigo.Param(r, "id"), 10, 64)
+		if err != nil {
+			writeJSONError(w, r, http.StatusBadRequest, "invalid_id", "Invalid dead letter id")
+			return
+		}
+
+		ctx, cancel := p.requestContext(r)
+		defer cancel()
+		var reqID string
+		var payload []byte
+		err = p.Dbh.QueryRowContext(ctx, fmt.Sprintf(`
+			SELECT coalesce(request_id, ''), payload
+			  FROM %s.%s
+			 WHERE dead_letter_id = $1
+		`, p.Schema, DeadLetterTable), id).Scan(&reqID, &payload)
+		if err == sql.ErrNoRows {
+			writeJSONError(w, r, http.StatusNotFound, "not_found", "No such dead letter")
+			return
+		} else if err != nil {
+			log.Printf("Requeue (SELECT): %s", err)
+			writeJSONError(w, r, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+
+		event := json.RawMessage(payload)
+		if perr := p.ParseEvent(ctx, &event, reqID); perr != nil && !errors.Is(perr, ErrDuplicate) {
+			_, err = p.Dbh.ExecContext(ctx, fmt.Sprintf(`
+				UPDATE %s.%s SET error = $2 WHERE dead_letter_id = $1
+			`, p.Schema, DeadLetterTable), id, perr.Error())
+			if err != nil {
+				log.Printf("Requeue (UPDATE): %s", err)
+			}
+			writeJSONError(w, r, http.StatusUnprocessableEntity, "store_failed", perr.Error())
+			return
+		}
+
+		_, err = p.Dbh.ExecContext(ctx, fmt.Sprintf(`
+			DELETE FROM %s.%s WHERE dead_letter_id = $1
+		`, p.Schema, DeadLetterTable), id)
+		if err != nil {
+			log.Printf("Requeue (DELETE): %s", err)
+			writeJSONError(w, r, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+		writeJSON(w, r, map[string]interface{}{"id": id, "requeued": true})
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+)
+
+// ContentHash identifies a message by its sender, recipient, subject and
+// body, so repeats of it can be recognized.
+func ContentHash(from, to, subject, body string) string {
+	h := sha256.New()
+	for _, s := range []string{from, to, subject, body} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// countDuplicate looks for a message with the given content hash,
+// stored within DedupWindow. When there is one, its duplicate_count is
+// incremented and true is returned.
+func (p *RelayMsgParser) countDuplicate(ctx context.Context, hash string) (bool, error) {
+	var id int64
+	err := retry(ctx, "StoreEvent (dedup)", p.StoreRetries, func() error {
+		return p.Dbh.QueryRowContext(ctx, fmt.Sprintf(`
+			UPDATE %[1]s SET duplicate_count = duplicate_count + 1
+			 WHERE message_id = (
+				SELECT message_id FROM %[1]s
+				 WHERE content_hash = $1
+				   AND created >= clock_timestamp() - $2 * interval '1 second'
+				 ORDER BY created DESC
+				 LIMIT 1
+			 )
+			RETURNING message_id
+		`, p.MsgTable()), hash, p.DedupWindow.Seconds()).Scan(&id)
+	})
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
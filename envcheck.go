@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	re "regexp"
+	"sort"
+	"strings"
+)
+
+// patternNames describes the values each envVars pattern accepts, for
+// reporting misconfiguration.
+var patternNames = map[*re.Regexp]string{
+	word:              "letters, digits and underscores",
+	nows:              "any value without whitespace",
+	digits:            "a whole number",
+	wordList:          "a comma-separated list of letters, digits and underscores",
+	keyPath:           "dot-separated keys of letters, digits and underscores",
+	headerList:        "a comma-separated list of header names",
+	routeList:         "a comma-separated list of webhook_id:route pairs",
+	webhookHeaderList: "a comma-separated list of Name:value pairs",
+	mediaTypeList:     "a comma-separated list of media types",
+	domainList:        "a comma-separated list of domain names",
+	urlPath:           "a path starting with /",
+	identifier:        "a table name: letters, digits and underscores, not starting with a digit",
+}
+
+// secretEnv matches the names of variables whose values mustn't be logged.
+// Webhook headers hold the credentials SparkPost sends.
+var secretEnv = re.MustCompile(`PASS|SECRET|TOKEN|AUTH|ACCESS_KEY|WEBHOOK_HEADERS`)
+
+// redactEnv returns a variable's value as it may be logged: secrets are
+// hidden entirely, and passwords removed from URLs. A URL's user with no
+// password is hidden too, since it may be a token.
+func redactEnv(name, value string) string {
+	if secretEnv.MatchString(name) {
+		return "[redacted]"
+	}
+	// URLs are shown as given, apart from the password, since they may be
+	// invalid because of how they're written.
+	if i := strings.Index(value, "://"); i >= 0 {
+		if at := strings.LastIndex(value, "@"); at > i {
+			if colon := strings.Index(value[i+3:at], ":"); colon >= 0 {
+				return value[:i+3+colon+1] + "xxxxx" + value[at:]
+			}
+			return value[:i+3] + "xxxxx" + value[at:]
+		}
+	}
+	return value
+}
+
+// checkEnv returns a description of each variable in cfg whose value doesn't
+// match its pattern in envVars, sorted by name.
+func checkEnv(envVars map[string]*re.Regexp, cfg map[string]string) []string {
+	problems := []string{}
+	for name, pattern := range envVars {
+		if pattern.MatchString(cfg[name]) {
+			continue
+		}
+		expected, ok := patternNames[pattern]
+		if !ok {
+			expected = "a value matching " + pattern.String()
+		}
+		problems = append(problems, fmt.Sprintf("%s=%q is not valid: expected %s",
+			name, redactEnv(name, cfg[name]), expected))
+	}
+	sort.Strings(problems)
+	return problems
+}
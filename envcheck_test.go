@@ -0,0 +1,60 @@
+package main
+
+import (
+	re "regexp"
+	"strings"
+	"testing"
+)
+
+func TestRedactEnv(t *testing.T) {
+	tests := []struct {
+		name, value, want string
+	}{
+		{"RELAYMSG_WEBHOOK_HEADERS", "Authorization:Bearer s3cret", "[redacted]"},
+		{"RELAYMSG_WEBHOOK_BASIC_AUTH", "sparkpost:s3cret", "[redacted]"},
+		{"RELAYMSG_WEBHOOK_HMAC_SECRET", "s3cret", "[redacted]"},
+		{"RELAYMSG_ADMIN_TOKEN", "s3cret", "[redacted]"},
+		{"RELAYMSG_PG_PASS", "s3cret", "[redacted]"},
+		{"AWS_SECRET_ACCESS_KEY", "s3cret", "[redacted]"},
+		{"DATABASE_URL", "postgres://user:s3cret@db:5432/relay", "postgres://user:xxxxx@db:5432/relay"},
+		{"RELAYMSG_REDIS_URL", "redis://s3cret@cache:6379", "redis://xxxxx@cache:6379"},
+		{"RELAYMSG_PUBLISH_URL", "nats://nats:4222", "nats://nats:4222"},
+		{"RELAYMSG_AUDIT_HEADERS", "X-Forwarded-For,User-Agent", "X-Forwarded-For,User-Agent"},
+		{"PORT", "80 80", "80 80"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := redactEnv(tt.name, tt.value); got != tt.want {
+				t.Errorf("redactEnv(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckEnv(t *testing.T) {
+	envVars := map[string]*re.Regexp{
+		"PORT":                        digits,
+		"RELAYMSG_WEBHOOK_HEADERS":    webhookHeaderList,
+		"RELAYMSG_WEBHOOK_BASIC_AUTH": nows,
+		"RELAYMSG_WEBHOOK_ROUTES":     routeList,
+	}
+	cfg := map[string]string{
+		"PORT":                        "80",
+		"RELAYMSG_WEBHOOK_HEADERS":    "Authorization:Bearer s3cret,X-Env",
+		"RELAYMSG_WEBHOOK_BASIC_AUTH": "sparkpost:s3cret pw",
+		"RELAYMSG_WEBHOOK_ROUTES":     "123:billing,456",
+	}
+	problems := checkEnv(envVars, cfg)
+	want := []string{
+		`RELAYMSG_WEBHOOK_BASIC_AUTH="[redacted]" is not valid: expected any value without whitespace`,
+		`RELAYMSG_WEBHOOK_HEADERS="[redacted]" is not valid: expected a comma-separated list of Name:value pairs`,
+	}
+	if strings.Join(problems, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got problems:\n%s\nwant:\n%s", strings.Join(problems, "\n"), strings.Join(want, "\n"))
+	}
+	for _, problem := range problems {
+		if strings.Contains(problem, "s3cret") {
+			t.Errorf("secret logged: %s", problem)
+		}
+	}
+}
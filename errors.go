@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// Errors returned by ParseEvent and StoreEvent wrap one of these, so callers
+// can tell with errors.Is whether an event should be skipped or the batch
+// retried.
+var (
+	// ErrParse means the event isn't valid JSON or isn't shaped like a relay
+	// message. It's already been recorded in the failures table.
+	ErrParse = errors.New("unparseable event")
+	// ErrOversized means the message is larger than MaxMessageSize and
+	// oversized messages are being dropped.
+	ErrOversized = errors.New("message too large")
+	// ErrUnknownWebhook means the event came from a webhook that isn't in
+	// RELAYMSG_WEBHOOK_IDS.
+	ErrUnknownWebhook = errors.New("unrecognized webhook")
+	// ErrDuplicate means the message repeats one stored within the
+	// deduplication window, and was counted rather than stored.
+	ErrDuplicate = errors.New("duplicate message")
+	// ErrOtherDomain means the message is to a domain which isn't in
+	// RELAYMSG_RECIPIENT_DOMAINS.
+	ErrOtherDomain = errors.New("recipient domain not accepted")
+	// ErrTransientDB means the database (or body storage) failed in a way
+	// that may succeed later, like a dropped connection.
+	ErrTransientDB = errors.New("transient database error")
+)
+
+// storeError wraps an error from storing a message, marking it with
+// ErrTransientDB when retrying might help.
+func storeError(stage, reqID string, err error) error {
+	if IsTransient(err) {
+		return fmt.Errorf("StoreEvent (%s) [req %s]: %w: %w", stage, reqID, ErrTransientDB, err)
+	}
+	return fmt.Errorf("StoreEvent (%s) [req %s]: %w", stage, reqID, err)
+}
+
+// ErrorResponse is the body of every error returned by the API.
+type ErrorResponse struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+	Path  string `json:"path"`
+}
+
+// writeJSONError responds with status and an ErrorResponse. code is a short
+// machine-readable identifier for the kind of error, like "not_found".
+func writeJSONError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	jsonBytes, err := json.Marshal(ErrorResponse{
+		Error: message,
+		Code:  code,
+		Path:  r.URL.Path,
+	})
+	if err != nil {
+		log.Printf("writeJSONError (JSON): %s", err)
+		http.Error(w, message, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(jsonBytes)
+}
+
+// writeJSON responds with v encoded as JSON.
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	writeJSONStatus(w, r, http.StatusOK, v)
+}
+
+// writeJSONStatus is like writeJSON, with a status other than 200.
+func writeJSONStatus(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	jsonBytes, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("writeJSON (JSON): %s", err)
+		writeJSONError(w, r, http.StatusInternalServerError, "encoding_error", "Encoding error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jsonBytes)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// DefaultEventPath is where relay messages are found in SparkPost webhook
+// events.
+const DefaultEventPath string = "msys.relay_message"
+
+// ParseEventPath splits a dotted path like "msys.relay_message" into keys.
+// The default path gives nil, for the built in handling of SparkPost events.
+func ParseEventPath(path string) ([]string, error) {
+	if path == "" || path == DefaultEventPath {
+		return nil, nil
+	}
+	keys := strings.Split(path, ".")
+	for _, key := range keys {
+		if key == "" {
+			return nil, fmt.Errorf("ParseEventPath: empty key in %q", path)
+		}
+	}
+	return keys, nil
+}
+
+// lookupPath follows keys through nested JSON objects in j. When there's
+// nothing at the path it returns nil, along with the first missing key.
+func lookupPath(j json.RawMessage, keys []string) (json.RawMessage, string, error) {
+	for _, key := range keys {
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(j, &obj); err != nil {
+			return nil, key, err
+		}
+		next, ok := obj[key]
+		if !ok {
+			return nil, key, nil
+		}
+		j = next
+	}
+	return j, "", nil
+}
+
+// eventType is EventType, taking into account a configured EventPath.
+func (p *RelayMsgParser) eventType(j *json.RawMessage) string {
+	if j != nil && len(p.EventPath) > 0 {
+		if raw, _, err := lookupPath(*j, p.EventPath); err == nil && raw != nil {
+			return "relay_message"
+		}
+	}
+	return EventType(j)
+}
+
+// parseEventAtPath is ParseEvent for payloads with the relay message at the
+// configured EventPath.
+func (p *RelayMsgParser) parseEventAtPath(ctx context.Context, j *json.RawMessage, reqID string) error {
+	raw, missing, err := lookupPath(*j, p.EventPath)
+	if err == nil && raw == nil {
+		log.Printf("ParseEvent ignored event with no %q key: %s\n", missing, string(*j))
+		return nil
+	}
+	var msg RelayMessage
+	if err == nil {
+		err = json.Unmarshal(raw, &msg)
+	}
+	if err != nil {
+		return p.parseFailure(ctx, j, reqID, err)
+	}
+	msg.Event = *j
+	Debugf("%s => %s (%s) [req %s]\n", msg.From, msg.To, msg.WebhookID, reqID)
+
+	return p.StoreEvent(ctx, &msg, reqID)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseEventPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want []string
+		ok   bool
+	}{
+		{"", nil, true},
+		{DefaultEventPath, nil, true},
+		{"data.relay", []string{"data", "relay"}, true},
+		{"relay_message", []string{"relay_message"}, true},
+		{"msys.relay_message.content", []string{"msys", "relay_message", "content"}, true},
+		{"data..relay", nil, false},
+		{".relay", nil, false},
+		{"data.", nil, false},
+		{".", nil, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseEventPath(tt.path)
+		if (err == nil) != tt.ok {
+			t.Errorf("ParseEventPath(%q) error %v, want ok %t", tt.path, err, tt.ok)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseEventPath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestEventPath(t *testing.T) {
+	const relay = `{"msg_from":"ann@example.org","rcpt_to":"bob@example.com","webhook_id":"1",` +
+		`"content":{"email_rfc822":"Subject: hi\r\n\r\nhi\r\n","headers":[{"Subject":"hi"}]}}`
+	tests := []struct {
+		name  string
+		path  string
+		event string
+		// stored is whether the message should be stored, failed whether
+		// the event should be recorded as a parse failure, and eventType
+		// how it's counted.
+		stored, failed bool
+		eventType      string
+	}{
+		{"default path", "", `{"msys":{"relay_message":` + relay + `}}`, true, false, "relay_message"},
+		{"default path, other shape", "", `{"data":{"relay":` + relay + `}}`, false, false, "unknown"},
+		{"configured path", "data.relay", `{"data":{"relay":` + relay + `}}`, true, false, "relay_message"},
+		{"top level", "relay", `{"relay":` + relay + `}`, true, false, "relay_message"},
+		{"missing key", "data.relay", `{"data":{"other":{}}}`, false, false, "unknown"},
+		{"other event", "data.relay", `{"msys":{"track_event":{"type":"click"}}}`, false, false, "click"},
+		{"not an object on the way", "data.relay", `{"data":"relay"}`, false, true, "unknown"},
+		{"relay message not an object", "data.relay", `{"data":{"relay":[1]}}`, false, true, "relay_message"},
+		{"not JSON", "data.relay", `{"data":`, false, true, "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, err := ParseEventPath(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := &RelayMsgParser{EventPath: path}
+			ts := newTestServer(t, p, nil, storeRows)
+			event := json.RawMessage(tt.event)
+			if got := p.eventType(&event); got != tt.eventType {
+				t.Errorf("event type %q, want %q", got, tt.eventType)
+			}
+
+			err = p.ParseEvent(context.Background(), &event, "req")
+			if tt.failed != errors.Is(err, ErrParse) || (!tt.failed && err != nil) {
+				t.Errorf("error %v, want a parse failure %t", err, tt.failed)
+			}
+			if n := len(ts.DB.Queries("relay_parse_failures")); (n > 0) != tt.failed {
+				t.Errorf("%d failures recorded", n)
+			}
+			to := storedColumn(t, ts.DB, "smtp_to")
+			if tt.stored && !reflect.DeepEqual(to, []driver.Value{"bob@example.com"}) {
+				t.Errorf("stored for %v", to)
+			} else if !tt.stored && len(to) != 0 {
+				t.Errorf("stored for %v, want nothing stored", to)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	re "regexp"
+	"strings"
+	"time"
+
+	"github.com/husobee/vestigo"
+)
+
+// mboxFromLine matches lines which need quoting in an mboxrd file: "From "
+// preceded by any number of ">".
+var mboxFromLine *re.Regexp = re.MustCompile(`^>*From `)
+
+// WriteMbox writes a message to w in mboxrd format: a "From " line with the
+// sender and time received, then the message with line endings converted to
+// LF and "From " lines quoted, then a blank line.
+func WriteMbox(w io.Writer, from string, received time.Time, rfc822 []byte) error {
+	if from == "" {
+		from = "MAILER-DAEMON"
+	}
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "From %s %s\n", strings.Join(strings.Fields(from), ""), received.UTC().Format(time.ANSIC))
+	body := bytes.TrimSuffix(bytes.ReplaceAll(rfc822, []byte("\r\n"), []byte("\n")), []byte("\n"))
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		if mboxFromLine.Match(line) {
+			bw.WriteByte('>')
+		}
+		bw.Write(line)
+		bw.WriteByte('\n')
+	}
+	bw.WriteByte('\n')
+	return bw.Flush()
+}
+
+// ExportHandler streams every message for the given localpart, oldest first,
+// as an mbox file. Messages stored without a body are left out. Rows are
+// written as they're read, so the export isn't held in memory; a failure
+// part way through can only be logged, leaving the file cut short.
+func (p *RelayMsgParser) ExportHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		localpart := p.normalizeLocalpart(vestigo.Param(r, "localpart"))
+
+		// The export may take much longer than QueryTimeout; it ends if the
+		// client goes away.
+		ctx := r.Context()
+		rows, err := p.ReadDB().QueryContext(ctx, fmt.Sprintf(`
+			SELECT message_id, coalesce(smtp_from, ''), created, rfc822,
+			       body_key, is_compressed, is_base64
+			  FROM %s
+			 WHERE %s = $1 ||'@'|| $2
+			   AND has_body IS NOT FALSE
+			 ORDER BY created, message_id
+		`, p.MsgTable(), p.recipientColumn()), localpart, p.Domain)
+		if err != nil {
+			log.Printf("ExportMessages (SELECT): %s", err)
+			writeJSONError(w, r, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+		defer rows.Close()
+
+		filename := strings.Map(func(r rune) rune {
+			if r == '"' || r == '\\' || r < ' ' {
+				return '_'
+			}
+			return r
+		}, localpart)
+		w.Header().Set("Content-Type", "application/mbox")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.mbox\"", filename))
+
+		n := 0
+		for rows.Next() {
+			var id int64
+			var from string
+			var created time.Time
+			var rfc822 []byte
+			var bodyKey sql.NullString
+			var isCompressed, isBase64 sql.NullBool
+			if err = rows.Scan(&id, &from, &created, &rfc822, &bodyKey, &isCompressed, &isBase64); err != nil {
+				log.Printf("ExportMessages (Scan): %s", err)
+				return
+			}
+			body, err := p.decodeBody(id, rfc822, bodyKey, isCompressed.Bool, isBase64.Bool)
+			if err != nil {
+				log.Printf("ExportMessages %s", err)
+				return
+			}
+			if err = WriteMbox(w, from, created, body); err != nil {
+				log.Printf("ExportMessages (write): %s", err)
+				return
+			}
+			n++
+		}
+		if err = rows.Err(); err != nil {
+			log.Printf("ExportMessages (Err): %s", err)
+			return
+		}
+		log.Printf("ExportMessages: exported %d messages for [%s]", n, localpart)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const DefaultMaxParseFailures int = 1000
+
+type ParseFailure struct {
+	ID      int64     `json:"id"`
+	Payload string    `json:"payload"`
+	Error   string    `json:"error"`
+	Created time.Time `json:"created"`
+}
+
+// RecordFailure stores a payload which couldn't be parsed, so it can be
+// inspected later. Problems storing the failure are logged, not returned, so
+// they never interrupt processing of the rest of a batch.
+func (p *RelayMsgParser) RecordFailure(ctx context.Context, payload []byte, perr error) {
+	_, err := p.Dbh.ExecContext(ctx, fmt.Sprintf(`
+		INSERT INTO %s.relay_parse_failures (payload, error)
+		VALUES ($1, $2)
+	`, p.Schema), payload, perr.Error())
+	if err != nil {
+		log.Printf("RecordFailure (INSERT): %s\n", err)
+		return
+	}
+
+	max := p.MaxParseFailures
+	if max <= 0 {
+		max = DefaultMaxParseFailures
+	}
+	_, err = p.Dbh.ExecContext(ctx, fmt.Sprintf(`
+		DELETE FROM %[1]s.relay_parse_failures
+		 WHERE failure_id <= (SELECT max(failure_id) FROM %[1]s.relay_parse_failures) - $1
+	`, p.Schema), max)
+	if err != nil {
+		log.Printf("RecordFailure (DELETE): %s\n", err)
+	}
+}
+
+// FailuresHandler lists the most recent parse failures, newest first.
+// The number returned may be set with limit, up to 500.
+func (p *RelayMsgParser) FailuresHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit, err := limitParam(r, 50, 500)
+		if err != nil {
+			writeJSONError(w, r, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+
+		ctx, cancel := p.requestContext(r)
+		defer cancel()
+		rows, err := p.ReadDB().QueryContext(ctx, fmt.Sprintf(`
+			SELECT failure_id, payload, error, created
+			  FROM %s.relay_parse_failures
+			 ORDER BY failure_id DESC
+			 LIMIT $1
+		`, p.Schema), limit)
+		if err != nil {
+			log.Printf("ListFailures (SELECT): %s", err)
+			writeJSONError(w, r, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+		defer rows.Close()
+
+		res := map[string][]ParseFailure{"results": {}}
+		for rows.Next() {
+			if rows.Err() == io.EOF {
+				break
+			}
+			f := ParseFailure{}
+			var payload []byte
+			if err = rows.Scan(&f.ID, &payload, &f.Error, &f.Created); err != nil {
+				log.Printf("ListFailures (Scan): %s", err)
+				writeJSONError(w, r, http.StatusInternalServerError, "database_error", "Database error")
+				return
+			}
+			f.Payload = string(payload)
+			res["results"] = append(res["results"], f)
+		}
+		if err = rows.Err(); err != nil {
+			log.Printf("ListFailures (Err): %s", err)
+			writeJSONError(w, r, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+
+		jsonBytes, err := json.Marshal(res)
+		if err != nil {
+			log.Printf("ListFailures (JSON): %s", err)
+			writeJSONError(w, r, http.StatusInternalServerError, "encoding_error", "Encoding error")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonBytes)
+	}
+}
+
+// limitParam reads the limit query parameter, applying a default and a cap.
+func limitParam(r *http.Request, def, max int) (int, error) {
+	val := r.URL.Query().Get("limit")
+	if val == "" {
+		return def, nil
+	}
+	limit, err := strconv.Atoi(val)
+	if err != nil || limit < 1 {
+		return 0, fmt.Errorf("invalid limit: %q", val)
+	}
+	if limit > max {
+		limit = max
+	}
+	return limit, nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/SparkPost/httpdump/storage"
+)
+
+// fakeQuery is a statement run against a fakeDB, with its arguments.
+type fakeQuery struct {
+	SQL  string
+	Args []driver.Value
+}
+
+// fakeRows is a result a fakeDB returns for a query. For statements which
+// don't return rows, the number of rows is the number affected.
+type fakeRows struct {
+	Cols []string
+	Vals [][]driver.Value
+}
+
+// storeRows answers the INSERT storing each message with a new message_id,
+// and anything else with no rows.
+func storeRows(q fakeQuery) (*fakeRows, error) {
+	if !strings.Contains(q.SQL, "RETURNING message_id, created") {
+		return nil, nil
+	}
+	id := atomic.AddInt64(&lastMessageID, 1)
+	return &fakeRows{Vals: [][]driver.Value{{id, time.Now()}}}, nil
+}
+
+var lastMessageID int64
+
+// anyRows answers each query with the first result any of handlers has for
+// it, or no rows.
+func anyRows(handlers ...func(q fakeQuery) (*fakeRows, error)) func(q fakeQuery) (*fakeRows, error) {
+	return func(q fakeQuery) (*fakeRows, error) {
+		for _, h := range handlers {
+			if res, err := h(q); res != nil || err != nil {
+				return res, err
+			}
+		}
+		return nil, nil
+	}
+}
+
+// fakeDB is a database/sql driver for tests which answers every statement
+// with whatever its handler returns for it, and records what was run. A nil
+// handler answers everything with no rows.
+type fakeDB struct {
+	mu      sync.Mutex
+	queries []fakeQuery
+	handler func(q fakeQuery) (*fakeRows, error)
+}
+
+// newFakeDB returns a connection pool backed by a fakeDB using handler.
+func newFakeDB(t testing.TB, handler func(q fakeQuery) (*fakeRows, error)) (*sql.DB, *fakeDB) {
+	f := &fakeDB{handler: handler}
+	dbh := sql.OpenDB(f)
+	t.Cleanup(func() { dbh.Close() })
+	return dbh, f
+}
+
+// Queries returns the statements run so far which contain substr.
+func (f *fakeDB) Queries(substr string) []fakeQuery {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	matched := []fakeQuery{}
+	for _, q := range f.queries {
+		if strings.Contains(q.SQL, substr) {
+			matched = append(matched, q)
+		}
+	}
+	return matched
+}
+
+func (f *fakeDB) run(query string, args []driver.NamedValue) (*fakeRows, error) {
+	q := fakeQuery{SQL: query}
+	for _, arg := range args {
+		q.Args = append(q.Args, arg.Value)
+	}
+	f.mu.Lock()
+	f.queries = append(f.queries, q)
+	f.mu.Unlock()
+	if f.handler == nil {
+		return &fakeRows{}, nil
+	}
+	res, err := f.handler(q)
+	if res == nil && err == nil {
+		res = &fakeRows{}
+	}
+	return res, err
+}
+
+func (f *fakeDB) Connect(ctx context.Context) (driver.Conn, error) { return &fakeConn{f}, nil }
+func (f *fakeDB) Driver() driver.Driver                            { return fakeDriver{} }
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	return nil, errors.New("fakeDriver: use sql.OpenDB")
+}
+
+type fakeConn struct{ f *fakeDB }
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("fakeConn: Prepare isn't supported")
+}
+func (c *fakeConn) Close() error              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) { return fakeTx{}, nil }
+
+// CheckNamedValue accepts arguments of any type, so tests can see exactly
+// what was passed.
+func (c *fakeConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if v, ok := nv.Value.(driver.Valuer); ok {
+		val, err := v.Value()
+		nv.Value = val
+		return err
+	}
+	return nil
+}
+
+// QueryContext runs query. Like a real driver's, it fails if ctx is done
+// by the time the statement finishes.
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	res, err := c.f.run(query, args)
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &fakeCursor{rows: res}, nil
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	res, err := c.f.run(query, args)
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(len(res.Vals)), nil
+}
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeCursor struct {
+	rows *fakeRows
+	next int
+}
+
+func (c *fakeCursor) Columns() []string {
+	if c.rows.Cols == nil && len(c.rows.Vals) > 0 {
+		cols := make([]string, len(c.rows.Vals[0]))
+		for i := range cols {
+			cols[i] = "col"
+		}
+		return cols
+	}
+	return c.rows.Cols
+}
+
+func (c *fakeCursor) Close() error { return nil }
+
+func (c *fakeCursor) Next(dest []driver.Value) error {
+	if c.next >= len(c.rows.Vals) {
+		return io.EOF
+	}
+	copy(dest, c.rows.Vals[c.next])
+	c.next++
+	return nil
+}
+
+// testServer serves every route with NewServer, backed by a fakeDB, and
+// keeps the webhook requests it's sent rather than storing them.
+type testServer struct {
+	*httptest.Server
+	DB *fakeDB
+
+	mu     sync.Mutex
+	dumped []*storage.Request
+}
+
+func (ts *testServer) Dump(req *storage.Request) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.dumped = append(ts.dumped, req)
+	return nil
+}
+
+// Dumped returns the webhook requests which would have been stored.
+func (ts *testServer) Dumped() []*storage.Request {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return append([]*storage.Request{}, ts.dumped...)
+}
+
+// newTestServer starts a testServer for p, with its database answered by
+// handler. The schema and domain are filled in when p doesn't set them.
+func newTestServer(t testing.TB, p *RelayMsgParser, cfg map[string]string, handler func(q fakeQuery) (*fakeRows, error)) *testServer {
+	ts := &testServer{}
+	p.Dbh, ts.DB = newFakeDB(t, handler)
+	if p.Schema == "" {
+		p.Schema = "relaymsg"
+	}
+	if p.Domain == "" {
+		p.Domain = "example.com"
+	}
+	if cfg == nil {
+		cfg = map[string]string{}
+	}
+	ts.Server = httptest.NewServer(NewServer(cfg, p, ts, nil, nil).Handler)
+	t.Cleanup(ts.Close)
+	return ts
+}
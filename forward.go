@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+)
+
+// SMTPRelay sends mail through an SMTP server, authenticating with PLAIN auth
+// when a user is set.
+type SMTPRelay struct {
+	Host string
+	Port string
+	User string
+	Pass string
+	// From is the envelope sender for forwarded mail. When empty, the
+	// original sender is used.
+	From string
+}
+
+// Send delivers msg to the single recipient to.
+func (s *SMTPRelay) Send(from, to string, msg []byte) error {
+	if s.From != "" {
+		from = s.From
+	}
+	var auth smtp.Auth
+	if s.User != "" {
+		auth = smtp.PlainAuth("", s.User, s.Pass, s.Host)
+	}
+	return smtp.SendMail(net.JoinHostPort(s.Host, s.Port), auth, from, []string{to}, msg)
+}
+
+type ForwardRequest struct {
+	To string `json:"to"`
+}
+
+type ForwardResponse struct {
+	ID     int64  `json:"id"`
+	To     string `json:"to"`
+	Status string `json:"status"`
+}
+
+// ForwardHandler re-delivers a stored message to the address in the JSON
+// request body, through the configured SMTP relay.
+func (p *RelayMsgParser) ForwardHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if p.Relay == nil {
+			writeJSONError(w, r, http.StatusServiceUnavailable, "not_configured", "Forwarding is not configured")
+			return
+		}
+
+		var fr ForwardRequest
+		err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&fr)
+		if err != nil {
+			writeJSONError(w, r, http.StatusBadRequest, "bad_request", "Request body must be JSON like {\"to\": \"user@example.com\"}")
+			return
+		}
+		addr, err := mail.ParseAddress(fr.To)
+		if err != nil {
+			writeJSONError(w, r, http.StatusBadRequest, "invalid_address", fmt.Sprintf("Invalid destination: %s", err))
+			return
+		}
+
+		m := p.messageWithBody(w, r, RawBody)
+		if m == nil {
+			return
+		}
+
+		err = p.Relay.Send(m.From, addr.Address, m.RFC822)
+		if err != nil {
+			log.Printf("ForwardMessage (SMTP): message %d to %s: %s", m.ID, addr.Address, err)
+			status := http.StatusBadGateway
+			if tpErr, ok := err.(*textproto.Error); ok && tpErr.Code >= 500 {
+				status = http.StatusUnprocessableEntity
+			}
+			writeJSONError(w, r, status, "smtp_error", err.Error())
+			return
+		}
+		log.Printf("ForwardMessage: message %d sent to %s", m.ID, addr.Address)
+
+		jsonBytes, err := json.Marshal(ForwardResponse{ID: m.ID, To: addr.Address, Status: "sent"})
+		if err != nil {
+			log.Printf("ForwardMessage (JSON): %s", err)
+			writeJSONError(w, r, http.StatusInternalServerError, "encoding_error", "Encoding error")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonBytes)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSMTP is an SMTP server which keeps the mail it's sent. replies, keyed
+// by command, override its answer to that command.
+type fakeSMTP struct {
+	ln      net.Listener
+	replies map[string]string
+
+	mu   sync.Mutex
+	auth string
+	from string
+	rcpt []string
+	data string
+}
+
+func newFakeSMTP(t *testing.T, replies map[string]string) *fakeSMTP {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeSMTP{ln: ln, replies: replies}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	tc := textproto.NewConn(conn)
+	tc.PrintfLine("220 fake ESMTP")
+	for {
+		line, err := tc.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd, arg, _ := strings.Cut(line, " ")
+		cmd = strings.ToUpper(cmd)
+		if reply, ok := f.replies[cmd]; ok {
+			tc.PrintfLine("%s", reply)
+			continue
+		}
+		f.mu.Lock()
+		switch cmd {
+		case "EHLO":
+			tc.PrintfLine("250-fake")
+			tc.PrintfLine("250 AUTH PLAIN")
+		case "AUTH":
+			f.auth = arg
+			tc.PrintfLine("235 2.7.0 Authenticated")
+		case "MAIL":
+			f.from = arg
+			tc.PrintfLine("250 2.1.0 OK")
+		case "RCPT":
+			f.rcpt = append(f.rcpt, arg)
+			tc.PrintfLine("250 2.1.5 OK")
+		case "DATA":
+			tc.PrintfLine("354 Go ahead")
+			data, err := tc.ReadDotBytes()
+			if err != nil {
+				f.mu.Unlock()
+				return
+			}
+			f.data = string(data)
+			tc.PrintfLine("250 2.0.0 Queued")
+		case "QUIT":
+			tc.PrintfLine("221 2.0.0 Bye")
+			f.mu.Unlock()
+			return
+		default:
+			tc.PrintfLine("502 5.5.2 Unknown command")
+		}
+		f.mu.Unlock()
+	}
+}
+
+func TestForwardHandler(t *testing.T) {
+	const token = "s3cret"
+	// The leading dot has to survive the SMTP transparency procedure.
+	const email = "From: ann@example.org\r\nSubject: hi\r\n\r\nhi\r\n.\r\nbye\r\n"
+	tests := []struct {
+		name    string
+		relay   *SMTPRelay
+		replies map[string]string
+		body    string
+		status  int
+		want    string
+		// from and auth are what the SMTP server should be sent; nothing is
+		// sent when from is empty.
+		from, auth string
+	}{
+		{"sent", &SMTPRelay{}, nil, `{"to":"Bob <bob@example.com>"}`, http.StatusOK,
+			`{"id":1,"to":"bob@example.com","status":"sent"}`, "FROM:<ann@example.org>", ""},
+		{"envelope sender set", &SMTPRelay{From: "relay@example.com"}, nil, `{"to":"bob@example.com"}`, http.StatusOK,
+			`"status":"sent"`, "FROM:<relay@example.com>", ""},
+		{"authenticated", &SMTPRelay{User: "relay", Pass: "pw"}, nil, `{"to":"bob@example.com"}`, http.StatusOK,
+			`"status":"sent"`, "FROM:<ann@example.org>", "PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00relay\x00pw"))},
+		{"recipient refused", &SMTPRelay{}, map[string]string{"RCPT": "550 5.1.1 No such user"}, `{"to":"bob@example.com"}`,
+			http.StatusUnprocessableEntity, "No such user", "", ""},
+		{"temporary failure", &SMTPRelay{}, map[string]string{"DATA": "451 4.3.0 Try again later"}, `{"to":"bob@example.com"}`,
+			http.StatusBadGateway, "Try again later", "", ""},
+		{"authentication refused", &SMTPRelay{User: "relay", Pass: "nope"}, map[string]string{"AUTH": "535 5.7.8 Bad credentials"}, `{"to":"bob@example.com"}`,
+			http.StatusUnprocessableEntity, "Bad credentials", "", ""},
+		{"invalid address", &SMTPRelay{}, nil, `{"to":"bob"}`, http.StatusBadRequest, "invalid_address", "", ""},
+		{"not JSON", &SMTPRelay{}, nil, `bob@example.com`, http.StatusBadRequest, "bad_request", "", ""},
+		{"not configured", nil, nil, `{"to":"bob@example.com"}`, http.StatusServiceUnavailable, "not_configured", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &RelayMsgParser{AdminToken: token}
+			var srv *fakeSMTP
+			if tt.relay != nil {
+				srv = newFakeSMTP(t, tt.replies)
+				tt.relay.Host, tt.relay.Port, _ = net.SplitHostPort(srv.ln.Addr().String())
+				p.Relay = tt.relay
+			}
+			ts := newTestServer(t, p, nil, func(q fakeQuery) (*fakeRows, error) {
+				if !strings.Contains(q.SQL, "WHERE message_id = $1") {
+					return nil, nil
+				}
+				return messageRow(q, map[string]driver.Value{
+					"created": time.Now(), "smtp_from": "ann@example.org", "smtp_to": "cat@example.com",
+					"has_body": true, "rfc822": []byte(email),
+				}), nil
+			})
+			header := http.Header{"Authorization": {"Bearer " + token}}
+			status, body := postWith(t, ts, "/message/1/forward", []byte(tt.body), header)
+			if status != tt.status || !strings.Contains(body, tt.want) {
+				t.Errorf("status %d, body %s; want %d, %s", status, body, tt.status, tt.want)
+			}
+			if tt.from == "" {
+				return
+			}
+			srv.mu.Lock()
+			defer srv.mu.Unlock()
+			if srv.from != tt.from || srv.auth != tt.auth || fmt.Sprint(srv.rcpt) != "[TO:<bob@example.com>]" {
+				t.Errorf("sent from %q to %q with auth %q", srv.from, srv.rcpt, srv.auth)
+			}
+			if want := strings.ReplaceAll(email, "\r\n", "\n"); srv.data != want {
+				t.Errorf("sent %q, want %q", srv.data, want)
+			}
+		})
+	}
+}
+
+func TestForwardHandlerErrors(t *testing.T) {
+	const token = "s3cret"
+	// A relay which isn't listening.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	ln.Close()
+
+	p := &RelayMsgParser{AdminToken: token, Relay: &SMTPRelay{Host: host, Port: port}}
+	ts := newTestServer(t, p, nil, nil)
+	header := http.Header{"Authorization": {"Bearer " + token}}
+	if status, body := postWith(t, ts, "/message/1/forward", []byte(`{"to":"bob@example.com"}`), header); status != http.StatusNotFound {
+		t.Errorf("missing message: status %d: %s", status, body)
+	}
+	if status, body := postWith(t, ts, "/message/1/forward", []byte(`{"to":"bob@example.com"}`), nil); status != http.StatusUnauthorized {
+		t.Errorf("without the admin token: status %d: %s", status, body)
+	}
+
+	ts = newTestServer(t, p, nil, func(q fakeQuery) (*fakeRows, error) {
+		return messageRow(q, map[string]driver.Value{"created": time.Now(), "has_body": true, "rfc822": []byte("Subject: hi\r\n\r\nhi\r\n")}), nil
+	})
+	status, body := postWith(t, ts, "/message/1/forward", []byte(`{"to":"bob@example.com"}`), header)
+	if status != http.StatusBadGateway || !strings.Contains(body, "smtp_error") {
+		t.Errorf("unreachable relay: status %d: %s", status, body)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/SparkPost/httpdump/storage"
+	"github.com/husobee/vestigo"
+)
+
+const HeadersTable string = "relay_request_headers"
+
+type RequestHeaders struct {
+	RequestID string              `json:"request_id"`
+	Headers   map[string][]string `json:"headers"`
+	Received  time.Time           `json:"received"`
+}
+
+// RecordHeaders keeps the AuditHeaders sent with a webhook request, keyed by
+// its request id. Requests without an id can't be looked up, so they're
+// skipped. Problems are logged rather than returned, so they never hold up
+// processing.
+func (p *RelayMsgParser) RecordHeaders(ctx context.Context, req *storage.Request, reqID string) {
+	if len(p.AuditHeaders) == 0 || reqID == "" {
+		return
+	}
+	stored := StoredHeader(req)
+	headers := map[string][]string{}
+	for _, name := range p.AuditHeaders {
+		if vals := stored.Values(name); len(vals) > 0 {
+			headers[http.CanonicalHeaderKey(name)] = vals
+		}
+	}
+	jsonBytes, err := json.Marshal(headers)
+	if err != nil {
+		log.Printf("RecordHeaders (JSON): %s\n", err)
+		return
+	}
+	_, err = p.Dbh.ExecContext(ctx, fmt.Sprintf(`
+		INSERT INTO %s.%s (request_id, headers, received)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (request_id) DO NOTHING
+	`, p.Schema, HeadersTable), reqID, string(jsonBytes), req.When)
+	if err != nil {
+		log.Printf("RecordHeaders (INSERT) [req %s]: %s\n", reqID, err)
+	}
+}
+
+// RequestHeadersHandler returns the headers recorded for a webhook request.
+func (p *RelayMsgParser) RequestHeadersHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rh := &RequestHeaders{RequestID: vestigo.Param(r, "request_id")}
+		ctx, cancel := p.requestContext(r)
+		defer cancel()
+		var headers []byte
+		err := p.ReadDB().QueryRowContext(ctx, fmt.Sprintf(`
+			SELECT headers, received
+			  FROM %s.%s
+			 WHERE request_id = $1
+		`, p.Schema, HeadersTable), rh.RequestID).Scan(&headers, &rh.Received)
+		if err == sql.ErrNoRows {
+			writeJSONError(w, r, http.StatusNotFound, "not_found", "No headers recorded for request")
+			return
+		} else if err != nil {
+			log.Printf("RequestHeaders (SELECT): %s", err)
+			writeJSONError(w, r, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+		if err = json.Unmarshal(headers, &rh.Headers); err != nil {
+			log.Printf("RequestHeaders (JSON): %s", err)
+			writeJSONError(w, r, http.StatusInternalServerError, "encoding_error", "Encoding error")
+			return
+		}
+		writeJSON(w, r, rh)
+	}
+}
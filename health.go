@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ReadyTimeout limits how long the database checks made by /readyz may take.
+const ReadyTimeout time.Duration = 2 * time.Second
+
+// Readiness serves /healthz and /readyz from as soon as the process starts
+// listening, and everything else once SetReady has been called, after the
+// schema has been set up. Until then other requests get a 503.
+type Readiness struct {
+	mu      sync.RWMutex
+	handler http.Handler
+	runner  *BatchRunner
+	dbhs    []*sql.DB
+}
+
+// SetReady starts passing requests to handler. Readiness from then on
+// depends on runner processing batches and each of dbhs being reachable.
+func (rd *Readiness) SetReady(handler http.Handler, runner *BatchRunner, dbhs ...*sql.DB) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	rd.handler, rd.runner, rd.dbhs = handler, runner, dbhs
+}
+
+// ReadyResponse reports on each of the checks made by /readyz, with "ok" or
+// what's wrong.
+type ReadyResponse struct {
+	Ready    bool   `json:"ready"`
+	Schema   string `json:"schema"`
+	Database string `json:"database"`
+	Batches  string `json:"batches"`
+}
+
+// Check reports whether the schema is set up, the batch processor running,
+// and the databases reachable.
+func (rd *Readiness) Check(ctx context.Context) ReadyResponse {
+	rd.mu.RLock()
+	handler, runner, dbhs := rd.handler, rd.runner, rd.dbhs
+	rd.mu.RUnlock()
+
+	res := ReadyResponse{Schema: "ok", Database: "ok", Batches: "ok"}
+	if handler == nil {
+		res.Schema, res.Database, res.Batches = "starting", "starting", "starting"
+		return res
+	}
+	if runner == nil || !runner.Running() {
+		res.Batches = "not running"
+	}
+	ctx, cancel := context.WithTimeout(ctx, ReadyTimeout)
+	defer cancel()
+	for _, dbh := range dbhs {
+		if err := dbh.PingContext(ctx); err != nil {
+			res.Database = err.Error()
+			break
+		}
+	}
+	res.Ready = res.Database == "ok" && res.Batches == "ok"
+	return res
+}
+
+func (rd *Readiness) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/healthz":
+		// Liveness: the process is up and responding.
+		writeJSON(w, r, map[string]string{"status": "ok"})
+		return
+	case "/readyz":
+		res := rd.Check(r.Context())
+		status := http.StatusOK
+		if !res.Ready {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSONStatus(w, r, status, res)
+		return
+	}
+
+	rd.mu.RLock()
+	handler := rd.handler
+	rd.mu.RUnlock()
+	if handler == nil {
+		w.Header().Set("Retry-After", "5")
+		writeJSONError(w, r, http.StatusServiceUnavailable, "starting", "Starting up, try again shortly")
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
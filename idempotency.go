@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+const IdempotencyTable string = "relay_idempotency_keys"
+
+const DefaultIdempotencyHeader string = "Idempotency-Key"
+
+// Idempotency drops repeated deliveries of the same webhook request. A
+// request's key is taken from Header, or is a hash of its body when that
+// header is missing. Keys are remembered for Window.
+type Idempotency struct {
+	Dbh    *sql.DB
+	Schema string
+	Header string
+	Window time.Duration
+}
+
+// SchemaInit creates the table keys are kept in. It lives alongside
+// raw_requests, which may not be the database messages are stored in.
+func (id *Idempotency) SchemaInit() error {
+	return createTable(id.Dbh, id.Schema, IdempotencyTable, []string{
+		fmt.Sprintf(`
+			CREATE TABLE IF NOT EXISTS %s.%s (
+				idempotency_key  text primary key,
+				created          timestamptz default clock_timestamp()
+			)
+		`, id.Schema, IdempotencyTable),
+	})
+}
+
+// statusRecorder notes the status code a handler responds with.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+// Wrap returns an ingest handler which responds 200 without calling h when a
+// request's key was seen within the window. If h fails, the key is forgotten
+// so the sender's retry is stored.
+func (id *Idempotency) Wrap(h http.HandlerFunc) http.HandlerFunc {
+	if id == nil || id.Window <= 0 {
+		return h
+	}
+	header := id.Header
+	if header == "" {
+		header = DefaultIdempotencyHeader
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(header)
+		if key == "" {
+			body, err := io.ReadAll(r.Body)
+			r.Body.Close()
+			if err != nil {
+				log.Printf("Idempotency (read): %s\n", err)
+				writeJSONError(w, r, http.StatusBadRequest, "bad_request", "Unable to read request")
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			sum := sha256.Sum256(body)
+			key = "sha256:" + hex.EncodeToString(sum[:])
+		}
+
+		// A row is only inserted or updated for keys which are new or expired.
+		res, err := id.Dbh.ExecContext(r.Context(), fmt.Sprintf(`
+			INSERT INTO %[1]s.%[2]s AS k (idempotency_key) VALUES ($1)
+			ON CONFLICT (idempotency_key) DO UPDATE SET created = clock_timestamp()
+			 WHERE k.created < clock_timestamp() - $2 * interval '1 second'
+		`, id.Schema, IdempotencyTable), key, id.Window.Seconds())
+		if err != nil {
+			// Better to store a duplicate than to lose a delivery.
+			log.Printf("Idempotency (INSERT): %s\n", err)
+			h(w, r)
+			return
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			log.Printf("Idempotency: ignoring repeated delivery with key %s\n", key)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		sr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h(sr, r)
+		if sr.status >= 400 {
+			_, err = id.Dbh.Exec(fmt.Sprintf(`
+				DELETE FROM %s.%s WHERE idempotency_key = $1
+			`, id.Schema, IdempotencyTable), key)
+			if err != nil {
+				log.Printf("Idempotency (DELETE): %s\n", err)
+			}
+		}
+	}
+}
+
+// Expire deletes keys older than the window.
+func (id *Idempotency) Expire() {
+	_, err := id.Dbh.Exec(fmt.Sprintf(`
+		DELETE FROM %s.%s
+		 WHERE created < clock_timestamp() - $1 * interval '1 second'
+	`, id.Schema, IdempotencyTable), id.Window.Seconds())
+	if err != nil {
+		log.Printf("Idempotency (expire): %s\n", err)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// keyRows answers the statements Idempotency runs, remembering the keys
+// inserted until they're deleted. Keys never expire.
+type keyRows struct {
+	mu   sync.Mutex
+	keys map[string]bool
+	err  error
+}
+
+func (k *keyRows) handle(q fakeQuery) (*fakeRows, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	switch {
+	case strings.Contains(q.SQL, "INSERT INTO relaymsg."+IdempotencyTable):
+		if k.err != nil {
+			return nil, k.err
+		}
+		key := q.Args[0].(string)
+		if k.keys[key] {
+			return &fakeRows{}, nil
+		}
+		k.keys[key] = true
+		return &fakeRows{Vals: [][]driver.Value{{key}}}, nil
+	case strings.Contains(q.SQL, "DELETE FROM relaymsg."+IdempotencyTable):
+		delete(k.keys, q.Args[0].(string))
+	}
+	return nil, nil
+}
+
+func TestIdempotency(t *testing.T) {
+	type delivery struct {
+		key, body string
+		// status is what the wrapped handler responds with, and stored
+		// whether it should be called.
+		status int
+		stored bool
+	}
+	tests := []struct {
+		name       string
+		header     string
+		window     time.Duration
+		err        error
+		deliveries []delivery
+	}{
+		{"repeated key", "", time.Hour, nil, []delivery{
+			{"a", "x", http.StatusOK, true},
+			{"a", "y", http.StatusOK, false},
+		}},
+		{"different keys", "", time.Hour, nil, []delivery{
+			{"a", "x", http.StatusOK, true},
+			{"b", "x", http.StatusOK, true},
+		}},
+		{"repeated body", "", time.Hour, nil, []delivery{
+			{"", "x", http.StatusOK, true},
+			{"", "x", http.StatusOK, false},
+		}},
+		{"different bodies", "", time.Hour, nil, []delivery{
+			{"", "x", http.StatusOK, true},
+			{"", "y", http.StatusOK, true},
+		}},
+		{"failed delivery retried", "", time.Hour, nil, []delivery{
+			{"a", "x", http.StatusServiceUnavailable, true},
+			{"a", "x", http.StatusOK, true},
+			{"a", "x", http.StatusOK, false},
+		}},
+		{"other header", "X-Delivery-ID", time.Hour, nil, []delivery{
+			{"a", "x", http.StatusOK, true},
+			{"a", "x", http.StatusOK, false},
+		}},
+		{"database error", "", time.Hour, errors.New("connection refused"), []delivery{
+			{"a", "x", http.StatusOK, true},
+			{"a", "x", http.StatusOK, true},
+		}},
+		{"disabled", "", 0, nil, []delivery{
+			{"a", "x", http.StatusOK, true},
+			{"a", "x", http.StatusOK, true},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows := &keyRows{keys: map[string]bool{}, err: tt.err}
+			dbh, db := newFakeDB(t, rows.handle)
+			id := &Idempotency{Dbh: dbh, Schema: "relaymsg", Header: tt.header, Window: tt.window}
+			header := tt.header
+			if header == "" {
+				header = DefaultIdempotencyHeader
+			}
+			for i, d := range tt.deliveries {
+				stored := false
+				h := id.Wrap(func(w http.ResponseWriter, r *http.Request) {
+					stored = true
+					w.WriteHeader(d.status)
+				})
+				r := httptest.NewRequest("POST", "/incoming", strings.NewReader(d.body))
+				if d.key != "" {
+					r.Header.Set(header, d.key)
+				}
+				w := httptest.NewRecorder()
+				h(w, r)
+				if stored != d.stored {
+					t.Errorf("delivery %d: stored = %t, want %t", i, stored, d.stored)
+				}
+				// Repeats are acknowledged, so the sender stops retrying.
+				want := d.status
+				if !d.stored {
+					want = http.StatusOK
+				}
+				if w.Code != want {
+					t.Errorf("delivery %d: status %d, want %d", i, w.Code, want)
+				}
+			}
+
+			inserts := db.Queries("INSERT INTO relaymsg." + IdempotencyTable)
+			if tt.window <= 0 {
+				if len(inserts) != 0 {
+					t.Errorf("keys recorded while disabled: %q", inserts[0].SQL)
+				}
+				return
+			}
+			for _, q := range inserts {
+				if q.Args[1] != tt.window.Seconds() {
+					t.Errorf("window of %v seconds, want %v", q.Args[1], tt.window.Seconds())
+				}
+			}
+			if tt.deliveries[0].key == "" {
+				sum := sha256.Sum256([]byte(tt.deliveries[0].body))
+				if want := "sha256:" + hex.EncodeToString(sum[:]); inserts[0].Args[0] != want {
+					t.Errorf("key %v, want %s", inserts[0].Args[0], want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/mail"
+	"sort"
+	"strings"
+)
+
+// MaxImportSize is the largest upload /admin/import accepts.
+const MaxImportSize int64 = 64 * 1024 * 1024
+
+// ImportFailure describes a message which couldn't be imported.
+type ImportFailure struct {
+	File  string `json:"file"`
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+// ImportResponse reports what was done with an import.
+type ImportResponse struct {
+	RequestID  string          `json:"request_id"`
+	Imported   int             `json:"imported"`
+	Duplicates int             `json:"duplicates"`
+	Failed     []ImportFailure `json:"failed"`
+}
+
+// SplitMbox splits an mbox file into its messages, undoing the quoting of
+// "From " lines, and converting line endings to CRLF as in relay webhooks.
+// Along with each message it returns the sender from its "From " line.
+func SplitMbox(r io.Reader) (froms []string, msgs [][]byte, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), int(MaxImportSize))
+	var cur *bytes.Buffer
+	blank := true
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if blank && strings.HasPrefix(line, "From ") {
+			if cur != nil {
+				msgs = append(msgs, cur.Bytes())
+			}
+			fields := strings.Fields(line)
+			from := ""
+			if len(fields) > 1 && fields[1] != "MAILER-DAEMON" {
+				from = fields[1]
+			}
+			froms = append(froms, from)
+			cur = &bytes.Buffer{}
+			blank = false
+			continue
+		}
+		if cur == nil {
+			if line == "" {
+				continue
+			}
+			return nil, nil, fmt.Errorf("SplitMbox: file doesn't start with a \"From \" line")
+		}
+		if blank {
+			// The blank line held back was part of the message.
+			cur.WriteString("\r\n")
+		}
+		blank = line == ""
+		if blank {
+			continue
+		}
+		if strings.HasPrefix(line, ">") && mboxFromLine.MatchString(line[1:]) {
+			line = line[1:]
+		}
+		cur.WriteString(line)
+		cur.WriteString("\r\n")
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("SplitMbox: %s", err)
+	}
+	if cur != nil {
+		msgs = append(msgs, cur.Bytes())
+	}
+	return froms, msgs, nil
+}
+
+// importHeaders are checked in order for the address a message was
+// delivered to.
+var importHeaders = []string{"Delivered-To", "X-Original-To", "To"}
+
+// ParseRFC822 turns a message into the relay message event SparkPost would
+// have sent for it. from, when set, is used as the envelope sender, as is to
+// for the recipient; otherwise they come from the headers.
+func ParseRFC822(raw []byte, from, to, webhookID string) (*RelayMessage, error) {
+	raw = bytes.ReplaceAll(bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n")), []byte("\n"), []byte("\r\n"))
+	m, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("ParseRFC822: %s", err)
+	}
+	msg := &RelayMessage{}
+	msg.WebhookID = webhookID
+	msg.Content.Email = string(raw)
+	names := make([]string, 0, len(m.Header))
+	for name := range m.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, val := range m.Header[name] {
+			msg.Content.Headers = append(msg.Content.Headers, map[string]string{name: val})
+		}
+	}
+
+	dec := &mime.WordDecoder{}
+	if msg.Content.Subject, err = dec.DecodeHeader(m.Header.Get("Subject")); err != nil {
+		msg.Content.Subject = m.Header.Get("Subject")
+	}
+	if addr, err := mail.ParseAddress(m.Header.Get("From")); err == nil {
+		msg.FriendlyFrom = addr.Address
+		msg.From = addr.Address
+	}
+	if from != "" {
+		msg.From = from
+	}
+	if addrs, err := m.Header.AddressList("To"); err == nil {
+		for _, addr := range addrs {
+			msg.Content.To = append(msg.Content.To, addr.Address)
+		}
+	}
+	msg.To = to
+	for _, name := range importHeaders {
+		if msg.To != "" {
+			break
+		}
+		if addrs, err := m.Header.AddressList(name); err == nil && len(addrs) > 0 {
+			msg.To = addrs[0].Address
+		}
+	}
+	if msg.To == "" {
+		return nil, fmt.Errorf("ParseRFC822: no recipient in %s", strings.Join(importHeaders, ", "))
+	}
+	return msg, nil
+}
+
+// isMbox guesses whether an upload is an mbox file rather than a single
+// message, from its name, content type or first line.
+func isMbox(name, contentType string, data []byte) bool {
+	if strings.HasSuffix(strings.ToLower(name), ".mbox") {
+		return true
+	}
+	if mt, _, err := mime.ParseMediaType(contentType); err == nil && mt == "application/mbox" {
+		return true
+	}
+	return bytes.HasPrefix(data, []byte("From "))
+}
+
+// importFile stores every message in an uploaded mbox or eml file.
+func (p *RelayMsgParser) importFile(r *http.Request, res *ImportResponse, name, contentType string, data []byte, to, webhookID string) {
+	froms, msgs := []string{""}, [][]byte{data}
+	if isMbox(name, contentType, data) {
+		var err error
+		if froms, msgs, err = SplitMbox(bytes.NewReader(data)); err != nil {
+			res.Failed = append(res.Failed, ImportFailure{File: name, Error: err.Error()})
+			return
+		}
+	}
+	for i, raw := range msgs {
+		msg, err := ParseRFC822(raw, froms[i], to, webhookID)
+		if err == nil {
+			err = p.StoreEvent(r.Context(), msg, res.RequestID)
+		}
+		if errors.Is(err, ErrDuplicate) {
+			res.Duplicates++
+		} else if err != nil {
+			log.Printf("ImportMessages: %s [%s %d]\n", err, name, i)
+			res.Failed = append(res.Failed, ImportFailure{File: name, Index: i, Error: err.Error()})
+		} else {
+			res.Imported++
+		}
+	}
+}
+
+// ImportHandler stores messages from existing mbox or eml files, as if they
+// had arrived by relay webhook. The request body is either a single file,
+// or a multipart form with any number of files. The webhook_id parameter
+// tags the messages with where they came from, and to sets the recipient
+// when the headers don't give the right one. Messages from the same import
+// share a request_id.
+func (p *RelayMsgParser) ImportHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, MaxImportSize)
+		res := &ImportResponse{RequestID: NewRequestID(), Failed: []ImportFailure{}}
+
+		mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if mt == "multipart/form-data" {
+			if err := r.ParseMultipartForm(32 * 1024 * 1024); err != nil {
+				writeJSONError(w, r, http.StatusBadRequest, "bad_request", fmt.Sprintf("Invalid upload: %s", err))
+				return
+			}
+			to, webhookID := r.FormValue("to"), r.FormValue("webhook_id")
+			for _, headers := range r.MultipartForm.File {
+				for _, fh := range headers {
+					f, err := fh.Open()
+					if err != nil {
+						res.Failed = append(res.Failed, ImportFailure{File: fh.Filename, Error: err.Error()})
+						continue
+					}
+					data, err := io.ReadAll(f)
+					f.Close()
+					if err != nil {
+						res.Failed = append(res.Failed, ImportFailure{File: fh.Filename, Error: err.Error()})
+						continue
+					}
+					p.importFile(r, res, fh.Filename, fh.Header.Get("Content-Type"), data, to, webhookID)
+				}
+			}
+		} else {
+			data, err := io.ReadAll(r.Body)
+			if err != nil {
+				writeJSONError(w, r, http.StatusRequestEntityTooLarge, "too_large", fmt.Sprintf("Upload must be at most %d bytes", MaxImportSize))
+				return
+			}
+			q := r.URL.Query()
+			p.importFile(r, res, "body", r.Header.Get("Content-Type"), data, q.Get("to"), q.Get("webhook_id"))
+		}
+
+		log.Printf("ImportMessages: imported %d, duplicates %d, failed %d [req %s]\n",
+			res.Imported, res.Duplicates, len(res.Failed), res.RequestID)
+		if res.Imported > 0 {
+			// Any number of recipients may have new messages.
+			for _, c := range p.summaryCaches {
+				c.DeletePrefix("")
+			}
+		}
+		writeJSON(w, r, res)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSplitMbox(t *testing.T) {
+	tests := []struct {
+		name  string
+		mbox  string
+		froms []string
+		msgs  []string
+		err   string
+	}{
+		{"two messages",
+			"From a@example.com Mon Jan  1 00:00:00 2024\nSubject: 1\n\nbody\n>From here\n\nFrom b@example.com Tue Jan  2 00:00:00 2024\nSubject: 2\n\n>>From there\n",
+			[]string{"a@example.com", "b@example.com"},
+			[]string{"Subject: 1\r\n\r\nbody\r\nFrom here\r\n", "Subject: 2\r\n\r\n>From there\r\n"}, ""},
+		{"CRLF line endings",
+			"From a@example.com Mon Jan  1 00:00:00 2024\r\nSubject: 1\r\n\r\nbody\r\n",
+			[]string{"a@example.com"}, []string{"Subject: 1\r\n\r\nbody\r\n"}, ""},
+		{"From line within a paragraph",
+			"From a@example.com Mon Jan  1 00:00:00 2024\nSubject: 1\n\nsent\nFrom me\n",
+			[]string{"a@example.com"}, []string{"Subject: 1\r\n\r\nsent\r\nFrom me\r\n"}, ""},
+		{"blank lines kept within a message",
+			"From a@example.com Mon Jan  1 00:00:00 2024\nSubject: 1\n\none\n\n\ntwo\n",
+			[]string{"a@example.com"}, []string{"Subject: 1\r\n\r\none\r\n\r\n\r\ntwo\r\n"}, ""},
+		{"bounce",
+			"\n\nFrom MAILER-DAEMON Mon Jan  1 00:00:00 2024\nSubject: failed\n",
+			[]string{""}, []string{"Subject: failed\r\n"}, ""},
+		{"empty", "", nil, nil, ""},
+		{"not an mbox", "Subject: 1\n\nbody\n", nil, nil, `doesn't start with a "From " line`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			froms, msgs, err := SplitMbox(strings.NewReader(tt.mbox))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("error %v, want %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, msg := range msgs {
+				got = append(got, string(msg))
+			}
+			if !reflect.DeepEqual(froms, tt.froms) || len(got) != len(tt.msgs) || (len(got) > 0 && !reflect.DeepEqual(got, tt.msgs)) {
+				t.Errorf("got %q %q, want %q %q", froms, got, tt.froms, tt.msgs)
+			}
+		})
+	}
+}
+
+func TestParseRFC822(t *testing.T) {
+	tests := []struct {
+		name             string
+		raw              string
+		from, to         string
+		wantFrom, wantTo string
+		subject          string
+		err              string
+	}{
+		{"headers", "From: Ann <ann@example.org>\nTo: bob@example.com, cat@example.com\nSubject: hi\n\nhi\n",
+			"", "", "ann@example.org", "bob@example.com", "hi", ""},
+		{"delivered to", "From: ann@example.org\nTo: list@example.net\nDelivered-To: bob@example.com\nSubject: hi\n\nhi\n",
+			"", "", "ann@example.org", "bob@example.com", "hi", ""},
+		{"original recipient", "From: ann@example.org\nTo: list@example.net\nX-Original-To: bob@example.com\n\nhi\n",
+			"", "", "ann@example.org", "bob@example.com", "", ""},
+		{"envelope given", "From: ann@example.org\nTo: bob@example.com\n\nhi\n",
+			"bounce@example.org", "cat@example.com", "bounce@example.org", "cat@example.com", "", ""},
+		{"encoded subject", "From: ann@example.org\nTo: bob@example.com\nSubject: =?utf-8?q?caf=C3=A9?=\n\nhi\n",
+			"", "", "ann@example.org", "bob@example.com", "café", ""},
+		{"bad encoded subject", "From: ann@example.org\nTo: bob@example.com\nSubject: =?x-nope?q?caf=E9?=\n\nhi\n",
+			"", "", "ann@example.org", "bob@example.com", "=?x-nope?q?caf=E9?=", ""},
+		{"no recipient", "From: ann@example.org\nSubject: hi\n\nhi\n", "", "", "", "", "", "no recipient"},
+		{"not a message", "not a header\n", "", "", "", "", "", "ParseRFC822"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := ParseRFC822([]byte(tt.raw), tt.from, tt.to, "import")
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("error %v, want %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.From != tt.wantFrom || msg.To != tt.wantTo || msg.Content.Subject != tt.subject || msg.WebhookID != "import" {
+				t.Errorf("from %q, to %q, subject %q, webhook %q", msg.From, msg.To, msg.Content.Subject, msg.WebhookID)
+			}
+			// Messages are stored with CRLF line endings, as relayed.
+			if want := strings.ReplaceAll(tt.raw, "\n", "\r\n"); msg.Content.Email != want {
+				t.Errorf("email %q, want %q", msg.Content.Email, want)
+			}
+		})
+	}
+}
+
+func TestImportHandler(t *testing.T) {
+	const token = "s3cret"
+	mbox := "From ann@example.org Mon Jan  1 00:00:00 2024\nFrom: ann@example.org\nTo: bob@example.com\n\none\n\n" +
+		"From ann@example.org Mon Jan  1 00:00:00 2024\nFrom: ann@example.org\n\nno recipient\n\n" +
+		"From ann@example.org Mon Jan  1 00:00:00 2024\nFrom: ann@example.org\nTo: cat@example.com\n\ntwo\n"
+	eml := "From: dan@example.org\nTo: eve@example.com\n\nthree\n"
+
+	// upload returns a multipart form holding files.
+	upload := func(files map[string]string) ([]byte, string) {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		mw.WriteField("webhook_id", "backfill")
+		for name, data := range files {
+			fw, err := mw.CreateFormFile("file", name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fw.Write([]byte(data))
+		}
+		mw.Close()
+		return buf.Bytes(), mw.FormDataContentType()
+	}
+	form, formType := upload(map[string]string{"old.mbox": mbox, "one.eml": eml})
+
+	tests := []struct {
+		name        string
+		path        string
+		body        []byte
+		contentType string
+		imported    int
+		failed      []ImportFailure
+		to          []string
+	}{
+		{"mbox body", "/admin/import", []byte(mbox), "application/mbox", 2,
+			[]ImportFailure{{File: "body", Index: 1, Error: "ParseRFC822: no recipient in Delivered-To, X-Original-To, To"}},
+			[]string{"bob@example.com", "cat@example.com"}},
+		{"eml body with recipient", "/admin/import?to=zed@example.com", []byte(eml), "message/rfc822", 1, nil,
+			[]string{"zed@example.com"}},
+		{"multipart", "/admin/import", form, formType, 3,
+			[]ImportFailure{{File: "old.mbox", Index: 1, Error: "ParseRFC822: no recipient in Delivered-To, X-Original-To, To"}},
+			[]string{"bob@example.com", "cat@example.com", "eve@example.com"}},
+		{"not an mbox", "/admin/import", []byte("\nnot a message"), "application/mbox", 0,
+			[]ImportFailure{{File: "body", Error: `SplitMbox: file doesn't start with a "From " line`}}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &RelayMsgParser{AdminToken: token}
+			ts := newTestServer(t, p, nil, storeRows)
+			header := http.Header{"Authorization": {"Bearer " + token}, "Content-Type": {tt.contentType}}
+			status, body := postWith(t, ts, tt.path, tt.body, header)
+			if status != http.StatusOK {
+				t.Fatalf("status %d: %s", status, body)
+			}
+			res := &ImportResponse{}
+			if err := json.Unmarshal([]byte(body), res); err != nil {
+				t.Fatal(err)
+			}
+			if tt.failed == nil {
+				tt.failed = []ImportFailure{}
+			}
+			if res.Imported != tt.imported || !reflect.DeepEqual(res.Failed, tt.failed) || res.RequestID == "" {
+				t.Errorf("response %s", body)
+			}
+
+			to := []string{}
+			for _, val := range storedColumn(t, ts.DB, "smtp_to") {
+				to = append(to, val.(string))
+			}
+			sort.Strings(to)
+			if len(to) != len(tt.to) || (len(to) > 0 && !reflect.DeepEqual(to, tt.to)) {
+				t.Errorf("stored for %q, want %q", to, tt.to)
+			}
+		})
+	}
+
+	ts := newTestServer(t, &RelayMsgParser{AdminToken: token}, nil, storeRows)
+	if status, _ := postWith(t, ts, "/admin/import", []byte(eml), http.Header{"Content-Type": {"message/rfc822"}}); status != http.StatusUnauthorized {
+		t.Errorf("import without the admin token: status %d", status)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/SparkPost/httpdump/storage"
+)
+
+const RequestIDHeader string = "X-Request-ID"
+
+// WithRequestID wraps an ingest handler, making sure each request has an
+// X-Request-ID header before it's stored, generating one when the client
+// didn't send it. The id is echoed back in the response.
+func WithRequestID(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if id == "" || len(id) > 128 {
+			id = NewRequestID()
+			r.Header.Set(RequestIDHeader, id)
+		}
+		w.Header().Set(RequestIDHeader, id)
+		h(w, r)
+	}
+}
+
+// NewRequestID returns a random (version 4) UUID.
+func NewRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("NewRequestID: %s\n", err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// RequestID reads the X-Request-ID header stored with a request. It returns
+// an empty string for requests stored without one.
+func RequestID(req *storage.Request) string {
+	return StoredHeader(req).Get(RequestIDHeader)
+}
+
+// StoredHeader parses the headers stored with a request. It returns an empty
+// header if they can't be parsed.
+func StoredHeader(req *storage.Request) http.Header {
+	hr, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(req.Head)))
+	if err != nil {
+		return http.Header{}
+	}
+	return hr.Header
+}
+
+const DefaultHMACHeader string = "X-Signature"
+
+// VerifyHMAC wraps an ingest handler, rejecting requests whose body doesn't
+// match the HMAC-SHA256 signature in the named header. The signature is hex
+// encoded, optionally prefixed with "sha256=". Requests pass through
+// unchecked when secret is empty.
+func VerifyHMAC(secret, header string, h http.HandlerFunc) http.HandlerFunc {
+	if secret == "" {
+		return h
+	}
+	if header == "" {
+		header = DefaultHMACHeader
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			log.Printf("VerifyHMAC (read): %s\n", err)
+			writeJSONError(w, r, http.StatusBadRequest, "bad_request", "Unable to read request")
+			return
+		}
+
+		sig := strings.TrimPrefix(strings.TrimSpace(r.Header.Get(header)), "sha256=")
+		got, err := hex.DecodeString(sig)
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		if err != nil || !hmac.Equal(got, mac.Sum(nil)) {
+			log.Printf("VerifyHMAC: rejected request from %s with bad signature\n", r.RemoteAddr)
+			writeJSONError(w, r, http.StatusUnauthorized, "invalid_signature", "Invalid signature")
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		h(w, r)
+	}
+}
+
+// IsTestPayload reports whether body is the payload SparkPost sends to test
+// a webhook when it's set up: events with nothing under "msys", as in
+// [{"msys": {}}].
+func IsTestPayload(body []byte) bool {
+	n := 0
+	err := EachEvent(body, func(event *json.RawMessage) error {
+		var blob map[string]map[string]json.RawMessage
+		if err := json.Unmarshal(*event, &blob); err != nil {
+			return err
+		}
+		msys, ok := blob["msys"]
+		if len(blob) != 1 || !ok || len(msys) != 0 {
+			return errNotTestPayload
+		}
+		n++
+		return nil
+	})
+	return err == nil && n > 0
+}
+
+var errNotTestPayload = errors.New("not a test payload")
+
+// AcceptTestPayload responds to SparkPost's webhook test payload with a 200
+// straight away, without storing it, so setting up a webhook succeeds
+// without a raw request which is then ignored.
+func AcceptTestPayload(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			log.Printf("AcceptTestPayload (read): %s\n", err)
+			writeJSONError(w, r, http.StatusBadRequest, "bad_request", "Unable to read request")
+			return
+		}
+		if IsTestPayload(body) {
+			log.Printf("AcceptTestPayload: acknowledged webhook test from %s\n", r.RemoteAddr)
+			writeJSON(w, r, map[string]bool{"test": true})
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		h(w, r)
+	}
+}
+
+// ParseWebhookHeaders parses a comma-separated list of Name:value pairs, the
+// headers a SparkPost webhook is configured to send with each delivery.
+// Values may contain spaces, as in "Authorization:Bearer s3cret", but not be
+// empty, since a missing header would match them.
+func ParseWebhookHeaders(spec string) (map[string]string, error) {
+	headers := map[string]string{}
+	if strings.TrimSpace(spec) == "" {
+		return headers, nil
+	}
+	for _, pair := range strings.Split(spec, ",") {
+		parts := strings.SplitN(pair, ":", 2)
+		name := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || name == "" || strings.ContainsAny(name, " \t") || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("ParseWebhookHeaders: expected Name:value, not %q", pair)
+		}
+		headers[http.CanonicalHeaderKey(name)] = strings.TrimSpace(parts[1])
+	}
+	return headers, nil
+}
+
+// VerifyWebhookHeaders wraps an ingest handler, rejecting requests with a 401
+// unless they carry each of the given headers with the given value, and,
+// when basicAuth is set as "user:password", matching HTTP basic auth
+// credentials. These are what SparkPost sends for a webhook configured with
+// custom headers or basic authentication. Requests pass through unchecked
+// when neither is set.
+func VerifyWebhookHeaders(headers map[string]string, basicAuth string, h http.HandlerFunc) http.HandlerFunc {
+	if len(headers) == 0 && basicAuth == "" {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		ok := true
+		for name, want := range headers {
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get(name)), []byte(want)) != 1 {
+				ok = false
+			}
+		}
+		if basicAuth != "" {
+			user, pass, found := r.BasicAuth()
+			if !found || subtle.ConstantTimeCompare([]byte(user+":"+pass), []byte(basicAuth)) != 1 {
+				ok = false
+			}
+		}
+		if !ok {
+			log.Printf("VerifyWebhookHeaders: rejected request from %s with missing or wrong credentials\n", r.RemoteAddr)
+			writeJSONError(w, r, http.StatusUnauthorized, "invalid_credentials", "Invalid webhook credentials")
+			return
+		}
+		h(w, r)
+	}
+}
+
+const DefaultContentTypes string = "application/json"
+
+// RequireContentType wraps an ingest handler, rejecting requests whose media
+// type isn't one of types with a 415. A "*" in types accepts anything.
+func RequireContentType(types []string, h http.HandlerFunc) http.HandlerFunc {
+	allowed := map[string]bool{}
+	for _, t := range types {
+		if t = strings.ToLower(strings.TrimSpace(t)); t == "*" {
+			return h
+		} else if t != "" {
+			allowed[t] = true
+		}
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || !allowed[mediaType] {
+			log.Printf("RequireContentType: rejected request from %s with Content-Type %q\n",
+				r.RemoteAddr, r.Header.Get("Content-Type"))
+			writeJSONError(w, r, http.StatusUnsupportedMediaType, "unsupported_media_type", "Unsupported Content-Type")
+			return
+		}
+		h(w, r)
+	}
+}
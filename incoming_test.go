@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// post posts body to path on ts as JSON, returning the status and body.
+func post(t *testing.T, ts *testServer, path string, body []byte) (int, string) {
+	t.Helper()
+	return postWith(t, ts, path, body, nil)
+}
+
+// postWith is post, sending header too.
+func postWith(t *testing.T, ts *testServer, path string, body []byte, header http.Header) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest("POST", ts.URL+path, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, vals := range header {
+		req.Header[name] = vals
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, string(resBody)
+}
+
+func TestAcceptTestPayload(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		test    bool
+	}{
+		{"test fixture", readFixture(t, "webhook_test.json"), true},
+		{"single test event", []byte(`{"msys":{}}`), true},
+		{"several test events", []byte(`[{"msys":{}},{"msys":{}}]`), true},
+		{"relay message", readFixture(t, "relay_message_array.json"), false},
+		{"test event with a relay message", []byte(`[{"msys":{}},{"msys":{"relay_message":{}}}]`), false},
+		{"empty array", []byte(`[]`), false},
+		{"other keys", []byte(`[{"msys":{},"meta":{}}]`), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, &RelayMsgParser{}, nil, nil)
+			if got := IsTestPayload(tt.payload); got != tt.test {
+				t.Errorf("IsTestPayload = %t, want %t", got, tt.test)
+			}
+			status, body := post(t, ts, "/incoming", tt.payload)
+			if status != http.StatusOK {
+				t.Fatalf("status %d: %s", status, body)
+			}
+			dumped := len(ts.Dumped())
+			if tt.test && (dumped != 0 || strings.TrimSpace(body) != `{"test":true}`) {
+				t.Errorf("test payload stored %d times, response %q", dumped, body)
+			} else if !tt.test && dumped != 1 {
+				t.Errorf("payload stored %d times", dumped)
+			}
+		})
+	}
+}
+
+func TestParseWebhookHeaders(t *testing.T) {
+	tests := []struct {
+		name string
+		spec string
+		// want is nil when the spec is refused, both at startup and by
+		// ParseWebhookHeaders.
+		want map[string]string
+	}{
+		{"unset", "", map[string]string{}},
+		{"one", "X-MSYS-Auth:s3cret", map[string]string{"X-Msys-Auth": "s3cret"}},
+		{"bearer token", "Authorization:Bearer abc.def-123",
+			map[string]string{"Authorization": "Bearer abc.def-123"}},
+		{"several", "authorization:Bearer abc,X-Relay-Env:prod",
+			map[string]string{"Authorization": "Bearer abc", "X-Relay-Env": "prod"}},
+		{"colon in value", "X-Token:a:b", map[string]string{"X-Token": "a:b"}},
+		{"no value", "X-Token", nil},
+		{"empty value", "X-Token:", nil},
+		{"no name", ":s3cret", nil},
+		{"space in name", "X Token:s3cret", nil},
+		{"empty pair", "X-A:1,,X-B:2", nil},
+		{"trailing comma", "X-A:1,", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if valid := webhookHeaderList.MatchString(tt.spec); valid != (tt.want != nil) {
+				t.Errorf("RELAYMSG_WEBHOOK_HEADERS=%q valid = %t", tt.spec, valid)
+			}
+			got, err := ParseWebhookHeaders(tt.spec)
+			if tt.want == nil {
+				if err == nil {
+					t.Errorf("parsed %q as %v", tt.spec, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyWebhookHeaders(t *testing.T) {
+	bearer := map[string]string{"Authorization": "Bearer s3cret", "X-Relay-Env": "prod"}
+	env := map[string]string{"X-Relay-Env": "prod"}
+	tests := []struct {
+		name      string
+		headers   map[string]string
+		basicAuth string
+		// user and pass are sent as basic auth when user is set.
+		user, pass string
+		sent       map[string]string
+		status     int
+	}{
+		{"unconfigured", nil, "", "", "", nil, http.StatusOK},
+		{"matching headers", bearer, "", "", "",
+			map[string]string{"Authorization": "Bearer s3cret", "X-Relay-Env": "prod"}, http.StatusOK},
+		{"header name case", bearer, "", "", "",
+			map[string]string{"authorization": "Bearer s3cret", "x-relay-env": "prod"}, http.StatusOK},
+		{"missing header", bearer, "", "", "",
+			map[string]string{"Authorization": "Bearer s3cret"}, http.StatusUnauthorized},
+		{"wrong value", bearer, "", "", "",
+			map[string]string{"Authorization": "Bearer guess", "X-Relay-Env": "prod"}, http.StatusUnauthorized},
+		{"value prefix", bearer, "", "", "",
+			map[string]string{"Authorization": "Bearer s3cre", "X-Relay-Env": "prod"}, http.StatusUnauthorized},
+		{"basic auth", nil, "sparkpost:pw", "sparkpost", "pw", nil, http.StatusOK},
+		{"wrong password", nil, "sparkpost:pw", "sparkpost", "guess", nil, http.StatusUnauthorized},
+		{"no basic auth", nil, "sparkpost:pw", "", "", nil, http.StatusUnauthorized},
+		{"headers and basic auth", env, "sparkpost:pw", "sparkpost", "pw", env, http.StatusOK},
+		{"basic auth without headers", env, "sparkpost:pw", "sparkpost", "pw", nil, http.StatusUnauthorized},
+		{"headers without basic auth", env, "sparkpost:pw", "", "", env, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			h := VerifyWebhookHeaders(tt.headers, tt.basicAuth, func(w http.ResponseWriter, r *http.Request) {
+				called = true
+			})
+			r := httptest.NewRequest("POST", "/incoming", strings.NewReader("[]"))
+			for name, val := range tt.sent {
+				r.Header.Set(name, val)
+			}
+			if tt.user != "" {
+				r.SetBasicAuth(tt.user, tt.pass)
+			}
+			w := httptest.NewRecorder()
+			h(w, r)
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if called != (tt.status == http.StatusOK) {
+				t.Errorf("handler called = %t with status %d", called, w.Code)
+			}
+		})
+	}
+}
+
+// hmacHex returns the hex HMAC-SHA256 of body with secret.
+func hmacHex(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyHMAC(t *testing.T) {
+	const body = `[{"msys":{"relay_message":{}}}]`
+	tests := []struct {
+		name   string
+		header string
+		sent   map[string]string
+		body   string
+		status int
+	}{
+		{"valid", "", map[string]string{"X-Signature": hmacHex("s3cret", body)}, body, http.StatusOK},
+		{"valid with prefix", "", map[string]string{"X-Signature": "sha256=" + hmacHex("s3cret", body)}, body, http.StatusOK},
+		{"valid in upper case", "", map[string]string{"X-Signature": strings.ToUpper(hmacHex("s3cret", body))}, body, http.StatusOK},
+		{"valid in another header", "X-Hub-Signature", map[string]string{"X-Hub-Signature": hmacHex("s3cret", body)}, body, http.StatusOK},
+		{"wrong header", "X-Hub-Signature", map[string]string{"X-Signature": hmacHex("s3cret", body)}, body, http.StatusUnauthorized},
+		{"wrong secret", "", map[string]string{"X-Signature": hmacHex("other", body)}, body, http.StatusUnauthorized},
+		{"missing header", "", nil, body, http.StatusUnauthorized},
+		{"empty header", "", map[string]string{"X-Signature": ""}, body, http.StatusUnauthorized},
+		{"malformed hex", "", map[string]string{"X-Signature": "zz" + hmacHex("s3cret", body)[2:]}, body, http.StatusUnauthorized},
+		{"truncated", "", map[string]string{"X-Signature": hmacHex("s3cret", body)[:32]}, body, http.StatusUnauthorized},
+		{"body changed after signing", "", map[string]string{"X-Signature": hmacHex("s3cret", body)}, body + " ", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var passed []byte
+			called := false
+			h := VerifyHMAC("s3cret", tt.header, func(w http.ResponseWriter, r *http.Request) {
+				called = true
+				passed, _ = io.ReadAll(r.Body)
+			})
+			r := httptest.NewRequest("POST", "/incoming", strings.NewReader(tt.body))
+			for name, val := range tt.sent {
+				r.Header.Set(name, val)
+			}
+			w := httptest.NewRecorder()
+			h(w, r)
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if called != (tt.status == http.StatusOK) {
+				t.Errorf("handler called = %t with status %d", called, w.Code)
+			}
+			// The handler still gets the body which was signed.
+			if called && string(passed) != tt.body {
+				t.Errorf("handler got %q", passed)
+			}
+			if !called && !strings.Contains(w.Body.String(), `"invalid_signature"`) {
+				t.Errorf("response %s", w.Body)
+			}
+		})
+	}
+
+	// Without a secret, requests aren't checked.
+	called := false
+	h := VerifyHMAC("", "", func(w http.ResponseWriter, r *http.Request) { called = true })
+	h(httptest.NewRecorder(), httptest.NewRequest("POST", "/incoming", strings.NewReader(body)))
+	if !called {
+		t.Error("unsigned request refused without a secret")
+	}
+}
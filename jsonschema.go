@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// JSONSchema is the subset of JSON Schema used to check incoming payloads:
+// type, properties, required, additionalProperties, items, minItems,
+// minLength, enum and anyOf. Other keywords are ignored.
+type JSONSchema struct {
+	// Type is a type name, or a list of them.
+	Type                 interface{}            `json:"type"`
+	Properties           map[string]*JSONSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties *bool                  `json:"additionalProperties"`
+	Items                *JSONSchema            `json:"items"`
+	MinItems             *int                   `json:"minItems"`
+	MinLength            *int                   `json:"minLength"`
+	Enum                 []interface{}          `json:"enum"`
+	AnyOf                []*JSONSchema          `json:"anyOf"`
+}
+
+// LoadJSONSchema reads a schema from a file.
+func LoadJSONSchema(path string) (*JSONSchema, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("LoadJSONSchema (read): %s", err)
+	}
+	s := &JSONSchema{}
+	if err = json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("LoadJSONSchema (JSON): %s: %s", path, err)
+	}
+	if err = s.check("$"); err != nil {
+		return nil, fmt.Errorf("LoadJSONSchema: %s: %s", path, err)
+	}
+	return s, nil
+}
+
+var jsonTypes = map[string]bool{
+	"object": true, "array": true, "string": true, "number": true,
+	"integer": true, "boolean": true, "null": true,
+}
+
+// types returns the type names the schema allows, or nil for any.
+func (s *JSONSchema) types() []string {
+	switch t := s.Type.(type) {
+	case string:
+		return []string{t}
+	case []interface{}:
+		names := make([]string, 0, len(t))
+		for _, n := range t {
+			if name, ok := n.(string); ok {
+				names = append(names, name)
+			}
+		}
+		return names
+	}
+	return nil
+}
+
+// check makes sure the schema only names types which exist, so a typo
+// doesn't silently reject every payload.
+func (s *JSONSchema) check(path string) error {
+	switch s.Type.(type) {
+	case nil, string, []interface{}:
+	default:
+		return fmt.Errorf("%s: type must be a string or a list of strings", path)
+	}
+	for _, t := range s.types() {
+		if !jsonTypes[t] {
+			return fmt.Errorf("%s: unknown type %q", path, t)
+		}
+	}
+	for name, prop := range s.Properties {
+		if err := prop.check(path + "." + name); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		if err := s.Items.check(path + "[]"); err != nil {
+			return err
+		}
+	}
+	for _, alt := range s.AnyOf {
+		if err := alt.check(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jsonType returns the schema type name of a value decoded by encoding/json.
+func jsonType(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+// Validate checks v, as decoded by encoding/json, against the schema. The
+// error names the first part of v which doesn't match, like
+// "$[0].msys.relay_message: missing required property \"content\"".
+func (s *JSONSchema) Validate(v interface{}) error {
+	return s.validate(v, "$")
+}
+
+func (s *JSONSchema) validate(v interface{}, path string) error {
+	if types := s.types(); len(types) > 0 {
+		got := jsonType(v)
+		ok := false
+		for _, t := range types {
+			if t == got || (t == "number" && got == "integer") {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("%s: expected %s, got %s", path, strings.Join(types, " or "), got)
+		}
+	}
+
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			if reflect.DeepEqual(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: value isn't one of those allowed", path)
+		}
+	}
+
+	if len(s.AnyOf) > 0 {
+		var errs []string
+		for _, alt := range s.AnyOf {
+			err := alt.validate(v, path)
+			if err == nil {
+				errs = nil
+				break
+			}
+			errs = append(errs, err.Error())
+		}
+		if errs != nil {
+			return fmt.Errorf("%s: matches none of the allowed forms (%s)", path, strings.Join(errs, "; "))
+		}
+	}
+
+	switch v := v.(type) {
+	case string:
+		if s.MinLength != nil && len([]rune(v)) < *s.MinLength {
+			return fmt.Errorf("%s: shorter than %d characters", path, *s.MinLength)
+		}
+
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			return fmt.Errorf("%s: fewer than %d items", path, *s.MinItems)
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				if err := s.Items.validate(item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				return fmt.Errorf("%s: missing required property %q", path, name)
+			}
+		}
+		// Check properties in a stable order, so the same payload always
+		// gets the same error.
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			prop, ok := s.Properties[name]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					return fmt.Errorf("%s: unexpected property %q", path, name)
+				}
+				continue
+			}
+			if err := prop.validate(v[name], path+"."+name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// MaxSchemaPayload is the largest request ValidateSchema reads. The whole
+// body is decoded before it's checked, which takes several times its size in
+// memory.
+const MaxSchemaPayload int64 = 64 * 1024 * 1024
+
+// ValidateSchema wraps an ingest handler, rejecting requests whose body
+// isn't JSON matching schema with a 422 describing the problem, and those
+// larger than MaxSchemaPayload with a 413. Requests pass through unchecked
+// when schema is nil.
+func ValidateSchema(schema *JSONSchema, h http.HandlerFunc) http.HandlerFunc {
+	if schema == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxSchemaPayload))
+		r.Body.Close()
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeJSONError(w, r, http.StatusRequestEntityTooLarge, "too_large", fmt.Sprintf("Request must be at most %d bytes", MaxSchemaPayload))
+				return
+			}
+			log.Printf("ValidateSchema (read): %s\n", err)
+			writeJSONError(w, r, http.StatusBadRequest, "bad_request", "Unable to read request")
+			return
+		}
+
+		var v interface{}
+		if err = json.Unmarshal(body, &v); err != nil {
+			writeJSONError(w, r, http.StatusUnprocessableEntity, "invalid_json", fmt.Sprintf("Invalid JSON: %s", err))
+			return
+		}
+		if err = schema.Validate(v); err != nil {
+			log.Printf("ValidateSchema: rejected request from %s: %s\n", r.RemoteAddr, err)
+			writeJSONError(w, r, http.StatusUnprocessableEntity, "schema_violation", err.Error())
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		h(w, r)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// mustSchema decodes a schema, failing the test if it's refused.
+func mustSchema(t *testing.T, src string) *JSONSchema {
+	t.Helper()
+	s := &JSONSchema{}
+	if err := json.Unmarshal([]byte(src), s); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.check("$"); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestJSONSchemaValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		value  string
+		// err is the error expected, or "" when the value matches.
+		err string
+	}{
+		{"integer", `{"type":"integer"}`, `3`, ""},
+		{"integer written as a float", `{"type":"integer"}`, `3.0`, ""},
+		{"fraction for an integer", `{"type":"integer"}`, `3.5`, "$: expected integer, got number"},
+		{"string for an integer", `{"type":"integer"}`, `"3"`, "$: expected integer, got string"},
+		{"integer for a number", `{"type":"number"}`, `3`, ""},
+		{"one of several types", `{"type":["string","null"]}`, `null`, ""},
+		{"none of several types", `{"type":["string","null"]}`, `{}`, "$: expected string or null, got object"},
+		{"required present", `{"required":["a"]}`, `{"a":null}`, ""},
+		{"required missing", `{"type":"object","required":["a","b"]}`, `{"a":1}`, `$: missing required property "b"`},
+		{"required of a non-object", `{"required":["a"]}`, `[]`, ""},
+		{"additional property allowed", `{"properties":{"a":{}}}`, `{"a":1,"b":2}`, ""},
+		{"additional property refused", `{"properties":{"a":{}},"additionalProperties":false}`, `{"a":1,"c":3,"b":2}`, `$: unexpected property "b"`},
+		{"only known properties", `{"properties":{"a":{}},"additionalProperties":false}`, `{"a":1}`, ""},
+		{"nested property", `{"properties":{"msys":{"properties":{"rcpt_to":{"type":"string"}}}}}`, `{"msys":{"rcpt_to":7}}`, "$.msys.rcpt_to: expected string, got integer"},
+		{"items", `{"items":{"type":"object"}}`, `[{},"x"]`, "$[1]: expected object, got string"},
+		{"min items", `{"minItems":1}`, `[]`, "$: fewer than 1 items"},
+		{"min length counts characters", `{"minLength":2}`, `"é"`, "$: shorter than 2 characters"},
+		{"enum", `{"enum":["a",1]}`, `1`, ""},
+		{"not in enum", `{"enum":["a",1]}`, `"b"`, "$: value isn't one of those allowed"},
+		{"any of, first", `{"anyOf":[{"type":"string"},{"type":"integer"}]}`, `"x"`, ""},
+		{"any of, second", `{"anyOf":[{"type":"string"},{"type":"integer"}]}`, `2`, ""},
+		{"any of, none", `{"anyOf":[{"type":"string"},{"type":"integer"}]}`, `true`,
+			"$: matches none of the allowed forms ($: expected string, got boolean; $: expected integer, got boolean)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := mustSchema(t, tt.schema)
+			var v interface{}
+			if err := json.Unmarshal([]byte(tt.value), &v); err != nil {
+				t.Fatal(err)
+			}
+			err := s.Validate(v)
+			if tt.err == "" {
+				if err != nil {
+					t.Errorf("error %v", err)
+				}
+			} else if err == nil || err.Error() != tt.err {
+				t.Errorf("error %v, want %s", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestLoadJSONSchema(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		err    string
+	}{
+		{"ok", `{"type":"array","items":{"anyOf":[{"type":"object"},{"type":["string","null"]}]}}`, ""},
+		{"unknown type", `{"properties":{"a":{"type":"strnig"}}}`, `$.a: unknown type "strnig"`},
+		{"unknown type in anyOf", `{"anyOf":[{"type":"int"}]}`, `$: unknown type "int"`},
+		{"type not a string", `{"items":{"type":7}}`, "$[]: type must be a string or a list of strings"},
+		{"not JSON", `{"type":`, "LoadJSONSchema (JSON)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "schema.json")
+			if err := os.WriteFile(path, []byte(tt.schema), 0600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := LoadJSONSchema(path)
+			if tt.err == "" {
+				if err != nil {
+					t.Errorf("error %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error %v, want %s", err, tt.err)
+			}
+		})
+	}
+	if _, err := LoadJSONSchema(filepath.Join(t.TempDir(), "missing.json")); err == nil || !strings.Contains(err.Error(), "LoadJSONSchema (read)") {
+		t.Errorf("missing file: error %v", err)
+	}
+}
+
+func TestValidateSchema(t *testing.T) {
+	schema := mustSchema(t, `{"type":"array","items":{"type":"object","required":["msys"]}}`)
+	tests := []struct {
+		name   string
+		body   []byte
+		status int
+		code   string
+		err    string
+	}{
+		{"matching", []byte(`[{"msys":{}}]`), http.StatusOK, "", ""},
+		{"not JSON", []byte(`[{"msys":`), http.StatusUnprocessableEntity, "invalid_json", "Invalid JSON: unexpected end of JSON input"},
+		{"not matching", []byte(`[{"msys":{}},{}]`), http.StatusUnprocessableEntity, "schema_violation", `$[1]: missing required property "msys"`},
+		{"too large", bytes.Repeat([]byte(" "), int(MaxSchemaPayload)+1), http.StatusRequestEntityTooLarge, "too_large", "Request must be at most"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var passed []byte
+			h := ValidateSchema(schema, func(w http.ResponseWriter, r *http.Request) {
+				passed, _ = io.ReadAll(r.Body)
+			})
+			w := httptest.NewRecorder()
+			h(w, httptest.NewRequest("POST", "/incoming", bytes.NewReader(tt.body)))
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status == http.StatusOK {
+				// The handler gets the body which was checked.
+				if !bytes.Equal(passed, tt.body) {
+					t.Errorf("handler got %q", passed)
+				}
+				return
+			}
+			if passed != nil {
+				t.Error("handler called")
+			}
+			var res ErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+			if res.Code != tt.code || !strings.HasPrefix(res.Error, tt.err) {
+				t.Errorf("error %+v, want %s: %s", res, tt.code, tt.err)
+			}
+		})
+	}
+
+	// Without a schema, requests aren't checked.
+	var passed []byte
+	h := ValidateSchema(nil, func(w http.ResponseWriter, r *http.Request) {
+		passed, _ = io.ReadAll(r.Body)
+	})
+	h(httptest.NewRecorder(), httptest.NewRequest("POST", "/incoming", strings.NewReader("not JSON")))
+	if string(passed) != "not JSON" {
+		t.Errorf("without a schema, handler got %q", passed)
+	}
+}
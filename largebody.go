@@ -0,0 +1,52 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+const BodyTable string = "relay_message_bodies"
+
+// PGBodyStore is a BodyStore backed by a table of its own, so that large
+// bodies don't bloat the messages table which every list and summary
+// query scans.
+type PGBodyStore struct {
+	Dbh    *sql.DB
+	Schema string
+}
+
+// SchemaInit creates the table bodies are kept in.
+func (s *PGBodyStore) SchemaInit() error {
+	return createTable(s.Dbh, s.Schema, BodyTable, []string{
+		fmt.Sprintf(`
+			CREATE TABLE IF NOT EXISTS %s.%s (
+				body_key  text primary key,
+				body      bytea not null,
+				created   timestamptz default clock_timestamp()
+			)
+		`, s.Schema, BodyTable),
+	})
+}
+
+func (s *PGBodyStore) Put(key string, body []byte) error {
+	_, err := s.Dbh.Exec(fmt.Sprintf(`
+		INSERT INTO %s.%s (body_key, body) VALUES ($1, $2)
+	`, s.Schema, BodyTable), key, body)
+	if err != nil {
+		return fmt.Errorf("PGBodyStore.Put: %s", err)
+	}
+	return nil
+}
+
+func (s *PGBodyStore) Get(key string) ([]byte, error) {
+	var body []byte
+	err := s.Dbh.QueryRow(fmt.Sprintf(`
+		SELECT body FROM %s.%s WHERE body_key = $1
+	`, s.Schema, BodyTable), key).Scan(&body)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("PGBodyStore.Get: no body with key %q", key)
+	} else if err != nil {
+		return nil, fmt.Errorf("PGBodyStore.Get: %s", err)
+	}
+	return body, nil
+}
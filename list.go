@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/husobee/vestigo"
+)
+
+// MessageListItem describes a message in a list, without its body.
+type MessageListItem struct {
+	ID      int64     `json:"id"`
+	From    string    `json:"from"`
+	To      string    `json:"to"`
+	ToBase  string    `json:"to_base"`
+	Subject string    `json:"subject"`
+	Created time.Time `json:"created"`
+	// FromName and ToName are the display names from the headers, if any.
+	FromName string `json:"from_name"`
+	ToName   string `json:"to_name"`
+	// Thread identifies the conversation the message is part of.
+	Thread string `json:"thread"`
+	// Route is the webhook route the message was stored under, if any.
+	Route string `json:"route"`
+}
+
+// messageListColumns are the columns listMessages expects a query to select.
+const messageListColumns = `message_id, coalesce(smtp_from, ''), coalesce(smtp_to, ''),
+		       coalesce(smtp_to_base, smtp_to, ''), coalesce(subject, ''), created,
+		       coalesce(from_name, ''), coalesce(to_name, ''),
+		       ` + threadExpr + `, coalesce(route, '')`
+
+// listMessages runs a query selecting messageListColumns.
+func (p *RelayMsgParser) listMessages(ctx context.Context, query string, args ...interface{}) ([]MessageListItem, error) {
+	rows, err := p.ReadDB().QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("listMessages (SELECT): %s", err)
+	}
+	defer rows.Close()
+
+	list := []MessageListItem{}
+	for rows.Next() {
+		if rows.Err() == io.EOF {
+			break
+		}
+		m := MessageListItem{}
+		if err = rows.Scan(&m.ID, &m.From, &m.To, &m.ToBase, &m.Subject, &m.Created,
+			&m.FromName, &m.ToName, &m.Thread, &m.Route); err != nil {
+			return nil, fmt.Errorf("listMessages (Scan): %s", err)
+		}
+		list = append(list, m)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("listMessages (Err): %s", err)
+	}
+	return list, nil
+}
+
+// EncodeCursor returns an opaque cursor for the position just after m in a
+// list ordered by created and message_id, newest first.
+func EncodeCursor(m *MessageListItem) string {
+	return base64.RawURLEncoding.EncodeToString(
+		[]byte(fmt.Sprintf("%s,%d", m.Created.UTC().Format(time.RFC3339Nano), m.ID)))
+}
+
+// DecodeCursor reverses EncodeCursor.
+func DecodeCursor(cursor string) (time.Time, int64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("invalid cursor")
+	}
+	parts := strings.SplitN(string(raw), ",", 2)
+	if len(parts) != 2 {
+		return time.Time{}, 0, fmt.Errorf("invalid cursor")
+	}
+	created, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("invalid cursor")
+	}
+	id, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("invalid cursor")
+	}
+	return created, id, nil
+}
+
+// MessagePage is a page of a message list. Next is the cursor to pass as
+// after to get the following page, and is empty on the last page.
+type MessagePage struct {
+	Results []MessageListItem `json:"results"`
+	Next    string            `json:"next,omitempty"`
+}
+
+// RecentHandler lists the newest messages for any recipient, 50 by default,
+// or up to 500 with limit. Pass the next cursor from a response as after to
+// get the following page; unlike an offset, this is stable while new
+// messages arrive.
+func (p *RelayMsgParser) RecentHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p.writeMessagePage(w, r, "RecentMessages", "")
+	}
+}
+
+// SenderHandler lists the messages from the address named by the address
+// route parameter, to any recipient, newest first and paged like
+// RecentHandler. The address is matched ignoring case.
+func (p *RelayMsgParser) SenderHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		address := strings.TrimSpace(vestigo.Param(r, "address"))
+		if address == "" {
+			writeJSONError(w, r, http.StatusBadRequest, "bad_request", "Missing sender address")
+			return
+		}
+		p.writeMessagePage(w, r, "SenderMessages", "lower(smtp_from) = lower($1)", address)
+	}
+}
+
+// writeMessagePage responds with a MessagePage of the messages matching
+// filter, a condition using filterArgs as its first placeholders, or of all
+// messages when filter is empty. The limit, after and route query parameters
+// are handled here. name is used in log messages.
+func (p *RelayMsgParser) writeMessagePage(w http.ResponseWriter, r *http.Request, name, filter string, filterArgs ...interface{}) {
+	limit, err := limitParam(r, 50, 500)
+	if err != nil {
+		writeJSONError(w, r, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	conds := []string{}
+	if filter != "" {
+		conds = append(conds, filter)
+	}
+	args := append(filterArgs, limit+1)
+	limitArg := len(args)
+	if after := r.URL.Query().Get("after"); after != "" {
+		created, id, err := DecodeCursor(after)
+		if err != nil {
+			writeJSONError(w, r, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+		args = append(args, created, id)
+		conds = append(conds, fmt.Sprintf("(created, message_id) < ($%d, $%d)", len(args)-1, len(args)))
+	}
+	route, err := routeParam(r)
+	if err != nil {
+		writeJSONError(w, r, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	if route != "" {
+		args = append(args, route)
+		conds = append(conds, fmt.Sprintf("route = $%d", len(args)))
+	}
+	where := ""
+	if len(conds) > 0 {
+		where = "WHERE " + strings.Join(conds, " AND ")
+	}
+
+	ctx, cancel := p.requestContext(r)
+	defer cancel()
+	// One extra row is fetched to tell whether there's another page.
+	list, err := p.listMessages(ctx, fmt.Sprintf(`
+		SELECT %s
+		  FROM %s
+		 %s
+		 ORDER BY created DESC, message_id DESC
+		 LIMIT $%d
+	`, messageListColumns, p.MsgTable(), where, limitArg), args...)
+	if err != nil {
+		log.Printf("%s: %s", name, err)
+		writeJSONError(w, r, http.StatusInternalServerError, "database_error", "Database error")
+		return
+	}
+	page := MessagePage{Results: list}
+	if len(list) > limit {
+		page.Results = list[:limit]
+		page.Next = EncodeCursor(&page.Results[limit-1])
+	}
+	writeJSON(w, r, page)
+}
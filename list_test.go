@@ -0,0 +1,245 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	created := time.Date(2024, 3, 1, 12, 0, 0, 123456789, time.FixedZone("EST", -5*3600))
+	tests := []MessageListItem{
+		{ID: 1, Created: created},
+		{ID: 1 << 60, Created: created.Add(time.Nanosecond)},
+		{ID: 0, Created: time.Unix(0, 0)},
+	}
+	for _, m := range tests {
+		gotCreated, gotID, err := DecodeCursor(EncodeCursor(&m))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !gotCreated.Equal(m.Created) || gotID != m.ID {
+			t.Errorf("cursor for %s,%d decoded as %s,%d", m.Created, m.ID, gotCreated, gotID)
+		}
+	}
+}
+
+func TestDecodeCursorInvalid(t *testing.T) {
+	for _, cursor := range []string{
+		"not base64!",
+		b64("2024-03-01T12:00:00Z"),
+		b64("yesterday,1"),
+		b64("2024-03-01T12:00:00Z,one"),
+	} {
+		if _, _, err := DecodeCursor(cursor); err == nil {
+			t.Errorf("DecodeCursor(%q) succeeded", cursor)
+		}
+	}
+}
+
+func b64(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+
+// messageTable is an in-memory message table answering the keyset queries
+// writeMessagePage makes, so pages can be fetched while it's added to.
+type messageTable struct {
+	mu   sync.Mutex
+	rows []MessageListItem
+	next int64
+}
+
+func (mt *messageTable) insert(created time.Time, n int) {
+	mt.insertRouted(created, "", n)
+}
+
+// insertRouted inserts n messages stored under route.
+func (mt *messageTable) insertRouted(created time.Time, route string, n int) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	for i := 0; i < n; i++ {
+		mt.next++
+		mt.rows = append(mt.rows, MessageListItem{ID: mt.next, Created: created, Route: route})
+	}
+}
+
+func (mt *messageTable) handle(q fakeQuery) (*fakeRows, error) {
+	if !strings.Contains(q.SQL, "ORDER BY created DESC, message_id DESC") {
+		return &fakeRows{}, nil
+	}
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	rows := append([]MessageListItem{}, mt.rows...)
+	sort.Slice(rows, func(i, j int) bool {
+		if !rows[i].Created.Equal(rows[j].Created) {
+			return rows[i].Created.After(rows[j].Created)
+		}
+		return rows[i].ID > rows[j].ID
+	})
+	limit, _ := strconv.Atoi(fmt.Sprint(q.Args[0]))
+	res := &fakeRows{}
+	for _, m := range rows {
+		if strings.Contains(q.SQL, "(created, message_id) < ($2, $3)") {
+			created, id := q.Args[1].(time.Time), q.Args[2].(int64)
+			if m.Created.After(created) || (m.Created.Equal(created) && m.ID >= id) {
+				continue
+			}
+		}
+		if strings.Contains(q.SQL, fmt.Sprintf("route = $%d", len(q.Args))) && m.Route != q.Args[len(q.Args)-1] {
+			continue
+		}
+		if len(res.Vals) == limit {
+			break
+		}
+		res.Vals = append(res.Vals, []driver.Value{m.ID, "", "", "", "", m.Created, "", "", fmt.Sprint(m.ID), m.Route})
+	}
+	return res, nil
+}
+
+// TestRecentPagination pages through the recent messages while more arrive,
+// including some created at the same time as the last one on a page.
+func TestRecentPagination(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		// between inserts messages after each page is fetched.
+		between func(mt *messageTable, page int, last MessageListItem)
+	}{
+		{"no inserts", func(*messageTable, int, MessageListItem) {}},
+		{"newer messages", func(mt *messageTable, page int, _ MessageListItem) {
+			mt.insert(start.Add(time.Duration(100+page)*time.Minute), 3)
+		}},
+		{"messages created with the page's last", func(mt *messageTable, _ int, last MessageListItem) {
+			mt.insert(last.Created, 2)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mt := &messageTable{}
+			// Pairs of messages share a created time, so pages split ties.
+			for i := 0; i < 10; i++ {
+				mt.insert(start.Add(time.Duration(i/2)*time.Minute), 1)
+			}
+			ts := newTestServer(t, &RelayMsgParser{AdminToken: "s3cret"}, nil, mt.handle)
+			header := http.Header{"Authorization": {"Bearer s3cret"}}
+
+			seen := map[int64]bool{}
+			var listed []MessageListItem
+			path := "/admin/recent?limit=3"
+			for page := 0; ; page++ {
+				if page > 10 {
+					t.Fatal("too many pages")
+				}
+				status, body := get(t, ts, path, header)
+				if status != http.StatusOK {
+					t.Fatalf("status %d: %s", status, body)
+				}
+				var mp MessagePage
+				if err := json.Unmarshal([]byte(body), &mp); err != nil {
+					t.Fatal(err)
+				}
+				if len(mp.Results) > 3 {
+					t.Fatalf("page of %d", len(mp.Results))
+				}
+				for _, m := range mp.Results {
+					if seen[m.ID] {
+						t.Errorf("message %d listed twice", m.ID)
+					}
+					seen[m.ID] = true
+					listed = append(listed, m)
+				}
+				if mp.Next == "" {
+					break
+				}
+				tt.between(mt, page, mp.Results[len(mp.Results)-1])
+				path = "/admin/recent?limit=3&after=" + mp.Next
+			}
+
+			// Every message there when the first page was fetched is listed,
+			// in order; ones arriving later are for the next refresh.
+			for id := int64(1); id <= 10; id++ {
+				if !seen[id] {
+					t.Errorf("message %d skipped", id)
+				}
+			}
+			for i := 1; i < len(listed); i++ {
+				a, b := listed[i-1], listed[i]
+				if a.Created.Before(b.Created) || (a.Created.Equal(b.Created) && a.ID < b.ID) {
+					t.Errorf("message %d listed before %d", a.ID, b.ID)
+				}
+			}
+		})
+	}
+}
+
+func TestRecentPaginationInvalid(t *testing.T) {
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/admin/recent?after=bogus", http.StatusBadRequest},
+		{"/admin/recent?limit=0", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		mt := &messageTable{}
+		ts := newTestServer(t, &RelayMsgParser{AdminToken: "s3cret"}, nil, mt.handle)
+		status, body := get(t, ts, tt.path, http.Header{"Authorization": {"Bearer s3cret"}})
+		if status != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.path, status, tt.status, body)
+		}
+		if n := len(ts.DB.Queries("")); n != 0 {
+			t.Errorf("%s: %d queries", tt.path, n)
+		}
+	}
+}
+
+func TestRecentRoute(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		// routes are the routes of the messages expected, newest first.
+		routes []string
+	}{
+		{"every route", "", http.StatusOK, []string{"billing", "", "support", "billing"}},
+		{"one route", "?route=billing", http.StatusOK, []string{"billing", "billing"}},
+		{"paged", "?route=billing&limit=1", http.StatusOK, []string{"billing"}},
+		{"unknown route", "?route=sales", http.StatusOK, []string{}},
+		{"invalid route", "?route=bill-ing", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mt := &messageTable{}
+			for i, route := range []string{"billing", "support", "", "billing"} {
+				mt.insertRouted(start.Add(time.Duration(i)*time.Minute), route, 1)
+			}
+			ts := newTestServer(t, &RelayMsgParser{AdminToken: "s3cret"}, nil, mt.handle)
+			status, body := get(t, ts, "/admin/recent"+tt.query, http.Header{"Authorization": {"Bearer s3cret"}})
+			if status != tt.status {
+				t.Fatalf("status %d, want %d: %s", status, tt.status, body)
+			}
+			if status != http.StatusOK {
+				return
+			}
+			var page MessagePage
+			if err := json.Unmarshal([]byte(body), &page); err != nil {
+				t.Fatal(err)
+			}
+			routes := []string{}
+			for _, m := range page.Results {
+				routes = append(routes, m.Route)
+			}
+			if !reflect.DeepEqual(routes, tt.routes) {
+				t.Errorf("got routes %q, want %q", routes, tt.routes)
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+)
+
+// logLevel is the minimum level which is logged. Info messages go straight to
+// log.Printf; only debug messages are checked against it.
+var logLevel LogLevel = LogInfo
+
+// SetLogLevel sets the minimum level by name; "debug" and "info" are known.
+func SetLogLevel(name string) error {
+	switch strings.ToLower(name) {
+	case "debug":
+		logLevel = LogDebug
+	case "", "info":
+		logLevel = LogInfo
+	default:
+		return fmt.Errorf("unknown log level [%s]", name)
+	}
+	return nil
+}
+
+// Debugf logs like log.Printf, when the log level is debug.
+func Debugf(format string, v ...interface{}) {
+	if logLevel <= LogDebug {
+		log.Output(2, fmt.Sprintf(format, v...))
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/SparkPost/httpdump/storage"
+)
+
+// countingWriter counts the bytes logged, discarding them.
+type countingWriter struct{ n int64 }
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	atomic.AddInt64(&w.n, int64(len(p)))
+	return len(p), nil
+}
+
+// batchPayload returns a webhook payload of n relay message events.
+func batchPayload(b testing.TB, n int) []byte {
+	events := make([]*json.RawMessage, n)
+	for i := range events {
+		events[i] = relayEvent(b, "sender@example.org", fmt.Sprintf("user%d@example.com", i), "hi",
+			"Subject: hi\r\n\r\nhi\r\n")
+	}
+	data, err := json.Marshal(events)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return data
+}
+
+// BenchmarkProcessRequestsLogging processes a large batch at each log
+// level, reporting how much is logged per batch. At info, only the
+// batch's totals should be.
+func BenchmarkProcessRequestsLogging(b *testing.B) {
+	const events = 1000
+	payload := batchPayload(b, events)
+	defer log.SetOutput(os.Stderr)
+	defer SetLogLevel("info")
+	for _, level := range []string{"info", "debug"} {
+		b.Run("level="+level, func(b *testing.B) {
+			if err := SetLogLevel(level); err != nil {
+				b.Fatal(err)
+			}
+			p := &RelayMsgParser{}
+			newTestServer(b, p, nil, storeRows)
+			w := &countingWriter{}
+			log.SetOutput(w)
+			reqs := []storage.Request{{Data: payload}}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				st, err := p.ProcessRequestsContext(context.Background(), reqs)
+				if err != nil {
+					b.Fatal(err)
+				} else if st.Stored != events {
+					b.Fatalf("stored %d of %d", st.Stored, events)
+				}
+			}
+			b.StopTimer()
+			log.SetOutput(os.Stderr)
+			b.ReportMetric(float64(atomic.LoadInt64(&w.n))/float64(b.N), "logbytes/op")
+		})
+	}
+}
+
+func TestSetLogLevel(t *testing.T) {
+	defer SetLogLevel("info")
+	defer log.SetOutput(os.Stderr)
+	tests := []struct {
+		level  string
+		ok     bool
+		logged bool
+	}{
+		{"", true, false},
+		{"info", true, false},
+		{"INFO", true, false},
+		{"debug", true, true},
+		{"Debug", true, true},
+		{"verbose", false, false},
+	}
+	for _, tt := range tests {
+		SetLogLevel("info")
+		if err := SetLogLevel(tt.level); (err == nil) != tt.ok {
+			t.Errorf("SetLogLevel(%q) error %v, want ok %t", tt.level, err, tt.ok)
+		}
+		var buf bytes.Buffer
+		log.SetOutput(&buf)
+		Debugf("per-event detail\n")
+		log.SetOutput(os.Stderr)
+		if logged := buf.Len() > 0; logged != tt.logged {
+			t.Errorf("level %q: debug logged = %t, want %t", tt.level, logged, tt.logged)
+		}
+	}
+}
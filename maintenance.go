@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MaintenanceInterval is the least time allowed between the start of one
+// maintenance run and the next, since each is expensive.
+const MaintenanceInterval time.Duration = 10 * time.Minute
+
+// maintenanceOps maps the operations accepted by Maintenance.Handler to the
+// statement run for each, formatted with the table name. REINDEX
+// CONCURRENTLY needs PostgreSQL 12 or later, but doesn't block writes.
+var maintenanceOps = map[string]string{
+	"vacuum":  "VACUUM (ANALYZE) %s",
+	"analyze": "ANALYZE %s",
+	"reindex": "REINDEX TABLE CONCURRENTLY %s",
+}
+
+// MaintenanceStatus describes the current or most recent maintenance run.
+type MaintenanceStatus struct {
+	Operation string     `json:"operation"`
+	Running   bool       `json:"running"`
+	Started   time.Time  `json:"started"`
+	Finished  *time.Time `json:"finished,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// Maintenance runs VACUUM, ANALYZE or REINDEX on a table in the background,
+// one at a time and at most once per MaintenanceInterval.
+type Maintenance struct {
+	Dbh   *sql.DB
+	Table string
+
+	mu     sync.Mutex
+	status *MaintenanceStatus
+}
+
+// Start begins op in the background. It returns the new status, or an error
+// and how long to wait before trying again if a run is in progress or one
+// started too recently.
+func (m *Maintenance) Start(op string) (MaintenanceStatus, time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.status != nil {
+		if m.status.Running {
+			return *m.status, 0, fmt.Errorf("%s is already running", m.status.Operation)
+		}
+		if wait := MaintenanceInterval - time.Since(m.status.Started); wait > 0 {
+			return *m.status, wait, fmt.Errorf("maintenance last ran %s ago; try again in %s",
+				time.Since(m.status.Started).Round(time.Second), wait.Round(time.Second))
+		}
+	}
+
+	st := &MaintenanceStatus{Operation: op, Running: true, Started: time.Now()}
+	m.status = st
+	go func() {
+		log.Printf("Maintenance: starting %s of %s\n", op, m.Table)
+		_, err := m.Dbh.ExecContext(context.Background(), fmt.Sprintf(maintenanceOps[op], m.Table))
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		finished := time.Now()
+		st.Running, st.Finished = false, &finished
+		if err != nil {
+			st.Error = err.Error()
+			log.Printf("Maintenance (%s): %s\n", op, err)
+			return
+		}
+		log.Printf("Maintenance: finished %s of %s in %s\n", op, m.Table, finished.Sub(st.Started))
+	}()
+	return *st, 0, nil
+}
+
+// Status returns the current or most recent run, or nil if there hasn't
+// been one.
+func (m *Maintenance) Status() *MaintenanceStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.status == nil {
+		return nil
+	}
+	st := *m.status
+	return &st
+}
+
+// Handler starts the operation named by the op parameter: vacuum (with
+// analyze), analyze or reindex. It responds with a 202 and the run's status,
+// which StatusHandler reports on until it's finished.
+func (m *Maintenance) Handler(w http.ResponseWriter, r *http.Request) {
+	op := r.URL.Query().Get("op")
+	if _, ok := maintenanceOps[op]; !ok {
+		writeJSONError(w, r, http.StatusBadRequest, "bad_request", "op must be vacuum, analyze or reindex")
+		return
+	}
+	st, wait, err := m.Start(op)
+	if err != nil {
+		if wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			writeJSONError(w, r, http.StatusTooManyRequests, "rate_limited", err.Error())
+		} else {
+			writeJSONError(w, r, http.StatusConflict, "in_progress", err.Error())
+		}
+		return
+	}
+	writeJSONStatus(w, r, http.StatusAccepted, st)
+}
+
+// StatusHandler reports on the current or most recent maintenance run.
+func (m *Maintenance) StatusHandler(w http.ResponseWriter, r *http.Request) {
+	st := m.Status()
+	if st == nil {
+		writeJSONError(w, r, http.StatusNotFound, "not_found", "No maintenance has run")
+		return
+	}
+	writeJSON(w, r, st)
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/husobee/vestigo"
+)
+
+// StoredMessage is a relay message as read back from the database.
+type StoredMessage struct {
+	ID        int64     `json:"id"`
+	WebhookID string    `json:"webhook_id"`
+	RequestID string    `json:"request_id"`
+	From      string    `json:"from"`
+	FromName  string    `json:"from_name"`
+	To        string    `json:"to"`
+	ToName    string    `json:"to_name"`
+	Subject   string    `json:"subject"`
+	Created   time.Time `json:"created"`
+	Status    int       `json:"status"`
+	Truncated bool      `json:"truncated"`
+	HasBody   bool      `json:"has_body"`
+	// Route is the webhook route the message was stored under, if any.
+	Route string `json:"route"`
+	// Duplicates counts repeats of the message which weren't stored.
+	Duplicates int         `json:"duplicate_count"`
+	Auth       AuthResults `json:"auth"`
+	// Metadata holds the event's metadata and rcpt_meta, merged.
+	Metadata json.RawMessage `json:"metadata,omitempty"`
+	// RFC822 is the message exactly as received, with any base64 encoding
+	// from the webhook payload removed.
+	RFC822 []byte `json:"-"`
+	// TextBody and HTMLBody are the first text/plain and text/html parts,
+	// when they were extracted as the message was stored.
+	TextBody sql.NullString `json:"-"`
+	HTMLBody sql.NullString `json:"-"`
+}
+
+// BodyPart returns the first inline part with the given media type, as
+// UTF-8. Bodies extracted when the message was stored are used if possible,
+// otherwise the message is parsed, so it must have been loaded with RawBody.
+func (m *StoredMessage) BodyPart(mediaType string) (string, bool, error) {
+	switch {
+	case mediaType == "text/plain" && m.TextBody.Valid:
+		return m.TextBody.String, true, nil
+	case mediaType == "text/html" && m.HTMLBody.Valid:
+		return m.HTMLBody.String, true, nil
+	}
+	return FindBodyPart(m.RFC822, mediaType)
+}
+
+// hasParsed reports whether the body part with the given media type was
+// extracted when the message was stored, so BodyPart needn't parse it.
+func (m *StoredMessage) hasParsed(mediaType string) bool {
+	switch mediaType {
+	case "text/plain":
+		return m.TextBody.Valid
+	case "text/html":
+		return m.HTMLBody.Valid
+	}
+	return false
+}
+
+// DecodeRFC822 removes the base64 encoding a webhook may have applied to a
+// message.
+func DecodeRFC822(data []byte, isBase64 bool) ([]byte, error) {
+	if !isBase64 {
+		return data, nil
+	}
+	decoded := make([]byte, base64.StdEncoding.DecodedLen(len(data)))
+	n, err := base64.StdEncoding.Decode(decoded, data)
+	if err != nil {
+		return nil, err
+	}
+	return decoded[:n], nil
+}
+
+// MessageBody is what of a message's body LoadMessage reads, beyond its
+// metadata. The zero value reads none of it.
+type MessageBody int
+
+const (
+	// ParsedBodies reads the text and HTML bodies extracted when the
+	// message was stored, into TextBody and HTMLBody.
+	ParsedBodies MessageBody = 1 << iota
+	// RawBody reads the message as received into RFC822, which may mean
+	// fetching it from external storage and decompressing it.
+	RawBody
+)
+
+// messageColumns are the metadata columns LoadMessage always reads.
+const messageColumns = `webhook_id, smtp_from, smtp_to, subject, created,
+	status_id, request_id, auth_spf, auth_dkim, auth_dmarc, auth_results,
+	spam_score, is_truncated, has_body, metadata::text, duplicate_count,
+	from_name, to_name, route`
+
+// rawBodyColumns are the columns decodeBody needs.
+const rawBodyColumns = `rfc822, is_base64, body_key, is_compressed`
+
+// LoadMessage reads a single message by id, with as much of its body as
+// body asks for. It returns nil without an error when there is no such
+// message.
+func (p *RelayMsgParser) LoadMessage(ctx context.Context, id int64, body MessageBody) (*StoredMessage, error) {
+	m := &StoredMessage{ID: id}
+	var webhookID, reqID, from, to, subject sql.NullString
+	var spf, dkim, dmarc, authRaw, metadata sql.NullString
+	var fromName, toName, route sql.NullString
+	var score sql.NullFloat64
+	var truncated, hasBody sql.NullBool
+	var status, duplicates sql.NullInt64
+	cols := messageColumns
+	dest := []interface{}{&webhookID, &from, &to, &subject, &m.Created,
+		&status, &reqID, &spf, &dkim, &dmarc, &authRaw,
+		&score, &truncated, &hasBody, &metadata, &duplicates,
+		&fromName, &toName, &route}
+	if body&ParsedBodies != 0 {
+		cols += ", text_body, html_body"
+		dest = append(dest, &m.TextBody, &m.HTMLBody)
+	}
+	var raw rawBody
+	if body&RawBody != 0 {
+		cols += ", " + rawBodyColumns
+		dest = append(dest, raw.dest()...)
+	}
+	row := p.ReadDB().QueryRowContext(ctx, fmt.Sprintf(`
+		SELECT %s
+		  FROM %s
+		 WHERE message_id = $1
+	`, cols, p.MsgTable()), id)
+	err := row.Scan(dest...)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("LoadMessage (SELECT): %s", err)
+	}
+	m.WebhookID, m.From, m.To, m.Subject = webhookID.String, from.String, to.String, subject.String
+	m.FromName, m.ToName, m.Route = fromName.String, toName.String, route.String
+	m.Status = int(status.Int64)
+	m.Duplicates = int(duplicates.Int64)
+	m.RequestID = reqID.String
+	m.Truncated = truncated.Bool
+	m.HasBody = !hasBody.Valid || hasBody.Bool
+	if metadata.Valid {
+		m.Metadata = json.RawMessage(metadata.String)
+	}
+	m.Auth = AuthResults{SPF: spf.String, DKIM: dkim.String, DMARC: dmarc.String, Raw: authRaw.String}
+	if score.Valid {
+		m.Auth.SpamScore = &score.Float64
+	}
+
+	if body&RawBody != 0 {
+		if m.RFC822, err = p.decodeBody(id, raw.rfc822, raw.bodyKey, raw.isCompressed.Bool, raw.isBase64.Bool); err != nil {
+			return nil, fmt.Errorf("LoadMessage %s", err)
+		}
+	}
+
+	return m, nil
+}
+
+// LoadRawBody reads the body of a message loaded without it into RFC822.
+func (p *RelayMsgParser) LoadRawBody(ctx context.Context, m *StoredMessage) error {
+	var raw rawBody
+	err := p.ReadDB().QueryRowContext(ctx, fmt.Sprintf(`
+		SELECT %s
+		  FROM %s
+		 WHERE message_id = $1
+	`, rawBodyColumns, p.MsgTable()), m.ID).Scan(raw.dest()...)
+	if err != nil {
+		return fmt.Errorf("LoadRawBody (SELECT): %s", err)
+	}
+	if m.RFC822, err = p.decodeBody(m.ID, raw.rfc822, raw.bodyKey, raw.isCompressed.Bool, raw.isBase64.Bool); err != nil {
+		return fmt.Errorf("LoadRawBody %s", err)
+	}
+	return nil
+}
+
+// rawBody holds the rawBodyColumns of a message, as stored.
+type rawBody struct {
+	rfc822                 []byte
+	isBase64, isCompressed sql.NullBool
+	bodyKey                sql.NullString
+}
+
+func (rb *rawBody) dest() []interface{} {
+	return []interface{}{&rb.rfc822, &rb.isBase64, &rb.bodyKey, &rb.isCompressed}
+}
+
+// decodeBody returns a stored message exactly as received, given its rfc822,
+// body_key, is_compressed and is_base64 columns.
+func (p *RelayMsgParser) decodeBody(id int64, rfc822 []byte, bodyKey sql.NullString, isCompressed, isBase64 bool) ([]byte, error) {
+	var err error
+	if rfc822 == nil && bodyKey.Valid {
+		if p.Bodies == nil {
+			return nil, fmt.Errorf("(body): message %d is in external storage, which isn't configured", id)
+		}
+		if rfc822, err = p.Bodies.Get(bodyKey.String); err != nil {
+			return nil, fmt.Errorf("(body): %s", err)
+		}
+	}
+
+	if isCompressed {
+		if rfc822, err = Decompress(rfc822); err != nil {
+			return nil, fmt.Errorf("(gunzip): %s", err)
+		}
+	}
+
+	if rfc822, err = DecodeRFC822(rfc822, isBase64); err != nil {
+		return nil, fmt.Errorf("(base64): %s", err)
+	}
+	return rfc822, nil
+}
+
+// messageFromRequest loads the message named by the id route parameter, with
+// as much of its body as body asks for, writing an error response and
+// returning nil if that isn't possible.
+func (p *RelayMsgParser) messageFromRequest(w http.ResponseWriter, r *http.Request, body MessageBody) *StoredMessage {
+	id, err := strconv.ParseInt(vestigo.Param(r, "id"), 10, 64)
+	if err != nil {
+		writeJSONError(w, r, http.StatusBadRequest, "invalid_id", "Invalid message id")
+		return nil
+	}
+	ctx, cancel := p.requestContext(r)
+	defer cancel()
+	m, err := p.LoadMessage(ctx, id, body)
+	if err != nil {
+		log.Printf("%s", err)
+		writeJSONError(w, r, http.StatusInternalServerError, "database_error", "Database error")
+		return nil
+	} else if m == nil {
+		writeJSONError(w, r, http.StatusNotFound, "not_found", "No such message")
+		return nil
+	}
+	return m
+}
+
+// messageWithBody is messageFromRequest for handlers which need the body,
+// responding with a 404 for messages stored with only their headers.
+func (p *RelayMsgParser) messageWithBody(w http.ResponseWriter, r *http.Request, body MessageBody) *StoredMessage {
+	m := p.messageFromRequest(w, r, body)
+	if m != nil && !m.HasBody {
+		writeJSONError(w, r, http.StatusNotFound, "no_body", "Message was stored without a body")
+		return nil
+	}
+	return m
+}
+
+// messageWithPart is messageWithBody for handlers which need the body parts
+// of the given media type. They're read from the bodies extracted when the
+// message was stored where possible, and only otherwise is the message as
+// received loaded to parse them from.
+func (p *RelayMsgParser) messageWithPart(w http.ResponseWriter, r *http.Request, mediaType string) *StoredMessage {
+	m := p.messageWithBody(w, r, ParsedBodies)
+	if m == nil || m.hasParsed(mediaType) {
+		return m
+	}
+	ctx, cancel := p.requestContext(r)
+	defer cancel()
+	if err := p.LoadRawBody(ctx, m); err != nil {
+		log.Printf("%s", err)
+		writeJSONError(w, r, http.StatusInternalServerError, "database_error", "Database error")
+		return nil
+	}
+	return m
+}
+
+// MessageHandler returns the metadata of a message as JSON, without its body.
+func (p *RelayMsgParser) MessageHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m := p.messageFromRequest(w, r, 0)
+		if m == nil {
+			return
+		}
+		jsonBytes, err := json.Marshal(m)
+		if err != nil {
+			log.Printf("MessageDetail (JSON): %s", err)
+			writeJSONError(w, r, http.StatusInternalServerError, "encoding_error", "Encoding error")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonBytes)
+	}
+}
+
+// MessageDownloadHandler returns a message exactly as received, as an .eml
+// attachment which can be opened in a mail client.
+func (p *RelayMsgParser) MessageDownloadHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m := p.messageWithBody(w, r, RawBody)
+		if m == nil {
+			return
+		}
+		w.Header().Set("Content-Type", "message/rfc822")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%d.eml\"", m.ID))
+		w.Header().Set("Content-Length", strconv.Itoa(len(m.RFC822)))
+		w.Write(m.RFC822)
+	}
+}
+
+// MessageTextHandler returns the first text/plain part of a message as UTF-8.
+// When there is no plain text part, the first text/html part is returned with
+// markup stripped.
+func (p *RelayMsgParser) MessageTextHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m := p.messageWithPart(w, r, "text/plain")
+		if m == nil {
+			return
+		}
+
+		text, found, err := m.BodyPart("text/plain")
+		if err == nil && !found {
+			text, found, err = m.BodyPart("text/html")
+			text = StripHTML(text)
+		}
+		if err != nil {
+			log.Printf("MessageText (MIME): message %d: %s", m.ID, err)
+			writeJSONError(w, r, http.StatusUnprocessableEntity, "unparseable_message", "Unable to parse message")
+			return
+		} else if !found {
+			writeJSONError(w, r, http.StatusNotFound, "not_found", "No text body in message")
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(text))
+	}
+}
+
+// MessageHTMLHandler returns the first text/html part of a message, sanitized
+// so it's safe to render in a browser. Admins may pass raw=1 to skip
+// sanitization.
+func (p *RelayMsgParser) MessageHTMLHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		raw := r.URL.Query().Get("raw") == "1"
+		if raw && !p.IsAdmin(r) {
+			writeJSONError(w, r, http.StatusForbidden, "forbidden", "raw=1 requires admin access")
+			return
+		}
+		m := p.messageWithPart(w, r, "text/html")
+		if m == nil {
+			return
+		}
+
+		body, found, err := m.BodyPart("text/html")
+		if err != nil {
+			log.Printf("MessageHTML (MIME): message %d: %s", m.ID, err)
+			writeJSONError(w, r, http.StatusUnprocessableEntity, "unparseable_message", "Unable to parse message")
+			return
+		} else if !found {
+			writeJSONError(w, r, http.StatusNotFound, "not_found", "No HTML body in message")
+			return
+		}
+		if !raw {
+			body = SanitizeHTML(body)
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; img-src http: https: data:; style-src 'unsafe-inline'")
+		w.Write([]byte(body))
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memStore is a BodyStore in memory, counting the bodies read from it.
+type memStore struct {
+	mu     sync.Mutex
+	bodies map[string][]byte
+	gets   int
+}
+
+func (s *memStore) Put(key string, body []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bodies[key] = body
+	return nil
+}
+
+func (s *memStore) Get(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gets++
+	body, ok := s.bodies[key]
+	if !ok {
+		return nil, errors.New("no such key")
+	}
+	return body, nil
+}
+
+// TestMessageBodyLoading checks each message endpoint only reads as much of
+// the message as it needs: the raw body, which may be in external storage,
+// only for downloads, or for the text and HTML bodies when they weren't
+// extracted as the message was stored.
+func TestMessageBodyLoading(t *testing.T) {
+	const email = "Subject: hi\r\nContent-Type: text/plain\r\n\r\nraw text\r\n"
+	tests := []struct {
+		name      string
+		path      string
+		textBody  driver.Value
+		htmlBody  driver.Value
+		status    int
+		want      string
+		rawLoaded bool
+	}{
+		{"metadata", "/message/1", "parsed text", nil, http.StatusOK, `"subject":"hi"`, false},
+		{"parsed text", "/message/1/text", "parsed text", nil, http.StatusOK, "parsed text", false},
+		{"text not parsed", "/message/1/text", nil, nil, http.StatusOK, "raw text", true},
+		{"parsed HTML", "/message/1/html", nil, "<p>parsed</p>", http.StatusOK, "<p>parsed</p>", false},
+		{"HTML not parsed", "/message/1/html", "parsed text", nil, http.StatusNotFound, "No HTML body", true},
+		{"download", "/message/1/download", "parsed text", "<p>parsed</p>", http.StatusOK, "raw text", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bodies := &memStore{bodies: map[string][]byte{"1.eml": []byte(email)}}
+			p := &RelayMsgParser{Bodies: bodies}
+			ts := newTestServer(t, p, nil, func(q fakeQuery) (*fakeRows, error) {
+				if !strings.Contains(q.SQL, "WHERE message_id = $1") {
+					return nil, nil
+				}
+				return messageRow(q, map[string]driver.Value{
+					"created": time.Now(), "subject": "hi", "has_body": true,
+					"body_key": "1.eml", "text_body": tt.textBody, "html_body": tt.htmlBody,
+				}), nil
+			})
+			status, body := get(t, ts, tt.path, nil)
+			if status != tt.status || !strings.Contains(body, tt.want) {
+				t.Errorf("status %d, body %q; want %d, %q", status, body, tt.status, tt.want)
+			}
+
+			selected := 0
+			for _, q := range ts.DB.Queries("WHERE message_id = $1") {
+				if strings.Contains(q.SQL, "rfc822") {
+					selected++
+				}
+			}
+			if rawLoaded := selected > 0; rawLoaded != tt.rawLoaded {
+				t.Errorf("raw body selected %t, want %t", rawLoaded, tt.rawLoaded)
+			}
+			if selected > 1 {
+				t.Errorf("raw body selected %d times", selected)
+			}
+			if fetched := bodies.gets > 0; fetched != tt.rawLoaded {
+				t.Errorf("body fetched from storage %t, want %t", fetched, tt.rawLoaded)
+			}
+		})
+	}
+}
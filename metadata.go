@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/SparkPost/gosparkpost/events"
+)
+
+// RelayMessage is a relay_message event, along with the metadata which
+// events.RelayMessage doesn't decode.
+type RelayMessage struct {
+	events.RelayMessage
+	Metadata map[string]interface{} `json:"metadata"`
+	RcptMeta map[string]interface{} `json:"rcpt_meta"`
+	// Event is the whole webhook event the message came from, if known.
+	Event json.RawMessage `json:"-"`
+}
+
+// EventJSON returns the webhook event for the raw_event column, or nil when
+// there isn't one. Events with NUL characters are left out, since jsonb
+// can't hold them.
+func (m *RelayMessage) EventJSON() interface{} {
+	if len(m.Event) == 0 {
+		return nil
+	}
+	if bytes.Contains(m.Event, []byte(`\u0000`)) {
+		log.Printf("EventJSON: not storing event from %s, which contains NUL\n", m.From)
+		return nil
+	}
+	return string(m.Event)
+}
+
+// MetadataJSON returns the event's metadata and rcpt_meta merged into one
+// JSON object, with rcpt_meta taking precedence as it does in SparkPost, or
+// nil when there's neither.
+func (m *RelayMessage) MetadataJSON() (interface{}, error) {
+	if len(m.Metadata) == 0 && len(m.RcptMeta) == 0 {
+		return nil, nil
+	}
+	merged := map[string]interface{}{}
+	for k, v := range m.Metadata {
+		merged[k] = v
+	}
+	for k, v := range m.RcptMeta {
+		merged[k] = v
+	}
+	jsonBytes, err := json.Marshal(merged)
+	if err != nil {
+		return nil, fmt.Errorf("MetadataJSON: %s", err)
+	}
+	return string(jsonBytes), nil
+}
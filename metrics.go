@@ -0,0 +1,58 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"time"
+)
+
+// BatchStats describes what happened to the requests in one batch.
+type BatchStats struct {
+	Requests int `json:"requests"`
+	// Failed counts requests and events which couldn't be parsed.
+	Failed int `json:"failed"`
+	Events int `json:"events"`
+	// Parsed counts relay message events, which are either stored or
+	// dead-lettered unless the batch fails.
+	Parsed       int `json:"parsed"`
+	Stored       int `json:"stored"`
+	DeadLettered int `json:"dead_lettered"`
+	// Duplicates counts messages skipped as repeats of a recent one.
+	Duplicates int `json:"duplicates"`
+	// OtherDomains counts messages skipped because they're to a domain
+	// which isn't accepted.
+	OtherDomains int `json:"other_domains"`
+	// Truncated counts requests with more than MaxEvents events, the rest
+	// of which were skipped.
+	Truncated     int            `json:"truncated"`
+	Ignored       int            `json:"ignored"`
+	IgnoredByType map[string]int `json:"ignored_by_type"`
+	Duration      time.Duration  `json:"duration"`
+}
+
+// batchMetrics holds running totals across batches, published by expvar.
+var batchMetrics = expvar.NewMap("batches")
+
+// Record logs the stats for a batch, and adds them to the running totals.
+// err is the error the batch failed with, if any.
+func (st *BatchStats) Record(err error) {
+	log.Printf("BatchStats: requests=%d failed=%d events=%d parsed=%d stored=%d dead_lettered=%d duplicates=%d other_domains=%d truncated=%d ignored=%d duration=%s error=%v\n",
+		st.Requests, st.Failed, st.Events, st.Parsed, st.Stored, st.DeadLettered, st.Duplicates, st.OtherDomains, st.Truncated, st.Ignored, st.Duration, err != nil)
+
+	if err != nil {
+		batchMetrics.Add("failed_batches", 1)
+	} else {
+		batchMetrics.Add("batches", 1)
+	}
+	batchMetrics.Add("requests", int64(st.Requests))
+	batchMetrics.Add("failed_requests", int64(st.Failed))
+	batchMetrics.Add("events", int64(st.Events))
+	batchMetrics.Add("parsed", int64(st.Parsed))
+	batchMetrics.Add("stored", int64(st.Stored))
+	batchMetrics.Add("dead_lettered", int64(st.DeadLettered))
+	batchMetrics.Add("duplicates", int64(st.Duplicates))
+	batchMetrics.Add("other_domains", int64(st.OtherDomains))
+	batchMetrics.Add("truncated_requests", int64(st.Truncated))
+	batchMetrics.Add("ignored", int64(st.Ignored))
+	batchMetrics.AddFloat("seconds", st.Duration.Seconds())
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	re "regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MigrationLockKey is the advisory lock key held while migrations run, so
+// instances starting together apply each migration once.
+const MigrationLockKey int64 = 0x72656c61796d6967 // "relaymig"
+
+// migrationFile matches migration file names, which start with a version
+// number, like 0001_add_column.sql.
+var migrationFile *re.Regexp = re.MustCompile(`^(\d+)_[\w.-]*\.sql$`)
+
+type migration struct {
+	Version int64
+	Path    string
+}
+
+// Migrate applies the .sql files in dir which haven't been applied yet, in
+// version order, recording each in the schema_migrations table. Version 0 is
+// the schema created by SchemaInit, and is recorded without a file. Within a
+// file, {{schema}} and {{table}} are replaced with the configured schema and
+// message table names. Each file runs in its own transaction.
+func Migrate(dbh *sql.DB, schema, table, dir string) error {
+	if table == "" {
+		table = DefaultTable
+	}
+	_, err := dbh.Exec(fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s.schema_migrations (
+			version  bigint primary key,
+			name     text,
+			applied  timestamptz default clock_timestamp()
+		)
+	`, schema))
+	if err != nil && !isDuplicateObject(err) {
+		return fmt.Errorf("Migrate (CREATE): %s", err)
+	}
+	_, err = dbh.Exec(fmt.Sprintf(`
+		INSERT INTO %s.schema_migrations (version, name)
+		VALUES (0, 'baseline') ON CONFLICT DO NOTHING
+	`, schema))
+	if err != nil {
+		return fmt.Errorf("Migrate (baseline): %s", err)
+	}
+
+	if dir == "" {
+		return nil
+	}
+	migrations, err := readMigrations(dir)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if err = applyMigration(dbh, schema, table, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readMigrations(dir string) ([]migration, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Migrate (ReadDir): %s", err)
+	}
+	migrations := []migration{}
+	seen := map[int64]string{}
+	for _, e := range entries {
+		m := migrationFile.FindStringSubmatch(e.Name())
+		if e.IsDir() || m == nil {
+			continue
+		}
+		version, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Migrate: bad version in [%s]: %s", e.Name(), err)
+		}
+		if version == 0 {
+			return nil, fmt.Errorf("Migrate: version 0 is reserved for the baseline schema [%s]", e.Name())
+		}
+		if other, ok := seen[version]; ok {
+			return nil, fmt.Errorf("Migrate: [%s] and [%s] have the same version", other, e.Name())
+		}
+		seen[version] = e.Name()
+		migrations = append(migrations, migration{Version: version, Path: filepath.Join(dir, e.Name())})
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+func applyMigration(dbh *sql.DB, schema, table string, m migration) error {
+	name := filepath.Base(m.Path)
+	tx, err := dbh.Begin()
+	if err != nil {
+		return fmt.Errorf("Migrate (Begin): %s", err)
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec("SELECT pg_advisory_xact_lock($1)", MigrationLockKey); err != nil {
+		return fmt.Errorf("Migrate (lock): %s", err)
+	}
+	var applied bool
+	err = tx.QueryRow(fmt.Sprintf(`
+		SELECT EXISTS(SELECT 1 FROM %s.schema_migrations WHERE version = $1)
+	`, schema), m.Version).Scan(&applied)
+	if err != nil {
+		return fmt.Errorf("Migrate (SELECT): %s", err)
+	}
+	if applied {
+		return nil
+	}
+
+	ddl, err := os.ReadFile(m.Path)
+	if err != nil {
+		return fmt.Errorf("Migrate (ReadFile): %s", err)
+	}
+	stmts := strings.NewReplacer("{{schema}}", schema, "{{table}}", table).Replace(string(ddl))
+	log.Printf("Migrate: applying [%s]\n", name)
+	if _, err = tx.Exec(stmts); err != nil {
+		return fmt.Errorf("Migrate (%s): %s", name, err)
+	}
+	_, err = tx.Exec(fmt.Sprintf(`
+		INSERT INTO %s.schema_migrations (version, name) VALUES ($1, $2)
+	`, schema), m.Version, name)
+	if err != nil {
+		return fmt.Errorf("Migrate (INSERT): %s", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("Migrate (Commit): %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"html"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	re "regexp"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// FindBodyPart walks the MIME tree of raw looking for the first inline part
+// with the given media type, and returns its content transcoded to UTF-8.
+func FindBodyPart(raw []byte, mediaType string) (string, bool, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return "", false, err
+	}
+	return findPart(textproto.MIMEHeader(msg.Header), msg.Body, mediaType)
+}
+
+func findPart(h textproto.MIMEHeader, body io.Reader, want string) (string, bool, error) {
+	ct := h.Get("Content-Type")
+	if ct == "" {
+		ct = "text/plain"
+	}
+	mediaType, params, err := mime.ParseMediaType(ct)
+	if err != nil {
+		// RFC 2045 says to treat unparseable types as plain text.
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextRawPart()
+			if err == io.EOF {
+				return "", false, nil
+			} else if err != nil {
+				return "", false, err
+			}
+			text, found, err := findPart(part.Header, part, want)
+			if err != nil || found {
+				return text, found, err
+			}
+		}
+	}
+
+	if mediaType != want {
+		return "", false, nil
+	}
+	if disp, _, err := mime.ParseMediaType(h.Get("Content-Disposition")); err == nil && disp == "attachment" {
+		return "", false, nil
+	}
+
+	data, err := io.ReadAll(transferDecoder(h.Get("Content-Transfer-Encoding"), body))
+	if err != nil {
+		return "", false, err
+	}
+	return toUTF8(data, params["charset"]), true, nil
+}
+
+func transferDecoder(cte string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(cte)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+	return r
+}
+
+// toUTF8 transcodes data from the named charset, which may be any label
+// browsers understand, like "iso-8859-1", "shift_jis" or "gb2312". Unknown
+// charsets are treated as UTF-8. Invalid sequences are replaced.
+func toUTF8(data []byte, charset string) string {
+	switch strings.ToLower(strings.TrimSpace(charset)) {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		// Text labelled ASCII is often UTF-8 really.
+		if utf8.Valid(data) {
+			return string(data)
+		}
+	}
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		log.Printf("toUTF8: unsupported charset [%s], assuming UTF-8", charset)
+		return strings.ToValidUTF8(string(data), "\uFFFD")
+	}
+	text, err := enc.NewDecoder().Bytes(data)
+	if err != nil {
+		log.Printf("toUTF8: decoding [%s]: %s", charset, err)
+		return strings.ToValidUTF8(string(data), "\uFFFD")
+	}
+	return string(text)
+}
+
+var htmlInvisible *re.Regexp = re.MustCompile(`(?is)<(script|style|head)\b.*?</(script|style|head)\s*>`)
+var htmlBreak *re.Regexp = re.MustCompile(`(?i)<(br|/p|/div|/tr|/li|/h[1-6])\b[^>]*>`)
+var htmlTag *re.Regexp = re.MustCompile(`(?s)<[^>]*>`)
+var blankLines *re.Regexp = re.MustCompile(`\n\s*\n\s*`)
+var spaces *re.Regexp = re.MustCompile(`[ \t\r\f]+`)
+
+// StripHTML reduces an HTML document to its visible text.
+func StripHTML(s string) string {
+	s = htmlInvisible.ReplaceAllString(s, "")
+	s = htmlBreak.ReplaceAllString(s, "\n")
+	s = htmlTag.ReplaceAllString(s, "")
+	s = html.UnescapeString(s)
+	s = spaces.ReplaceAllString(s, " ")
+	s = blankLines.ReplaceAllString(s, "\n\n")
+	return strings.TrimSpace(s)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestToUTF8(t *testing.T) {
+	tests := []struct {
+		charset string
+		data    string
+		want    string
+	}{
+		{"", "café", "café"},
+		{"utf-8", "café", "café"},
+		{"UTF8", "café", "café"},
+		{"utf-8", "caf\xe9", "caf�"},
+		{"", "caf\xe9", "caf�"},
+		{"us-ascii", "plain", "plain"},
+		// Mislabelled UTF-8 is kept; other 8-bit text is taken to be
+		// windows-1252, as browsers do.
+		{"us-ascii", "café", "café"},
+		{"us-ascii", "caf\xe9", "café"},
+		{"iso-8859-1", "caf\xe9", "café"},
+		{"ISO-8859-1", "caf\xe9", "café"},
+		{"latin1", "caf\xe9", "café"},
+		{"iso-8859-1", "\x80", "€"},
+		{"windows-1252", "\x93hi\x94 \x80", "“hi” €"},
+		{"cp1252", "\x85", "…"},
+		{"iso-8859-15", "\xa4", "€"},
+		{"koi8-r", "\xf0\xd2\xc9\xd7\xc5\xd4", "Привет"},
+		{"shift_jis", "\x82\xb1\x82\xf1\x82\xc9\x82\xbf\x82\xcd", "こんにちは"},
+		{"iso-2022-jp", "\x1b$B$3$s$K$A$O\x1b(B", "こんにちは"},
+		{"euc-kr", "\xbe\xc8\xb3\xe7", "안녕"},
+		{"gb2312", "\xc4\xe3\xba\xc3", "你好"},
+		{"big5", "\xa7\x41\xa6\x6e", "你好"},
+		{"utf-16le", "h\x00i\x00", "hi"},
+		{"x-unknown", "café", "café"},
+		{"x-unknown", "caf\xe9", "caf�"},
+	}
+	for _, tt := range tests {
+		if got := toUTF8([]byte(tt.data), tt.charset); got != tt.want {
+			t.Errorf("toUTF8(%q, %q) = %q, want %q", tt.data, tt.charset, got, tt.want)
+		}
+	}
+}
+
+func TestFindBodyPart(t *testing.T) {
+	raw := strings.Join([]string{
+		"From: a@example.com",
+		"Content-Type: multipart/alternative; boundary=b",
+		"",
+		"--b",
+		"Content-Type: text/plain; charset=iso-8859-1",
+		"Content-Transfer-Encoding: quoted-printable",
+		"",
+		"Caf=E9 at noon",
+		"--b",
+		"Content-Type: text/html; charset=shift_jis",
+		"Content-Transfer-Encoding: base64",
+		"",
+		"PHA+grGC8YLJgr+CzTwvcD4=",
+		"--b--",
+		"",
+	}, "\r\n")
+	tests := []struct {
+		mediaType string
+		want      string
+		found     bool
+	}{
+		{"text/plain", "Café at noon", true},
+		{"text/html", "<p>こんにちは</p>", true},
+		{"text/calendar", "", false},
+	}
+	for _, tt := range tests {
+		got, found, err := FindBodyPart([]byte(raw), tt.mediaType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want || found != tt.found {
+			t.Errorf("FindBodyPart(%s) = %q, %t; want %q, %t", tt.mediaType, got, found, tt.want, tt.found)
+		}
+	}
+}
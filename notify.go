@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/husobee/vestigo"
+	"github.com/lib/pq"
+)
+
+// NotifyBuffer is how many notifications may be queued for one client.
+// Further notifications are dropped until it catches up.
+const NotifyBuffer int = 16
+
+// NotifyChannel returns the PostgreSQL channel notifications for a recipient
+// address are sent on. Addresses are hashed, since channel names are limited
+// to identifiers.
+func NotifyChannel(addr string) string {
+	sum := sha256.Sum256([]byte(addr))
+	return "relaymsg_" + hex.EncodeToString(sum[:16])
+}
+
+// NotifyStored announces a newly stored message to anyone listening for its
+// recipient. Problems are logged, not returned, since the message is already
+// stored.
+func (p *RelayMsgParser) NotifyStored(ctx context.Context, item *MessageListItem) {
+	note := *item
+	note.Subject = TruncateRunes(note.Subject, 200)
+	// NOTIFY payloads must be under 8000 bytes.
+	payload, err := json.Marshal(note)
+	if err != nil || len(payload) >= 8000 {
+		log.Printf("NotifyStored (JSON): message %d: %v\n", item.ID, err)
+		return
+	}
+	_, err = p.Dbh.ExecContext(ctx, "SELECT pg_notify($1, $2)",
+		NotifyChannel(item.ToBase), string(payload))
+	if err != nil {
+		log.Printf("NotifyStored (NOTIFY): message %d: %s\n", item.ID, err)
+	}
+}
+
+// notifyListener is the part of a pq.Listener a Notifier uses.
+type notifyListener interface {
+	Listen(channel string) error
+	Unlisten(channel string) error
+	NotificationChannel() <-chan *pq.Notification
+	Close() error
+}
+
+// Notifier shares one LISTEN connection between all clients waiting for new
+// messages, listening on each channel while anyone is subscribed to it.
+type Notifier struct {
+	listener notifyListener
+	// listenMu is held while subscribing and unsubscribing, so LISTEN and
+	// UNLISTEN for a channel happen in order, and guards listening.
+	listenMu  sync.Mutex
+	listening map[string]bool
+	// mu guards subs. It's never held while waiting on the database, since
+	// LISTEN can wait for pending notifications to be delivered, which
+	// needs mu.
+	mu   sync.Mutex
+	subs map[string]map[chan []byte]bool
+}
+
+// NewNotifier connects to the database at dsn to listen for notifications,
+// until ctx is done.
+func NewNotifier(ctx context.Context, dsn string) *Notifier {
+	return newNotifier(ctx, pq.NewListener(dsn, time.Second, time.Minute,
+		func(ev pq.ListenerEventType, err error) {
+			if err != nil {
+				log.Printf("Notifier: %s\n", err)
+			}
+		}))
+}
+
+func newNotifier(ctx context.Context, listener notifyListener) *Notifier {
+	n := &Notifier{
+		listener:  listener,
+		listening: map[string]bool{},
+		subs:      map[string]map[chan []byte]bool{},
+	}
+	go n.run(ctx)
+	return n
+}
+
+func (n *Notifier) run(ctx context.Context) {
+	defer n.listener.Close()
+	notify := n.listener.NotificationChannel()
+	for {
+		select {
+		case <-ctx.Done():
+			// Closing subscribers' channels ends their streams, so the
+			// server can shut down.
+			n.mu.Lock()
+			for _, subs := range n.subs {
+				for ch := range subs {
+					close(ch)
+				}
+			}
+			n.subs = nil
+			n.mu.Unlock()
+			return
+		case note := <-notify:
+			// nil means the connection was re-established, and
+			// notifications may have been missed.
+			if note == nil {
+				continue
+			}
+			n.mu.Lock()
+			for ch := range n.subs[note.Channel] {
+				select {
+				case ch <- []byte(note.Extra):
+				default:
+					// the client isn't keeping up
+				}
+			}
+			n.mu.Unlock()
+		}
+	}
+}
+
+// shutDown reports whether the Notifier has stopped.
+func (n *Notifier) shutDown() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.subs == nil
+}
+
+// Subscribe returns a channel which receives the payload of each notification
+// on channel, and a func to call when done with it. The channel is closed
+// when the Notifier shuts down.
+func (n *Notifier) Subscribe(channel string) (<-chan []byte, func(), error) {
+	errShutDown := fmt.Errorf("Notifier: shutting down")
+	n.listenMu.Lock()
+	defer n.listenMu.Unlock()
+	if n.shutDown() {
+		return nil, nil, errShutDown
+	}
+	if !n.listening[channel] {
+		if err := n.listener.Listen(channel); err != nil && err != pq.ErrChannelAlreadyOpen {
+			return nil, nil, fmt.Errorf("Notifier (LISTEN): %s", err)
+		}
+		n.listening[channel] = true
+	}
+
+	ch := make(chan []byte, NotifyBuffer)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.subs == nil {
+		return nil, nil, errShutDown
+	}
+	if n.subs[channel] == nil {
+		n.subs[channel] = map[chan []byte]bool{}
+	}
+	n.subs[channel][ch] = true
+
+	return ch, func() { n.unsubscribe(channel, ch) }, nil
+}
+
+func (n *Notifier) unsubscribe(channel string, ch chan []byte) {
+	n.listenMu.Lock()
+	defer n.listenMu.Unlock()
+	n.mu.Lock()
+	if !n.subs[channel][ch] {
+		n.mu.Unlock()
+		return
+	}
+	delete(n.subs[channel], ch)
+	last := len(n.subs[channel]) == 0
+	if last {
+		delete(n.subs, channel)
+	}
+	n.mu.Unlock()
+
+	if last && n.listening[channel] {
+		delete(n.listening, channel)
+		if err := n.listener.Unlisten(channel); err != nil && err != pq.ErrChannelNotOpen {
+			log.Printf("Notifier (UNLISTEN): %s\n", err)
+		}
+	}
+}
+
+// subscribeRecipient subscribes to notifications for the localpart in the
+// request, writing an error response and returning nil if that isn't
+// possible.
+func (p *RelayMsgParser) subscribeRecipient(w http.ResponseWriter, r *http.Request) (<-chan []byte, func()) {
+	if p.Notifier == nil {
+		writeJSONError(w, r, http.StatusNotFound, "not_found", "Notifications are not enabled")
+		return nil, nil
+	}
+	localpart := p.normalizeLocalpart(vestigo.Param(r, "localpart"))
+	ch, unsubscribe, err := p.Notifier.Subscribe(NotifyChannel(localpart + "@" + p.Domain))
+	if err != nil {
+		log.Printf("%s", err)
+		writeJSONError(w, r, http.StatusInternalServerError, "database_error", "Database error")
+		return nil, nil
+	}
+	return ch, unsubscribe
+}
+
+// EventsHandler streams a Server-Sent Event for each new message stored for
+// the given localpart, until the client disconnects.
+func (p *RelayMsgParser) EventsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeJSONError(w, r, http.StatusInternalServerError, "streaming_unsupported", "Streaming unsupported")
+			return
+		}
+		ch, unsubscribe := p.subscribeRecipient(w, r)
+		if ch == nil {
+			return
+		}
+		defer unsubscribe()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		// Comments keep proxies from closing an idle stream.
+		keepalive := time.NewTicker(30 * time.Second)
+		defer keepalive.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-keepalive.C:
+				if _, err := w.Write([]byte(": keepalive\n\n")); err != nil {
+					return
+				}
+			case payload, ok := <-ch:
+				if !ok {
+					return
+				}
+				data := strings.Replace(string(payload), "\n", "\ndata: ", -1)
+				if _, err := fmt.Fprintf(w, "event: message\ndata: %s\n\n", data); err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+		}
+	}
+}
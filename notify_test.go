@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// fakeListener stands in for a pq.Listener. Like a real one, LISTEN and
+// UNLISTEN can't complete while notifications are waiting to be delivered:
+// each first sends two notifications on the busy channel, and only returns
+// once they're received.
+type fakeListener struct {
+	notify chan *pq.Notification
+
+	mu        sync.Mutex
+	listening map[string]bool
+}
+
+func newFakeListener() *fakeListener {
+	return &fakeListener{notify: make(chan *pq.Notification), listening: map[string]bool{}}
+}
+
+const busyChannel = "busy"
+
+func (l *fakeListener) deliverPending() {
+	for i := 0; i < 2; i++ {
+		l.notify <- &pq.Notification{Channel: busyChannel, Extra: "pending"}
+	}
+}
+
+// next returns the next notification on ch which isn't a pending one.
+func next(ch <-chan []byte) string {
+	for payload := range ch {
+		if string(payload) != "pending" {
+			return string(payload)
+		}
+	}
+	return ""
+}
+
+func (l *fakeListener) Listen(channel string) error {
+	l.deliverPending()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.listening[channel] = true
+	return nil
+}
+
+func (l *fakeListener) Unlisten(channel string) error {
+	l.deliverPending()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.listening, channel)
+	return nil
+}
+
+func (l *fakeListener) Listening(channel string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.listening[channel]
+}
+
+func (l *fakeListener) NotificationChannel() <-chan *pq.Notification { return l.notify }
+func (l *fakeListener) Close() error                                 { return nil }
+
+// within fails the test if fn doesn't return in time.
+func within(t *testing.T, what string, fn func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s deadlocked", what)
+	}
+}
+
+func TestNotifierSubscribe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l := newFakeListener()
+	n := newNotifier(ctx, l)
+
+	// Subscribing while notifications are pending for an existing
+	// subscriber must not wait on them being delivered.
+	var a, b <-chan []byte
+	var unsubA, unsubB func()
+	within(t, "first Subscribe", func() {
+		var err error
+		if a, unsubA, err = n.Subscribe(busyChannel); err != nil {
+			t.Error(err)
+		}
+	})
+	within(t, "second Subscribe", func() {
+		var err error
+		if b, unsubB, err = n.Subscribe("two"); err != nil {
+			t.Error(err)
+		}
+	})
+	if !l.Listening(busyChannel) || !l.Listening("two") {
+		t.Fatal("not listening on both channels")
+	}
+	if got := string(<-a); got != "pending" {
+		t.Errorf("got %q", got)
+	}
+
+	// Each subscriber only gets its own channel's notifications.
+	tests := []struct {
+		channel, other string
+		ch             <-chan []byte
+	}{
+		{busyChannel, "two", a},
+		{"two", busyChannel, b},
+	}
+	for _, tt := range tests {
+		within(t, "notify", func() {
+			l.notify <- &pq.Notification{Channel: tt.channel, Extra: "new " + tt.channel}
+			l.notify <- &pq.Notification{Channel: tt.other, Extra: "new " + tt.other}
+		})
+		if got := next(tt.ch); got != "new "+tt.channel {
+			t.Errorf("%s got %q", tt.channel, got)
+		}
+	}
+
+	within(t, "unsubscribe", unsubA)
+	if l.Listening(busyChannel) {
+		t.Error("still listening once nobody's subscribed")
+	}
+	// Unsubscribing twice does nothing.
+	within(t, "second unsubscribe", unsubA)
+
+	cancel()
+	within(t, "shutdown", func() {
+		for range b {
+		}
+	})
+	unsubB()
+	if _, _, err := n.Subscribe("three"); err == nil {
+		t.Error("subscribed after shutting down")
+	}
+}
+
+func TestNotifierConcurrentSubscribers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l := newFakeListener()
+	n := newNotifier(ctx, l)
+
+	within(t, "concurrent Subscribe and unsubscribe", func() {
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				channel := []string{"one", "two"}[i%2]
+				_, unsubscribe, err := n.Subscribe(channel)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				unsubscribe()
+			}(i)
+		}
+		wg.Wait()
+	})
+	if l.Listening("one") || l.Listening("two") {
+		t.Error("still listening once nobody's subscribed")
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// DefaultOutboundQueue is how many messages may wait to be sent to the
+// outbound webhook before more are dropped.
+const DefaultOutboundQueue int = 1000
+
+// OutboundTimeout limits each attempt to deliver to the outbound webhook.
+const OutboundTimeout time.Duration = 10 * time.Second
+
+// OutboundAttempts is how many times delivery of each message is tried.
+const OutboundAttempts int = 3
+
+// OutboundMessage is posted to the outbound webhook for each stored message.
+type OutboundMessage struct {
+	MessageListItem
+	WebhookID string `json:"webhook_id"`
+	RequestID string `json:"request_id"`
+	// RFC822 is the whole message, when bodies are included.
+	RFC822 string `json:"rfc822,omitempty"`
+}
+
+// OutboundWebhook posts each stored message to another service. Messages
+// are queued and sent in the background, so a slow or unavailable endpoint
+// never holds up batches; when the queue is full, messages are dropped.
+type OutboundWebhook struct {
+	URL string
+	// IncludeBody adds the whole message to each post.
+	IncludeBody bool
+	// Secret, when set, signs each post with a hex-encoded HMAC-SHA256 of
+	// the body in the X-Signature header, as VerifyHMAC expects.
+	Secret string
+	Client *http.Client
+
+	queue chan *OutboundMessage
+}
+
+// NewOutboundWebhook returns an OutboundWebhook with room for size messages
+// in its queue, delivering them until ctx is done.
+func NewOutboundWebhook(ctx context.Context, url string, size int) *OutboundWebhook {
+	if size < 1 {
+		size = DefaultOutboundQueue
+	}
+	ow := &OutboundWebhook{
+		URL:    url,
+		Client: &http.Client{Timeout: OutboundTimeout},
+		queue:  make(chan *OutboundMessage, size),
+	}
+	go ow.run(ctx)
+	return ow
+}
+
+// Enqueue queues msg for delivery, or drops it if the queue is full.
+func (ow *OutboundWebhook) Enqueue(msg *OutboundMessage) {
+	select {
+	case ow.queue <- msg:
+	default:
+		log.Printf("OutboundWebhook: queue full, dropping message %d\n", msg.ID)
+		batchMetrics.Add("outbound_dropped", 1)
+	}
+}
+
+func (ow *OutboundWebhook) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-ow.queue:
+			ow.deliver(ctx, msg)
+		}
+	}
+}
+
+// deliver posts msg, retrying failures with a growing delay.
+func (ow *OutboundWebhook) deliver(ctx context.Context, msg *OutboundMessage) {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("OutboundWebhook (JSON): message %d: %s\n", msg.ID, err)
+		return
+	}
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		err = postSigned(ctx, ow.Client, ow.URL, ow.Secret, body)
+		if err == nil {
+			batchMetrics.Add("outbound_sent", 1)
+			return
+		}
+		if attempt >= OutboundAttempts {
+			break
+		}
+		log.Printf("OutboundWebhook: message %d: %s, retrying in %s\n", msg.ID, err, delay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+	log.Printf("OutboundWebhook: giving up on message %d: %s\n", msg.ID, err)
+	batchMetrics.Add("outbound_failed", 1)
+}
+
+// postSigned posts a JSON body to url, signed with secret when it's set. Any
+// status other than 2xx is an error.
+func postSigned(ctx context.Context, client *http.Client, url, secret string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		req.Header.Set(DefaultHMACHeader, hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
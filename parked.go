@@ -0,0 +1,119 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/husobee/vestigo"
+)
+
+// ParkedBatchID is the batch_id of raw requests which have failed too many
+// times, so later batches skip them.
+const ParkedBatchID int64 = -1
+
+// DefaultMaxRequestRetries is how many batches a raw request may fail in
+// before it's parked.
+const DefaultMaxRequestRetries int = 5
+
+// RawRequestsInit adds the columns used to track failures and checkpoints
+// to the raw_requests table, which pg.SchemaInit creates.
+func RawRequestsInit(dbh *sql.DB, schema string) error {
+	return addColumns(dbh, schema, "raw_requests", []string{
+		"fail_count integer not null default 0",
+		"last_error text",
+		"parked_at timestamptz",
+		"processed_at timestamptz",
+		"resumed bool not null default false",
+	})
+}
+
+// ParkedRequest describes a raw request which was set aside after failing
+// in too many batches.
+type ParkedRequest struct {
+	ID        int64     `json:"id"`
+	When      time.Time `json:"when"`
+	FailCount int       `json:"fail_count"`
+	LastError string    `json:"last_error"`
+	ParkedAt  time.Time `json:"parked_at"`
+	Size      int       `json:"size"`
+}
+
+// ParkedHandler lists parked raw requests, newest first.
+func (p *RelayMsgParser) ParkedHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit, err := limitParam(r, 50, 500)
+		if err != nil {
+			writeJSONError(w, r, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+
+		ctx, cancel := p.requestContext(r)
+		defer cancel()
+		rows, err := p.DumpDB().QueryContext(ctx, fmt.Sprintf(`
+			SELECT request_id, "when", fail_count, coalesce(last_error, ''),
+			       coalesce(parked_at, "when"), octet_length(data)
+			  FROM %s.raw_requests
+			 WHERE batch_id = $1
+			 ORDER BY request_id DESC
+			 LIMIT $2
+		`, p.Schema), ParkedBatchID, limit)
+		if err != nil {
+			log.Printf("ListParked (SELECT): %s", err)
+			writeJSONError(w, r, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+		defer rows.Close()
+
+		list := []ParkedRequest{}
+		for rows.Next() {
+			pr := ParkedRequest{}
+			if err = rows.Scan(&pr.ID, &pr.When, &pr.FailCount, &pr.LastError, &pr.ParkedAt, &pr.Size); err != nil {
+				log.Printf("ListParked (Scan): %s", err)
+				writeJSONError(w, r, http.StatusInternalServerError, "database_error", "Database error")
+				return
+			}
+			list = append(list, pr)
+		}
+		if err = rows.Err(); err != nil {
+			log.Printf("ListParked (Err): %s", err)
+			writeJSONError(w, r, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+		writeJSON(w, r, map[string][]ParkedRequest{"results": list})
+	}
+}
+
+// UnparkHandler returns a parked raw request to the queue, with its failure
+// count reset, for when whatever made it fail has been fixed.
+func (p *RelayMsgParser) UnparkHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(vestigo.Param(r, "id"), 10, 64)
+		if err != nil {
+			writeJSONError(w, r, http.StatusBadRequest, "invalid_id", "Invalid request id")
+			return
+		}
+
+		ctx, cancel := p.requestContext(r)
+		defer cancel()
+		res, err := p.DumpDB().ExecContext(ctx, fmt.Sprintf(`
+			UPDATE %s.raw_requests
+			   SET batch_id = NULL, fail_count = 0, parked_at = NULL
+			 WHERE request_id = $1 AND batch_id = $2
+		`, p.Schema), id, ParkedBatchID)
+		if err != nil {
+			log.Printf("Unpark (UPDATE): %s", err)
+			writeJSONError(w, r, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			writeJSONError(w, r, http.StatusNotFound, "not_found", "No such parked request")
+			return
+		}
+		log.Printf("Unpark: requeued request %d\n", id)
+		writeJSON(w, r, map[string]interface{}{"id": id, "requeued": true})
+	}
+}
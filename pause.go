@@ -0,0 +1,42 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+// IngestSwitch lets operators stop accepting webhooks, for maintenance,
+// while reads and batch processing carry on. It isn't persisted, so ingest
+// resumes on restart.
+type IngestSwitch struct {
+	paused atomic.Bool
+}
+
+// Wrap returns an ingest handler which responds 503 while ingest is paused,
+// so senders retry later.
+func (is *IngestSwitch) Wrap(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if is.paused.Load() {
+			w.Header().Set("Retry-After", "60")
+			writeJSONError(w, r, http.StatusServiceUnavailable, "ingest_paused", "Ingest is paused")
+			return
+		}
+		h(w, r)
+	}
+}
+
+// Handler sets whether ingest is paused, and reports the new state.
+func (is *IngestSwitch) Handler(paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if is.paused.Swap(paused) != paused {
+			log.Printf("IngestSwitch: paused=%t\n", paused)
+		}
+		is.StatusHandler(w, r)
+	}
+}
+
+// StatusHandler reports whether ingest is paused.
+func (is *IngestSwitch) StatusHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, map[string]bool{"paused": is.paused.Load()})
+}
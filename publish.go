@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// DefaultPublishQueue is how many messages may wait to be published before
+// more are dropped.
+const DefaultPublishQueue int = 10000
+
+// DefaultPublishSubject is the topic or subject messages are published to.
+const DefaultPublishSubject string = "relaymsg.stored"
+
+// PublishRetryMaxDelay caps the wait between attempts to reach the broker.
+const PublishRetryMaxDelay time.Duration = 30 * time.Second
+
+// StreamMessage is the compact form of a stored message which is published.
+type StreamMessage struct {
+	ID        int64     `json:"id"`
+	WebhookID string    `json:"webhook_id"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Subject   string    `json:"subject"`
+	Created   time.Time `json:"created"`
+	Size      int       `json:"size"`
+}
+
+// Publisher makes stored messages available to stream consumers. Publish
+// must not block.
+type Publisher interface {
+	Publish(msg *StreamMessage)
+}
+
+// NoopPublisher publishes nothing.
+type NoopPublisher struct{}
+
+func (NoopPublisher) Publish(msg *StreamMessage) {}
+
+// Broker sends a message to a subject on a message bus, like NATS.
+type Broker interface {
+	Send(subject string, data []byte) error
+}
+
+// QueuedPublisher publishes to a Broker in the background. While the broker
+// can't be reached, messages wait in a bounded queue and sending is retried
+// with a growing delay; once the queue is full, further messages are
+// dropped rather than holding up batches.
+type QueuedPublisher struct {
+	Broker  Broker
+	Subject string
+
+	queue chan []byte
+}
+
+// NewQueuedPublisher returns a QueuedPublisher with room for size messages
+// in its queue, publishing them until ctx is done.
+func NewQueuedPublisher(ctx context.Context, broker Broker, subject string, size int) *QueuedPublisher {
+	if size < 1 {
+		size = DefaultPublishQueue
+	}
+	if subject == "" {
+		subject = DefaultPublishSubject
+	}
+	qp := &QueuedPublisher{Broker: broker, Subject: subject, queue: make(chan []byte, size)}
+	go qp.run(ctx)
+	return qp
+}
+
+func (qp *QueuedPublisher) Publish(msg *StreamMessage) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Publish (JSON): message %d: %s\n", msg.ID, err)
+		return
+	}
+	select {
+	case qp.queue <- data:
+	default:
+		log.Printf("Publish: queue full, dropping message %d\n", msg.ID)
+		batchMetrics.Add("publish_dropped", 1)
+	}
+}
+
+func (qp *QueuedPublisher) run(ctx context.Context) {
+	for {
+		var data []byte
+		select {
+		case <-ctx.Done():
+			return
+		case data = <-qp.queue:
+		}
+		delay := time.Second
+		for {
+			err := qp.Broker.Send(qp.Subject, data)
+			if err == nil {
+				batchMetrics.Add("published", 1)
+				break
+			}
+			log.Printf("Publish: %s, retrying in %s with %d queued\n", err, delay, len(qp.queue))
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			if delay *= 2; delay > PublishRetryMaxDelay {
+				delay = PublishRetryMaxDelay
+			}
+		}
+	}
+}
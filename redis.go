@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// RedisTimeout limits how long a Redis command may take, so a struggling
+// server slows requests down by at most this much.
+const RedisTimeout time.Duration = 500 * time.Millisecond
+
+// RedisPoolSize is the most idle connections a RedisClient keeps.
+const RedisPoolSize int = 8
+
+// RedisMaxBulk is the longest string reply a RedisClient accepts, the most a
+// Redis string can hold, so a corrupt length can't exhaust memory.
+const RedisMaxBulk int = 512 << 20
+
+// RedisMaxArray is the most items an array reply may have.
+const RedisMaxArray int = 1 << 20
+
+// errRedisNil is returned for a nil reply, like GET of a missing key.
+var errRedisNil = errors.New("redis: nil")
+
+// RedisClient is a minimal client for the handful of Redis commands the
+// summary cache needs.
+type RedisClient struct {
+	addr     string
+	password string
+	db       int
+	pool     chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// NewRedisClient parses a URL like redis://:password@host:6379/0. No
+// connection is made until a command is sent.
+func NewRedisClient(redisURL string) (*RedisClient, error) {
+	u, err := url.Parse(redisURL)
+	if err != nil {
+		return nil, fmt.Errorf("NewRedisClient: %s", err)
+	}
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("NewRedisClient: scheme must be redis, not %q", u.Scheme)
+	}
+	rc := &RedisClient{addr: u.Host, pool: make(chan *redisConn, RedisPoolSize)}
+	if u.Port() == "" {
+		rc.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		rc.password, _ = u.User.Password()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if rc.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("NewRedisClient: invalid database %q", db)
+		}
+	}
+	return rc, nil
+}
+
+// get returns an idle connection, or makes a new one. pooled is whether it
+// was idle, and so may have been closed by the server meanwhile.
+func (rc *RedisClient) get() (c *redisConn, pooled bool, err error) {
+	select {
+	case c := <-rc.pool:
+		return c, true, nil
+	default:
+	}
+	c, err = rc.dial()
+	return c, false, err
+}
+
+// dial makes a new connection, authenticated and using the database asked
+// for.
+func (rc *RedisClient) dial() (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", rc.addr, RedisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{Conn: conn, r: bufio.NewReader(conn)}
+	if rc.password != "" {
+		if _, err = c.do("AUTH", rc.password); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if rc.db != 0 {
+		if _, err = c.do("SELECT", strconv.Itoa(rc.db)); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// put returns a connection to the pool, closing it if the pool is full.
+func (rc *RedisClient) put(c *redisConn) {
+	select {
+	case rc.pool <- c:
+	default:
+		c.Close()
+	}
+}
+
+// Do sends a command and returns its reply: a string, an int64, nil, or a
+// []interface{} of those. Error replies are returned as errors. When an idle
+// connection turns out to have been closed, like by the server's timeout,
+// the command is sent again on a new one; the commands used are all safe to
+// repeat.
+func (rc *RedisClient) Do(args ...string) (interface{}, error) {
+	c, pooled, err := rc.get()
+	if err != nil {
+		return nil, fmt.Errorf("Redis (connect): %s", err)
+	}
+	reply, err := c.do(args...)
+	if pooled && (errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)) {
+		c.Close()
+		if c, err = rc.dial(); err != nil {
+			return nil, fmt.Errorf("Redis (connect): %s", err)
+		}
+		reply, err = c.do(args...)
+	}
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		// The connection may be left mid-reply; don't reuse it.
+		c.Close()
+		return nil, fmt.Errorf("Redis (%s): %s", args[0], err)
+	}
+	rc.put(c)
+	if err != nil {
+		return nil, fmt.Errorf("Redis (%s): %s", args[0], err)
+	}
+	return reply, nil
+}
+
+// redisError is an error reply from the server.
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	c.SetDeadline(time.Now().Add(RedisTimeout))
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c, b.String()); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+func (c *redisConn) readReply() (interface{}, error) {
+	// Lines longer than the buffer are cut short with an error, rather
+	// than growing without bound.
+	buf, err := c.r.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	line := strings.TrimSuffix(string(buf), "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		} else if n < 0 {
+			return nil, nil
+		} else if n > RedisMaxBulk {
+			return nil, fmt.Errorf("%d byte reply is too long", n)
+		}
+		buf := make([]byte, n+2)
+		if _, err = io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		} else if string(buf[n:]) != "\r\n" {
+			return nil, fmt.Errorf("reply longer than its length of %d", n)
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		} else if n < 0 {
+			return nil, nil
+		} else if n > RedisMaxArray {
+			return nil, fmt.Errorf("%d item reply is too long", n)
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("unexpected reply %q", line)
+}
+
+// Get returns the value of key, or errRedisNil when it isn't set.
+func (rc *RedisClient) Get(key string) (string, error) {
+	reply, err := rc.Do("GET", key)
+	if err != nil {
+		return "", err
+	}
+	val, ok := reply.(string)
+	if !ok {
+		return "", errRedisNil
+	}
+	return val, nil
+}
+
+// Set sets key to val, expiring after ttl.
+func (rc *RedisClient) Set(key, val string, ttl time.Duration) error {
+	_, err := rc.Do("SET", key, val, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	return err
+}
+
+// DeletePrefix deletes every key starting with prefix. Keys are found with
+// SCAN, so this doesn't block the server, but may miss keys set meanwhile.
+func (rc *RedisClient) DeletePrefix(prefix string) error {
+	pattern := redisGlobEscape(prefix) + "*"
+	cursor := "0"
+	for {
+		reply, err := rc.Do("SCAN", cursor, "MATCH", pattern, "COUNT", "100")
+		if err != nil {
+			return err
+		}
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 2 {
+			return fmt.Errorf("Redis (SCAN): unexpected reply")
+		}
+		cursor, _ = parts[0].(string)
+		keys, _ := parts[1].([]interface{})
+		if len(keys) > 0 {
+			args := []string{"DEL"}
+			for _, k := range keys {
+				if key, ok := k.(string); ok {
+					args = append(args, key)
+				}
+			}
+			if _, err = rc.Do(args...); err != nil {
+				return err
+			}
+		}
+		if cursor == "0" || cursor == "" {
+			return nil
+		}
+	}
+}
+
+// redisGlobEscape escapes the characters SCAN's MATCH treats specially.
+func redisGlobEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
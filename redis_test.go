@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestRedisReadReply(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply string
+		want  interface{}
+		err   string
+	}{
+		{"status", "+OK\r\n", "OK", ""},
+		{"error", "-ERR unknown command\r\n", nil, "ERR unknown command"},
+		{"integer", ":-42\r\n", int64(-42), ""},
+		{"bulk", "$5\r\nhe\r\no\r\n", "he\r\no", ""},
+		{"empty bulk", "$0\r\n\r\n", "", ""},
+		{"nil bulk", "$-1\r\n", nil, ""},
+		{"array", "*3\r\n$1\r\na\r\n:1\r\n$-1\r\n", []interface{}{"a", int64(1), nil}, ""},
+		{"nested array", "*2\r\n$1\r\n0\r\n*1\r\n$3\r\nkey\r\n", []interface{}{"0", []interface{}{"key"}}, ""},
+		{"nil array", "*-1\r\n", nil, ""},
+		{"truncated bulk", "$5\r\nhel", nil, "EOF"},
+		{"bulk longer than its length", "$2\r\nhello\r\n", nil, "longer than its length"},
+		{"oversized bulk", "$" + strconv.Itoa(RedisMaxBulk+1) + "\r\n", nil, "too long"},
+		{"oversized array", "*" + strconv.Itoa(RedisMaxArray+1) + "\r\n", nil, "too long"},
+		{"bad length", "$x\r\n", nil, "invalid syntax"},
+		{"unknown type", "!oops\r\n", nil, "unexpected reply"},
+		{"empty line", "\r\n", nil, "empty reply"},
+		{"overlong line", "+" + strings.Repeat("a", 8192) + "\r\n", nil, "buffer full"},
+		{"no line", "", nil, "EOF"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Reading a byte at a time checks replies split across reads
+			// are put back together.
+			c := &redisConn{r: bufio.NewReader(iotest.OneByteReader(strings.NewReader(tt.reply)))}
+			got, err := c.readReply()
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("error %v, want %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeRedis is a Redis server with just the commands RedisClient uses.
+type fakeRedis struct {
+	t        *testing.T
+	ln       net.Listener
+	password string
+
+	mu       sync.Mutex
+	data     map[string]string
+	commands [][]string
+	conns    []net.Conn
+	scanKeys []string
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{t: t, ln: ln, password: password, data: map[string]string{}}
+	t.Cleanup(func() {
+		ln.Close()
+		f.dropConns()
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.conns = append(f.conns, conn)
+			f.mu.Unlock()
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+// dropConns closes every connection, like the server's idle timeout.
+func (f *fakeRedis) dropConns() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, conn := range f.conns {
+		conn.Close()
+	}
+	f.conns = nil
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	// Commands are arrays of bulk strings, so the client's own reader
+	// parses them.
+	c := &redisConn{Conn: conn, r: bufio.NewReader(conn)}
+	authed := f.password == ""
+	for {
+		req, err := c.readReply()
+		if err != nil {
+			return
+		}
+		args := []string{}
+		for _, arg := range req.([]interface{}) {
+			args = append(args, arg.(string))
+		}
+		f.mu.Lock()
+		f.commands = append(f.commands, args)
+		var reply string
+		switch {
+		case args[0] == "AUTH":
+			authed = args[1] == f.password
+			reply = "+OK\r\n"
+			if !authed {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authed:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case args[0] == "SELECT":
+			reply = "+OK\r\n"
+		case args[0] == "GET":
+			if val, ok := f.data[args[1]]; ok {
+				reply = "$" + strconv.Itoa(len(val)) + "\r\n" + val + "\r\n"
+			} else {
+				reply = "$-1\r\n"
+			}
+		case args[0] == "SET":
+			f.data[args[1]] = args[2]
+			reply = "+OK\r\n"
+		case args[0] == "DEL":
+			for _, key := range args[1:] {
+				delete(f.data, key)
+			}
+			reply = ":" + strconv.Itoa(len(args)-1) + "\r\n"
+		case args[0] == "SCAN":
+			reply = f.scan(args[1], args[3])
+		default:
+			reply = "-ERR unknown command '" + args[0] + "'\r\n"
+		}
+		f.mu.Unlock()
+		if _, err = conn.Write([]byte(reply)); err != nil {
+			return
+		}
+	}
+}
+
+// scan answers SCAN one matching key at a time, so DeletePrefix has to
+// follow the cursor, with the cursor being the index of the next key among
+// those there when the scan started.
+func (f *fakeRedis) scan(cursor, pattern string) string {
+	if cursor == "0" {
+		f.scanKeys = []string{}
+		for key := range f.data {
+			f.scanKeys = append(f.scanKeys, key)
+		}
+		sort.Strings(f.scanKeys)
+	}
+	keys := f.scanKeys
+	i, _ := strconv.Atoi(cursor)
+	matched := []string{}
+	for ; i < len(keys) && len(matched) == 0; i++ {
+		if ok, _ := path.Match(pattern, keys[i]); ok {
+			matched = append(matched, keys[i])
+		}
+	}
+	next := strconv.Itoa(i)
+	if i >= len(keys) {
+		next = "0"
+	}
+	reply := "*2\r\n$" + strconv.Itoa(len(next)) + "\r\n" + next + "\r\n*" + strconv.Itoa(len(matched)) + "\r\n"
+	for _, key := range matched {
+		reply += "$" + strconv.Itoa(len(key)) + "\r\n" + key + "\r\n"
+	}
+	return reply
+}
+
+func (f *fakeRedis) sent(name string) [][]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	found := [][]string{}
+	for _, cmd := range f.commands {
+		if cmd[0] == name {
+			found = append(found, cmd)
+		}
+	}
+	return found
+}
+
+func TestNewRedisClient(t *testing.T) {
+	tests := []struct {
+		url      string
+		addr     string
+		password string
+		db       int
+		ok       bool
+	}{
+		{"redis://cache:6380", "cache:6380", "", 0, true},
+		{"redis://cache", "cache:6379", "", 0, true},
+		{"redis://:s3cret@cache/2", "cache:6379", "s3cret", 2, true},
+		{"http://cache", "", "", 0, false},
+		{"redis://cache/two", "", "", 0, false},
+	}
+	for _, tt := range tests {
+		rc, err := NewRedisClient(tt.url)
+		if (err == nil) != tt.ok {
+			t.Errorf("NewRedisClient(%q) error %v, want ok %t", tt.url, err, tt.ok)
+			continue
+		}
+		if tt.ok && (rc.addr != tt.addr || rc.password != tt.password || rc.db != tt.db) {
+			t.Errorf("NewRedisClient(%q) = %s %q %d, want %s %q %d", tt.url, rc.addr, rc.password, rc.db, tt.addr, tt.password, tt.db)
+		}
+	}
+}
+
+func TestRedisClient(t *testing.T) {
+	f := newFakeRedis(t, "s3cret")
+	rc, err := NewRedisClient("redis://:s3cret@" + f.ln.Addr().String() + "/3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = rc.Get("missing"); err != errRedisNil {
+		t.Errorf("Get of a missing key: %v, want errRedisNil", err)
+	}
+	// Values may hold anything, including what looks like protocol.
+	val := "line\r\n$3\r\nnot a reply\x00"
+	if err = rc.Set("summary|a", val, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := rc.Get("summary|a"); err != nil || got != val {
+		t.Errorf("Get = %q, %v; want %q", got, err, val)
+	}
+	if set := f.sent("SET"); len(set) != 1 || set[0][3] != "PX" || set[0][4] != "60000" {
+		t.Errorf("SET sent as %q", set)
+	}
+	if n := len(f.sent("AUTH")); n != 1 {
+		t.Errorf("authenticated %d times, want once on the one connection", n)
+	}
+	if sel := f.sent("SELECT"); len(sel) != 1 || sel[0][1] != "3" {
+		t.Errorf("SELECT sent as %q", sel)
+	}
+
+	// Error replies leave the connection usable.
+	if _, err = rc.Do("NOPE"); err == nil || !strings.Contains(err.Error(), "unknown command") {
+		t.Errorf("error %v, want the error reply", err)
+	}
+	if _, err = rc.Get("summary|a"); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(f.sent("AUTH")); n != 1 {
+		t.Errorf("reconnected %d times after an error reply", n-1)
+	}
+
+	// An idle connection the server has closed is replaced.
+	f.dropConns()
+	if got, err := rc.Get("summary|a"); err != nil || got != val {
+		t.Errorf("Get after the connection was dropped = %q, %v", got, err)
+	}
+	if n := len(f.sent("AUTH")); n != 2 {
+		t.Errorf("authenticated %d times, want a new connection", n)
+	}
+}
+
+func TestRedisDeletePrefix(t *testing.T) {
+	f := newFakeRedis(t, "")
+	rc, err := NewRedisClient("redis://" + f.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a|user|1", "a|user|2", "a|user*|1", "a|other|1", "b|user|1"} {
+		if err = rc.Set(key, "x", time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = rc.DeletePrefix("a|user*"); err != nil {
+		t.Fatal(err)
+	}
+	if err = rc.DeletePrefix("a|user|"); err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	left := []string{}
+	for key := range f.data {
+		left = append(left, key)
+	}
+	f.mu.Unlock()
+	sort.Strings(left)
+	if want := []string{"a|other|1", "b|user|1"}; !reflect.DeepEqual(left, want) {
+		t.Errorf("left %q, want %q", left, want)
+	}
+	if scans := f.sent("SCAN"); len(scans) < 3 || scans[0][3] != `a|user\**` {
+		t.Errorf("SCAN sent as %q", scans)
+	}
+}
+
+func TestRedisUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	rc, err := NewRedisClient("redis://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = rc.Get("key"); err == nil || !strings.Contains(err.Error(), "Redis (connect)") {
+		t.Errorf("error %v, want a connect error", err)
+	}
+}
@@ -1,39 +1,192 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	re "regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/SparkPost/gosparkpost/events"
 	"github.com/SparkPost/httpdump/storage"
 	"github.com/SparkPost/httpdump/storage/pg"
-
-	"github.com/husobee/vestigo"
-	cache "github.com/patrickmn/go-cache"
+	"github.com/lib/pq"
 )
 
 const MaxMessageSize int = 8 * 1024
 
+const DefaultTable string = "relay_messages"
+
+// IndexLockKey, along with a hash of the index name, is the advisory lock
+// held while building an index in the background.
+const IndexLockKey int32 = 0x72656c69 // "reli"
+
+// identifier matches table names which are safe to interpolate into SQL, or
+// an empty string.
+var identifier *re.Regexp = re.MustCompile(`^([A-Za-z_][A-Za-z0-9_]{0,62})?$`)
+
 type RelayMsgParser struct {
 	Schema string
+	Table  string
 	Domain string
 	Dbh    *sql.DB
+	// ReadDbh, when set, is a separate connection pool for the read-only
+	// API handlers, so batch processing can't starve them of connections.
+	ReadDbh *sql.DB
+	// DumpDbh, when set, is the database holding raw_requests, if that's
+	// not the one messages are stored in.
+	DumpDbh *sql.DB
+
+	// IgnoreEvents holds event types which are skipped without logging,
+	// other than at debug level.
+	IgnoreEvents map[string]bool
+
+	// MaxParseFailures is how many unparseable payloads are kept in
+	// relay_parse_failures. Older ones are deleted as new ones arrive.
+	MaxParseFailures int
+
+	// MaxEvents, when positive, is the most events handled from a single
+	// request. The rest are skipped, so one huge payload can't take up a
+	// whole batch.
+	MaxEvents int
+
+	// MaxSubjectLen, when positive, is the most characters of a subject which
+	// are stored. The rfc822 column always has the full subject.
+	MaxSubjectLen int
+
+	// NormalizeSubjects groups messages in the subject summary by their
+	// subjects without reply and forward prefixes, runs of whitespace or
+	// case, so a conversation isn't split across groups. Subjects are
+	// still stored as received.
+	NormalizeSubjects bool
+
+	// LowercaseLocalpart lowercases the whole recipient address when it's
+	// stored and queried, rather than only the domain.
+	LowercaseLocalpart bool
+
+	// Subaddressing stores recipients with any +tag removed in smtp_to_base,
+	// and has summaries match on that instead of smtp_to.
+	Subaddressing bool
+
+	// EventPath holds the keys leading to the relay message in each event,
+	// when it isn't the usual msys.relay_message.
+	EventPath []string
+
+	// AuditHeaders names the webhook request headers kept in
+	// relay_request_headers.
+	AuditHeaders []string
+
+	// Notify sends a PostgreSQL notification for each message stored, on
+	// the channel for its recipient, and Notifier relays them to clients.
+	Notify   bool
+	Notifier *Notifier
+	// WSOrigins are the origins, besides the server's own, whose pages may
+	// open WebSockets. "*" allows any.
+	WSOrigins []string
+
+	// Outbound, when set, is sent each message once it's stored.
+	Outbound *OutboundWebhook
+
+	// Subscriptions, when set, calls the callbacks registered for each
+	// message's recipient once it's stored.
+	Subscriptions *Subscriptions
+
+	// Publisher makes each stored message available to stream consumers.
+	Publisher Publisher
+
+	// TruncateOversize stores the first MaxMessageSize bytes of larger
+	// messages, flagged with is_truncated, instead of rejecting them.
+	TruncateOversize bool
+
+	// WebhookIDs, when not empty, lists the webhooks events are expected
+	// from. Events from others are rejected, or with FlagUnknownWebhooks
+	// stored with webhook_unknown set.
+	WebhookIDs          map[string]bool
+	FlagUnknownWebhooks bool
+
+	// RecipientDomains, when not empty, lists the domains messages are
+	// accepted for. Messages to others are skipped, or with
+	// DeadLetterOtherDomains set aside as dead letters.
+	RecipientDomains       map[string]bool
+	DeadLetterOtherDomains bool
+
+	// Routes tags messages from particular webhooks with a route, stored in
+	// the route column, so each tenant's messages can be told apart.
+	Routes map[string]string
+
+	// Compress gzips message bodies of at least CompressMinBytes before
+	// they're stored. Bodies which don't get any smaller are stored as
+	// they are.
+	Compress         bool
+	CompressMinBytes int
+
+	// StoreRawEvents keeps each whole webhook event in the raw_event
+	// column, so fields which aren't otherwise stored can be queried later.
+	StoreRawEvents bool
+
+	// Bodies, when set, receives each message body, and only its key is
+	// stored in the body_key column. KeepInline also keeps the body in the
+	// rfc822 column.
+	Bodies     BodyStore
+	BodyPrefix string
+	KeepInline bool
+
+	// InlineMaxBytes, when positive, limits Bodies to bodies larger than
+	// this as stored, so smaller ones stay in the rfc822 column. Messages
+	// of MaxMessageSize or more are then kept rather than rejected.
+	InlineMaxBytes int
+
+	// DedupWindow, when positive, skips storing a message with the same
+	// sender, recipient, subject and body as one stored that recently,
+	// incrementing the earlier message's duplicate_count instead.
+	DedupWindow time.Duration
+
+	// StoreRetries is how many times an insert which fails with a transient
+	// error is attempted before the batch is abandoned.
+	StoreRetries int
+
+	// QueryTimeout limits how long API handlers wait for the database.
+	QueryTimeout time.Duration
+
+	// Relay is used to forward stored messages.
+	Relay *SMTPRelay
+
+	// AdminToken grants access to admin-only endpoints and options.
+	AdminToken string
+
+	// Redis, when set, holds summaries so they're shared between instances,
+	// for CacheTTL.
+	Redis    *RedisClient
+	CacheTTL time.Duration
+
+	// summaryCaches are the caches of the summary handlers, so entries can
+	// be dropped when messages change.
+	summaryCaches []SummaryCache
 }
 
-func SchemaInit(dbh *sql.DB, schema string) error {
+func SchemaInit(dbh *sql.DB, schema, table string) error {
 	if schema == "" {
 		schema = "request_dump"
 	}
 	if strings.Index(schema, " ") >= 0 {
 		return fmt.Errorf("SchemaInit: schemas containing a space are not supported")
 	}
+	if table == "" {
+		table = DefaultTable
+	}
+	if !identifier.MatchString(table) {
+		return fmt.Errorf("SchemaInit: unsupported table name [%s]", table)
+	}
 
 	exists, err := pg.SchemaExists(dbh, schema)
 	if err != nil {
@@ -43,182 +196,792 @@ func SchemaInit(dbh *sql.DB, schema string) error {
 		return fmt.Errorf("PostgreSQL schema [%s] does not exist - did you run httpdump/storage/pg.SchemaInit?", schema)
 	}
 
-	table := "relay_messages"
-	exists, err = pg.TableExistsInSchema(dbh, table, schema)
+	err = createTable(dbh, schema, table, []string{
+		fmt.Sprintf(`
+			CREATE TABLE IF NOT EXISTS %s.%s (
+				message_id  bigserial primary key,
+				webhook_id  text,
+				smtp_from   text,
+				smtp_to     text,
+				subject     text,
+				rfc822      bytea,
+				is_base64   bool,
+				created     timestamptz default clock_timestamp(),
+				status_id   integer default 0
+			)
+		`, schema, table),
+	})
+	if err != nil {
+		return err
+	}
+	err = createIndex(dbh, schema, table, table+"_smtp_to_smtp_from_idx", "smtp_to, smtp_from")
+	if err != nil {
+		return err
+	}
+
+	// Columns added since the table was first created.
+	err = addColumns(dbh, schema, table, []string{
+		"request_id text",
+		"body_key text",
+		"is_compressed bool default false",
+		"auth_spf text",
+		"auth_dkim text",
+		"auth_dmarc text",
+		"auth_results text",
+		"spam_score real",
+		"text_body text",
+		"html_body text",
+		"smtp_to_base text",
+		"is_truncated bool default false",
+		"webhook_unknown bool default false",
+		"size_bytes integer",
+		"has_body bool default true",
+		"metadata jsonb",
+		"content_hash text",
+		"duplicate_count integer default 0",
+		"from_name text",
+		"to_name text",
+		"raw_event jsonb",
+		"thread_id text",
+		"route text",
+	})
+	if err != nil {
+		return err
+	}
+	err = createIndex(dbh, schema, table, table+"_smtp_from_created_idx", "lower(smtp_from), created")
+	if err != nil {
+		return err
+	}
+	err = createIndex(dbh, schema, table, table+"_content_hash_idx", "content_hash, created")
+	if err != nil {
+		return err
+	}
+	err = createIndex(dbh, schema, table, table+"_smtp_to_thread_idx", "smtp_to, thread_id")
+	if err != nil {
+		return err
+	}
+	err = createIndex(dbh, schema, table, table+"_smtp_to_base_idx", "smtp_to_base")
+	if err != nil {
+		return err
+	}
+	// Reads for a recipient filter and sort on created, as timelines,
+	// exports and since/until ranges do, so a busy recipient's messages are
+	// range scanned rather than all read and sorted.
+	err = createIndex(dbh, schema, table, table+"_smtp_to_created_idx", "smtp_to, created")
+	if err != nil {
+		return err
+	}
+	err = createIndex(dbh, schema, table, table+"_smtp_to_base_created_idx", "smtp_to_base, created")
+	if err != nil {
+		return err
+	}
+	err = createIndex(dbh, schema, table, table+"_route_created_idx", "route, created")
+	if err != nil {
+		return err
+	}
+	// Message lists page by (created, message_id), newest first, so each
+	// page after the first starts with an index seek.
+	err = createIndex(dbh, schema, table, table+"_created_message_id_idx", "created DESC, message_id DESC")
+	if err != nil {
+		return err
+	}
+
+	err = createTable(dbh, schema, "relay_parse_failures", []string{
+		fmt.Sprintf(`
+			CREATE TABLE IF NOT EXISTS %s.%s (
+				failure_id  bigserial primary key,
+				payload     bytea,
+				error       text,
+				created     timestamptz default clock_timestamp()
+			)
+		`, schema, "relay_parse_failures"),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = createTable(dbh, schema, HeadersTable, []string{
+		fmt.Sprintf(`
+			CREATE TABLE IF NOT EXISTS %s.%s (
+				request_id  text primary key,
+				headers     jsonb,
+				received    timestamptz,
+				created     timestamptz default clock_timestamp()
+			)
+		`, schema, HeadersTable),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = createTable(dbh, schema, DeadLetterTable, []string{
+		fmt.Sprintf(`
+			CREATE TABLE IF NOT EXISTS %s.%s (
+				dead_letter_id  bigserial primary key,
+				request_id      text,
+				payload         bytea,
+				error           text,
+				created         timestamptz default clock_timestamp()
+			)
+		`, schema, DeadLetterTable),
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// requestContext returns a context for database calls made while handling r,
+// which is cancelled if the client goes away or QueryTimeout passes.
+func (p *RelayMsgParser) requestContext(r *http.Request) (context.Context, context.CancelFunc) {
+	if p.QueryTimeout > 0 {
+		return context.WithTimeout(r.Context(), p.QueryTimeout)
+	}
+	return context.WithCancel(r.Context())
+}
+
+// sharedContext is like requestContext, but isn't cancelled when r's
+// client goes away or r's handler returns, for work whose result other
+// requests are waiting for too.
+func (p *RelayMsgParser) sharedContext(r *http.Request) (context.Context, context.CancelFunc) {
+	ctx := context.WithoutCancel(r.Context())
+	if p.QueryTimeout > 0 {
+		return context.WithTimeout(ctx, p.QueryTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// ReadDB returns the connection pool to use for API reads.
+func (p *RelayMsgParser) ReadDB() *sql.DB {
+	if p.ReadDbh != nil {
+		return p.ReadDbh
+	}
+	return p.Dbh
+}
+
+// DumpDB returns the database holding the raw requests.
+func (p *RelayMsgParser) DumpDB() *sql.DB {
+	if p.DumpDbh != nil {
+		return p.DumpDbh
+	}
+	return p.Dbh
+}
+
+// MsgTable returns the schema-qualified name of the table messages are
+// stored in.
+func (p *RelayMsgParser) MsgTable() string {
+	table := p.Table
+	if table == "" {
+		table = DefaultTable
+	}
+	return p.Schema + "." + table
+}
+
+// createSchema creates schema unless it already exists. raw_requests'
+// schema is created by pg.SchemaInit; this is for a separate message
+// database.
+func createSchema(dbh *sql.DB, schema string) error {
+	_, err := dbh.Exec(fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s", schema))
+	if err != nil && !isDuplicateObject(err) {
+		return fmt.Errorf("SchemaInit (schema): %s", err)
+	}
+	return nil
+}
+
+// createTable runs ddls to create table in schema, unless it already exists.
+// Another instance may be doing the same thing at the same time, so the DDL
+// should use IF NOT EXISTS, and errors saying an object already exists are
+// ignored.
+func createTable(dbh *sql.DB, schema, table string, ddls []string) error {
+	exists, err := pg.TableExistsInSchema(dbh, table, schema)
 	if err != nil {
 		return err
 	}
 	if exists == false {
 		log.Printf("SchemaInit: creating table [%s.%s]\n", schema, table)
-		ddls := []string{
-			fmt.Sprintf(`
-				CREATE TABLE %s.%s (
-					message_id  bigserial primary key,
-					webhook_id  text,
-					smtp_from   text,
-					smtp_to     text,
-					subject     text,
-					rfc822      bytea,
-					is_base64   bool,
-					created     timestamptz default clock_timestamp(),
-					status_id   integer default 0
-				)
-			`, schema, table),
-			fmt.Sprintf("CREATE INDEX %s_smtp_to_smtp_from_idx ON %s.%s (smtp_to, smtp_from)",
-				table, schema, table),
-		}
 		for _, ddl := range ddls {
 			_, err := dbh.Exec(ddl)
-			if err != nil {
+			if err != nil && !isDuplicateObject(err) {
 				return fmt.Errorf("SchemaInit: %s", err)
 			}
 		}
 	}
+	return nil
+}
+
+// isDuplicateObject reports whether err is PostgreSQL complaining that an
+// object being created already exists. Concurrent CREATE ... IF NOT EXISTS
+// statements can also fail with a unique violation on the system catalogs.
+func isDuplicateObject(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	if !ok {
+		return false
+	}
+	switch pqErr.Code {
+	case "42P07", // duplicate_table
+		"42710", // duplicate_object
+		"42P06", // duplicate_schema
+		"23505": // unique_violation
+		return true
+	}
+	return false
+}
+
+// createIndex creates an index on cols of table, unless a valid one already
+// exists. Building an index on a large table takes a while and blocks
+// writes, so when the table already has rows the index is built with CREATE
+// INDEX CONCURRENTLY in the background instead, and errors are only logged.
+func createIndex(dbh *sql.DB, schema, table, name, cols string) error {
+	var valid sql.NullBool
+	err := dbh.QueryRow(`
+		SELECT i.indisvalid
+		  FROM pg_index i
+		  JOIN pg_class c ON c.oid = i.indexrelid
+		  JOIN pg_namespace n ON n.oid = c.relnamespace
+		 WHERE n.nspname = $1 AND c.relname = $2
+	`, schema, name).Scan(&valid)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("SchemaInit (index): %s", err)
+	}
+	if valid.Bool {
+		return nil
+	}
+
+	var populated bool
+	err = dbh.QueryRow(fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %s.%s)", schema, table)).Scan(&populated)
+	if err != nil {
+		return fmt.Errorf("SchemaInit (index): %s", err)
+	}
+	if !populated && !valid.Valid {
+		_, err = dbh.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s.%s (%s)", name, schema, table, cols))
+		if err != nil && !isDuplicateObject(err) {
+			return fmt.Errorf("SchemaInit: %s", err)
+		}
+		return nil
+	}
+
+	go func() {
+		// Only one instance builds the index; an invalid index might be
+		// another instance's build in progress.
+		ctx := context.Background()
+		conn, err := dbh.Conn(ctx)
+		if err != nil {
+			log.Printf("SchemaInit (index): %s\n", err)
+			return
+		}
+		defer conn.Close()
+		var locked bool
+		err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1, hashtext($2))",
+			IndexLockKey, schema+"."+name).Scan(&locked)
+		if err != nil || !locked {
+			return
+		}
+		defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1, hashtext($2))", IndexLockKey, schema+"."+name)
+
+		log.Printf("SchemaInit: building index [%s.%s] in the background\n", schema, name)
+		// A failed concurrent build leaves an invalid index behind, which
+		// has to be dropped before trying again.
+		drop := fmt.Sprintf("DROP INDEX CONCURRENTLY IF EXISTS %s.%s", schema, name)
+		if valid.Valid {
+			if _, err := conn.ExecContext(ctx, drop); err != nil {
+				log.Printf("SchemaInit (index): %s\n", err)
+				return
+			}
+		}
+		_, err = conn.ExecContext(ctx, fmt.Sprintf("CREATE INDEX CONCURRENTLY IF NOT EXISTS %s ON %s.%s (%s)",
+			name, schema, table, cols))
+		if err != nil {
+			log.Printf("SchemaInit (index): building [%s.%s]: %s\n", schema, name, err)
+			if _, err = conn.ExecContext(ctx, drop); err != nil {
+				log.Printf("SchemaInit (index): %s\n", err)
+			}
+			return
+		}
+		log.Printf("SchemaInit: built index [%s.%s]\n", schema, name)
+	}()
+	return nil
+}
 
+// addColumns adds any of the given column definitions which don't exist yet
+// to an existing table.
+func addColumns(dbh *sql.DB, schema, table string, cols []string) error {
+	for _, col := range cols {
+		_, err := dbh.Exec(fmt.Sprintf("ALTER TABLE %s.%s ADD COLUMN IF NOT EXISTS %s",
+			schema, table, col))
+		if err != nil && !isDuplicateObject(err) {
+			return fmt.Errorf("SchemaInit: %s", err)
+		}
+	}
 	return nil
 }
 
-// ProcessBatches splits webhook payloads into individual events and stores
+// DefaultMaxEvents is how many events are handled from each request, unless
+// configured otherwise. SparkPost sends at most a few hundred at a time.
+const DefaultMaxEvents int = 10000
+
+// errTooManyEvents stops reading a payload once MaxEvents have been handled.
+var errTooManyEvents = errors.New("too many events")
+
+// ProcessRequests splits webhook payloads into individual events and stores
 // data about each message in the relay_messages table.
 func (p *RelayMsgParser) ProcessRequests(reqs []storage.Request) error {
+	_, err := p.ProcessRequestsContext(context.Background(), reqs)
+	return err
+}
+
+// ProcessRequestsContext is like ProcessRequests, stopping early when ctx is
+// done, and reports what was done with the requests. Each request is
+// checkpointed once it's been handled, so an interrupted batch can resume
+// after it.
+func (p *RelayMsgParser) ProcessRequestsContext(ctx context.Context, reqs []storage.Request) (*BatchStats, error) {
 	log.Printf("ProcessRequests called with %d requests\n", len(reqs))
+	st := &BatchStats{Requests: len(reqs), IgnoredByType: map[string]int{}}
+	resumed, err := p.resumedRequests(ctx, reqs)
+	if err != nil {
+		return st, fmt.Errorf("ProcessRequests (resumed): %w: %s", ErrTransientDB, err)
+	}
 	for i, req := range reqs {
-		var events []*json.RawMessage
-		err := json.Unmarshal([]byte(req.Data), &events)
-		if err != nil {
-			log.Printf("ProcessRequests failed to parse JSON:\n%s\n", req.Data)
-		} else {
-			log.Printf("ProcessRequests found %d events from request %d\n", len(events), i)
-			for _, event := range events {
-				err := p.ParseEvent(event)
-				if err != nil {
+		reqID := RequestID(&req)
+		// Messages stored from a request before its batch stopped are
+		// skipped when it's resumed.
+		ectx := ctx
+		if req.ID != nil && resumed[*req.ID] {
+			ectx = withResumed(ctx)
+		}
+		p.RecordHeaders(ctx, &req, reqID)
+		// abort is set when an event fails in a way which should fail the
+		// whole batch, rather than the payload being unparseable.
+		var abort error
+		n := 0
+		err := EachEvent(req.Data, func(event *json.RawMessage) error {
+			if p.MaxEvents > 0 && n >= p.MaxEvents {
+				return errTooManyEvents
+			}
+			n++
+			st.Events++
+			typ := p.eventType(event)
+			if typ != "relay_message" {
+				st.Ignored++
+				st.IgnoredByType[typ]++
+				if p.IgnoreEvents[typ] {
+					Debugf("ProcessRequests ignored %s event\n", typ)
+				} else {
+					log.Printf("ParseEvent ignored event: %s\n", string(*event))
+				}
+				return nil
+			}
+			st.Parsed++
+			err := p.ParseEvent(ectx, event, reqID)
+			if errors.Is(err, ErrParse) {
+				// Already recorded as a failure; nothing to retry.
+				st.Failed++
+				return nil
+			} else if errors.Is(err, ErrDuplicate) {
+				st.Duplicates++
+				return nil
+			} else if errors.Is(err, ErrOtherDomain) && !p.DeadLetterOtherDomains {
+				Debugf("%s\n", err)
+				st.OtherDomains++
+				return nil
+			} else if err != nil && shouldDeadLetter(ctx, err) {
+				if derr := p.DeadLetter(ctx, event, reqID, err); derr != nil {
+					log.Printf("%s\n", derr)
+					abort = err
 					return err
 				}
+				st.DeadLettered++
+				return nil
+			} else if err != nil {
+				abort = err
+				return err
 			}
+			st.Stored++
+			return nil
+		})
+		if abort != nil {
+			return st, abort
+		} else if errors.Is(err, errTooManyEvents) {
+			log.Printf("ProcessRequests skipped events after the first %d [req %s]\n", n, reqID)
+			st.Truncated++
+		} else if err != nil {
+			// Events before the malformed part of the payload have been
+			// handled; the whole payload is kept as a failure.
+			log.Printf("ProcessRequests failed to parse JSON after %d events [req %s]:\n%s\n", n, reqID, req.Data)
+			p.RecordFailure(ctx, req.Data, err)
+			st.Failed++
+			p.checkpoint(ctx, &req)
+			continue
 		}
+		p.checkpoint(ctx, &req)
+		Debugf("ProcessRequests found %d events in request %d [req %s]\n", n, i, reqID)
 	}
-	return nil
+	log.Printf("ProcessRequests processed %d, dead-lettered %d, duplicates %d, ignored %d by type %v\n",
+		st.Stored, st.DeadLettered, st.Duplicates, st.Ignored, st.IgnoredByType)
+	return st, nil
+}
+
+// EachEvent calls fn with each event in a webhook payload, in order,
+// stopping at the first error fn returns. Payloads are normally an array of
+// events, but some sources post a single event object, which is treated as
+// an array of one. Events are decoded one at a time, so the memory used
+// doesn't grow with the number in the payload.
+func EachEvent(data []byte, fn func(*json.RawMessage) error) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	trimmed := bytes.TrimLeft(data, " \t\r\n")
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		event := &json.RawMessage{}
+		if err := dec.Decode(event); err != nil {
+			return err
+		}
+		if err := expectEOF(dec); err != nil {
+			return err
+		}
+		return fn(event)
+	}
+
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	} else if tok == nil {
+		return expectEOF(dec)
+	} else if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return fmt.Errorf("EachEvent: expected an array of events")
+	}
+	for dec.More() {
+		event := &json.RawMessage{}
+		if err = dec.Decode(event); err != nil {
+			return err
+		}
+		if err = fn(event); err != nil {
+			return err
+		}
+	}
+	if _, err = dec.Token(); err != nil {
+		return err
+	}
+	return expectEOF(dec)
 }
 
-var relayMsg *re.Regexp = re.MustCompile(`^\s*\{\s*"msys"\s*:\s*{\s*"relay_message"\s*:`)
+// expectEOF makes sure nothing but whitespace follows the payload.
+func expectEOF(dec *json.Decoder) error {
+	if _, err := dec.Token(); err != io.EOF {
+		return fmt.Errorf("EachEvent: unexpected data after events")
+	}
+	return nil
+}
 
-func (p *RelayMsgParser) ParseEvent(j *json.RawMessage) error {
+// EventType returns the type of a webhook event: the key under "msys", or
+// for keys like "message_event" which group several types, the "type" field
+// inside it. It returns "unknown" for events it can't make sense of.
+func EventType(j *json.RawMessage) string {
 	if j == nil {
+		return "unknown"
+	}
+	var blob map[string]map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(*j), &blob); err != nil {
+		return "unknown"
+	}
+	msys := blob["msys"]
+	if _, ok := msys["relay_message"]; ok {
+		return "relay_message"
+	}
+	if len(msys) != 1 {
+		return "unknown"
+	}
+	for key, raw := range msys {
+		var inner struct {
+			Type string `json:"type"`
+		}
+		if json.Unmarshal(raw, &inner) == nil && inner.Type != "" {
+			return inner.Type
+		}
+		return key
+	}
+	return "unknown"
+}
+
+// extractBodies finds the first text/plain and text/html parts of a message,
+// returning NULL for either which is missing.
+func extractBodies(msg *events.RelayMessage) (textBody, htmlBody interface{}) {
+	raw, err := DecodeRFC822([]byte(msg.Content.Email), msg.Content.Base64)
+	if err != nil {
+		log.Printf("extractBodies (base64): message from %s: %s\n", msg.From, err)
+		return nil, nil
+	}
+	// PostgreSQL text can't hold NUL characters.
+	if text, found, err := FindBodyPart(raw, "text/plain"); err == nil && found {
+		textBody = strings.Replace(text, "\x00", "", -1)
+	}
+	if html, found, err := FindBodyPart(raw, "text/html"); err == nil && found {
+		htmlBody = strings.Replace(html, "\x00", "", -1)
+	}
+	return textBody, htmlBody
+}
+
+// TruncateRunes shortens s to at most max characters, ending with an
+// ellipsis when anything was cut. It never splits a multibyte character.
+// A max of zero or less means no limit.
+func TruncateRunes(s string, max int) string {
+	if max <= 0 || utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	runes := []rune(s)
+	return string(runes[:max-1]) + "…"
+}
+
+// TruncateMessage cuts a message down to MaxMessageSize bytes. Base64
+// encoded messages are cut at a multiple of four characters, so what's left
+// can still be decoded.
+func TruncateMessage(email string, isBase64 bool) string {
+	if len(email) <= MaxMessageSize {
+		return email
+	}
+	n := MaxMessageSize
+	if isBase64 {
+		n -= n % 4
+	}
+	return email[:n]
+}
+
+// nullString maps empty strings to NULL for insertion.
+func nullString(s string) interface{} {
+	if s == "" {
 		return nil
 	}
+	return s
+}
 
-	idx := relayMsg.FindStringIndex(string(*j))
-	if len(idx) == 0 || idx[0] < 0 {
-		log.Printf("ParseEvent ignored event: %s\n", string(*j))
+// ParseEvent stores the relay message in j. reqID identifies the webhook
+// request the event arrived in. Every key under "msys" is looked at, in
+// whatever order they appear; only relay_message is stored, and others are
+// ignored.
+func (p *RelayMsgParser) ParseEvent(ctx context.Context, j *json.RawMessage, reqID string) error {
+	if j == nil {
 		return nil
 	}
+	if len(p.EventPath) > 0 {
+		return p.parseEventAtPath(ctx, j, reqID)
+	}
 
-	var blob map[string]map[string]events.RelayMessage
+	var blob map[string]json.RawMessage
+	var msys map[string]json.RawMessage
 	err := json.Unmarshal([]byte(*j), &blob)
-	if err != nil {
-		log.Printf("ParseEvent failed to parse JSON:\n%s\n", string(*j))
-	} else {
-		msys, ok := blob["msys"]
+	if err == nil {
+		raw, ok := blob["msys"]
 		if !ok {
 			log.Printf("ParseEvent ignored event with no \"msys\" key: %s\n", string(*j))
 			return nil
 		}
-		msg, ok := msys["relay_message"]
-		if !ok {
-			log.Printf("ParseEvent ignored event with no \"relay_message\" key: %s\n", string(*j))
-			return nil
-		}
-		log.Printf("%s => %s (%s)\n", msg.From, msg.To, msg.WebhookID)
+		err = json.Unmarshal(raw, &msys)
+	}
+	if err != nil {
+		return p.parseFailure(ctx, j, reqID, err)
+	}
 
-		err := p.StoreEvent(&msg)
-		if err != nil {
+	keys := make([]string, 0, len(msys))
+	for key := range msys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	stored := false
+	for _, key := range keys {
+		if key != "relay_message" {
+			Debugf("ParseEvent ignored %q key [req %s]\n", key, reqID)
+			continue
+		}
+		var msg RelayMessage
+		if err = json.Unmarshal(msys[key], &msg); err != nil {
+			return p.parseFailure(ctx, j, reqID, err)
+		}
+		msg.Event = *j
+		Debugf("%s => %s (%s) [req %s]\n", msg.From, msg.To, msg.WebhookID, reqID)
+		if err = p.StoreEvent(ctx, &msg, reqID); err != nil {
 			return err
 		}
+		stored = true
+	}
+	if !stored {
+		log.Printf("ParseEvent ignored event with no \"relay_message\" key: %s\n", string(*j))
 	}
 	return nil
 }
 
-func (p *RelayMsgParser) StoreEvent(msg *events.RelayMessage) error {
-	if len(msg.Content.Email) >= MaxMessageSize {
-		return fmt.Errorf("StoreEvent (size): ignoring message from %s, size %d\n",
-			msg.From, len(msg.Content.Email))
-	}
-	_, err := p.Dbh.Exec(fmt.Sprintf(`
-		INSERT INTO %s.relay_messages (
-			webhook_id, smtp_from, smtp_to,
-			subject, rfc822, is_base64
-		) VALUES ($1, $2, $3, $4, $5, $6)
-	`, p.Schema),
-		msg.WebhookID, msg.From, msg.To,
-		msg.Content.Subject, msg.Content.Email, msg.Content.Base64)
-	if err != nil {
-		return fmt.Errorf("StoreEvent (INSERT): %s", err)
-	}
-	return nil
+// parseFailure records an event which couldn't be parsed, returning an
+// error wrapping ErrParse.
+func (p *RelayMsgParser) parseFailure(ctx context.Context, j *json.RawMessage, reqID string, err error) error {
+	log.Printf("ParseEvent failed to parse JSON [req %s]:\n%s\n", reqID, string(*j))
+	p.RecordFailure(ctx, []byte(*j), err)
+	return fmt.Errorf("ParseEvent [req %s]: %w: %s", reqID, ErrParse, err)
 }
 
-type SummaryResponse struct {
-	Subject string `json:"subject"`
-	Count   int    `json:"count"`
+// offloadsLarge reports whether large bodies are moved to Bodies, leaving
+// only smaller ones inline.
+func (p *RelayMsgParser) offloadsLarge() bool {
+	return p.Bodies != nil && p.InlineMaxBytes > 0
 }
 
-func (p *RelayMsgParser) SummaryHandler() http.HandlerFunc {
-	// Initialize cache container with 1 second TTL, checks running twice a second.
-	c := cache.New(1*time.Second, 500*time.Millisecond)
-	return func(w http.ResponseWriter, r *http.Request) {
-		localpart := vestigo.Param(r, "localpart")
+func (p *RelayMsgParser) StoreEvent(ctx context.Context, msg *RelayMessage, reqID string) error {
+	unknownWebhook := len(p.WebhookIDs) > 0 && !p.WebhookIDs[msg.WebhookID]
+	if unknownWebhook {
+		if !p.FlagUnknownWebhooks {
+			return fmt.Errorf("StoreEvent (webhook): %w: rejecting message from %s with webhook_id %q [req %s]",
+				ErrUnknownWebhook, msg.From, msg.WebhookID, reqID)
+		}
+		log.Printf("StoreEvent (webhook): flagging message from %s with unrecognized webhook_id %q [req %s]\n",
+			msg.From, msg.WebhookID, reqID)
+	}
+
+	if len(p.RecipientDomains) > 0 && !p.RecipientDomains[addressDomain(msg.To)] {
+		return fmt.Errorf("StoreEvent (domain): %w: ignoring message from %s to %s [req %s]",
+			ErrOtherDomain, msg.From, msg.To, reqID)
+	}
 
-		// Check cache first
-		jsonUntyped, found := c.Get(localpart)
-		if found {
-			jsonBytes := jsonUntyped.([]byte)
-			log.Printf("SummarizeEvents (cache): hit for [%s]", localpart)
-			w.Write(jsonBytes)
-			return
+	truncated := false
+	if len(msg.Content.Email) >= MaxMessageSize && !p.offloadsLarge() {
+		if !p.TruncateOversize {
+			return fmt.Errorf("StoreEvent (size): %w: ignoring message from %s, size %d [req %s]",
+				ErrOversized, msg.From, len(msg.Content.Email), reqID)
 		}
+		log.Printf("StoreEvent (size): truncating message from %s, size %d [req %s]\n",
+			msg.From, len(msg.Content.Email), reqID)
+		msg.Content.Email = TruncateMessage(msg.Content.Email, msg.Content.Base64)
+		truncated = true
+	}
 
-		rows, err := p.Dbh.Query(fmt.Sprintf(`
-			SELECT subject, count(distinct(smtp_from))
-				FROM %s.relay_messages
-			 WHERE smtp_to = $1 ||'@'|| $2
-			 GROUP BY 1
-		`, p.Schema), localpart, p.Domain)
+	to := NormalizeAddress(msg.To, p.LowercaseLocalpart)
+	contentHash := ContentHash(msg.From, to, msg.Content.Subject, msg.Content.Email)
+	if isResumed(ctx) && reqID != "" {
+		stored, err := p.storedBefore(ctx, reqID, contentHash)
 		if err != nil {
-			log.Printf("SummarizeEvents (SELECT): %s", err)
-			http.Error(w, "Database error", http.StatusInternalServerError)
-			return
+			return storeError("resume", reqID, err)
+		} else if stored {
+			Debugf("StoreEvent: skipping message from %s to %s stored before the batch stopped [req %s]\n", msg.From, to, reqID)
+			return fmt.Errorf("StoreEvent: %w: from %s to %s, already stored [req %s]", ErrDuplicate, msg.From, to, reqID)
+		}
+	}
+	if p.DedupWindow > 0 {
+		dup, err := p.countDuplicate(ctx, contentHash)
+		if err != nil {
+			return storeError("dedup", reqID, err)
+		} else if dup {
+			Debugf("StoreEvent: skipping repeat of a recent message from %s to %s [req %s]\n", msg.From, to, reqID)
+			return fmt.Errorf("StoreEvent: %w: from %s to %s [req %s]", ErrDuplicate, msg.From, to, reqID)
 		}
-		defer rows.Close()
+	}
 
-		res := map[string][]SummaryResponse{}
-		for rows.Next() {
-			if rows.Err() == io.EOF {
-				break
-			}
-			s := SummaryResponse{}
-			if err = rows.Scan(&s.Subject, &s.Count); err != nil {
-				log.Printf("SummarizeEvents (Scan): %s", err)
-				http.Error(w, "Database error", http.StatusInternalServerError)
-				return
-			}
-			res["results"] = append(res["results"], s)
+	// Relay webhooks may be set up to send only the headers, in which case
+	// there's nothing to compress, upload or extract bodies from.
+	hasBody := msg.Content.Email != ""
+	if !hasBody {
+		Debugf("StoreEvent: message from %s has no body [req %s]\n", msg.From, reqID)
+	}
+
+	var rfc822 interface{} = msg.Content.Email
+	body := []byte(msg.Content.Email)
+	compressed := false
+	if p.Compress && hasBody {
+		zbody, ok, err := compressBody(body, p.CompressMinBytes)
+		if err != nil {
+			return fmt.Errorf("StoreEvent (gzip) [req %s]: %s", reqID, err)
 		}
-		if err = rows.Err(); err != nil {
-			log.Printf("SummarizeEvents (Err): %s", err)
-			http.Error(w, "Database error", http.StatusInternalServerError)
-			return
+		if ok {
+			rfc822, body, compressed = zbody, zbody, true
 		}
+	}
 
-		jsonBytes, err := json.Marshal(res)
-		if err != nil {
-			log.Printf("SummarizeEvents (JSON): %s", err)
-			http.Error(w, "Encoding error", http.StatusInternalServerError)
-			return
+	var bodyKey interface{}
+	if p.Bodies != nil && hasBody && len(body) > p.InlineMaxBytes {
+		key := p.BodyPrefix + NewRequestID() + ".eml"
+		if err := p.Bodies.Put(key, body); err != nil {
+			return storeError("body", reqID, err)
 		}
+		bodyKey = key
+		if !p.KeepInline {
+			rfc822 = nil
+		}
+	}
+
+	auth := ParseAuthResults(msg.Content.Headers)
+	subject := msg.Content.Subject
+	if subject == "" {
+		subject = headerValue(msg.Content.Headers, "Subject")
+	}
+	subject = TruncateRunes(subject, p.MaxSubjectLen)
+	textBody, htmlBody := extractBodies(&msg.RelayMessage)
+	fromName, toName := DisplayNames(msg.Content.Headers, msg.To)
+	threadKey := ThreadKey(msg.Content.Headers)
+	var rawEvent interface{}
+	if p.StoreRawEvents {
+		rawEvent = msg.EventJSON()
+	}
+	metadata, err := msg.MetadataJSON()
+	if err != nil {
+		return fmt.Errorf("StoreEvent (metadata) [req %s]: %s", reqID, err)
+	}
+	var toBase interface{}
+	if p.Subaddressing {
+		toBase = BaseAddress(to)
+	}
 
-		// Add result to cache
-		c.Set(localpart, jsonBytes, cache.DefaultExpiration)
+	query := fmt.Sprintf(`
+		INSERT INTO %s (
+			webhook_id, smtp_from, smtp_to,
+			subject, rfc822, is_base64, request_id, body_key,
+			is_compressed, auth_spf, auth_dkim, auth_dmarc,
+			auth_results, spam_score, text_body, html_body,
+			smtp_to_base, is_truncated, webhook_unknown, size_bytes,
+			has_body, metadata, content_hash, from_name, to_name,
+			raw_event, thread_id, route
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14,
+			$15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26, $27, $28)
+		RETURNING message_id, created
+	`, p.MsgTable())
+	item := &MessageListItem{From: msg.From, To: to, ToBase: to, Subject: subject,
+		FromName: fromName, ToName: toName}
+	if p.Subaddressing {
+		item.ToBase = toBase.(string)
+	}
+	// Retry through brief outages like a failover, rather than failing the
+	// whole batch.
+	err = retry(ctx, "StoreEvent (INSERT)", p.StoreRetries, func() error {
+		return p.Dbh.QueryRowContext(ctx, query,
+			msg.WebhookID, msg.From, to,
+			subject, rfc822, msg.Content.Base64, reqID, bodyKey,
+			compressed, nullString(auth.SPF), nullString(auth.DKIM), nullString(auth.DMARC),
+			nullString(auth.Raw), auth.SpamScore, textBody, htmlBody,
+			toBase, truncated, unknownWebhook, len(msg.Content.Email),
+			hasBody, metadata, contentHash, fromName, toName,
+			rawEvent, threadKey, p.routeFor(msg.WebhookID)).Scan(&item.ID, &item.Created)
+	})
+	if err != nil {
+		return storeError("INSERT", reqID, err)
+	}
+	if key, ok := threadKey.(string); ok {
+		item.Thread = key
+	} else {
+		item.Thread = strconv.FormatInt(item.ID, 10)
+	}
 
-		w.Write(jsonBytes)
+	if p.Notify {
+		p.NotifyStored(ctx, item)
+	}
+	if p.Outbound != nil {
+		out := &OutboundMessage{MessageListItem: *item, WebhookID: msg.WebhookID, RequestID: reqID}
+		if p.Outbound.IncludeBody && hasBody {
+			if raw, err := DecodeRFC822([]byte(msg.Content.Email), msg.Content.Base64); err == nil {
+				out.RFC822 = string(raw)
+			}
+		}
+		p.Outbound.Enqueue(out)
+	}
+	if p.Subscriptions != nil {
+		p.Subscriptions.Enqueue(item)
 	}
+	if p.Publisher != nil {
+		p.Publisher.Publish(&StreamMessage{ID: item.ID, WebhookID: msg.WebhookID,
+			From: item.From, To: item.To, Subject: item.Subject, Created: item.Created,
+			Size: len(msg.Content.Email)})
+	}
+	return nil
 }
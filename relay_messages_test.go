@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SparkPost/httpdump/storage"
+)
+
+// relayEvent returns a webhook event holding a relay message, with email as
+// its whole RFC822 body.
+func relayEvent(t testing.TB, from, to, subject, email string) *json.RawMessage {
+	t.Helper()
+	event := map[string]interface{}{"msys": map[string]interface{}{
+		"relay_message": map[string]interface{}{
+			"msg_from":   from,
+			"rcpt_to":    to,
+			"webhook_id": "1234567890",
+			"content": map[string]interface{}{
+				"subject":                subject,
+				"email_rfc822":           email,
+				"email_rfc822_is_base64": false,
+				"headers":                []map[string]string{{"Subject": subject}},
+			},
+		},
+	}}
+	data, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := json.RawMessage(data)
+	return &raw
+}
+
+// insertedValue returns the value an INSERT gave col, if it named it.
+func insertedValue(q fakeQuery, col string) (driver.Value, bool) {
+	start := strings.Index(q.SQL, "(")
+	end := strings.Index(q.SQL, ")")
+	if start < 0 || end < start {
+		return nil, false
+	}
+	for i, name := range strings.Split(q.SQL[start+1:end], ",") {
+		if strings.TrimSpace(name) == col {
+			return q.Args[i], true
+		}
+	}
+	return nil, false
+}
+
+// storedColumn returns the value col was given by each INSERT of a message.
+func storedColumn(t testing.TB, db *fakeDB, col string) []driver.Value {
+	t.Helper()
+	vals := []driver.Value{}
+	for _, q := range db.Queries("RETURNING message_id, created") {
+		val, ok := insertedValue(q, col)
+		if !ok {
+			t.Fatalf("no %s column in %s", col, q.SQL)
+		}
+		vals = append(vals, val)
+	}
+	return vals
+}
+
+// readFixture returns the contents of a file in testdata.
+func readFixture(t testing.TB, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// processFixture runs a batch of one request, with a fixture as its payload.
+func processFixture(t testing.TB, p *RelayMsgParser, name string) (*BatchStats, *testServer) {
+	t.Helper()
+	ts := newTestServer(t, p, nil, storeRows)
+	st, err := p.ProcessRequestsContext(context.Background(), []storage.Request{{Data: readFixture(t, name)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st, ts
+}
+
+func TestEachEvent(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		events  int
+		ok      bool
+	}{
+		{"array", `[{"a":1},{"b":2}]`, 2, true},
+		{"empty array", `[]`, 0, true},
+		{"null", `null`, 0, true},
+		{"single object", `{"a":1}`, 1, true},
+		{"single object with whitespace", " \r\n\t{\"a\":1}\n", 1, true},
+		{"object then data", `{"a":1} {"b":2}`, 0, false},
+		{"array then data", `[{"a":1}] []`, 1, false},
+		{"string", `"event"`, 0, false},
+		{"truncated", `[{"a":1},{"b":`, 1, false},
+	}
+	for _, tt := range tests {
+		events := 0
+		err := EachEvent([]byte(tt.payload), func(*json.RawMessage) error {
+			events++
+			return nil
+		})
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: error %v, want ok %t", tt.name, err, tt.ok)
+		}
+		if events != tt.events {
+			t.Errorf("%s: %d events, want %d", tt.name, events, tt.events)
+		}
+	}
+}
+
+// TestEachEventMemory checks the memory held while events are handled
+// doesn't grow with the number in the payload, as it would if they were all
+// decoded up front.
+func TestEachEventMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds large payloads")
+	}
+	const limit = 1 << 20
+	tests := []struct {
+		events int
+	}{
+		{1000},
+		{10000},
+		{40000},
+	}
+	for _, tt := range tests {
+		payload := batchPayload(t, tt.events)
+		var ms runtime.MemStats
+		// Twice, to free json.Marshal's pooled buffer as well.
+		runtime.GC()
+		runtime.GC()
+		runtime.ReadMemStats(&ms)
+		base, peak := ms.HeapAlloc, uint64(0)
+		n := 0
+		err := EachEvent(payload, func(*json.RawMessage) error {
+			n++
+			if n%(tt.events/10) == 0 {
+				runtime.GC()
+				runtime.ReadMemStats(&ms)
+				if ms.HeapAlloc > base && ms.HeapAlloc-base > peak {
+					peak = ms.HeapAlloc - base
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != tt.events {
+			t.Errorf("%d events, want %d", n, tt.events)
+		}
+		if peak > limit {
+			t.Errorf("%d events (%d bytes): heap grew by %d bytes, want at most %d",
+				tt.events, len(payload), peak, limit)
+		}
+	}
+}
+
+func TestProcessFixtures(t *testing.T) {
+	tests := []struct {
+		fixture string
+		events  int
+		stored  int
+		to      []driver.Value
+		// columns are values every stored message should have.
+		columns map[string]driver.Value
+	}{
+		{"relay_message.json", 1, 1, []driver.Value{"user@example.com"},
+			map[string]driver.Value{"has_body": true, "subject": "Hello"}},
+		{"relay_message_array.json", 1, 1, []driver.Value{"user@example.com"}, nil},
+		// The subject comes from the headers when there's no body.
+		{"headers_only.json", 1, 1, []driver.Value{"user@example.com"},
+			map[string]driver.Value{"has_body": false, "subject": "Hello", "rfc822": "",
+				"smtp_from": "sender@example.org", "size_bytes": 0, "text_body": nil}},
+		// Other event types may come before relay_message, or msys.
+		{"relay_message_not_first.json", 1, 1, []driver.Value{"user@example.com"},
+			map[string]driver.Value{"subject": "Hello"}},
+		{"msys_not_first.json", 1, 1, []driver.Value{"user@example.com"},
+			map[string]driver.Value{"subject": "Hello"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			st, ts := processFixture(t, &RelayMsgParser{}, tt.fixture)
+			if st.Events != tt.events || st.Stored != tt.stored || st.Failed != 0 {
+				t.Errorf("%d events, %d stored, %d failed; want %d, %d, 0",
+					st.Events, st.Stored, st.Failed, tt.events, tt.stored)
+			}
+			to := storedColumn(t, ts.DB, "smtp_to")
+			if len(to) != len(tt.to) {
+				t.Fatalf("stored to %v, want %v", to, tt.to)
+			}
+			for i := range to {
+				if to[i] != tt.to[i] {
+					t.Errorf("stored to %v, want %v", to, tt.to)
+				}
+			}
+			for col, want := range tt.columns {
+				for _, got := range storedColumn(t, ts.DB, col) {
+					if got != want {
+						t.Errorf("stored %s %#v, want %#v", col, got, want)
+					}
+				}
+			}
+			if n := len(ts.DB.Queries("relay_parse_failures")); n != 0 {
+				t.Errorf("%d failures recorded", n)
+			}
+		})
+	}
+}
+
+func TestEventType(t *testing.T) {
+	tests := []struct {
+		event string
+		want  string
+	}{
+		{`{"msys":{"relay_message":{}}}`, "relay_message"},
+		{`{"msys":{"message_event":{"type":"delivery"},"relay_message":{}}}`, "relay_message"},
+		{`{"meta":{},"msys":{"track_event":{"type":"click"},"relay_message":{}}}`, "relay_message"},
+		{`{"msys":{"message_event":{"type":"delivery"}}}`, "delivery"},
+		{`{"msys":{"gen_event":{}}}`, "gen_event"},
+		{`{"msys":{"message_event":{},"track_event":{}}}`, "unknown"},
+		{`{"msys":{}}`, "unknown"},
+		{`[]`, "unknown"},
+	}
+	for _, tt := range tests {
+		event := json.RawMessage(tt.event)
+		if got := EventType(&event); got != tt.want {
+			t.Errorf("EventType(%s) = %q, want %q", tt.event, got, tt.want)
+		}
+	}
+}
+
+// schemaRows answers the catalog queries SchemaInit runs: the schema exists,
+// tables exist when tableExists, indexes are valid when indexValid, and the
+// message table has rows when populated.
+func schemaRows(tableExists, indexValid, populated bool) func(q fakeQuery) (*fakeRows, error) {
+	return func(q fakeQuery) (*fakeRows, error) {
+		switch {
+		case strings.Contains(q.SQL, "information_schema.schemata"):
+			return &fakeRows{Vals: [][]driver.Value{{true}}}, nil
+		case strings.Contains(q.SQL, "information_schema.tables"):
+			return &fakeRows{Vals: [][]driver.Value{{tableExists}}}, nil
+		case strings.Contains(q.SQL, "pg_index"):
+			if !indexValid {
+				return nil, nil
+			}
+			return &fakeRows{Vals: [][]driver.Value{{true}}}, nil
+		case strings.Contains(q.SQL, "SELECT EXISTS (SELECT 1 FROM"):
+			return &fakeRows{Vals: [][]driver.Value{{populated}}}, nil
+		case strings.Contains(q.SQL, "pg_try_advisory_lock"):
+			return &fakeRows{Vals: [][]driver.Value{{true}}}, nil
+		}
+		return nil, nil
+	}
+}
+
+func TestSchemaInitReadIndexes(t *testing.T) {
+	indexes := map[string]string{
+		"relay_messages_smtp_to_created_idx":      "(smtp_to, created)",
+		"relay_messages_smtp_to_base_created_idx": "(smtp_to_base, created)",
+		"relay_messages_created_message_id_idx":   "(created DESC, message_id DESC)",
+	}
+	tests := []struct {
+		name                               string
+		tableExists, indexValid, populated bool
+		// create is how each index is expected to be built, or "" when it
+		// shouldn't be.
+		create string
+	}{
+		{"new table", false, false, false, "CREATE INDEX IF NOT EXISTS"},
+		{"empty table", true, false, false, "CREATE INDEX IF NOT EXISTS"},
+		{"table with messages", true, false, true, "CREATE INDEX CONCURRENTLY IF NOT EXISTS"},
+		{"index exists", true, true, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dbh, db := newFakeDB(t, schemaRows(tt.tableExists, tt.indexValid, tt.populated))
+			if err := SchemaInit(dbh, "relaymsg", ""); err != nil {
+				t.Fatal(err)
+			}
+			for name, cols := range indexes {
+				want := tt.create + " " + name + " ON relaymsg.relay_messages " + cols
+				if tt.create == "" {
+					if qs := db.Queries(" " + name + " "); len(qs) != 0 {
+						t.Errorf("%s was created again: %s", name, qs[0].SQL)
+					}
+					continue
+				}
+				// Concurrent builds happen in the background.
+				deadline := time.Now().Add(5 * time.Second)
+				for len(db.Queries(want)) == 0 && time.Now().Before(deadline) {
+					time.Sleep(10 * time.Millisecond)
+				}
+				if len(db.Queries(want)) != 1 {
+					t.Errorf("%q wasn't run once", want)
+				}
+			}
+		})
+	}
+}
@@ -1,53 +1,169 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"database/sql"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	re "regexp"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
-	"github.com/SparkPost/httpdump/storage"
 	"github.com/SparkPost/httpdump/storage/pg"
-
-	"github.com/husobee/vestigo"
 )
 
 var word *re.Regexp = re.MustCompile(`^\w*$`)
 var nows *re.Regexp = re.MustCompile(`^\S*$`)
 var digits *re.Regexp = re.MustCompile(`^\d*$`)
+var wordList *re.Regexp = re.MustCompile(`^[\w,]*$`)
+var keyPath *re.Regexp = re.MustCompile(`^[\w.]*$`)
+var headerList *re.Regexp = re.MustCompile(`^[\w,-]*$`)
+var routeList *re.Regexp = re.MustCompile(`^[\w:,]*$`)
+var webhookHeaderList *re.Regexp = re.MustCompile(`^([^:,\s]+:[^,]+(,[^:,\s]+:[^,]+)*)?$`)
+var mediaTypeList *re.Regexp = re.MustCompile(`^[\w/+.,*-]*$`)
+var domainList *re.Regexp = re.MustCompile(`^[\w.,-]*$`)
+var urlPath *re.Regexp = re.MustCompile(`^(/[\w./-]*)?$`)
 
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
 	// Set up validation for config from our environment.
 	envVars := map[string]*re.Regexp{
-		"PORT":                    digits,
-		"DATABASE_URL":            nows,
-		"RELAYMSG_PG_DB":          word,
-		"RELAYMSG_PG_SCHEMA":      word,
-		"RELAYMSG_PG_USER":        word,
-		"RELAYMSG_PG_PASS":        nows,
-		"RELAYMSG_PG_MAX_CONNS":   digits,
-		"RELAYMSG_BATCH_INTERVAL": digits,
-		"RELAYMSG_INBOUND_DOMAIN": nows,
-		"RELAYMSG_ALLOWED_ORIGIN": nows,
+		"PORT":                               digits,
+		"DATABASE_URL":                       nows,
+		"RELAYMSG_MSG_DATABASE_URL":          nows,
+		"RELAYMSG_PAYLOAD_SCHEMA":            nows,
+		"RELAYMSG_PG_DB":                     word,
+		"RELAYMSG_PG_SCHEMA":                 word,
+		"RELAYMSG_PG_TABLE":                  identifier,
+		"RELAYMSG_PG_USER":                   word,
+		"RELAYMSG_PG_PASS":                   nows,
+		"RELAYMSG_PG_MAX_CONNS":              digits,
+		"RELAYMSG_PG_READ_MAX_CONNS":         digits,
+		"RELAYMSG_PG_CONNECT_ATTEMPTS":       digits,
+		"RELAYMSG_PG_CONNECT_TIMEOUT":        digits,
+		"RELAYMSG_BATCH_INTERVAL":            digits,
+		"RELAYMSG_BATCH_MAX_INTERVAL":        digits,
+		"RELAYMSG_INBOUND_DOMAIN":            nows,
+		"RELAYMSG_ALLOWED_ORIGIN":            nows,
+		"RELAYMSG_WS_ORIGINS":                nows,
+		"RELAYMSG_ADMIN_TOKEN":               nows,
+		"RELAYMSG_MAX_PARSE_FAILURES":        digits,
+		"RELAYMSG_MAX_EVENTS":                digits,
+		"RELAYMSG_INLINE_MAX_BYTES":          digits,
+		"RELAYMSG_MAX_REQUEST_RETRIES":       digits,
+		"RELAYMSG_IGNORE_EVENTS":             wordList,
+		"RELAYMSG_LOG_LEVEL":                 word,
+		"RELAYMSG_WEBHOOK_HMAC_SECRET":       nows,
+		"RELAYMSG_WEBHOOK_HMAC_HEADER":       nows,
+		"RELAYMSG_WEBHOOK_HEADERS":           webhookHeaderList,
+		"RELAYMSG_WEBHOOK_BASIC_AUTH":        nows,
+		"RELAYMSG_S3_BUCKET":                 nows,
+		"RELAYMSG_S3_REGION":                 nows,
+		"RELAYMSG_S3_ENDPOINT":               nows,
+		"RELAYMSG_S3_PREFIX":                 nows,
+		"RELAYMSG_S3_KEEP_INLINE":            digits,
+		"AWS_ACCESS_KEY_ID":                  nows,
+		"AWS_SECRET_ACCESS_KEY":              nows,
+		"AWS_SESSION_TOKEN":                  nows,
+		"RELAYMSG_COMPRESS":                  digits,
+		"RELAYMSG_COMPRESS_MIN_BYTES":        digits,
+		"RELAYMSG_STORE_RAW_EVENTS":          digits,
+		"RELAYMSG_SMTP_HOST":                 nows,
+		"RELAYMSG_SMTP_PORT":                 digits,
+		"RELAYMSG_SMTP_USER":                 nows,
+		"RELAYMSG_SMTP_PASS":                 nows,
+		"RELAYMSG_SMTP_FROM":                 nows,
+		"RELAYMSG_SUBJECT_MAX_LEN":           digits,
+		"RELAYMSG_NORMALIZE_SUBJECTS":        digits,
+		"RELAYMSG_MIGRATIONS_DIR":            nows,
+		"RELAYMSG_BATCH_TIMEOUT":             digits,
+		"RELAYMSG_QUERY_TIMEOUT":             digits,
+		"RELAYMSG_STORE_RETRIES":             digits,
+		"RELAYMSG_TLS_CERT":                  nows,
+		"RELAYMSG_TLS_KEY":                   nows,
+		"RELAYMSG_LISTEN_ADDR":               nows,
+		"RELAYMSG_LOWERCASE_LOCALPART":       digits,
+		"RELAYMSG_SUBADDRESSING":             digits,
+		"RELAYMSG_EVENT_PATH":                keyPath,
+		"RELAYMSG_AUDIT_HEADERS":             headerList,
+		"RELAYMSG_IDEMPOTENCY_WINDOW":        digits,
+		"RELAYMSG_DEDUP_WINDOW":              digits,
+		"RELAYMSG_CACHE_BACKEND":             word,
+		"RELAYMSG_CACHE_TTL":                 digits,
+		"RELAYMSG_REDIS_URL":                 nows,
+		"RELAYMSG_OUTBOUND_URL":              nows,
+		"RELAYMSG_OUTBOUND_BODY":             digits,
+		"RELAYMSG_OUTBOUND_SECRET":           nows,
+		"RELAYMSG_OUTBOUND_QUEUE":            digits,
+		"RELAYMSG_SUBSCRIPTIONS":             digits,
+		"RELAYMSG_SUBSCRIPTION_MAX_FAILURES": digits,
+		"RELAYMSG_SUBSCRIPTION_WORKERS":      digits,
+		"RELAYMSG_PUBLISH_BACKEND":           word,
+		"RELAYMSG_PUBLISH_URL":               nows,
+		"RELAYMSG_PUBLISH_SUBJECT":           nows,
+		"RELAYMSG_PUBLISH_QUEUE":             digits,
+		"RELAYMSG_IDEMPOTENCY_HEADER":        nows,
+		"RELAYMSG_NOTIFY":                    digits,
+		"RELAYMSG_INBOUND_PATH":              urlPath,
+		"RELAYMSG_SUMMARY_PATH":              urlPath,
+		"RELAYMSG_BATCH_MAX_REQUESTS":        digits,
+		"RELAYMSG_BATCH_WORKERS":             digits,
+		"RELAYMSG_OVERSIZE":                  word,
+		"RELAYMSG_WEBHOOK_IDS":               wordList,
+		"RELAYMSG_UNKNOWN_WEBHOOKS":          word,
+		"RELAYMSG_RECIPIENT_DOMAINS":         domainList,
+		"RELAYMSG_OTHER_DOMAINS":             word,
+		"RELAYMSG_WEBHOOK_ROUTES":            routeList,
+		"RELAYMSG_INBOUND_CONTENT_TYPES":     mediaTypeList,
 	}
 	// Config container
 	cfg := map[string]string{}
-	for k, v := range envVars {
+	for k := range envVars {
 		cfg[k] = os.Getenv(k)
-		if !v.MatchString(cfg[k]) {
-			log.Fatalf("Unsupported value for %s, double check your parameters.", k)
+	}
+	if problems := checkEnv(envVars, cfg); len(problems) > 0 {
+		for _, problem := range problems {
+			log.Printf("Config: %s\n", problem)
 		}
+		log.Fatalf("Config: %d environment variables have unsupported values, double check your parameters.", len(problems))
+	}
+
+	if err := SetLogLevel(cfg["RELAYMSG_LOG_LEVEL"]); err != nil {
+		log.Fatal(err)
+	}
+
+	if (cfg["RELAYMSG_TLS_CERT"] == "") != (cfg["RELAYMSG_TLS_KEY"] == "") {
+		log.Fatal("RELAYMSG_TLS_CERT and RELAYMSG_TLS_KEY must be set together")
 	}
 
 	// Set defaults
 	if cfg["PORT"] == "" {
 		cfg["PORT"] = "5000"
 	}
+	if cfg["RELAYMSG_OVERSIZE"] == "" {
+		cfg["RELAYMSG_OVERSIZE"] = "drop"
+	}
+	if cfg["RELAYMSG_OVERSIZE"] != "drop" && cfg["RELAYMSG_OVERSIZE"] != "truncate" {
+		log.Fatalf("RELAYMSG_OVERSIZE must be drop or truncate, not %q", cfg["RELAYMSG_OVERSIZE"])
+	}
+	if cfg["RELAYMSG_UNKNOWN_WEBHOOKS"] == "" {
+		cfg["RELAYMSG_UNKNOWN_WEBHOOKS"] = "reject"
+	}
+	if cfg["RELAYMSG_UNKNOWN_WEBHOOKS"] != "reject" && cfg["RELAYMSG_UNKNOWN_WEBHOOKS"] != "flag" {
+		log.Fatalf("RELAYMSG_UNKNOWN_WEBHOOKS must be reject or flag, not %q", cfg["RELAYMSG_UNKNOWN_WEBHOOKS"])
+	}
+	if cfg["RELAYMSG_OTHER_DOMAINS"] == "" {
+		cfg["RELAYMSG_OTHER_DOMAINS"] = "skip"
+	}
+	if cfg["RELAYMSG_OTHER_DOMAINS"] != "skip" && cfg["RELAYMSG_OTHER_DOMAINS"] != "deadletter" {
+		log.Fatalf("RELAYMSG_OTHER_DOMAINS must be skip or deadletter, not %q", cfg["RELAYMSG_OTHER_DOMAINS"])
+	}
 	if cfg["RELAYMSG_BATCH_INTERVAL"] == "" {
 		cfg["RELAYMSG_BATCH_INTERVAL"] = "10"
 	}
@@ -55,8 +171,31 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	if cfg["RELAYMSG_BATCH_MAX_INTERVAL"] == "" {
+		cfg["RELAYMSG_BATCH_MAX_INTERVAL"] = "60"
+	}
+	batchMaxInterval, err := strconv.Atoi(cfg["RELAYMSG_BATCH_MAX_INTERVAL"])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg["RELAYMSG_BATCH_TIMEOUT"] == "" {
+		cfg["RELAYMSG_BATCH_TIMEOUT"] = "300"
+	}
+	batchTimeout, err := strconv.Atoi(cfg["RELAYMSG_BATCH_TIMEOUT"])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg["RELAYMSG_QUERY_TIMEOUT"] == "" {
+		cfg["RELAYMSG_QUERY_TIMEOUT"] = "30"
+	}
+	queryTimeout, err := strconv.Atoi(cfg["RELAYMSG_QUERY_TIMEOUT"])
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Every summary matches recipients on this domain, so without it they'd
+	// quietly find nothing.
 	if cfg["RELAYMSG_INBOUND_DOMAIN"] == "" {
-		cfg["RELAYMSG_INBOUND_DOMAIN"] = "hey.avocado.industries"
+		log.Fatal("RELAYMSG_INBOUND_DOMAIN must be set to the relay webhook's inbound domain")
 	}
 	if cfg["RELAYMSG_PG_MAX_CONNS"] == "" {
 		cfg["RELAYMSG_PG_MAX_CONNS"] = "18"
@@ -66,16 +205,146 @@ func main() {
 		log.Fatal(err)
 	}
 
-	pgcfg := &pg.PGConfig{
-		Db:   cfg["RELAYMSG_PG_DB"],
-		User: cfg["RELAYMSG_PG_USER"],
-		Pass: cfg["RELAYMSG_PG_PASS"],
-		Opts: map[string]string{
-			"sslmode": "disable",
-		},
-		Url: cfg["DATABASE_URL"],
+	if cfg["RELAYMSG_MAX_PARSE_FAILURES"] == "" {
+		cfg["RELAYMSG_MAX_PARSE_FAILURES"] = strconv.Itoa(DefaultMaxParseFailures)
+	}
+	maxParseFailures, err := strconv.Atoi(cfg["RELAYMSG_MAX_PARSE_FAILURES"])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if cfg["RELAYMSG_MAX_EVENTS"] == "" {
+		cfg["RELAYMSG_MAX_EVENTS"] = strconv.Itoa(DefaultMaxEvents)
+	}
+	maxEvents, err := strconv.Atoi(cfg["RELAYMSG_MAX_EVENTS"])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if cfg["RELAYMSG_COMPRESS_MIN_BYTES"] == "" {
+		cfg["RELAYMSG_COMPRESS_MIN_BYTES"] = strconv.Itoa(DefaultCompressMinBytes)
+	}
+	compressMinBytes, err := strconv.Atoi(cfg["RELAYMSG_COMPRESS_MIN_BYTES"])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if cfg["RELAYMSG_MAX_REQUEST_RETRIES"] == "" {
+		cfg["RELAYMSG_MAX_REQUEST_RETRIES"] = strconv.Itoa(DefaultMaxRequestRetries)
+	}
+	maxRequestRetries, err := strconv.Atoi(cfg["RELAYMSG_MAX_REQUEST_RETRIES"])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if cfg["RELAYMSG_STORE_RETRIES"] == "" {
+		cfg["RELAYMSG_STORE_RETRIES"] = strconv.Itoa(DefaultStoreRetries)
+	}
+	storeRetries, err := strconv.Atoi(cfg["RELAYMSG_STORE_RETRIES"])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	batchMaxRequests := 0
+	if cfg["RELAYMSG_BATCH_MAX_REQUESTS"] != "" {
+		batchMaxRequests, err = strconv.Atoi(cfg["RELAYMSG_BATCH_MAX_REQUESTS"])
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	batchWorkers := 1
+	if cfg["RELAYMSG_BATCH_WORKERS"] != "" {
+		batchWorkers, err = strconv.Atoi(cfg["RELAYMSG_BATCH_WORKERS"])
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if cfg["RELAYMSG_CACHE_TTL"] == "" {
+		cfg["RELAYMSG_CACHE_TTL"] = strconv.Itoa(int(DefaultCacheTTL.Seconds()))
+	}
+	cacheTTL, err := strconv.Atoi(cfg["RELAYMSG_CACHE_TTL"])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	dedupWindow := 0
+	if cfg["RELAYMSG_DEDUP_WINDOW"] != "" {
+		dedupWindow, err = strconv.Atoi(cfg["RELAYMSG_DEDUP_WINDOW"])
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	idempotencyWindow := 0
+	if cfg["RELAYMSG_IDEMPOTENCY_WINDOW"] != "" {
+		idempotencyWindow, err = strconv.Atoi(cfg["RELAYMSG_IDEMPOTENCY_WINDOW"])
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	maxSubjectLen := 0
+	if cfg["RELAYMSG_SUBJECT_MAX_LEN"] != "" {
+		maxSubjectLen, err = strconv.Atoi(cfg["RELAYMSG_SUBJECT_MAX_LEN"])
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Cancelled on SIGINT or SIGTERM, to shut down cleanly.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Start listening before connecting to the database and setting up the
+	// schema, so /healthz and /readyz respond while that's going on. Other
+	// requests are served once startup is complete.
+	readiness := &Readiness{}
+	portSpec := listenAddr(cfg["RELAYMSG_LISTEN_ADDR"], cfg["PORT"])
+	server := &http.Server{Addr: portSpec, Handler: readiness}
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		<-ctx.Done()
+		log.Printf("Shutting down\n")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Shutdown: %s\n", err)
+		}
+	}()
+	listener, err := net.Listen("tcp", portSpec)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		err := serve(server, listener, cfg["RELAYMSG_TLS_CERT"], cfg["RELAYMSG_TLS_KEY"])
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	pgcfg, err := NewPGConfig(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg["RELAYMSG_PG_CONNECT_ATTEMPTS"] == "" {
+		cfg["RELAYMSG_PG_CONNECT_ATTEMPTS"] = strconv.Itoa(DefaultConnectAttempts)
+	}
+	connectAttempts, err := strconv.Atoi(cfg["RELAYMSG_PG_CONNECT_ATTEMPTS"])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg["RELAYMSG_PG_CONNECT_TIMEOUT"] == "" {
+		cfg["RELAYMSG_PG_CONNECT_TIMEOUT"] = strconv.Itoa(int(DefaultConnectTimeout.Seconds()))
+	}
+	connectTimeout, err := strconv.Atoi(cfg["RELAYMSG_PG_CONNECT_TIMEOUT"])
+	if err != nil {
+		log.Fatal(err)
 	}
-	dbh, err := pgcfg.Connect()
+	dbh, err := ConnectWithRetry(ctx, "Connect", pgcfg,
+		connectAttempts, time.Duration(connectTimeout)*time.Second)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -83,6 +352,41 @@ func main() {
 		dbh.SetMaxOpenConns(maxConns)
 	}
 
+	// Optionally store messages in a different database from raw requests.
+	msgcfg, err := NewMsgPGConfig(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	msgDbh := dbh
+	if msgcfg != nil {
+		msgDbh, err = ConnectWithRetry(ctx, "Connect (messages)", msgcfg,
+			connectAttempts, time.Duration(connectTimeout)*time.Second)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if maxConns > 0 {
+			msgDbh.SetMaxOpenConns(maxConns)
+		}
+	} else {
+		msgcfg = pgcfg
+	}
+
+	// Optionally give the API its own, separately limited, connection pool.
+	var readDbh *sql.DB
+	if cfg["RELAYMSG_PG_READ_MAX_CONNS"] != "" {
+		readMaxConns, err := strconv.Atoi(cfg["RELAYMSG_PG_READ_MAX_CONNS"])
+		if err != nil {
+			log.Fatal(err)
+		}
+		if readMaxConns > 0 {
+			readDbh, err = msgcfg.Connect()
+			if err != nil {
+				log.Fatal(err)
+			}
+			readDbh.SetMaxOpenConns(readMaxConns)
+		}
+	}
+
 	// Configure PostgreSQL dumper with connection details.
 	schema := cfg["RELAYMSG_PG_SCHEMA"]
 	if schema == "" {
@@ -93,55 +397,294 @@ func main() {
 	// make sure schema and raw_requests table exist
 	err = pg.SchemaInit(dbh, schema)
 	if err != nil {
+		// Another instance starting at the same time may have created the
+		// schema or table between our existence check and CREATE; once
+		// they exist, a second attempt succeeds.
+		log.Printf("%s, retrying\n", err)
+		if err = pg.SchemaInit(dbh, schema); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err = RawRequestsInit(dbh, schema); err != nil {
 		log.Fatal(err)
 	}
 	// make sure relay_messages table exists
-	err = SchemaInit(dbh, schema)
+	table := cfg["RELAYMSG_PG_TABLE"]
+	if table == "" {
+		table = DefaultTable
+	}
+	if msgDbh != dbh {
+		if err = createSchema(msgDbh, schema); err != nil {
+			log.Fatal(err)
+		}
+	}
+	err = SchemaInit(msgDbh, schema, table)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// routes messages are tagged with by webhook
+	routes, err := ParseWebhookRoutes(cfg["RELAYMSG_WEBHOOK_ROUTES"])
+	if err != nil {
+		log.Fatal(err)
+	}
+	// apply any schema changes from migration files
+	err = Migrate(msgDbh, schema, table, cfg["RELAYMSG_MIGRATIONS_DIR"])
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	pgDumper.Dbh = dbh
 
-	// Set up our handler which writes to, and reads from PostgreSQL.
-	reqDumper := storage.HandlerFactory(pgDumper)
-
 	// Set up our handler which writes individual events to PostgreSQL.
 	msgParser := &RelayMsgParser{
-		Dbh:    dbh,
-		Schema: schema,
-		Domain: cfg["RELAYMSG_INBOUND_DOMAIN"],
+		Dbh:     msgDbh,
+		ReadDbh: readDbh,
+		DumpDbh: dbh,
+		Schema:  schema,
+		Table:   table,
+		Domain:  strings.ToLower(cfg["RELAYMSG_INBOUND_DOMAIN"]),
+
+		MaxParseFailures:  maxParseFailures,
+		MaxEvents:         maxEvents,
+		AdminToken:        cfg["RELAYMSG_ADMIN_TOKEN"],
+		IgnoreEvents:      map[string]bool{},
+		Compress:          cfg["RELAYMSG_COMPRESS"] == "1",
+		CompressMinBytes:  compressMinBytes,
+		StoreRawEvents:    cfg["RELAYMSG_STORE_RAW_EVENTS"] == "1",
+		MaxSubjectLen:     maxSubjectLen,
+		NormalizeSubjects: cfg["RELAYMSG_NORMALIZE_SUBJECTS"] == "1",
+		QueryTimeout:      time.Duration(queryTimeout) * time.Second,
+		StoreRetries:      storeRetries,
+		DedupWindow:       time.Duration(dedupWindow) * time.Second,
+		CacheTTL:          time.Duration(cacheTTL) * time.Second,
+
+		LowercaseLocalpart: cfg["RELAYMSG_LOWERCASE_LOCALPART"] == "1",
+		Subaddressing:      cfg["RELAYMSG_SUBADDRESSING"] == "1",
+		TruncateOversize:   cfg["RELAYMSG_OVERSIZE"] == "truncate",
+
+		WebhookIDs:             map[string]bool{},
+		FlagUnknownWebhooks:    cfg["RELAYMSG_UNKNOWN_WEBHOOKS"] == "flag",
+		RecipientDomains:       map[string]bool{},
+		DeadLetterOtherDomains: cfg["RELAYMSG_OTHER_DOMAINS"] == "deadletter",
+		Routes:                 routes,
+	}
+	// Optionally share cached summaries between instances through Redis.
+	switch cfg["RELAYMSG_CACHE_BACKEND"] {
+	case "", "memory":
+	case "redis":
+		msgParser.Redis, err = NewRedisClient(cfg["RELAYMSG_REDIS_URL"])
+		if err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatalf("RELAYMSG_CACHE_BACKEND must be memory or redis, not %q", cfg["RELAYMSG_CACHE_BACKEND"])
+	}
+	msgParser.EventPath, err = ParseEventPath(cfg["RELAYMSG_EVENT_PATH"])
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, name := range strings.Split(cfg["RELAYMSG_AUDIT_HEADERS"], ",") {
+		if name != "" {
+			msgParser.AuditHeaders = append(msgParser.AuditHeaders, name)
+		}
+	}
+	for _, id := range strings.Split(cfg["RELAYMSG_WEBHOOK_IDS"], ",") {
+		if id != "" {
+			msgParser.WebhookIDs[id] = true
+		}
+	}
+	// The inbound domain is always accepted, since it's the one the API reads.
+	if cfg["RELAYMSG_RECIPIENT_DOMAINS"] != "" {
+		msgParser.RecipientDomains[msgParser.Domain] = true
+		for _, domain := range strings.Split(cfg["RELAYMSG_RECIPIENT_DOMAINS"], ",") {
+			if domain != "" {
+				msgParser.RecipientDomains[strings.ToLower(domain)] = true
+			}
+		}
+	}
+	for _, typ := range strings.Split(cfg["RELAYMSG_IGNORE_EVENTS"], ",") {
+		if typ != "" {
+			msgParser.IgnoreEvents[typ] = true
+		}
 	}
 
-	// recurring job to transform blobs of webhook data into relay_messages
-	interval := time.Duration(batchInterval) * time.Second
-	ticker := time.NewTicker(interval)
-	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				go func() {
-					_, err := storage.ProcessBatch(pgDumper, msgParser)
-					if err != nil {
-						log.Printf("%s\n", err)
-					}
-				}()
+	// Optionally keep message bodies in S3 rather than PostgreSQL.
+	if cfg["RELAYMSG_S3_BUCKET"] != "" {
+		if cfg["RELAYMSG_S3_REGION"] == "" {
+			cfg["RELAYMSG_S3_REGION"] = "us-east-1"
+		}
+		msgParser.Bodies = &S3Store{
+			Bucket:       cfg["RELAYMSG_S3_BUCKET"],
+			Region:       cfg["RELAYMSG_S3_REGION"],
+			Endpoint:     cfg["RELAYMSG_S3_ENDPOINT"],
+			AccessKey:    cfg["AWS_ACCESS_KEY_ID"],
+			SecretKey:    cfg["AWS_SECRET_ACCESS_KEY"],
+			SessionToken: cfg["AWS_SESSION_TOKEN"],
+			Client:       &http.Client{Timeout: 30 * time.Second},
+		}
+		msgParser.BodyPrefix = cfg["RELAYMSG_S3_PREFIX"]
+		msgParser.KeepInline = cfg["RELAYMSG_S3_KEEP_INLINE"] == "1"
+	}
+
+	// Optionally move only large bodies out of the messages table, to S3
+	// when it's configured or otherwise to a table of their own.
+	if cfg["RELAYMSG_INLINE_MAX_BYTES"] != "" {
+		if msgParser.InlineMaxBytes, err = strconv.Atoi(cfg["RELAYMSG_INLINE_MAX_BYTES"]); err != nil {
+			log.Fatal(err)
+		}
+		if msgParser.InlineMaxBytes > 0 && msgParser.Bodies == nil {
+			bodies := &PGBodyStore{Dbh: msgDbh, Schema: schema}
+			if err = bodies.SchemaInit(); err != nil {
+				log.Fatal(err)
 			}
+			msgParser.Bodies = bodies
 		}
-	}()
+	}
 
-	router := vestigo.NewRouter()
+	// Optionally allow forwarding stored messages over SMTP.
+	if cfg["RELAYMSG_SMTP_HOST"] != "" {
+		if cfg["RELAYMSG_SMTP_PORT"] == "" {
+			cfg["RELAYMSG_SMTP_PORT"] = "587"
+		}
+		msgParser.Relay = &SMTPRelay{
+			Host: cfg["RELAYMSG_SMTP_HOST"],
+			Port: cfg["RELAYMSG_SMTP_PORT"],
+			User: cfg["RELAYMSG_SMTP_USER"],
+			Pass: cfg["RELAYMSG_SMTP_PASS"],
+			From: cfg["RELAYMSG_SMTP_FROM"],
+		}
+	}
 
-	router.SetGlobalCors(&vestigo.CorsAccessControl{
-		AllowOrigin:   []string{cfg["RELAYMSG_ALLOWED_ORIGIN"]},
-		ExposeHeaders: []string{"accept"},
-		AllowHeaders:  []string{"accept"},
-	})
+	// Optionally push new messages to clients as they're stored.
+	if cfg["RELAYMSG_NOTIFY"] == "1" {
+		msgParser.Notify = true
+		msgParser.Notifier = NewNotifier(ctx, DSN(msgcfg))
+		wsOrigins := cfg["RELAYMSG_WS_ORIGINS"]
+		if wsOrigins == "" {
+			wsOrigins = cfg["RELAYMSG_ALLOWED_ORIGIN"]
+		}
+		if wsOrigins != "" {
+			msgParser.WSOrigins = strings.Split(wsOrigins, ",")
+		}
+	}
 
-	// Install handler to store votes in database (incoming webhook events)
-	router.Post("/incoming", reqDumper)
-	router.Get("/summary/:localpart", msgParser.SummaryHandler())
+	// Optionally pass each stored message on to another service.
+	if cfg["RELAYMSG_OUTBOUND_URL"] != "" {
+		if !strings.HasPrefix(cfg["RELAYMSG_OUTBOUND_URL"], "http://") && !strings.HasPrefix(cfg["RELAYMSG_OUTBOUND_URL"], "https://") {
+			log.Fatal("RELAYMSG_OUTBOUND_URL must be an http:// or https:// URL")
+		}
+		outboundQueue := DefaultOutboundQueue
+		if cfg["RELAYMSG_OUTBOUND_QUEUE"] != "" {
+			if outboundQueue, err = strconv.Atoi(cfg["RELAYMSG_OUTBOUND_QUEUE"]); err != nil {
+				log.Fatal(err)
+			}
+		}
+		msgParser.Outbound = NewOutboundWebhook(ctx, cfg["RELAYMSG_OUTBOUND_URL"], outboundQueue)
+		msgParser.Outbound.IncludeBody = cfg["RELAYMSG_OUTBOUND_BODY"] == "1"
+		msgParser.Outbound.Secret = cfg["RELAYMSG_OUTBOUND_SECRET"]
+	}
+
+	// Optionally let recipients register callbacks for their new messages.
+	if cfg["RELAYMSG_SUBSCRIPTIONS"] == "1" {
+		workers := DefaultSubscriptionWorkers
+		if cfg["RELAYMSG_SUBSCRIPTION_WORKERS"] != "" {
+			if workers, err = strconv.Atoi(cfg["RELAYMSG_SUBSCRIPTION_WORKERS"]); err != nil {
+				log.Fatal(err)
+			}
+		}
+		msgParser.Subscriptions = NewSubscriptions(ctx, msgDbh, schema, DefaultSubscriptionQueue, workers)
+		if cfg["RELAYMSG_SUBSCRIPTION_MAX_FAILURES"] != "" {
+			if msgParser.Subscriptions.MaxFailures, err = strconv.Atoi(cfg["RELAYMSG_SUBSCRIPTION_MAX_FAILURES"]); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if err = msgParser.Subscriptions.SchemaInit(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Optionally publish each stored message to a message bus.
+	switch cfg["RELAYMSG_PUBLISH_BACKEND"] {
+	case "", "none":
+		msgParser.Publisher = NoopPublisher{}
+	case "nats":
+		broker, err := NewNATSBroker(cfg["RELAYMSG_PUBLISH_URL"])
+		if err != nil {
+			log.Fatal(err)
+		}
+		publishQueue := DefaultPublishQueue
+		if cfg["RELAYMSG_PUBLISH_QUEUE"] != "" {
+			if publishQueue, err = strconv.Atoi(cfg["RELAYMSG_PUBLISH_QUEUE"]); err != nil {
+				log.Fatal(err)
+			}
+		}
+		msgParser.Publisher = NewQueuedPublisher(ctx, broker, cfg["RELAYMSG_PUBLISH_SUBJECT"], publishQueue)
+	default:
+		log.Fatalf("RELAYMSG_PUBLISH_BACKEND must be none or nats, not %q", cfg["RELAYMSG_PUBLISH_BACKEND"])
+	}
+
+	// Check the webhook headers now, so a typo stops startup.
+	if _, err = ParseWebhookHeaders(cfg["RELAYMSG_WEBHOOK_HEADERS"]); err != nil {
+		log.Fatal(err)
+	}
+
+	// Optionally reject payloads which don't match a JSON schema.
+	var payloadSchema *JSONSchema
+	if cfg["RELAYMSG_PAYLOAD_SCHEMA"] != "" {
+		payloadSchema, err = LoadJSONSchema(cfg["RELAYMSG_PAYLOAD_SCHEMA"])
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Optionally drop repeated deliveries of the same webhook request.
+	var idempotency *Idempotency
+	if idempotencyWindow > 0 {
+		idempotency = &Idempotency{
+			Dbh:    dbh,
+			Schema: schema,
+			Header: cfg["RELAYMSG_IDEMPOTENCY_HEADER"],
+			Window: time.Duration(idempotencyWindow) * time.Second,
+		}
+		if err = idempotency.SchemaInit(); err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			ticker := time.NewTicker(idempotency.Window)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					idempotency.Expire()
+				}
+			}
+		}()
+	}
+
+	// recurring job to transform blobs of webhook data into relay_messages
+	runner := &BatchRunner{
+		Batcher:   &LimitedBatcher{PgDumper: pgDumper, Max: batchMaxRequests},
+		Processor: msgParser,
+		Workers:   batchWorkers,
+		Dbh:       dbh,
+		Schema:    schema,
+		Timeout:   time.Duration(batchTimeout) * time.Second,
+
+		MaxInterval: time.Duration(batchMaxInterval) * time.Second,
+		MaxRetries:  maxRequestRetries,
+	}
+	runner.Start(ctx, time.Duration(batchInterval)*time.Second)
+
+	// Route requests to our handlers.
+	dbhs := []*sql.DB{dbh}
+	if msgDbh != dbh {
+		dbhs = append(dbhs, msgDbh)
+	}
+	readiness.SetReady(NewServer(cfg, msgParser, pgDumper, idempotency, payloadSchema).Handler, runner, dbhs...)
+	log.Printf("Ready\n")
 
-	portSpec := fmt.Sprintf(":%s", cfg["PORT"])
-	log.Fatal(http.ListenAndServe(portSpec, router))
+	// wait for a signal, then for in-flight requests to finish
+	<-shutdown
 }
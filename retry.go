@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// DefaultStoreRetries is how many times an insert is attempted before the
+// batch is given up on and left to be retried later.
+const DefaultStoreRetries int = 5
+
+// StoreRetryDelay is the wait before the first retry, doubled after each
+// failed attempt up to StoreRetryMaxDelay.
+const StoreRetryDelay time.Duration = 100 * time.Millisecond
+const StoreRetryMaxDelay time.Duration = 5 * time.Second
+
+// IsTransient reports whether err is a database error which may succeed if
+// the statement is retried, like a dropped connection during a failover or a
+// serialization failure.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch {
+		case strings.HasPrefix(string(pqErr.Code), "08"): // connection_exception
+			return true
+		case pqErr.Code == "40001", // serialization_failure
+			pqErr.Code == "40P01", // deadlock_detected
+			pqErr.Code == "57P01", // admin_shutdown
+			pqErr.Code == "57P02", // crash_shutdown
+			pqErr.Code == "57P03": // cannot_connect_now
+			return true
+		}
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// retry calls fn until it succeeds, returns an error which isn't transient,
+// or has been called attempts times, backing off exponentially in between.
+// name is used to log each retry.
+func retry(ctx context.Context, name string, attempts int, fn func() error) error {
+	delay := StoreRetryDelay
+	var err error
+	for i := 1; ; i++ {
+		if err = fn(); err == nil || !IsTransient(err) || i >= attempts {
+			return err
+		}
+		log.Printf("%s: attempt %d of %d failed, retrying in %s: %s\n", name, i, attempts, delay, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > StoreRetryMaxDelay {
+			delay = StoreRetryMaxDelay
+		}
+	}
+}
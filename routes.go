@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ParseWebhookRoutes reads a comma-separated list of webhook_id:route pairs,
+// naming the route messages from each webhook are stored under.
+func ParseWebhookRoutes(spec string) (map[string]string, error) {
+	routes := map[string]string{}
+	for _, pair := range strings.Split(spec, ",") {
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("ParseWebhookRoutes: expected webhook_id:route, not %q", pair)
+		}
+		if parts[1] == "" || !identifier.MatchString(parts[1]) {
+			return nil, fmt.Errorf("ParseWebhookRoutes: unsupported route name [%s]", parts[1])
+		}
+		routes[parts[0]] = parts[1]
+	}
+	return routes, nil
+}
+
+// routeFor returns the route to store messages from the given webhook
+// under, or nil for those which aren't routed.
+func (p *RelayMsgParser) routeFor(webhookID string) interface{} {
+	if route, ok := p.Routes[webhookID]; ok {
+		return route
+	}
+	return nil
+}
+
+// routeParam returns the route named by r's route query parameter, which
+// limits reads to the messages stored under it, or "" if there's none.
+func routeParam(r *http.Request) (string, error) {
+	route := r.URL.Query().Get("route")
+	if route != "" && !identifier.MatchString(route) {
+		return "", fmt.Errorf("invalid route: %q", route)
+	}
+	return route, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseWebhookRoutes(t *testing.T) {
+	tests := []struct {
+		spec string
+		want map[string]string
+		ok   bool
+	}{
+		{"", map[string]string{}, true},
+		{"123:tenant_a", map[string]string{"123": "tenant_a"}, true},
+		{"123:tenant_a,456:tenant_b,", map[string]string{"123": "tenant_a", "456": "tenant_b"}, true},
+		{"123", nil, false},
+		{":tenant_a", nil, false},
+		{"123:", nil, false},
+		{"123:tenant.a", nil, false},
+		{"123:1tenant", nil, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseWebhookRoutes(tt.spec)
+		if (err == nil) != tt.ok {
+			t.Errorf("ParseWebhookRoutes(%q) error %v, want ok %t", tt.spec, err, tt.ok)
+			continue
+		}
+		if tt.ok && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseWebhookRoutes(%q) = %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+// TestStoreEventRoute checks routed and unrouted messages both go to the
+// main table, so they share its IDs, indexes and reads.
+func TestStoreEventRoute(t *testing.T) {
+	tests := []struct {
+		name   string
+		routes map[string]string
+		want   interface{}
+	}{
+		{"no routes", nil, nil},
+		{"other webhook routed", map[string]string{"999": "tenant_b"}, nil},
+		{"routed", map[string]string{"1234567890": "tenant_a"}, "tenant_a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &RelayMsgParser{Routes: tt.routes}
+			ts := newTestServer(t, p, nil, storeRows)
+			event := relayEvent(t, "sender@example.org", "user@example.com", "hi", "Subject: hi\r\n\r\nhi\r\n")
+			if err := p.ParseEvent(context.Background(), event, "req"); err != nil {
+				t.Fatal(err)
+			}
+			stored := storedColumn(t, ts.DB, "route")
+			if len(stored) != 1 {
+				t.Fatalf("%d messages stored", len(stored))
+			}
+			if stored[0] != tt.want {
+				t.Errorf("route %v, want %v", stored[0], tt.want)
+			}
+			insert := ts.DB.Queries("RETURNING message_id, created")[0].SQL
+			if !strings.Contains(insert, "INSERT INTO "+p.MsgTable()+" ") {
+				t.Errorf("not stored in %s: %s", p.MsgTable(), insert)
+			}
+		})
+	}
+}
+
+func TestMessageRoute(t *testing.T) {
+	tests := []struct {
+		name  string
+		route driver.Value
+		want  string
+	}{
+		{"routed", "billing", `"route":"billing"`},
+		{"not routed", nil, `"route":""`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, &RelayMsgParser{}, nil, func(q fakeQuery) (*fakeRows, error) {
+				if !strings.Contains(q.SQL, "WHERE message_id = $1") {
+					return nil, nil
+				}
+				return messageRow(q, map[string]driver.Value{"created": time.Now(), "route": tt.route}), nil
+			})
+			status, body := get(t, ts, "/message/1", nil)
+			if status != http.StatusOK || !strings.Contains(body, tt.want) {
+				t.Errorf("status %d, body %s; want %s", status, body, tt.want)
+			}
+		})
+	}
+}
+
+// messageRow answers a query for a single message with a row holding the
+// given values for the columns named, and NULL for the rest.
+func messageRow(q fakeQuery, vals map[string]driver.Value) *fakeRows {
+	sel := q.SQL[strings.Index(q.SQL, "SELECT")+len("SELECT") : strings.Index(q.SQL, "FROM")]
+	row := []driver.Value{}
+	for _, col := range strings.Split(sel, ",") {
+		row = append(row, vals[strings.TrimSpace(col)])
+	}
+	return &fakeRows{Vals: [][]driver.Value{row}}
+}
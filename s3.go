@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BodyStore keeps message bodies outside of PostgreSQL, under a string key.
+type BodyStore interface {
+	Put(key string, body []byte) error
+	Get(key string) ([]byte, error)
+}
+
+// S3Store is a BodyStore backed by an S3 (or S3 compatible) bucket. Requests
+// are signed with AWS Signature Version 4, using path-style URLs.
+type S3Store struct {
+	Bucket       string
+	Region       string
+	Endpoint     string // defaults to https://s3.<region>.amazonaws.com
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	Client       *http.Client
+}
+
+func (s *S3Store) Put(key string, body []byte) error {
+	res, err := s.do("PUT", key, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("S3Store.Put (%s): %s: %s", key, res.Status, msg)
+	}
+	return nil
+}
+
+func (s *S3Store) Get(key string) ([]byte, error) {
+	res, err := s.do("GET", key, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, fmt.Errorf("S3Store.Get (%s): %s: %s", key, res.Status, msg)
+	}
+	return io.ReadAll(res.Body)
+}
+
+func (s *S3Store) do(method, key string, body []byte) (*http.Response, error) {
+	endpoint := s.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", s.Region)
+	}
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/") + "/" + s.Bucket + "/" + key)
+	if err != nil {
+		return nil, fmt.Errorf("S3Store (URL): %s", err)
+	}
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("S3Store (request): %s", err)
+	}
+	s.sign(req, body, time.Now().UTC())
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("S3Store (%s): %s", method, err)
+	}
+	return res, nil
+}
+
+// sign adds AWS Signature Version 4 headers to req.
+func (s *S3Store) sign(req *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	headers := []string{"x-amz-content-sha256", "x-amz-date"}
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+		headers = append(headers, "x-amz-security-token")
+	}
+	signV4(req, headers, payloadHash, now, s.Region, "s3", s.AccessKey, s.SecretKey)
+}
+
+// signV4 adds an AWS Signature Version 4 Authorization header to req, which
+// must already have an X-Amz-Date header for now. The host and the headers
+// named in signed, in lower case, are signed, along with the method, path,
+// query string and payloadHash, the hex SHA-256 of the body. The path is
+// escaped as the signature expects, which S3 requires of the request too.
+func signV4(req *http.Request, signed []string, payloadHash string, now time.Time, region, service, accessKey, secretKey string) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+
+	if req.URL.Path == "" {
+		req.URL.Path = "/"
+	}
+	req.URL.RawPath = awsEscape(req.URL.Path, false)
+	headers := append([]string{"host"}, signed...)
+	sort.Strings(headers)
+	canonicalHeaders := ""
+	for _, h := range headers {
+		val := strings.Join(req.Header.Values(h), ",")
+		if h == "host" {
+			val = req.URL.Host
+			if req.Host != "" {
+				val = req.Host
+			}
+		}
+		canonicalHeaders += h + ":" + strings.Join(strings.Fields(val), " ") + "\n"
+	}
+	signedHeaders := strings.Join(headers, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.RawPath,
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+// canonicalQuery returns query as Signature Version 4 signs it: sorted by
+// name and then value, with both escaped.
+func canonicalQuery(query url.Values) string {
+	params := []string{}
+	for name, vals := range query {
+		for _, val := range vals {
+			params = append(params, awsEscape(name, true)+"="+awsEscape(val, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// awsEscape percent-encodes every byte of s but the unreserved characters
+// A-Z, a-z, 0-9, '-', '.', '_' and '~', and '/' unless escapeSlash, as
+// Signature Version 4 requires. Unlike url.QueryEscape, spaces become %20.
+func awsEscape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~', c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"github.com/microcosm-cc/bluemonday"
+)
+
+// sanitizeTags lists the elements SanitizeHTML keeps, with the attributes
+// allowed on each of them. Elements not listed are dropped, but their content
+// is kept, except for the ones in sanitizeDrop.
+var sanitizeTags = map[string][]string{
+	"a": {"href", "title"}, "abbr": {"title"}, "b": nil, "blockquote": nil,
+	"br": nil, "caption": nil, "center": nil, "code": nil, "dd": nil,
+	"div": {"align"}, "dl": nil, "dt": nil, "em": nil, "font": {"color", "size"},
+	"h1": nil, "h2": nil, "h3": nil, "h4": nil, "h5": nil, "h6": nil,
+	"hr": nil, "i": nil, "img": {"src", "alt", "title", "width", "height"},
+	"li": nil, "ol": nil, "p": {"align"}, "pre": nil, "s": nil, "small": nil,
+	"span": nil, "strong": nil, "sub": nil, "sup": nil,
+	"table": {"width", "border", "cellpadding", "cellspacing", "align"},
+	"tbody": nil, "td": {"width", "colspan", "rowspan", "align", "valign"},
+	"tfoot": nil, "th": {"width", "colspan", "rowspan", "align", "valign"},
+	"thead": nil, "tr": nil, "u": nil, "ul": nil,
+}
+
+// sanitizeDrop lists elements which are removed along with their content.
+var sanitizeDrop = []string{"script", "style", "head", "iframe", "object", "embed", "noscript", "template", "svg", "math"}
+
+// sanitizePolicy is built from sanitizeTags and sanitizeDrop. Documents are
+// parsed with an HTML tokenizer, so malformed markup and encoded URLs are
+// seen the way a browser would see them.
+var sanitizePolicy = newSanitizePolicy()
+
+func newSanitizePolicy() *bluemonday.Policy {
+	policy := bluemonday.NewPolicy()
+	for tag, attrs := range sanitizeTags {
+		policy.AllowElements(tag)
+		if len(attrs) > 0 {
+			policy.AllowAttrs(attrs...).OnElements(tag)
+		}
+	}
+	policy.SkipElementsContent(sanitizeDrop...)
+	policy.AllowURLSchemes("http", "https", "mailto", "cid")
+	policy.AllowRelativeURLs(true)
+	policy.RequireParseableURLs(true)
+	policy.RequireNoFollowOnLinks(true)
+	policy.AddTargetBlankToFullyQualifiedLinks(true)
+	return policy
+}
+
+// SanitizeHTML makes an HTML document safe to render in a browser, by keeping
+// only an allow-list of elements and attributes, and only http(s), mailto,
+// cid and relative links.
+func SanitizeHTML(s string) string {
+	return sanitizePolicy.Sanitize(s)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+)
+
+func TestSanitizeHTML(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		// keep must appear in the output.
+		keep []string
+	}{
+		{"script", `<p>hi</p><script>alert(1)</script>`, []string{"<p>hi</p>"}},
+		{"script with attribute containing >", `<script a=">">alert(1)</script>`, nil},
+		{"unclosed script", `<p>hi<script>alert(1)`, []string{"hi"}},
+		{"uppercase script", `<SCRIPT>alert(1)</SCRIPT>`, nil},
+		{"event handler", `<img src="https://example.com/a.png" onerror="alert(1)">`, []string{`src="https://example.com/a.png"`}},
+		{"event handler without quotes", `<img src=x onerror=alert(1)//>`, nil},
+		{"event handler after slash", `<img/src="x"/onerror=alert(1)>`, nil},
+		{"javascript link", `<a href="javascript:alert(1)">x</a>`, []string{"x"}},
+		{"entity encoded javascript", `<a href="&#106;avascript:alert(1)">x</a>`, []string{"x"}},
+		{"hex entity javascript", `<a href="&#x6A;&#x61;vascript:alert(1)">x</a>`, nil},
+		{"javascript with tab", "<a href=\"java\tscript:alert(1)\">x</a>", nil},
+		{"javascript with leading space", `<a href=" javascript:alert(1)">x</a>`, nil},
+		{"data URL", `<a href="data:text/html,<script>alert(1)</script>">x</a>`, nil},
+		{"vbscript", `<a href="vbscript:msgbox(1)">x</a>`, nil},
+		{"attribute breaking out of quotes", `<a title='a"onmouseover="alert(1)'>x</a>`, nil},
+		{"comment hiding a tag", `<!--><script>alert(1)</script>-->`, nil},
+		{"conditional comment", `<!--[if IE]><script>alert(1)</script><![endif]-->`, nil},
+		{"CDATA", `<![CDATA[<script>alert(1)</script>]]>`, nil},
+		{"svg", `<svg onload="alert(1)"><script>alert(1)</script></svg>`, nil},
+		{"style element", `<style>body{background:url(javascript:alert(1))}</style>`, nil},
+		{"style attribute", `<p style="background:url(javascript:alert(1))">x</p>`, []string{"<p>x</p>"}},
+		{"iframe", `<iframe src="javascript:alert(1)"></iframe>`, nil},
+		{"nested tags", `<scr<script>ipt>alert(1)</script>`, nil},
+		{"form", `<form action="https://evil.example"><input name=p></form>`, nil},
+		{"meta refresh", `<meta http-equiv="refresh" content="0;url=javascript:alert(1)">`, nil},
+		{"base", `<base href="javascript:alert(1)//">`, nil},
+		{"allowed markup", `<table border="1"><tr><td colspan="2"><b>hi</b></td></tr></table>`,
+			[]string{`<table border="1">`, `<td colspan="2">`, "<b>hi</b>"}},
+		{"links", `<a href="https://example.com/">x</a>`,
+			[]string{`href="https://example.com/"`, "nofollow", `target="_blank"`}},
+		{"mailto and cid", `<a href="mailto:a@example.com">a</a><img src="cid:logo">`,
+			[]string{`href="mailto:a@example.com"`, `src="cid:logo"`}},
+		{"relative link", `<a href="#top">top</a>`, []string{`href="#top"`}},
+		{"text escaped", `<p>1 &lt; 2 &amp;&amp; 3 &gt; 2</p>`, []string{"1 &lt; 2 &amp;&amp; 3 &gt; 2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := SanitizeHTML(tt.in)
+			if err := checkSanitized(out); err != nil {
+				t.Errorf("SanitizeHTML(%q) = %q: %s", tt.in, out, err)
+			}
+			for _, want := range tt.keep {
+				if !strings.Contains(out, want) {
+					t.Errorf("SanitizeHTML(%q) = %q, missing %q", tt.in, out, want)
+				}
+			}
+		})
+	}
+}
+
+// checkSanitized parses s the way a browser would, and returns an error for
+// the first element, attribute or link which isn't allowed.
+func checkSanitized(s string) error {
+	z := html.NewTokenizer(strings.NewReader(s))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			if z.Err() == io.EOF {
+				return nil
+			}
+			return z.Err()
+		case html.CommentToken, html.DoctypeToken:
+			return fmt.Errorf("%q kept", z.Token().String())
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tok := z.Token()
+			allowed, ok := sanitizeTags[tok.Data]
+			if !ok {
+				return fmt.Errorf("element %q kept", tok.Data)
+			}
+			for _, attr := range tok.Attr {
+				if tok.Data == "a" && (attr.Key == "rel" || attr.Key == "target") {
+					continue
+				} else if !stringInSlice(attr.Key, allowed) {
+					return fmt.Errorf("attribute %q kept on %q", attr.Key, tok.Data)
+				}
+				if attr.Key != "href" && attr.Key != "src" {
+					continue
+				}
+				u, err := url.Parse(attr.Val)
+				if err != nil {
+					return fmt.Errorf("%s %q: %s", attr.Key, attr.Val, err)
+				}
+				switch strings.ToLower(u.Scheme) {
+				case "", "http", "https", "mailto", "cid":
+				default:
+					return fmt.Errorf("%s %q kept", attr.Key, attr.Val)
+				}
+			}
+		}
+	}
+}
+
+func stringInSlice(s string, list []string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/SparkPost/httpdump/storage"
+	"github.com/husobee/vestigo"
+)
+
+// NewServer wires up the routes for every endpoint. dumper stores incoming
+// webhook requests, and idempotency, when not nil, drops repeated ones.
+// Payloads not matching schema, when not nil, are rejected, as are requests
+// without the webhook headers in cfg, which should already have been checked
+// by ParseWebhookHeaders. Defaults are used for any paths missing from cfg.
+// The caller sets the address and starts the server.
+func NewServer(cfg map[string]string, p *RelayMsgParser, dumper storage.Dumper, idempotency *Idempotency, schema *JSONSchema) *http.Server {
+	inboundPath := cfg["RELAYMSG_INBOUND_PATH"]
+	if inboundPath == "" {
+		inboundPath = "/incoming"
+	}
+	summaryPath := strings.TrimSuffix(cfg["RELAYMSG_SUMMARY_PATH"], "/")
+	if summaryPath == "" {
+		summaryPath = "/summary"
+	}
+
+	router := vestigo.NewRouter()
+
+	cors := &vestigo.CorsAccessControl{
+		AllowOrigin:   []string{cfg["RELAYMSG_ALLOWED_ORIGIN"]},
+		ExposeHeaders: []string{"accept", "X-Total-Count"},
+		AllowHeaders:  []string{"accept", "Content-Type", "Authorization"},
+	}
+	router.SetGlobalCors(cors)
+
+	// Install handler to store votes in database (incoming webhook events)
+	contentTypes := cfg["RELAYMSG_INBOUND_CONTENT_TYPES"]
+	if contentTypes == "" {
+		contentTypes = DefaultContentTypes
+	}
+	webhookHeaders, _ := ParseWebhookHeaders(cfg["RELAYMSG_WEBHOOK_HEADERS"])
+	ingest := &IngestSwitch{}
+	incoming := ingest.Wrap(RequireContentType(strings.Split(contentTypes, ","),
+		VerifyWebhookHeaders(webhookHeaders, cfg["RELAYMSG_WEBHOOK_BASIC_AUTH"],
+			VerifyHMAC(cfg["RELAYMSG_WEBHOOK_HMAC_SECRET"], cfg["RELAYMSG_WEBHOOK_HMAC_HEADER"],
+				AcceptTestPayload(ValidateSchema(schema, WithRequestID(idempotency.Wrap(storage.HandlerFactory(dumper)))))))))
+	router.Post(inboundPath, incoming)
+	router.Get("/version", VersionHandler)
+	// A trailing slash is an empty localpart, rejected as such.
+	router.Get(summaryPath+"/", RequireLocalpart(p.SummaryHandler()))
+	router.Get(summaryPath+"/:localpart", RequireLocalpart(p.SummaryHandler()))
+	router.Get(summaryPath+"/:localpart/senders", RequireLocalpart(p.SendersHandler()))
+	router.Get(summaryPath+"/:localpart/timeline", RequireLocalpart(p.TimelineHandler()))
+	router.Get(summaryPath+"/:localpart/count", RequireLocalpart(p.CountHandler()))
+	router.Get("/threads/:localpart", RequireLocalpart(p.ThreadsHandler()))
+	router.Get("/subscriptions/:localpart", p.RequireAdmin(RequireLocalpart(p.SubscriptionsHandler())))
+	router.Post("/subscriptions/:localpart", p.RequireAdmin(RequireLocalpart(p.SubscribeHandler())))
+	router.Delete("/subscriptions/:localpart/:id", p.RequireAdmin(RequireLocalpart(p.UnsubscribeHandler())))
+	router.Post("/messages/batch", p.RequireAdmin(p.MessageBatchHandler()))
+	router.Post("/messages/:localpart/status", p.RequireAdmin(RequireLocalpart(p.StatusHandler())))
+	router.Get("/messages/:localpart/export", RequireLocalpart(p.ExportHandler()))
+	router.Get("/events/:localpart", RequireLocalpart(p.EventsHandler()))
+	router.Get("/ws/:localpart", RequireLocalpart(p.WebSocketHandler()))
+	router.Get("/message/:id", p.MessageHandler())
+	router.Get("/message/:id/text", p.MessageTextHandler())
+	router.Get("/message/:id/html", p.MessageHTMLHandler())
+	router.Get("/message/:id/download", p.MessageDownloadHandler())
+	router.Post("/message/:id/forward", p.RequireAdmin(p.ForwardHandler()))
+	router.Get("/admin/failures", p.RequireAdmin(p.FailuresHandler()))
+	router.Get("/admin/stats", p.RequireAdmin(p.StatsHandler()))
+	router.Get("/admin/storage", p.RequireAdmin(p.StorageHandler()))
+	router.Get("/admin/recent", p.RequireAdmin(p.RecentHandler()))
+	router.Get("/admin/from/:address", p.RequireAdmin(p.SenderHandler()))
+	router.Get("/admin/requests/:request_id/headers", p.RequireAdmin(p.RequestHeadersHandler()))
+	router.Get("/admin/ingest", p.RequireAdmin(ingest.StatusHandler))
+	router.Post("/admin/pause-ingest", p.RequireAdmin(ingest.Handler(true)))
+	router.Post("/admin/resume-ingest", p.RequireAdmin(ingest.Handler(false)))
+	maintenance := &Maintenance{Dbh: p.Dbh, Table: p.MsgTable()}
+	router.Post("/admin/maintenance", p.RequireAdmin(maintenance.Handler))
+	router.Get("/admin/maintenance", p.RequireAdmin(maintenance.StatusHandler))
+	router.Get("/admin/metrics", p.RequireAdmin(expvar.Handler().ServeHTTP))
+	router.Post("/admin/import", p.RequireAdmin(p.ImportHandler()))
+	router.Get("/admin/parked", p.RequireAdmin(p.ParkedHandler()))
+	router.Post("/admin/parked/:id/requeue", p.RequireAdmin(p.UnparkHandler()))
+	router.Get("/admin/dead-letters", p.RequireAdmin(p.DeadLettersHandler()))
+	router.Post("/admin/dead-letters/:id/requeue", p.RequireAdmin(p.RequeueHandler()))
+
+	return &http.Server{Handler: withCORS(cors, router)}
+}
+
+// withCORS fills in what the router's CORS support leaves out. The router
+// only answers preflight requests, so the origin and exposed headers are set
+// here on the responses to the requests themselves; without them a browser
+// won't let the page read the response, or headers like X-Total-Count. And
+// the router expects each header a preflight asks to send as its own value,
+// where browsers send a comma-separated list, so that's split up first.
+func withCORS(cors *vestigo.CorsAccessControl, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("Origin"); origin != "" && r.Method != http.MethodOptions {
+			for _, allowed := range cors.AllowOrigin {
+				if allowed == origin || allowed == "*" {
+					w.Header().Set("Access-Control-Allow-Origin", allowed)
+					w.Header().Set("Access-Control-Expose-Headers", strings.Join(cors.ExposeHeaders, ", "))
+					w.Header().Add("Vary", "Origin")
+					break
+				}
+			}
+		}
+		if vals := r.Header.Values("Access-Control-Request-Headers"); len(vals) != 0 {
+			names := []string{}
+			for _, val := range vals {
+				for _, name := range strings.Split(val, ",") {
+					if name = strings.TrimSpace(name); name != "" {
+						names = append(names, name)
+					}
+				}
+			}
+			r.Header["Access-Control-Request-Headers"] = names
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// serve serves server's requests on listener until it's shut down. With a
+// certificate and key it serves TLS, and so HTTP/2, directly; otherwise
+// plain HTTP, for a proxy to terminate TLS in front of.
+func serve(server *http.Server, listener net.Listener, certFile, keyFile string) error {
+	if certFile != "" && keyFile != "" {
+		log.Printf("Listening for HTTPS on %s\n", listener.Addr())
+		return server.ServeTLS(listener, certFile, keyFile)
+	}
+	log.Printf("Listening for HTTP on %s\n", listener.Addr())
+	return server.Serve(listener)
+}
+
+// listenAddr returns the address to listen on: addr if it includes a port,
+// addr with port if it's only a host, or all interfaces on port if it's empty.
+func listenAddr(addr, port string) string {
+	if addr == "" {
+		return ":" + port
+	}
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(strings.Trim(addr, "[]"), port)
+}
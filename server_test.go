@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 and its key
+// to dir, returning their paths and a pool trusting the certificate.
+func writeTestCert(t *testing.T, dir string) (string, string, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "relaymsg test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err = os.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err = os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(certPEM)
+	return certFile, keyFile, pool
+}
+
+func TestServe(t *testing.T) {
+	certFile, keyFile, pool := writeTestCert(t, t.TempDir())
+	tests := []struct {
+		name              string
+		certFile, keyFile string
+		scheme            string
+		proto             string
+	}{
+		{"plain HTTP", "", "", "http", "HTTP/1.1"},
+		{"only a certificate", certFile, "", "http", "HTTP/1.1"},
+		{"TLS", certFile, keyFile, "https", "HTTP/2.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			server := &http.Server{Handler: http.HandlerFunc(VersionHandler)}
+			served := make(chan error, 1)
+			go func() {
+				served <- serve(server, listener, tt.certFile, tt.keyFile)
+			}()
+
+			client := &http.Client{Transport: &http.Transport{
+				TLSClientConfig:   &tls.Config{RootCAs: pool},
+				ForceAttemptHTTP2: true,
+			}}
+			res, err := client.Get(tt.scheme + "://" + listener.Addr().String() + "/version")
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				t.Errorf("status %d", res.StatusCode)
+			}
+			if res.Proto != tt.proto {
+				t.Errorf("served with %s, want %s", res.Proto, tt.proto)
+			}
+
+			if err = server.Shutdown(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if err = <-served; err != http.ErrServerClosed {
+				t.Errorf("serve returned %v, want http.ErrServerClosed", err)
+			}
+		})
+	}
+}
+
+func TestServerRoutes(t *testing.T) {
+	const token = "s3cret"
+	tests := []struct {
+		name       string
+		adminToken string
+		path       string
+		auth       string
+		status     int
+	}{
+		{"version", token, "/version", "", http.StatusOK},
+		{"summary", token, "/summary/user", "", http.StatusOK},
+		{"unknown route", token, "/nope", "", http.StatusNotFound},
+		{"admin without a token", token, "/admin/failures", "", http.StatusUnauthorized},
+		{"admin with the wrong token", token, "/admin/failures", "Bearer nope", http.StatusUnauthorized},
+		{"admin with a longer token", token, "/admin/failures", "Bearer " + token + "x", http.StatusUnauthorized},
+		{"admin with a basic auth token", token, "/admin/failures", "Basic " + token, http.StatusUnauthorized},
+		{"admin token in lowercase scheme", token, "/admin/failures", "bearer " + token, http.StatusUnauthorized},
+		{"admin with the token", token, "/admin/failures", "Bearer " + token, http.StatusOK},
+		{"admin disabled", "", "/admin/failures", "Bearer ", http.StatusUnauthorized},
+		{"raw HTML without a token", token, "/message/1/html?raw=1", "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, &RelayMsgParser{AdminToken: tt.adminToken}, nil, nil)
+			header := http.Header{}
+			if tt.auth != "" {
+				header.Set("Authorization", tt.auth)
+			}
+			status, body := get(t, ts, tt.path, header)
+			if status != tt.status {
+				t.Errorf("status %d, want %d: %s", status, tt.status, body)
+			}
+			if status == http.StatusUnauthorized {
+				if n := len(ts.DB.Queries("")); n != 0 {
+					t.Errorf("%d queries run for an unauthorized request", n)
+				}
+			}
+		})
+	}
+}
+
+func TestStatusRequiresAdmin(t *testing.T) {
+	const token = "s3cret"
+	tests := []struct {
+		name   string
+		auth   string
+		status int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"wrong token", "Bearer nope", http.StatusUnauthorized},
+		{"admin", "Bearer " + token, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, &RelayMsgParser{AdminToken: token}, nil, nil)
+			header := http.Header{}
+			if tt.auth != "" {
+				header.Set("Authorization", tt.auth)
+			}
+			status, body := postWith(t, ts, "/messages/user/status", []byte(`{"status": 1, "ids": "all"}`), header)
+			if status != tt.status {
+				t.Errorf("status %d, want %d: %s", status, tt.status, body)
+			}
+			if n := len(ts.DB.Queries("UPDATE")); (n != 0) != (tt.status == http.StatusOK) {
+				t.Errorf("%d updates run", n)
+			}
+		})
+	}
+}
+
+func TestServerCORS(t *testing.T) {
+	const origin = "https://app.example.com"
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		header  map[string]string
+		check   string
+		want    []string
+		missing bool
+	}{
+		{"preflight for an admin POST", "OPTIONS", "/messages/user/status", map[string]string{
+			"Access-Control-Request-Method":  "POST",
+			"Access-Control-Request-Headers": "content-type, authorization",
+		}, "Access-Control-Allow-Headers", []string{"content-type", "authorization"}, false},
+		{"preflight for a header not allowed", "OPTIONS", "/messages/user/status", map[string]string{
+			"Access-Control-Request-Method":  "POST",
+			"Access-Control-Request-Headers": "content-type, x-other",
+		}, "Access-Control-Allow-Headers", nil, true},
+		{"summary total", "GET", "/summary/user", nil, "Access-Control-Expose-Headers", []string{"x-total-count"}, false},
+		{"summary origin", "GET", "/summary/user", nil, "Access-Control-Allow-Origin", []string{origin}, false},
+		{"other origin", "GET", "/summary/user", map[string]string{"Origin": "https://evil.example"}, "Access-Control-Allow-Origin", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, &RelayMsgParser{}, map[string]string{"RELAYMSG_ALLOWED_ORIGIN": origin}, nil)
+			req, err := http.NewRequest(tt.method, ts.URL+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Origin", origin)
+			for name, val := range tt.header {
+				req.Header.Set(name, val)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			got := strings.ToLower(res.Header.Get(tt.check))
+			if tt.missing {
+				if got != "" {
+					t.Errorf("%s: %s, want none", tt.check, got)
+				}
+				return
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(got, want) {
+					t.Errorf("%s: %q, want %s in it", tt.check, got, want)
+				}
+			}
+		})
+	}
+}
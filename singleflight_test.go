@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestSummaryCancelledWaiter has two requests for the same cold summary
+// share a query, and one of them give up before it finishes. The other
+// should still get the result, whichever of them started the query.
+func TestSummaryCancelledWaiter(t *testing.T) {
+	tests := []struct {
+		name string
+		// cancelLeader is whether the request which started the query
+		// gives up, rather than the one waiting for it.
+		cancelLeader bool
+	}{
+		{"leader cancelled", true},
+		{"follower cancelled", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			started := make(chan struct{}, 1)
+			release := make(chan struct{})
+			ts := newTestServer(t, &RelayMsgParser{CacheTTL: time.Minute}, nil, func(q fakeQuery) (*fakeRows, error) {
+				if strings.Contains(q.SQL, "count(distinct(smtp_from))") {
+					started <- struct{}{}
+					<-release
+				}
+				return summaryRows(q)
+			})
+			type result struct {
+				status int
+				err    error
+			}
+			request := func(ctx context.Context, results chan<- result) {
+				req, err := http.NewRequestWithContext(ctx, "GET", ts.URL+"/summary/user", nil)
+				if err != nil {
+					results <- result{err: err}
+					return
+				}
+				res, err := http.DefaultClient.Do(req)
+				if err != nil {
+					results <- result{err: err}
+					return
+				}
+				io.Copy(io.Discard, res.Body)
+				res.Body.Close()
+				results <- result{status: res.StatusCode}
+			}
+
+			leaderCtx, cancelLeader := context.WithCancel(context.Background())
+			defer cancelLeader()
+			followerCtx, cancelFollower := context.WithCancel(context.Background())
+			defer cancelFollower()
+			leader, follower := make(chan result, 1), make(chan result, 1)
+			go request(leaderCtx, leader)
+			within(t, "starting the query", func() { <-started })
+			go request(followerCtx, follower)
+			// Give the follower time to join the query.
+			time.Sleep(100 * time.Millisecond)
+
+			cancelled, waiting := leader, follower
+			if tt.cancelLeader {
+				cancelLeader()
+			} else {
+				cancelled, waiting = follower, leader
+				cancelFollower()
+			}
+			within(t, "the cancelled request", func() {
+				if res := <-cancelled; res.err == nil {
+					t.Errorf("cancelled request got status %d", res.status)
+				}
+			})
+			// Give the server time to notice the request has gone.
+			time.Sleep(100 * time.Millisecond)
+			close(release)
+			within(t, "the waiting request", func() {
+				if res := <-waiting; res.err != nil || res.status != http.StatusOK {
+					t.Errorf("waiting request got status %d, error %v", res.status, res.err)
+				}
+			})
+			if n := len(ts.DB.Queries("count(distinct(smtp_from))")); n != 1 {
+				t.Errorf("%d queries were run, want 1", n)
+			}
+		})
+	}
+}
+
+// TestSummaryColdKey fires concurrent requests for summaries nobody has
+// asked for yet. The database holds the first query up for long enough
+// for the rest to arrive, which should wait for it rather than query too.
+func TestSummaryColdKey(t *testing.T) {
+	tests := []struct {
+		name       string
+		requests   int
+		localparts int
+	}{
+		{"one request", 1, 1},
+		{"same localpart", 20, 1},
+		{"two localparts", 20, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, &RelayMsgParser{CacheTTL: time.Minute}, nil, func(q fakeQuery) (*fakeRows, error) {
+				time.Sleep(100 * time.Millisecond)
+				return summaryRows(q)
+			})
+			var wg sync.WaitGroup
+			bodies := make([]string, tt.requests)
+			for i := 0; i < tt.requests; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					status, body := get(t, ts, fmt.Sprintf("/summary/user%d", i%tt.localparts), nil)
+					if status != 200 {
+						t.Errorf("status %d: %s", status, body)
+					}
+					bodies[i] = body
+				}(i)
+			}
+			wg.Wait()
+			if n := len(ts.DB.Queries("count(distinct(smtp_from))")); n != tt.localparts {
+				t.Errorf("%d queries were run, want %d", n, tt.localparts)
+			}
+			for i := tt.localparts; i < tt.requests; i++ {
+				if bodies[i] != bodies[i%tt.localparts] {
+					t.Errorf("request %d got %s, want %s", i, bodies[i], bodies[i%tt.localparts])
+				}
+			}
+		})
+	}
+}
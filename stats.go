@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	cache "github.com/patrickmn/go-cache"
+)
+
+type StatsResponse struct {
+	Messages            int64            `json:"messages"`
+	ByDomain            map[string]int64 `json:"messages_by_domain"`
+	Oldest              *time.Time       `json:"oldest_message"`
+	TableBytes          int64            `json:"table_bytes"`
+	UnprocessedRequests int64            `json:"unprocessed_requests"`
+	ParkedRequests      int64            `json:"parked_requests"`
+}
+
+// Stats gathers an overview of what's stored, for capacity planning.
+func (p *RelayMsgParser) Stats(ctx context.Context) (*StatsResponse, error) {
+	dbh := p.ReadDB()
+	st := &StatsResponse{ByDomain: map[string]int64{}}
+	var oldest sql.NullTime
+	err := dbh.QueryRowContext(ctx, fmt.Sprintf(`
+		SELECT count(*), min(created), pg_total_relation_size('%[1]s')
+		  FROM %[1]s
+	`, p.MsgTable())).Scan(&st.Messages, &oldest, &st.TableBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Stats (messages): %s", err)
+	}
+	if oldest.Valid {
+		st.Oldest = &oldest.Time
+	}
+
+	rows, err := dbh.QueryContext(ctx, fmt.Sprintf(`
+		SELECT lower(split_part(smtp_to, '@', 2)), count(*)
+		  FROM %s
+		 GROUP BY 1
+	`, p.MsgTable()))
+	if err != nil {
+		return nil, fmt.Errorf("Stats (domains): %s", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if rows.Err() == io.EOF {
+			break
+		}
+		var domain string
+		var n int64
+		if err = rows.Scan(&domain, &n); err != nil {
+			return nil, fmt.Errorf("Stats (Scan): %s", err)
+		}
+		st.ByDomain[domain] = n
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("Stats (Err): %s", err)
+	}
+
+	err = p.DumpDB().QueryRowContext(ctx, fmt.Sprintf(`
+		SELECT count(*) FROM %s.raw_requests
+		 WHERE (batch_id = 0 OR batch_id IS NULL)
+	`, p.Schema)).Scan(&st.UnprocessedRequests)
+	if err != nil {
+		return nil, fmt.Errorf("Stats (raw_requests): %s", err)
+	}
+	err = p.DumpDB().QueryRowContext(ctx, fmt.Sprintf(`
+		SELECT count(*) FROM %s.raw_requests WHERE batch_id = $1
+	`, p.Schema), ParkedBatchID).Scan(&st.ParkedRequests)
+	if err != nil {
+		return nil, fmt.Errorf("Stats (parked): %s", err)
+	}
+
+	return st, nil
+}
+
+// StatsHandler serves Stats as JSON, caching the result for a few seconds.
+func (p *RelayMsgParser) StatsHandler() http.HandlerFunc {
+	c := cache.New(10*time.Second, 5*time.Second)
+	return func(w http.ResponseWriter, r *http.Request) {
+		jsonUntyped, found := c.Get("stats")
+		if !found {
+			ctx, cancel := p.requestContext(r)
+			st, err := p.Stats(ctx)
+			cancel()
+			if err != nil {
+				log.Printf("%s", err)
+				writeJSONError(w, r, http.StatusInternalServerError, "database_error", "Database error")
+				return
+			}
+			jsonBytes, err := json.Marshal(st)
+			if err != nil {
+				log.Printf("Stats (JSON): %s", err)
+				writeJSONError(w, r, http.StatusInternalServerError, "encoding_error", "Encoding error")
+				return
+			}
+			c.Set("stats", jsonBytes, cache.DefaultExpiration)
+			jsonUntyped = jsonBytes
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonUntyped.([]byte))
+	}
+}
+
+type StorageResponse struct {
+	Recipient string `json:"recipient"`
+	Messages  int64  `json:"messages"`
+	Bytes     int64  `json:"bytes"`
+}
+
+// StorageHandler reports the number and total size of messages stored for
+// each recipient, largest first. The number of recipients returned may be
+// set with limit, up to 500.
+func (p *RelayMsgParser) StorageHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit, err := limitParam(r, 50, 500)
+		if err != nil {
+			writeJSONError(w, r, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+
+		ctx, cancel := p.requestContext(r)
+		defer cancel()
+		rows, err := p.ReadDB().QueryContext(ctx, fmt.Sprintf(`
+			SELECT coalesce(%s, ''), count(*), coalesce(sum(size_bytes), 0)
+			  FROM %s
+			 GROUP BY 1
+			 ORDER BY 3 DESC, 1
+			 LIMIT $1
+		`, p.recipientColumn(), p.MsgTable()), limit)
+		if err != nil {
+			log.Printf("StorageReport (SELECT): %s", err)
+			writeJSONError(w, r, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+		defer rows.Close()
+
+		list := []StorageResponse{}
+		for rows.Next() {
+			sr := StorageResponse{}
+			if err = rows.Scan(&sr.Recipient, &sr.Messages, &sr.Bytes); err != nil {
+				log.Printf("StorageReport (Scan): %s", err)
+				writeJSONError(w, r, http.StatusInternalServerError, "database_error", "Database error")
+				return
+			}
+			list = append(list, sr)
+		}
+		if err = rows.Err(); err != nil {
+			log.Printf("StorageReport (Err): %s", err)
+			writeJSONError(w, r, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+		writeJSON(w, r, map[string][]StorageResponse{"results": list})
+	}
+}
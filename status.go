@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/husobee/vestigo"
+)
+
+// MaxStatusIDs is the most message ids a single status update may name.
+const MaxStatusIDs int = 1000
+
+// StatusRequest is the body of a bulk status update. IDs is a list of
+// message ids, or the string "all"; it's treated as "all" when missing.
+type StatusRequest struct {
+	Status *int            `json:"status"`
+	IDs    json.RawMessage `json:"ids"`
+}
+
+// messageIDs returns the ids named by the request, or nil for all messages.
+func (sr *StatusRequest) messageIDs() ([]int64, error) {
+	if len(sr.IDs) == 0 {
+		return nil, nil
+	}
+	var all string
+	if err := json.Unmarshal(sr.IDs, &all); err == nil {
+		if all != "all" {
+			return nil, fmt.Errorf("ids must be a list of message ids or \"all\"")
+		}
+		return nil, nil
+	}
+	var ids []int64
+	if err := json.Unmarshal(sr.IDs, &ids); err != nil {
+		return nil, fmt.Errorf("ids must be a list of message ids or \"all\"")
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("ids must not be empty")
+	} else if len(ids) > MaxStatusIDs {
+		return nil, fmt.Errorf("at most %d ids may be updated at once", MaxStatusIDs)
+	}
+	return ids, nil
+}
+
+// int64Array formats ids as a PostgreSQL array literal.
+func int64Array(ids []int64) string {
+	strs := make([]string, len(ids))
+	for i, id := range ids {
+		strs[i] = strconv.FormatInt(id, 10)
+	}
+	return "{" + strings.Join(strs, ",") + "}"
+}
+
+// StatusHandler sets the status of many messages to the given localpart in
+// one go, like marking them all read. The JSON request body holds the new
+// status and the ids of the messages to update, or "all". Ids of messages to
+// other recipients are ignored. The response holds the number updated.
+func (p *RelayMsgParser) StatusHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		localpart := p.normalizeLocalpart(vestigo.Param(r, "localpart"))
+
+		var sr StatusRequest
+		err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&sr)
+		if err != nil || sr.Status == nil {
+			writeJSONError(w, r, http.StatusBadRequest, "bad_request", "Request body must be JSON like {\"status\": 1, \"ids\": [42]}")
+			return
+		}
+		if *sr.Status < 0 {
+			writeJSONError(w, r, http.StatusBadRequest, "bad_request", "status must not be negative")
+			return
+		}
+		ids, err := sr.messageIDs()
+		if err != nil {
+			writeJSONError(w, r, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+
+		query := fmt.Sprintf(`
+			UPDATE %s SET status_id = $3
+			 WHERE %s = $1 ||'@'|| $2
+		`, p.MsgTable(), p.recipientColumn())
+		args := []interface{}{localpart, p.Domain, *sr.Status}
+		if ids != nil {
+			query += " AND message_id = ANY($4::bigint[])"
+			args = append(args, int64Array(ids))
+		}
+
+		ctx, cancel := p.requestContext(r)
+		defer cancel()
+		res, err := p.Dbh.ExecContext(ctx, query, args...)
+		if err != nil {
+			log.Printf("UpdateStatus (UPDATE): %s", err)
+			writeJSONError(w, r, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			log.Printf("UpdateStatus (RowsAffected): %s", err)
+		}
+		p.invalidateSummaries(localpart)
+
+		writeJSON(w, r, map[string]interface{}{"status": *sr.Status, "updated": n})
+	}
+}
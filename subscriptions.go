@@ -0,0 +1,458 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/husobee/vestigo"
+)
+
+const SubscriptionTable string = "relay_subscriptions"
+
+// DefaultSubscriptionQueue is how many stored messages may wait for their
+// subscriptions to be called before more are dropped.
+const DefaultSubscriptionQueue int = 1000
+
+// DefaultSubscriptionWorkers is how many stored messages have their
+// subscriptions called at once, so a slow callback only holds up its own.
+const DefaultSubscriptionWorkers int = 8
+
+// DefaultSubscriptionMaxFailures is how many deliveries to a subscription
+// may fail in a row before it's disabled.
+const DefaultSubscriptionMaxFailures int = 10
+
+// MaxSubscriptions is the most callbacks one recipient may register.
+const MaxSubscriptions int = 10
+
+// Subscription is a callback URL registered for a recipient, which is
+// posted each new message for them.
+type Subscription struct {
+	ID  int64  `json:"id"`
+	URL string `json:"url"`
+	// Secret signs each post, like RELAYMSG_OUTBOUND_SECRET. It's only
+	// returned when the subscription is registered.
+	Secret    string     `json:"secret,omitempty"`
+	Created   time.Time  `json:"created"`
+	Failures  int        `json:"failures"`
+	LastError string     `json:"last_error,omitempty"`
+	Disabled  *time.Time `json:"disabled,omitempty"`
+}
+
+// SubscriptionMessage is posted to a subscription for each new message.
+type SubscriptionMessage struct {
+	MessageListItem
+	SubscriptionID int64 `json:"subscription_id"`
+}
+
+// Subscriptions calls the callbacks recipients have registered when new
+// messages are stored for them. Like OutboundWebhook, calls are made in the
+// background, with stored messages waiting in a bounded queue, by a pool of
+// workers; each message's callbacks are called at once. A subscription
+// which fails MaxFailures times in a row is disabled until it's registered
+// again. Callbacks are only called on public addresses.
+type Subscriptions struct {
+	Dbh         *sql.DB
+	Schema      string
+	MaxFailures int
+	Client      *http.Client
+
+	queue chan *MessageListItem
+}
+
+// NewSubscriptions returns a Subscriptions with room for size messages in
+// its queue, and the given number of workers calling subscriptions until
+// ctx is done.
+func NewSubscriptions(ctx context.Context, dbh *sql.DB, schema string, size, workers int) *Subscriptions {
+	if size < 1 {
+		size = DefaultSubscriptionQueue
+	}
+	if workers < 1 {
+		workers = DefaultSubscriptionWorkers
+	}
+	s := &Subscriptions{
+		Dbh:         dbh,
+		Schema:      schema,
+		MaxFailures: DefaultSubscriptionMaxFailures,
+		Client:      newCallbackClient(),
+		queue:       make(chan *MessageListItem, size),
+	}
+	for i := 0; i < workers; i++ {
+		go s.run(ctx)
+	}
+	return s
+}
+
+var errPrivateAddress = errors.New("not a public address")
+
+// nonPublicNets are ranges callbacks can't be called on, besides those the
+// net.IP methods know about.
+var nonPublicNets = parseCIDRs("0.0.0.0/8", "100.64.0.0/10", "192.0.0.0/24", "198.18.0.0/15", "240.0.0.0/4")
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, nets[i], _ = net.ParseCIDR(cidr)
+	}
+	return nets
+}
+
+// isPublicIP reports whether ip is on the public internet, rather than
+// loopback, private, link-local (like the 169.254.169.254 cloud metadata
+// service) or otherwise special.
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, n := range nonPublicNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// publicOnly is a net.Dialer Control function which refuses to connect to
+// addresses which aren't public. It's checked with the address actually
+// being dialed, after the name is resolved, so DNS can't be used to point a
+// callback inside the network, and it applies to redirects too.
+func publicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+		return fmt.Errorf("%w: %s", errPrivateAddress, host)
+	}
+	return nil
+}
+
+// newCallbackClient returns a client for calling subscriptions, which only
+// connects to public addresses, and never through a proxy.
+func newCallbackClient() *http.Client {
+	dialer := &net.Dialer{Timeout: OutboundTimeout, Control: publicOnly}
+	return &http.Client{
+		Timeout: OutboundTimeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: OutboundTimeout,
+			MaxIdleConnsPerHost: 2,
+			IdleConnTimeout:     time.Minute,
+		},
+	}
+}
+
+// SchemaInit creates the table subscriptions are kept in.
+func (s *Subscriptions) SchemaInit() error {
+	return createTable(s.Dbh, s.Schema, SubscriptionTable, []string{
+		fmt.Sprintf(`
+			CREATE TABLE IF NOT EXISTS %s.%s (
+				subscription_id  bigserial primary key,
+				address          text not null,
+				url              text not null,
+				secret           text not null,
+				created          timestamptz default clock_timestamp(),
+				failures         integer not null default 0,
+				last_error       text,
+				disabled_at      timestamptz,
+				unique (address, url)
+			)
+		`, s.Schema, SubscriptionTable),
+	})
+}
+
+func (s *Subscriptions) table() string {
+	return s.Schema + "." + SubscriptionTable
+}
+
+// Enqueue queues item for its recipient's subscriptions, or drops it if the
+// queue is full.
+func (s *Subscriptions) Enqueue(item *MessageListItem) {
+	select {
+	case s.queue <- item:
+	default:
+		log.Printf("Subscriptions: queue full, dropping message %d\n", item.ID)
+		batchMetrics.Add("subscription_dropped", 1)
+	}
+}
+
+func (s *Subscriptions) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case item := <-s.queue:
+			s.deliver(ctx, item)
+		}
+	}
+}
+
+// deliver calls each enabled subscription for item's recipient.
+func (s *Subscriptions) deliver(ctx context.Context, item *MessageListItem) {
+	rows, err := s.Dbh.QueryContext(ctx, fmt.Sprintf(`
+		SELECT subscription_id, url, secret FROM %s
+		 WHERE address = $1 AND disabled_at IS NULL
+	`, s.table()), item.ToBase)
+	if err != nil {
+		log.Printf("Subscriptions (SELECT): message %d: %s\n", item.ID, err)
+		return
+	}
+	subs := []Subscription{}
+	for rows.Next() {
+		var sub Subscription
+		if err = rows.Scan(&sub.ID, &sub.URL, &sub.Secret); err != nil {
+			break
+		}
+		subs = append(subs, sub)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+	if err != nil {
+		log.Printf("Subscriptions (Scan): message %d: %s\n", item.ID, err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for i := range subs {
+		body, err := json.Marshal(&SubscriptionMessage{MessageListItem: *item, SubscriptionID: subs[i].ID})
+		if err != nil {
+			log.Printf("Subscriptions (JSON): message %d: %s\n", item.ID, err)
+			break
+		}
+		wg.Add(1)
+		go func(sub *Subscription) {
+			defer wg.Done()
+			s.call(ctx, sub, body)
+		}(&subs[i])
+	}
+	wg.Wait()
+}
+
+// call posts body to sub, retrying failures with a growing delay, and
+// records the outcome.
+func (s *Subscriptions) call(ctx context.Context, sub *Subscription, body []byte) {
+	var err error
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		if err = postSigned(ctx, s.Client, sub.URL, sub.Secret, body); err == nil {
+			break
+		}
+		if attempt >= OutboundAttempts {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+
+	if err == nil {
+		batchMetrics.Add("subscription_sent", 1)
+		_, err = s.Dbh.ExecContext(ctx, fmt.Sprintf(`
+			UPDATE %s SET failures = 0, last_error = NULL
+			 WHERE subscription_id = $1 AND failures > 0
+		`, s.table()), sub.ID)
+		if err != nil {
+			log.Printf("Subscriptions (UPDATE): %s\n", err)
+		}
+		return
+	}
+
+	batchMetrics.Add("subscription_failed", 1)
+	var disabled bool
+	err = s.Dbh.QueryRowContext(ctx, fmt.Sprintf(`
+		UPDATE %s
+		   SET failures = failures + 1, last_error = $2,
+		       disabled_at = CASE WHEN $3 > 0 AND failures + 1 >= $3 THEN now() END
+		 WHERE subscription_id = $1
+		RETURNING disabled_at IS NOT NULL
+	`, s.table()), sub.ID, err.Error(), s.MaxFailures).Scan(&disabled)
+	if err != nil {
+		log.Printf("Subscriptions (UPDATE): %s\n", err)
+	} else if disabled {
+		log.Printf("Subscriptions: disabled subscription %d after %d failures\n", sub.ID, s.MaxFailures)
+		batchMetrics.Add("subscription_disabled", 1)
+	}
+}
+
+// validCallbackURL reports whether u is an absolute http or https URL,
+// which isn't obviously for a private address. Names are only resolved
+// when the callback is called.
+func validCallbackURL(u string) bool {
+	parsed, err := url.Parse(u)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Hostname() == "" {
+		return false
+	}
+	host := strings.ToLower(strings.TrimSuffix(parsed.Hostname(), "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil && !isPublicIP(ip) {
+		return false
+	}
+	return true
+}
+
+// subscriptionsFor returns p.Subscriptions, or responds with a 404 when
+// subscriptions aren't enabled.
+func (p *RelayMsgParser) subscriptionsFor(w http.ResponseWriter, r *http.Request) *Subscriptions {
+	if p.Subscriptions == nil {
+		writeJSONError(w, r, http.StatusNotFound, "not_found", "Subscriptions are not enabled")
+	}
+	return p.Subscriptions
+}
+
+// SubscriptionsHandler lists the callbacks registered for the given
+// localpart, including disabled ones, without their secrets. Like
+// registering and removing callbacks, it's for admins only.
+func (p *RelayMsgParser) SubscriptionsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := p.subscriptionsFor(w, r)
+		if s == nil {
+			return
+		}
+		localpart := p.normalizeLocalpart(vestigo.Param(r, "localpart"))
+
+		ctx, cancel := p.requestContext(r)
+		defer cancel()
+		rows, err := s.Dbh.QueryContext(ctx, fmt.Sprintf(`
+			SELECT subscription_id, url, created, failures,
+			       coalesce(last_error, ''), disabled_at
+			  FROM %s
+			 WHERE address = $1 ||'@'|| $2
+			 ORDER BY subscription_id
+		`, s.table()), localpart, p.Domain)
+		if err != nil {
+			log.Printf("ListSubscriptions (SELECT): %s", err)
+			writeJSONError(w, r, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+		defer rows.Close()
+
+		list := []Subscription{}
+		for rows.Next() {
+			var sub Subscription
+			var disabled sql.NullTime
+			if err = rows.Scan(&sub.ID, &sub.URL, &sub.Created, &sub.Failures,
+				&sub.LastError, &disabled); err != nil {
+				log.Printf("ListSubscriptions (Scan): %s", err)
+				writeJSONError(w, r, http.StatusInternalServerError, "database_error", "Database error")
+				return
+			}
+			if disabled.Valid {
+				sub.Disabled = &disabled.Time
+			}
+			list = append(list, sub)
+		}
+		if err = rows.Err(); err != nil {
+			log.Printf("ListSubscriptions (Err): %s", err)
+			writeJSONError(w, r, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+		writeJSON(w, r, map[string][]Subscription{"results": list})
+	}
+}
+
+// SubscribeHandler registers a callback URL for the given localpart, from a
+// JSON body like {"url": "https://example.com/new-mail"}. The response
+// includes the secret posts are signed with. Registering a URL again gives
+// it a new secret, and enables it again if it was disabled.
+func (p *RelayMsgParser) SubscribeHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := p.subscriptionsFor(w, r)
+		if s == nil {
+			return
+		}
+		localpart := p.normalizeLocalpart(vestigo.Param(r, "localpart"))
+
+		var req struct {
+			URL string `json:"url"`
+		}
+		err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&req)
+		if err != nil || !validCallbackURL(req.URL) {
+			writeJSONError(w, r, http.StatusBadRequest, "bad_request", "Request body must be JSON like {\"url\": \"https://example.com/new-mail\"}")
+			return
+		}
+		secret := make([]byte, 32)
+		if _, err = rand.Read(secret); err != nil {
+			log.Printf("Subscribe (secret): %s", err)
+			writeJSONError(w, r, http.StatusInternalServerError, "internal_error", "Internal error")
+			return
+		}
+
+		ctx, cancel := p.requestContext(r)
+		defer cancel()
+		sub := Subscription{URL: req.URL, Secret: hex.EncodeToString(secret)}
+		err = s.Dbh.QueryRowContext(ctx, fmt.Sprintf(`
+			INSERT INTO %[1]s (address, url, secret)
+			SELECT $1 ||'@'|| $2, $3, $4
+			 WHERE (SELECT count(*) FROM %[1]s WHERE address = $1 ||'@'|| $2 AND url <> $3) < $5
+			ON CONFLICT (address, url) DO UPDATE
+			   SET secret = EXCLUDED.secret, failures = 0, last_error = NULL, disabled_at = NULL
+			RETURNING subscription_id, created
+		`, s.table()), localpart, p.Domain, sub.URL, sub.Secret, MaxSubscriptions).Scan(&sub.ID, &sub.Created)
+		if err == sql.ErrNoRows {
+			writeJSONError(w, r, http.StatusConflict, "too_many_subscriptions",
+				fmt.Sprintf("At most %d callbacks may be registered for a recipient", MaxSubscriptions))
+			return
+		} else if err != nil {
+			log.Printf("Subscribe (INSERT): %s", err)
+			writeJSONError(w, r, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+		writeJSONStatus(w, r, http.StatusCreated, sub)
+	}
+}
+
+// UnsubscribeHandler removes one of the given localpart's subscriptions.
+func (p *RelayMsgParser) UnsubscribeHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := p.subscriptionsFor(w, r)
+		if s == nil {
+			return
+		}
+		localpart := p.normalizeLocalpart(vestigo.Param(r, "localpart"))
+		id, err := strconv.ParseInt(vestigo.Param(r, "id"), 10, 64)
+		if err != nil {
+			writeJSONError(w, r, http.StatusBadRequest, "invalid_id", "Invalid subscription id")
+			return
+		}
+
+		ctx, cancel := p.requestContext(r)
+		defer cancel()
+		res, err := s.Dbh.ExecContext(ctx, fmt.Sprintf(`
+			DELETE FROM %s
+			 WHERE subscription_id = $1 AND address = $2 ||'@'|| $3
+		`, s.table()), id, localpart, p.Domain)
+		if err != nil {
+			log.Printf("Unsubscribe (DELETE): %s", err)
+			writeJSONError(w, r, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			writeJSONError(w, r, http.StatusNotFound, "not_found", "No such subscription")
+			return
+		}
+		writeJSON(w, r, map[string]interface{}{"id": id, "deleted": true})
+	}
+}
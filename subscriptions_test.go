@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIsPublicIP(t *testing.T) {
+	tests := []struct {
+		ip     string
+		public bool
+	}{
+		{"93.184.216.34", true},
+		{"8.8.8.8", true},
+		{"2606:4700:4700::1111", true},
+		{"169.254.169.254", false},
+		{"127.0.0.1", false},
+		{"127.1.2.3", false},
+		{"10.0.0.1", false},
+		{"172.16.5.4", false},
+		{"192.168.1.1", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"0.1.2.3", false},
+		{"224.0.0.1", false},
+		{"::1", false},
+		{"::", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:169.254.169.254", false},
+	}
+	for _, tt := range tests {
+		if got := isPublicIP(net.ParseIP(tt.ip)); got != tt.public {
+			t.Errorf("isPublicIP(%s) = %t, want %t", tt.ip, got, tt.public)
+		}
+	}
+}
+
+func TestValidCallbackURL(t *testing.T) {
+	tests := []struct {
+		url   string
+		valid bool
+	}{
+		{"https://example.com/new-mail", true},
+		{"http://example.com:8080/hook", true},
+		{"https://93.184.216.34/hook", true},
+		{"ftp://example.com/", false},
+		{"/new-mail", false},
+		{"https://", false},
+		{"http://localhost/hook", false},
+		{"http://LOCALHOST./hook", false},
+		{"http://api.localhost/hook", false},
+		{"http://127.0.0.1:8080/hook", false},
+		{"http://169.254.169.254/latest/meta-data/", false},
+		{"http://10.1.2.3/hook", false},
+		{"http://[::1]/hook", false},
+		{"http://[fe80::1]/hook", false},
+	}
+	for _, tt := range tests {
+		if got := validCallbackURL(tt.url); got != tt.valid {
+			t.Errorf("validCallbackURL(%q) = %t, want %t", tt.url, got, tt.valid)
+		}
+	}
+}
+
+// TestCallbackClientPrivate checks callbacks can't reach addresses inside
+// the network, however the URL names them.
+func TestCallbackClientPrivate(t *testing.T) {
+	var called atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called.Store(true)
+	}))
+	defer srv.Close()
+	_, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	redirect := httptest.NewServer(http.RedirectHandler(srv.URL, http.StatusFound))
+	defer redirect.Close()
+
+	tests := []struct {
+		name string
+		url  string
+	}{
+		{"loopback", srv.URL},
+		{"name for loopback", "http://localhost:" + port},
+		{"redirect", redirect.URL},
+	}
+	client := newCallbackClient()
+	for _, tt := range tests {
+		err := postSigned(context.Background(), client, tt.url, "", []byte("{}"))
+		if !errors.Is(err, errPrivateAddress) {
+			t.Errorf("%s: error %v, want %v", tt.name, err, errPrivateAddress)
+		}
+	}
+	if called.Load() {
+		t.Error("a private address was called")
+	}
+}
+
+func TestSubscriptionRoutesRequireAdmin(t *testing.T) {
+	const token = "s3cret"
+	tests := []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{"GET", "/subscriptions/user", ""},
+		{"POST", "/subscriptions/user", `{"url": "https://example.com/new-mail"}`},
+		{"DELETE", "/subscriptions/user/1", ""},
+	}
+	for _, tt := range tests {
+		for _, auth := range []string{"", "Bearer nope", "Bearer " + token} {
+			p := &RelayMsgParser{AdminToken: token}
+			ts := newTestServer(t, p, nil, func(q fakeQuery) (*fakeRows, error) {
+				return &fakeRows{Vals: [][]driver.Value{{int64(1), time.Now()}}}, nil
+			})
+			p.Subscriptions = &Subscriptions{Dbh: p.Dbh, Schema: p.Schema}
+			req, err := http.NewRequest(tt.method, ts.URL+tt.path, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if auth != "" {
+				req.Header.Set("Authorization", auth)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			admin := auth == "Bearer "+token
+			if unauthorized := res.StatusCode == http.StatusUnauthorized; unauthorized == admin {
+				t.Errorf("%s %s with %q: status %d", tt.method, tt.path, auth, res.StatusCode)
+			}
+			if n := len(ts.DB.Queries("")); !admin && n != 0 {
+				t.Errorf("%s %s with %q: %d queries", tt.method, tt.path, auth, n)
+			}
+		}
+	}
+}
+
+// TestSubscriptionsSlowCallback checks a callback which hangs doesn't hold
+// up others, for the same message or for others being delivered by the
+// other workers.
+func TestSubscriptionsSlowCallback(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+	fast := make(chan string, 10)
+	fastSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fast <- r.URL.Path
+	}))
+	defer fastSrv.Close()
+
+	// Each recipient has the slow callback, and a fast one.
+	db, _ := newFakeDB(t, func(q fakeQuery) (*fakeRows, error) {
+		if !strings.Contains(q.SQL, "SELECT subscription_id, url, secret") {
+			return nil, nil
+		}
+		to := q.Args[0].(string)
+		return &fakeRows{Vals: [][]driver.Value{
+			{int64(1), slow.URL, "secret"},
+			{int64(2), fastSrv.URL + "/" + to, "secret"},
+		}}, nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := NewSubscriptions(ctx, db, "relaymsg", 10, 2)
+	// The test servers are on loopback.
+	s.Client = &http.Client{Timeout: time.Minute}
+
+	tests := []string{"a@example.com", "b@example.com"}
+	for i, to := range tests {
+		s.Enqueue(&MessageListItem{ID: int64(i), To: to, ToBase: to})
+	}
+	for _, to := range tests {
+		select {
+		case got := <-fast:
+			if !strings.HasPrefix(got, "/") || !strings.HasSuffix(got, "@example.com") {
+				t.Errorf("called %s", got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("fast callback for %s held up by a slow one", to)
+		}
+	}
+}
@@ -0,0 +1,549 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	// Time zone names for tz are checked even where the system has no
+	// zoneinfo database.
+	_ "time/tzdata"
+
+	"github.com/husobee/vestigo"
+	"golang.org/x/sync/singleflight"
+)
+
+type SummaryResponse struct {
+	Subject string `json:"subject"`
+	Count   int    `json:"count"`
+}
+
+type SenderResponse struct {
+	From  string `json:"from"`
+	Count int    `json:"count"`
+}
+
+// summaryResult is what the summary handlers keep in their cache, so the total
+// can be reported on cache hits without decoding the JSON body again.
+type summaryResult struct {
+	Body  []byte
+	Total int
+}
+
+// summaryQuery describes one of the aggregate queries served under /summary.
+// Query is formatted with the message table, the recipient column and any
+// extra predicates from summaryFilter, and is passed the localpart and domain as $1 and $2.
+// Sorts maps the names accepted by the sort parameter to ORDER BY clauses,
+// and DefaultSort names the one used when none is given. Queries which
+// group by time set Intervals, mapping the names accepted by the interval
+// parameter to date_trunc units, and are formatted with the unit and the
+// placeholder holding the time zone as well.
+// New returns an empty result, along with pointers to scan each column of a
+// row into.
+type summaryQuery struct {
+	Name            string
+	Query           string
+	Sorts           map[string]string
+	DefaultSort     string
+	Intervals       map[string]string
+	DefaultInterval string
+	New             func() (interface{}, []interface{})
+}
+
+// NoSubject stands in for the subject of messages without one in summaries.
+const NoSubject string = "(no subject)"
+
+// strippedSubjectExpr is a message's subject without any reply or forward
+// prefixes, like "Re: " or "Fwd[2]: ", and with runs of whitespace
+// collapsed.
+const strippedSubjectExpr = `btrim(regexp_replace(regexp_replace(coalesce(subject, ''),
+				'^\s*((re|fwd?)\s*(\[\d+\])?\s*:\s*)+', '', 'i'), '\s+', ' ', 'g'))`
+
+// subjectSummaryQuery counts distinct senders by subject. With normalize,
+// subjects are grouped by strippedSubjectExpr regardless of case, and each
+// group is shown with one of its stripped subjects.
+func subjectSummaryQuery(normalize bool) string {
+	if normalize {
+		return `
+			SELECT coalesce(nullif(min(` + strippedSubjectExpr + `), ''), '` + NoSubject + `'),
+			       count(distinct(smtp_from))
+				FROM %s
+			 WHERE %s = $1 ||'@'|| $2%s
+			 GROUP BY lower(` + strippedSubjectExpr + `)
+		`
+	}
+	return `
+			SELECT coalesce(nullif(subject, ''), '` + NoSubject + `'), count(distinct(smtp_from))
+				FROM %s
+			 WHERE %s = $1 ||'@'|| $2%s
+			 GROUP BY 1
+		`
+}
+
+// SummaryHandler returns counts of distinct senders grouped by subject for
+// the given localpart. Messages with a missing or empty subject are grouped
+// under NoSubject. The response is always of the form
+// {"results": [...]}, with an empty array when nothing matched, and the
+// X-Total-Count header holds the total number of results across all pages.
+// Passing strict=1 returns a 404 instead when there are no messages for the
+// recipient. Results are sorted by count, or by subject with sort=subject,
+// and may be paged through with limit and offset. With NormalizeSubjects,
+// subjects differing only in Re: and Fwd: prefixes, whitespace or case are
+// grouped together.
+func (p *RelayMsgParser) SummaryHandler() http.HandlerFunc {
+	return p.summaryHandler(summaryQuery{
+		Name:  "SummarizeEvents",
+		Query: subjectSummaryQuery(p.NormalizeSubjects),
+		Sorts: map[string]string{
+			"count":   "2 DESC, 1",
+			"subject": "1, 2 DESC",
+		},
+		DefaultSort: "count",
+		New: func() (interface{}, []interface{}) {
+			s := &SummaryResponse{}
+			return s, []interface{}{&s.Subject, &s.Count}
+		},
+	})
+}
+
+// SendersHandler returns the number of messages from each sender to the given
+// localpart, busiest senders first. The response shape matches SummaryHandler.
+func (p *RelayMsgParser) SendersHandler() http.HandlerFunc {
+	return p.summaryHandler(summaryQuery{
+		Name: "SummarizeSenders",
+		Query: `
+			SELECT smtp_from, count(*)
+				FROM %s
+			 WHERE %s = $1 ||'@'|| $2%s
+			 GROUP BY 1
+		`,
+		Sorts: map[string]string{
+			"count": "2 DESC, 1",
+			"from":  "1, 2 DESC",
+		},
+		DefaultSort: "count",
+		New: func() (interface{}, []interface{}) {
+			s := &SenderResponse{}
+			return s, []interface{}{&s.From, &s.Count}
+		},
+	})
+}
+
+type TimelineResponse struct {
+	Bucket time.Time `json:"bucket"`
+	Count  int       `json:"count"`
+}
+
+// inLocation shows the bucket in the time zone it was computed in.
+func (t *TimelineResponse) inLocation(loc *time.Location) {
+	t.Bucket = t.Bucket.In(loc)
+}
+
+// TimelineHandler returns the number of messages to the given localpart in
+// each day, or each hour or week with interval=hour or interval=week, for
+// charting. Buckets start at midnight (or the hour) in the IANA time zone
+// named by tz, UTC by default. Buckets without messages are left out.
+func (p *RelayMsgParser) TimelineHandler() http.HandlerFunc {
+	return p.summaryHandler(summaryQuery{
+		Name: "SummarizeTimeline",
+		Query: `
+			SELECT date_trunc('%[4]s', created AT TIME ZONE %[5]s) AT TIME ZONE %[5]s, count(*)
+				FROM %[1]s
+			 WHERE %[2]s = $1 ||'@'|| $2%[3]s
+			 GROUP BY 1
+		`,
+		Sorts: map[string]string{
+			"bucket": "1",
+		},
+		DefaultSort: "bucket",
+		Intervals: map[string]string{
+			"hour": "hour",
+			"day":  "day",
+			"week": "week",
+		},
+		DefaultInterval: "day",
+		New: func() (interface{}, []interface{}) {
+			s := &TimelineResponse{}
+			return s, []interface{}{&s.Bucket, &s.Count}
+		},
+	})
+}
+
+// localizer is implemented by summary results holding times, so they can be
+// shown in the time zone requested.
+type localizer interface {
+	inLocation(loc *time.Location)
+}
+
+// summaryFilter holds the optional query parameters which narrow down the
+// messages a summary is computed over, and which page of results is returned.
+type summaryFilter struct {
+	Since *time.Time
+	Until *time.Time
+	// Status, when set, matches messages with that status.
+	Status *int
+	// MetaKey and MetaValue, when MetaKey is set, match messages whose
+	// metadata has that key with that value.
+	MetaKey   string
+	MetaValue string
+	// Route, when set, matches messages stored under that webhook route.
+	Route    string
+	Sort     string
+	Interval string
+	// TZ names the time zone time buckets are computed in, and Location is
+	// the same zone.
+	TZ       string
+	Location *time.Location
+	Limit    int
+	Offset   int
+}
+
+// parseSummaryFilter reads the filter for q from the query string. since and
+// until may each be an RFC3339 timestamp or seconds since the epoch.
+func parseSummaryFilter(r *http.Request, q *summaryQuery) (*summaryFilter, error) {
+	f := &summaryFilter{}
+	var err error
+	vals := r.URL.Query()
+
+	f.Sort = vals.Get("sort")
+	if f.Sort == "" {
+		f.Sort = q.DefaultSort
+	} else if _, ok := q.Sorts[f.Sort]; !ok {
+		return nil, fmt.Errorf("invalid sort: %q", f.Sort)
+	}
+	if q.Intervals != nil {
+		f.Interval = vals.Get("interval")
+		if f.Interval == "" {
+			f.Interval = q.DefaultInterval
+		} else if _, ok := q.Intervals[f.Interval]; !ok {
+			return nil, fmt.Errorf("invalid interval: %q", f.Interval)
+		}
+		f.TZ = vals.Get("tz")
+		if f.TZ == "" {
+			f.TZ = "UTC"
+		}
+		if f.Location, err = time.LoadLocation(f.TZ); err != nil || f.TZ == "Local" {
+			return nil, fmt.Errorf("invalid tz: %q", f.TZ)
+		}
+	}
+	if val := vals.Get("limit"); val != "" {
+		if f.Limit, err = strconv.Atoi(val); err != nil || f.Limit < 1 {
+			return nil, fmt.Errorf("invalid limit: %q", val)
+		}
+	}
+	if val := vals.Get("offset"); val != "" {
+		if f.Offset, err = strconv.Atoi(val); err != nil || f.Offset < 0 {
+			return nil, fmt.Errorf("invalid offset: %q", val)
+		}
+	}
+
+	if f.Since, err = parseTimeParam(vals.Get("since")); err != nil {
+		return nil, fmt.Errorf("invalid since: %s", err)
+	}
+	if f.Until, err = parseTimeParam(vals.Get("until")); err != nil {
+		return nil, fmt.Errorf("invalid until: %s", err)
+	}
+	if val := vals.Get("status"); val != "" {
+		status, err := strconv.Atoi(val)
+		if err != nil || status < 0 {
+			return nil, fmt.Errorf("invalid status: %q", val)
+		}
+		f.Status = &status
+	}
+	f.MetaKey, f.MetaValue = vals.Get("meta_key"), vals.Get("meta_value")
+	if f.MetaKey == "" && f.MetaValue != "" {
+		return nil, fmt.Errorf("meta_value requires meta_key")
+	}
+	if f.Route, err = routeParam(r); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func parseTimeParam(val string) (*time.Time, error) {
+	if val == "" {
+		return nil, nil
+	}
+	if digits.MatchString(val) {
+		secs, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		t := time.Unix(secs, 0)
+		return &t, nil
+	}
+	t, err := time.Parse(time.RFC3339, val)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// Where returns SQL predicates for the filter, each starting with AND, and
+// args with the corresponding values appended.
+func (f *summaryFilter) Where(args []interface{}) (string, []interface{}) {
+	where := ""
+	if f.Since != nil {
+		args = append(args, *f.Since)
+		where += fmt.Sprintf(" AND created >= $%d", len(args))
+	}
+	if f.Until != nil {
+		args = append(args, *f.Until)
+		where += fmt.Sprintf(" AND created <= $%d", len(args))
+	}
+	if f.Status != nil {
+		args = append(args, *f.Status)
+		where += fmt.Sprintf(" AND status_id = $%d", len(args))
+	}
+	if f.MetaKey != "" {
+		args = append(args, f.MetaKey, f.MetaValue)
+		where += fmt.Sprintf(" AND metadata->>$%d = $%d", len(args)-1, len(args))
+	}
+	if f.Route != "" {
+		args = append(args, f.Route)
+		where += fmt.Sprintf(" AND route = $%d", len(args))
+	}
+	return where, args
+}
+
+// Key identifies the filter as part of a cache key. Every field of the filter
+// must be represented here.
+func (f *summaryFilter) Key() string {
+	key := fmt.Sprintf("|sort=%s|interval=%s|tz=%s|limit=%d|offset=%d", f.Sort, f.Interval, f.TZ, f.Limit, f.Offset)
+	if f.Since != nil {
+		key += "|since=" + f.Since.UTC().Format(time.RFC3339Nano)
+	}
+	if f.Until != nil {
+		key += "|until=" + f.Until.UTC().Format(time.RFC3339Nano)
+	}
+	if f.Status != nil {
+		key += fmt.Sprintf("|status=%d", *f.Status)
+	}
+	if f.MetaKey != "" {
+		key += fmt.Sprintf("|meta=%q=%q", f.MetaKey, f.MetaValue)
+	}
+	if f.Route != "" {
+		key += "|route=" + f.Route
+	}
+	return key
+}
+
+// summaryCacheKey builds a cache key from everything that affects the result
+// of a summary query, so differently filtered requests never share an entry.
+func (p *RelayMsgParser) summaryCacheKey(localpart string, f *summaryFilter) string {
+	return p.summaryCachePrefix(localpart) + f.Key()
+}
+
+// summaryCachePrefix starts the cache key of every summary for localpart.
+// Filter keys start with a "|", so one recipient's prefix can't match
+// another's.
+func (p *RelayMsgParser) summaryCachePrefix(localpart string) string {
+	return fmt.Sprintf("%q@%q", localpart, p.Domain)
+}
+
+// invalidateSummaries drops every cached summary for localpart.
+func (p *RelayMsgParser) invalidateSummaries(localpart string) {
+	prefix := p.summaryCachePrefix(localpart) + "|"
+	for _, c := range p.summaryCaches {
+		c.DeletePrefix(prefix)
+	}
+}
+
+// errSummaryEncoding means a summary was read but couldn't be encoded.
+var errSummaryEncoding = errors.New("encoding error")
+
+func (p *RelayMsgParser) summaryHandler(q summaryQuery) http.HandlerFunc {
+	c := p.newSummaryCache(q.Name, 0)
+	// Requests which miss the cache while the same summary is being read
+	// wait for that query rather than running their own.
+	flights := &singleflight.Group{}
+	return func(w http.ResponseWriter, r *http.Request) {
+		localpart := p.normalizeLocalpart(vestigo.Param(r, "localpart"))
+		strict := r.URL.Query().Get("strict") == "1"
+		filter, err := parseSummaryFilter(r, &q)
+		if err != nil {
+			writeJSONError(w, r, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+		key := p.summaryCacheKey(localpart, filter)
+
+		// Check cache first
+		if sr, found := c.Get(key); found {
+			log.Printf("%s (cache): hit for [%s]", q.Name, key)
+			writeSummary(w, r, sr, strict)
+			return
+		}
+
+		ctx, cancel := p.requestContext(r)
+		defer cancel()
+		// The query is shared with every request waiting for key, so it
+		// carries on if this one goes away; each request only stops
+		// waiting when its own context is done.
+		ch := flights.DoChan(key, func() (interface{}, error) {
+			ctx, cancel := p.sharedContext(r)
+			defer cancel()
+			sr, err := p.loadSummary(ctx, &q, localpart, filter)
+			if err == nil {
+				// Add result to cache
+				c.Set(key, sr)
+			}
+			return sr, err
+		})
+		var res singleflight.Result
+		select {
+		case res = <-ch:
+		case <-ctx.Done():
+			res.Err = ctx.Err()
+		}
+		val, err, shared := res.Val, res.Err, res.Shared
+		if err != nil {
+			if errors.Is(err, errSummaryEncoding) {
+				writeJSONError(w, r, http.StatusInternalServerError, "encoding_error", "Encoding error")
+			} else {
+				writeJSONError(w, r, http.StatusInternalServerError, "database_error", "Database error")
+			}
+			return
+		}
+		if shared {
+			log.Printf("%s (cache): shared a query for [%s]", q.Name, key)
+		}
+		writeSummary(w, r, val.(*summaryResult), strict)
+	}
+}
+
+// loadSummary runs q for localpart, logging any error.
+func (p *RelayMsgParser) loadSummary(ctx context.Context, q *summaryQuery, localpart string, filter *summaryFilter) (*summaryResult, error) {
+	where, args := filter.Where([]interface{}{localpart, p.Domain})
+	fmtArgs := []interface{}{p.MsgTable(), p.recipientColumn(), where}
+	if q.Intervals != nil {
+		args = append(args, filter.TZ)
+		fmtArgs = append(fmtArgs, q.Intervals[filter.Interval], fmt.Sprintf("$%d", len(args)))
+	}
+	query := fmt.Sprintf(q.Query, fmtArgs...)
+	page := fmt.Sprintf(`
+		SELECT q.*, count(*) OVER ()
+		  FROM (%s) q
+		 ORDER BY %s`, query, q.Sorts[filter.Sort])
+	pageArgs := args
+	if filter.Limit > 0 {
+		pageArgs = append(pageArgs, filter.Limit)
+		page += fmt.Sprintf(" LIMIT $%d", len(pageArgs))
+	}
+	if filter.Offset > 0 {
+		pageArgs = append(pageArgs, filter.Offset)
+		page += fmt.Sprintf(" OFFSET $%d", len(pageArgs))
+	}
+
+	rows, err := p.ReadDB().QueryContext(ctx, page, pageArgs...)
+	if err != nil {
+		log.Printf("%s (SELECT): %s", q.Name, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	total := 0
+	results := []interface{}{}
+	for rows.Next() {
+		if rows.Err() == io.EOF {
+			break
+		}
+		res, dest := q.New()
+		if err = rows.Scan(append(dest, &total)...); err != nil {
+			log.Printf("%s (Scan): %s", q.Name, err)
+			return nil, err
+		}
+		if l, ok := res.(localizer); ok && filter.Location != nil {
+			l.inLocation(filter.Location)
+		}
+		results = append(results, res)
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("%s (Err): %s", q.Name, err)
+		return nil, err
+	}
+
+	// An offset past the last result leaves nothing to read the total from.
+	if len(results) == 0 && filter.Offset > 0 {
+		err = p.ReadDB().QueryRowContext(ctx, fmt.Sprintf("SELECT count(*) FROM (%s) q", query), args...).Scan(&total)
+		if err != nil {
+			log.Printf("%s (count): %s", q.Name, err)
+			return nil, err
+		}
+	}
+
+	jsonBytes, err := json.Marshal(map[string][]interface{}{"results": results})
+	if err != nil {
+		log.Printf("%s (JSON): %s", q.Name, err)
+		return nil, fmt.Errorf("%w: %s", errSummaryEncoding, err)
+	}
+	return &summaryResult{Body: jsonBytes, Total: total}, nil
+}
+
+// CountCacheTTL is how long message counts are cached. Counts are cheap to
+// serve from cache and are often polled, and status updates drop them
+// from the cache anyway.
+const CountCacheTTL time.Duration = 10 * time.Second
+
+// CountHandler returns the number of messages for the given localpart, as
+// {"count": N}, without the cost of grouping them like the other summaries.
+// It accepts the same since, until, status and metadata filters, so
+// status=0 counts unread messages. strict=1 returns a 404 for no messages.
+func (p *RelayMsgParser) CountHandler() http.HandlerFunc {
+	q := summaryQuery{Name: "CountMessages", Sorts: map[string]string{"count": ""}, DefaultSort: "count"}
+	c := p.newSummaryCache(q.Name, CountCacheTTL)
+	return func(w http.ResponseWriter, r *http.Request) {
+		localpart := p.normalizeLocalpart(vestigo.Param(r, "localpart"))
+		strict := r.URL.Query().Get("strict") == "1"
+		filter, err := parseSummaryFilter(r, &q)
+		if err != nil {
+			writeJSONError(w, r, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+		key := p.summaryCacheKey(localpart, filter)
+		if sr, found := c.Get(key); found {
+			writeSummary(w, r, sr, strict)
+			return
+		}
+
+		where, args := filter.Where([]interface{}{localpart, p.Domain})
+		ctx, cancel := p.requestContext(r)
+		defer cancel()
+		var count int
+		err = p.ReadDB().QueryRowContext(ctx, fmt.Sprintf(`
+			SELECT count(*)
+			  FROM %s
+			 WHERE %s = $1 ||'@'|| $2%s
+		`, p.MsgTable(), p.recipientColumn(), where), args...).Scan(&count)
+		if err != nil {
+			log.Printf("%s (SELECT): %s", q.Name, err)
+			writeJSONError(w, r, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+
+		jsonBytes, err := json.Marshal(map[string]int{"count": count})
+		if err != nil {
+			log.Printf("%s (JSON): %s", q.Name, err)
+			writeJSONError(w, r, http.StatusInternalServerError, "encoding_error", "Encoding error")
+			return
+		}
+		sr := &summaryResult{Body: jsonBytes, Total: count}
+		c.Set(key, sr)
+		writeSummary(w, r, sr, strict)
+	}
+}
+
+// writeSummary sends a (possibly cached) summary to the client.
+func writeSummary(w http.ResponseWriter, r *http.Request, sr *summaryResult, strict bool) {
+	if strict && sr.Total == 0 {
+		writeJSONError(w, r, http.StatusNotFound, "not_found", "No messages for recipient")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Total-Count", strconv.Itoa(sr.Total))
+	w.Write(sr.Body)
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// get requests path from ts, returning the status and body.
+func get(t *testing.T, ts *testServer, path string, header http.Header) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest("GET", ts.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, vals := range header {
+		req.Header[name] = vals
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, string(body)
+}
+
+// summaryRows answers the subject summary query with one row, whose subject
+// describes the arguments it was run with, and whose count is a checksum of
+// the query.
+func summaryRows(q fakeQuery) (*fakeRows, error) {
+	if !strings.Contains(q.SQL, "count(distinct(smtp_from))") {
+		return nil, nil
+	}
+	args := []string{}
+	for _, arg := range q.Args {
+		if t, ok := arg.(time.Time); ok {
+			arg = t.UTC().Format(time.RFC3339Nano)
+		}
+		args = append(args, fmt.Sprint(arg))
+	}
+	return &fakeRows{Vals: [][]driver.Value{{strings.Join(args, " "), int64(crc32.ChecksumIEEE([]byte(q.SQL))), int64(1)}}}, nil
+}
+
+func TestSummaryFilterKey(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		same bool
+	}{
+		{"no filter", "", "", true},
+		{"sub-second since", "since=2024-01-01T00:00:00.1Z", "since=2024-01-01T00:00:00.2Z", false},
+		{"sub-second until", "until=2024-01-01T00:00:00.1Z", "until=2024-01-01T00:00:00Z", false},
+		{"same instant in different zones", "since=2024-01-01T00:00:00Z", "since=2024-01-01T01:00:00%2B01:00", true},
+		{"unix and RFC3339", "since=1704067200", "since=2024-01-01T00:00:00Z", true},
+		{"since and until", "since=1704067200", "until=1704067200", false},
+		{"status", "status=0", "status=1", false},
+		{"metadata", "meta_key=a&meta_value=b", "meta_key=a&meta_value=c", false},
+		{"metadata key and value", "meta_key=a%7C&meta_value=b", "meta_key=a&meta_value=%7Cb", false},
+		{"paging", "limit=10", "limit=10&offset=10", false},
+		{"sort", "sort=count", "", true},
+	}
+	q := summaryQuery{Sorts: map[string]string{"count": "", "subject": ""}, DefaultSort: "count"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys := []string{}
+			for _, query := range []string{tt.a, tt.b} {
+				f, err := parseSummaryFilter(httptest.NewRequest("GET", "/summary/x?"+query, nil), &q)
+				if err != nil {
+					t.Fatalf("%q: %s", query, err)
+				}
+				keys = append(keys, f.Key())
+			}
+			if same := keys[0] == keys[1]; same != tt.same {
+				t.Errorf("keys %q and %q: same = %t, want %t", keys[0], keys[1], same, tt.same)
+			}
+		})
+	}
+}
+
+func TestSummaryTimeRange(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		// args are the time arguments the query is expected to be run with.
+		args string
+	}{
+		{"RFC3339", "since=2024-01-01T00:00:00Z&until=2024-02-01T00:00:00Z", 200,
+			"2024-01-01T00:00:00Z 2024-02-01T00:00:00Z"},
+		{"unix", "since=1704067200", 200, "2024-01-01T00:00:00Z"},
+		{"sub-second", "until=2024-01-01T00:00:00.25Z", 200, "2024-01-01T00:00:00.25Z"},
+		{"malformed since", "since=yesterday", 400, ""},
+		{"malformed until", "until=2024-13-01T00:00:00Z", 400, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, &RelayMsgParser{}, nil, summaryRows)
+			status, body := get(t, ts, "/summary/user?"+tt.query, nil)
+			if status != tt.status {
+				t.Fatalf("status %d, want %d: %s", status, tt.status, body)
+			}
+			if tt.status != 200 {
+				if n := len(ts.DB.Queries("")); n != 0 {
+					t.Errorf("%d queries were run for a bad request", n)
+				}
+				return
+			}
+			want := "user example.com " + tt.args
+			if !strings.Contains(body, fmt.Sprintf("%q", want)) {
+				t.Errorf("got %s, want a query run with %q", body, want)
+			}
+		})
+	}
+}
+
+// TestSummaryCacheTimeRange checks that ranges differing by less than a
+// second aren't served each other's cached results.
+func TestSummaryCacheTimeRange(t *testing.T) {
+	ts := newTestServer(t, &RelayMsgParser{CacheTTL: time.Minute}, nil, summaryRows)
+	for i := 0; i < 2; i++ {
+		for _, since := range []string{"2024-01-01T00:00:00.1Z", "2024-01-01T00:00:00.2Z"} {
+			_, body := get(t, ts, "/summary/user?since="+since, nil)
+			res := struct{ Results []SummaryResponse }{}
+			if err := json.Unmarshal([]byte(body), &res); err != nil {
+				t.Fatal(err)
+			}
+			if len(res.Results) != 1 || !strings.HasSuffix(res.Results[0].Subject, since) {
+				t.Errorf("since=%s got %s", since, body)
+			}
+		}
+	}
+	if n := len(ts.DB.Queries("count(distinct(smtp_from))")); n != 2 {
+		t.Errorf("%d queries were run, want 2", n)
+	}
+}
+
+// TestSummaryCacheFilters checks that differently filtered summaries for the
+// same localpart are cached separately.
+func TestSummaryCacheFilters(t *testing.T) {
+	tests := []struct {
+		name    string
+		queries []string
+	}{
+		{"status", []string{"status=0", "status=1", ""}},
+		{"metadata", []string{"meta_key=campaign&meta_value=a", "meta_key=campaign&meta_value=b"}},
+		{"time range", []string{"since=1704067200", "until=1704067200"}},
+		{"paging", []string{"limit=1", "limit=1&offset=1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, &RelayMsgParser{CacheTTL: time.Minute}, nil, summaryRows)
+			first := map[string]string{}
+			// The second time round, every summary comes from the cache.
+			for i := 0; i < 2; i++ {
+				for _, query := range tt.queries {
+					status, body := get(t, ts, "/summary/user?"+query, nil)
+					if status != 200 {
+						t.Fatalf("%q: status %d: %s", query, status, body)
+					}
+					if i == 0 {
+						for other, otherBody := range first {
+							if body == otherBody {
+								t.Errorf("%q and %q both got %s", query, other, body)
+							}
+						}
+						first[query] = body
+					} else if body != first[query] {
+						t.Errorf("%q got %s from the cache, want %s", query, body, first[query])
+					}
+				}
+			}
+			if n := len(ts.DB.Queries("count(distinct(smtp_from))")); n != len(tt.queries) {
+				t.Errorf("%d queries were run, want %d", n, len(tt.queries))
+			}
+		})
+	}
+}
+
+func TestSummaryCacheKeyDomain(t *testing.T) {
+	f := &summaryFilter{Sort: "count"}
+	tests := []struct {
+		a, b RelayMsgParser
+		la   string
+		lb   string
+	}{
+		{RelayMsgParser{Domain: "a.example.com"}, RelayMsgParser{Domain: "b.example.com"}, "user", "user"},
+		{RelayMsgParser{Domain: "example.com"}, RelayMsgParser{Domain: "example.com"}, "user", "user2"},
+		// Quoting keeps a localpart from running into the domain.
+		{RelayMsgParser{Domain: "b@example.com"}, RelayMsgParser{Domain: "example.com"}, "a", "a@b"},
+	}
+	for _, tt := range tests {
+		ka, kb := tt.a.summaryCacheKey(tt.la, f), tt.b.summaryCacheKey(tt.lb, f)
+		if ka == kb {
+			t.Errorf("%s@%s and %s@%s share the key %q", tt.la, tt.a.Domain, tt.lb, tt.b.Domain, ka)
+		}
+	}
+}
+
+// TestSummaryNoSubject stores subjectless messages, and checks the summary
+// query groups them under NoSubject rather than an empty subject. The fake
+// database stands in for the query's coalesce(nullif(...)).
+func TestSummaryNoSubject(t *testing.T) {
+	tests := []struct {
+		name      string
+		normalize bool
+		subject   string
+		want      string
+	}{
+		{"empty subject", false, "", NoSubject},
+		{"blank subject normalized", true, "", NoSubject},
+		{"subject", false, "Hello", "Hello"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &RelayMsgParser{NormalizeSubjects: tt.normalize}
+			var ts *testServer
+			ts = newTestServer(t, p, nil, anyRows(storeRows, func(q fakeQuery) (*fakeRows, error) {
+				if !strings.Contains(q.SQL, "count(distinct(smtp_from))") {
+					return nil, nil
+				}
+				subjects := storedColumn(t, ts.DB, "subject")
+				if len(subjects) != 1 {
+					return nil, fmt.Errorf("%d messages stored", len(subjects))
+				}
+				subject := subjects[0]
+				if subject == "" && strings.Contains(q.SQL, "nullif(") &&
+					strings.Contains(q.SQL, "'"+NoSubject+"'") {
+					subject = NoSubject
+				}
+				return &fakeRows{Vals: [][]driver.Value{{subject, int64(1), int64(1)}}}, nil
+			}))
+			email := "From: sender@example.org\r\n\r\nhi\r\n"
+			if tt.subject != "" {
+				email = "Subject: " + tt.subject + "\r\n" + email
+			}
+			event := relayEvent(t, "sender@example.org", "user@example.com", tt.subject, email)
+			if err := p.ParseEvent(context.Background(), event, "req"); err != nil {
+				t.Fatal(err)
+			}
+
+			status, body := get(t, ts, "/summary/user", nil)
+			if status != http.StatusOK {
+				t.Fatalf("status %d: %s", status, body)
+			}
+			var res struct{ Results []SummaryResponse }
+			if err := json.Unmarshal([]byte(body), &res); err != nil {
+				t.Fatal(err)
+			}
+			if len(res.Results) != 1 || res.Results[0].Subject != tt.want {
+				t.Errorf("results %+v, want subject %q", res.Results, tt.want)
+			}
+		})
+	}
+}
+
+// TestRecipientRangeQueries checks that reads for a recipient match the
+// recipient column for equality and compare created as stored, so they can
+// range scan the (smtp_to, created) and (smtp_to_base, created) indexes.
+func TestRecipientRangeQueries(t *testing.T) {
+	const rng = "since=2024-01-01T00:00:00Z&until=2024-02-01T00:00:00Z"
+	tests := []struct {
+		name string
+		path string
+		// ranged is whether since and until are applied to the query.
+		ranged bool
+	}{
+		{"summary", "/summary/user?" + rng, true},
+		{"senders", "/summary/user/senders?" + rng, true},
+		{"timeline", "/summary/user/timeline?" + rng, true},
+		{"count", "/summary/user/count?" + rng, true},
+		{"threads", "/threads/user", false},
+		{"export", "/messages/user/export", false},
+	}
+	for _, tt := range tests {
+		for _, subaddressing := range []bool{false, true} {
+			col := "smtp_to"
+			if subaddressing {
+				col = "smtp_to_base"
+			}
+			t.Run(tt.name+"/"+col, func(t *testing.T) {
+				ts := newTestServer(t, &RelayMsgParser{Subaddressing: subaddressing}, nil, nil)
+				get(t, ts, tt.path, nil)
+				qs := ts.DB.Queries(col + " = $1 ||'@'|| $2")
+				if len(qs) == 0 {
+					t.Fatalf("no query matched %s for equality", col)
+				}
+				q := qs[0]
+				if q.Args[0] != "user" || q.Args[1] != "example.com" {
+					t.Errorf("args %v, want the localpart and domain first", q.Args)
+				}
+				if !tt.ranged {
+					return
+				}
+				for _, cond := range []string{"AND created >= $3", "AND created <= $4"} {
+					if !strings.Contains(q.SQL, cond) {
+						t.Errorf("query doesn't contain %q: %s", cond, q.SQL)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestSummaryRoute(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		// args are the arguments the query is expected to be run with.
+		args string
+	}{
+		{"no route", "", 200, "user example.com"},
+		{"route", "?route=billing", 200, "user example.com billing"},
+		{"route and range", "?since=1704067200&route=billing", 200, "user example.com 2024-01-01T00:00:00Z billing"},
+		{"invalid route", "?route=bill-ing", 400, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, &RelayMsgParser{CacheTTL: time.Minute}, nil, summaryRows)
+			// A summary cached for every route mustn't be served for one.
+			if status, body := get(t, ts, "/summary/user", nil); status != 200 {
+				t.Fatalf("status %d: %s", status, body)
+			}
+			status, body := get(t, ts, "/summary/user"+tt.query, nil)
+			if status != tt.status {
+				t.Fatalf("status %d, want %d: %s", status, tt.status, body)
+			}
+			if status != 200 {
+				return
+			}
+			if !strings.Contains(body, fmt.Sprintf("%q", tt.args)) {
+				t.Errorf("got %s, want a query run with %q", body, tt.args)
+			}
+			for _, q := range ts.DB.Queries("count(distinct(smtp_from))") {
+				if routed := strings.Contains(q.SQL, "AND route = $"); routed != (q.Args[len(q.Args)-1] == "billing") {
+					t.Errorf("route condition %t for args %v", routed, q.Args)
+				}
+			}
+		})
+	}
+}
+
+func TestSummaryEmpty(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler func(q fakeQuery) (*fakeRows, error)
+		query   string
+		status  int
+		body    string
+		// total is the X-Total-Count header expected, "" for none.
+		total string
+	}{
+		{"no messages", nil, "", http.StatusOK, `{"results":[]}`, "0"},
+		{"no messages, strict", nil, "?strict=1", http.StatusNotFound, "", ""},
+		{"messages", summaryRows, "", http.StatusOK, "", "1"},
+		{"messages, strict", summaryRows, "?strict=1", http.StatusOK, "", "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, &RelayMsgParser{}, nil, tt.handler)
+			res, err := http.Get(ts.URL + "/summary/user" + tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			body, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != tt.status {
+				t.Fatalf("status %d, want %d: %s", res.StatusCode, tt.status, body)
+			}
+			if tt.body != "" && strings.TrimSpace(string(body)) != tt.body {
+				t.Errorf("body %s, want %s", body, tt.body)
+			}
+			if total := res.Header.Get("X-Total-Count"); total != tt.total {
+				t.Errorf("X-Total-Count %q, want %q", total, tt.total)
+			}
+		})
+	}
+}
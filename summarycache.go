@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+
+	cache "github.com/patrickmn/go-cache"
+)
+
+// DefaultCacheTTL is how long summaries are cached.
+const DefaultCacheTTL time.Duration = 1 * time.Second
+
+// SummaryCache holds summary results between requests.
+type SummaryCache interface {
+	Get(key string) (*summaryResult, bool)
+	Set(key string, sr *summaryResult)
+	// DeletePrefix drops every entry whose key starts with prefix.
+	DeletePrefix(prefix string)
+}
+
+// memoryCache is a SummaryCache local to this process.
+type memoryCache struct {
+	c *cache.Cache
+}
+
+func newMemoryCache(ttl time.Duration) *memoryCache {
+	return &memoryCache{c: cache.New(ttl, ttl/2)}
+}
+
+func (mc *memoryCache) Get(key string) (*summaryResult, bool) {
+	res, found := mc.c.Get(key)
+	if !found {
+		return nil, false
+	}
+	return res.(*summaryResult), true
+}
+
+func (mc *memoryCache) Set(key string, sr *summaryResult) {
+	mc.c.Set(key, sr, cache.DefaultExpiration)
+}
+
+func (mc *memoryCache) DeletePrefix(prefix string) {
+	for key := range mc.c.Items() {
+		if strings.HasPrefix(key, prefix) {
+			mc.c.Delete(key)
+		}
+	}
+}
+
+// redisCache is a SummaryCache shared by every instance using the same
+// Redis server. Keys are prefixed with the name of the summary. When Redis
+// can't be reached, the in-memory fallback is used instead, so summaries
+// are still cached, if less effectively.
+type redisCache struct {
+	client   *RedisClient
+	name     string
+	ttl      time.Duration
+	fallback *memoryCache
+}
+
+func (rc *redisCache) key(key string) string {
+	return "relaymsg:" + rc.name + ":" + key
+}
+
+func (rc *redisCache) Get(key string) (*summaryResult, bool) {
+	val, err := rc.client.Get(rc.key(key))
+	if err == errRedisNil {
+		return nil, false
+	} else if err != nil {
+		log.Printf("SummaryCache (%s): %s, using memory\n", rc.name, err)
+		return rc.fallback.Get(key)
+	}
+	sr := &summaryResult{}
+	if err = json.Unmarshal([]byte(val), sr); err != nil {
+		log.Printf("SummaryCache (%s): %s\n", rc.name, err)
+		return nil, false
+	}
+	return sr, true
+}
+
+func (rc *redisCache) Set(key string, sr *summaryResult) {
+	jsonBytes, err := json.Marshal(sr)
+	if err != nil {
+		log.Printf("SummaryCache (%s): %s\n", rc.name, err)
+		return
+	}
+	if err = rc.client.Set(rc.key(key), string(jsonBytes), rc.ttl); err != nil {
+		log.Printf("SummaryCache (%s): %s, using memory\n", rc.name, err)
+		rc.fallback.Set(key, sr)
+	}
+}
+
+func (rc *redisCache) DeletePrefix(prefix string) {
+	rc.fallback.DeletePrefix(prefix)
+	if err := rc.client.DeletePrefix(rc.key(prefix)); err != nil {
+		log.Printf("SummaryCache (%s): %s\n", rc.name, err)
+	}
+}
+
+// newSummaryCache returns the cache for the named summary, in Redis when
+// it's configured and otherwise in memory. Entries last for ttl, or
+// CacheTTL when ttl is zero.
+func (p *RelayMsgParser) newSummaryCache(name string, ttl time.Duration) SummaryCache {
+	if ttl <= 0 {
+		ttl = p.CacheTTL
+	}
+	if ttl <= 0 {
+		ttl = DefaultCacheTTL
+	}
+	var c SummaryCache = newMemoryCache(ttl)
+	if p.Redis != nil {
+		c = &redisCache{client: p.Redis, name: name, ttl: ttl, fallback: c.(*memoryCache)}
+	}
+	p.summaryCaches = append(p.summaryCaches, c)
+	return c
+}
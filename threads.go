@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/husobee/vestigo"
+)
+
+// messageIDs returns the ids in a Message-ID, In-Reply-To or References
+// header, without their angle brackets.
+func messageIDs(header string) []string {
+	ids := []string{}
+	for _, field := range strings.Fields(header) {
+		if id := strings.Trim(field, "<>,"); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// ThreadKey returns the Message-ID of the first message in the
+// conversation a message belongs to: the first of its References, or
+// failing that its In-Reply-To, or its own Message-ID when it starts a
+// thread. It returns nil when the message has none of those headers, so it
+// makes a thread on its own.
+func ThreadKey(headers []map[string]string) interface{} {
+	for _, name := range []string{"References", "In-Reply-To", "Message-ID"} {
+		if ids := messageIDs(headerValue(headers, name)); len(ids) > 0 {
+			return ids[0]
+		}
+	}
+	return nil
+}
+
+// threadExpr gives a message's thread, which is its own id when it isn't
+// part of a conversation.
+const threadExpr = "coalesce(thread_id, message_id::text)"
+
+// Thread is a conversation: messages which reply to each other, oldest
+// first.
+type Thread struct {
+	Thread   string            `json:"thread"`
+	Subject  string            `json:"subject"`
+	Latest   time.Time         `json:"latest"`
+	Messages []MessageListItem `json:"messages"`
+}
+
+// ThreadsHandler lists the conversations in the given localpart's messages,
+// with the most recently active first. Messages are grouped by the
+// References and In-Reply-To headers they were stored with; those without
+// are threads of their own. It returns 50 threads by default, or up to 500
+// with limit, skipping offset threads.
+func (p *RelayMsgParser) ThreadsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		localpart := p.normalizeLocalpart(vestigo.Param(r, "localpart"))
+		limit, err := limitParam(r, 50, 500)
+		if err != nil {
+			writeJSONError(w, r, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+		offset := 0
+		if val := r.URL.Query().Get("offset"); val != "" {
+			if offset, err = strconv.Atoi(val); err != nil || offset < 0 {
+				writeJSONError(w, r, http.StatusBadRequest, "bad_request", fmt.Sprintf("invalid offset: %q", val))
+				return
+			}
+		}
+
+		ctx, cancel := p.requestContext(r)
+		defer cancel()
+		list, err := p.listMessages(ctx, fmt.Sprintf(`
+			WITH t AS (
+				SELECT %[1]s AS thread, max(created) AS latest
+				  FROM %[2]s
+				 WHERE %[3]s = $1 ||'@'|| $2
+				 GROUP BY 1
+				 ORDER BY latest DESC, thread
+				 LIMIT $3 OFFSET $4
+			)
+			SELECT %[4]s
+			  FROM %[2]s JOIN t ON %[1]s = t.thread
+			 WHERE %[3]s = $1 ||'@'|| $2
+			 ORDER BY t.latest DESC, t.thread, created, message_id
+		`, threadExpr, p.MsgTable(), p.recipientColumn(), messageListColumns),
+			localpart, p.Domain, limit, offset)
+		if err != nil {
+			log.Printf("ListThreads: %s", err)
+			writeJSONError(w, r, http.StatusInternalServerError, "database_error", "Database error")
+			return
+		}
+
+		threads := []*Thread{}
+		for _, m := range list {
+			if len(threads) == 0 || threads[len(threads)-1].Thread != m.Thread {
+				threads = append(threads, &Thread{Thread: m.Thread, Subject: m.Subject})
+			}
+			t := threads[len(threads)-1]
+			t.Messages = append(t.Messages, m)
+			if m.Created.After(t.Latest) {
+				t.Latest = m.Created
+			}
+		}
+		writeJSON(w, r, map[string][]*Thread{"results": threads})
+	}
+}
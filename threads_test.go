@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestThreadKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []map[string]string
+		want    interface{}
+	}{
+		{"starts a thread", []map[string]string{{"Message-ID": "<a@example.com>"}}, "a@example.com"},
+		{"reply", []map[string]string{{"Message-ID": "<b@example.com>"}, {"In-Reply-To": "<a@example.com>"}}, "a@example.com"},
+		{"reply to a reply", []map[string]string{
+			{"Message-ID": "<c@example.com>"},
+			{"In-Reply-To": "<b@example.com>"},
+			{"References": "<a@example.com> <b@example.com>"},
+		}, "a@example.com"},
+		{"folded references", []map[string]string{{"References": "\r\n <a@example.com>,\r\n\t<b@example.com>"}}, "a@example.com"},
+		{"header case", []map[string]string{{"message-id": "<a@example.com>"}}, "a@example.com"},
+		{"empty references", []map[string]string{{"References": " "}, {"In-Reply-To": "<a@example.com>"}}, "a@example.com"},
+		{"no ids", []map[string]string{{"Subject": "hi"}}, nil},
+		{"no headers", nil, nil},
+	}
+	for _, tt := range tests {
+		if got := ThreadKey(tt.headers); got != tt.want {
+			t.Errorf("%s: ThreadKey = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// relayEventWithHeaders is a relay message event with headers.
+func relayEventWithHeaders(t *testing.T, headers []map[string]string) *json.RawMessage {
+	t.Helper()
+	var event map[string]map[string]map[string]interface{}
+	if err := json.Unmarshal(*relayEvent(t, "ann@example.org", "bob@example.com", "hi", "Subject: hi\r\n\r\nhi\r\n"), &event); err != nil {
+		t.Fatal(err)
+	}
+	event["msys"]["relay_message"]["content"].(map[string]interface{})["headers"] = headers
+	data, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := json.RawMessage(data)
+	return &raw
+}
+
+func TestThreadStored(t *testing.T) {
+	p := &RelayMsgParser{}
+	ts := newTestServer(t, p, nil, storeRows)
+	for _, headers := range [][]map[string]string{
+		{{"Message-ID": "<a@example.com>"}},
+		{{"Message-ID": "<b@example.com>"}, {"References": "<a@example.com>"}},
+		{{"Subject": "hi"}},
+	} {
+		if err := p.ParseEvent(context.Background(), relayEventWithHeaders(t, headers), "req"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := storedColumn(t, ts.DB, "thread_id")
+	if want := []driver.Value{"a@example.com", "a@example.com", nil}; !reflect.DeepEqual(got, want) {
+		t.Errorf("thread_id stored as %v, want %v", got, want)
+	}
+}
+
+func TestThreadsHandler(t *testing.T) {
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	// row is a message as listMessages selects it.
+	row := func(id int64, thread, subject string, created time.Time) []driver.Value {
+		return []driver.Value{id, "ann@example.org", "bob@example.com", "bob@example.com", subject, created, "", "", thread, ""}
+	}
+	tests := []struct {
+		name   string
+		query  string
+		rows   [][]driver.Value
+		status int
+		// threads is the ids of the messages in each thread returned, and
+		// args what the query was run with.
+		threads [][]int64
+		args    []driver.Value
+	}{
+		{"grouped", "", [][]driver.Value{
+			row(3, "a@example.com", "Lunch?", day),
+			row(5, "a@example.com", "Re: Lunch?", day.Add(2*time.Hour)),
+			row(4, "4", "Alone", day.Add(time.Hour)),
+		}, http.StatusOK, [][]int64{{3, 5}, {4}}, []driver.Value{"bob", "example.com", 50, 0}},
+		{"paged", "?limit=1&offset=1", [][]driver.Value{
+			row(4, "4", "Alone", day.Add(time.Hour)),
+		}, http.StatusOK, [][]int64{{4}}, []driver.Value{"bob", "example.com", 1, 1}},
+		{"none", "", nil, http.StatusOK, [][]int64{}, []driver.Value{"bob", "example.com", 50, 0}},
+		{"bad offset", "?offset=-1", nil, http.StatusBadRequest, nil, nil},
+		{"limit capped", "?limit=501", nil, http.StatusOK, [][]int64{}, []driver.Value{"bob", "example.com", 500, 0}},
+		{"bad limit", "?limit=0", nil, http.StatusBadRequest, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, &RelayMsgParser{}, nil, func(q fakeQuery) (*fakeRows, error) {
+				if strings.Contains(q.SQL, "GROUP BY") {
+					return &fakeRows{Vals: tt.rows}, nil
+				}
+				return nil, nil
+			})
+			status, body := get(t, ts, "/threads/bob"+tt.query, nil)
+			if status != tt.status {
+				t.Fatalf("status %d: %s", status, body)
+			}
+			if status != http.StatusOK {
+				if qs := ts.DB.Queries("GROUP BY"); len(qs) != 0 {
+					t.Error("queried for a bad request")
+				}
+				return
+			}
+			var res struct{ Results []Thread }
+			if err := json.Unmarshal([]byte(body), &res); err != nil {
+				t.Fatal(err)
+			}
+			threads := [][]int64{}
+			for _, th := range res.Results {
+				ids := []int64{}
+				for _, m := range th.Messages {
+					ids = append(ids, m.ID)
+				}
+				threads = append(threads, ids)
+				// A thread is named by its first message, and active as of
+				// its last.
+				last := th.Messages[len(th.Messages)-1]
+				if th.Thread != th.Messages[0].Thread || th.Subject != th.Messages[0].Subject || !th.Latest.Equal(last.Created) {
+					t.Errorf("thread %+v", th)
+				}
+			}
+			if !reflect.DeepEqual(threads, tt.threads) {
+				t.Errorf("threads %v, want %v", threads, tt.threads)
+			}
+			if qs := ts.DB.Queries("GROUP BY"); len(qs) != 1 {
+				t.Errorf("queried %d times", len(qs))
+			} else if !reflect.DeepEqual(qs[0].Args, tt.args) {
+				t.Errorf("queried with %v, want %v", qs[0].Args, tt.args)
+			}
+		})
+	}
+}
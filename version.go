@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+)
+
+// Build information, set at build time with, for example:
+//
+//	go build -ldflags "-X main.GitCommit=$(git rev-parse HEAD) -X main.BuildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	GitCommit = "dev"
+	BuildTime = "dev"
+)
+
+type VersionResponse struct {
+	GitCommit string `json:"git_commit"`
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+}
+
+// VersionHandler reports which build is running.
+func VersionHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, VersionResponse{
+		GitCommit: GitCommit,
+		BuildTime: BuildTime,
+		GoVersion: runtime.Version(),
+	})
+}
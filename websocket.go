@@ -0,0 +1,120 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsWriteTimeout limits how long a single message may take to send, so a
+// stuck client can't hold up its handler forever.
+const wsWriteTimeout time.Duration = 10 * time.Second
+
+// wsPingInterval is how often idle connections are pinged. A client which
+// hasn't answered within two intervals is assumed gone.
+const wsPingInterval time.Duration = 30 * time.Second
+
+// wsMaxMessage is the largest message accepted from a client. Clients have
+// no reason to send anything but control frames, which are smaller still.
+const wsMaxMessage int64 = 64 * 1024
+
+// checkWSOrigin reports whether a WebSocket may be opened for r. Browsers
+// send cookies and other credentials along with WebSocket upgrades from any
+// site, so only pages on the server's own origin, or one of WSOrigins, may
+// open one. Requests without an Origin aren't from a browser, and are let
+// through.
+func (p *RelayMsgParser) checkWSOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range p.WSOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// WebSocketHandler upgrades to a WebSocket, and sends a JSON message for each
+// new message stored for the given localpart, until the client disconnects.
+func (p *RelayMsgParser) WebSocketHandler() http.HandlerFunc {
+	upgrader := &websocket.Upgrader{
+		CheckOrigin: p.checkWSOrigin,
+		Error: func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+			writeJSONError(w, r, status, "bad_request", "WebSocket upgrade required")
+		},
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Checked before subscribing, so a rejected page can't make the
+		// server LISTEN on its behalf.
+		if !p.checkWSOrigin(r) {
+			writeJSONError(w, r, http.StatusForbidden, "forbidden", "Origin not allowed")
+			return
+		}
+		ch, unsubscribe := p.subscribeRecipient(w, r)
+		if ch == nil {
+			return
+		}
+		defer unsubscribe()
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Printf("WebSocketHandler (upgrade): %s\n", err)
+			return
+		}
+		defer conn.Close()
+
+		// Reading answers the client's pings and close, and notices when
+		// it's gone; anything else it sends is discarded. Messages are
+		// read through, rather than skipped, so the limit applies to all
+		// of a fragmented one.
+		closed := make(chan struct{})
+		conn.SetReadLimit(wsMaxMessage)
+		conn.SetReadDeadline(time.Now().Add(2 * wsPingInterval))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(2 * wsPingInterval))
+		})
+		go func() {
+			defer close(closed)
+			for {
+				_, msg, err := conn.NextReader()
+				if err != nil {
+					return
+				}
+				if _, err = io.Copy(io.Discard, msg); err != nil {
+					return
+				}
+			}
+		}()
+
+		keepalive := time.NewTicker(wsPingInterval)
+		defer keepalive.Stop()
+		for {
+			select {
+			case <-closed:
+				return
+			case <-keepalive.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout)); err != nil {
+					return
+				}
+			case payload, ok := <-ch:
+				if !ok {
+					conn.WriteControl(websocket.CloseMessage,
+						websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(wsWriteTimeout))
+					return
+				}
+				conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+				if err := conn.WriteMessage(websocket.TextMessage, payload); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
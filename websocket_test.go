@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/lib/pq"
+)
+
+// newWSServer returns a test server pushing notifications from l, which
+// may open WebSockets from origins.
+func newWSServer(t *testing.T, l *fakeListener, origins ...string) *testServer {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	p := &RelayMsgParser{Notifier: newNotifier(ctx, l), WSOrigins: origins}
+	return newTestServer(t, p, nil, nil)
+}
+
+// dialWS opens a WebSocket for user's messages, with header.
+func dialWS(ts *testServer, dialer *websocket.Dialer, header http.Header) (*websocket.Conn, *http.Response, error) {
+	return dialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws/user", header)
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	tests := []struct {
+		name    string
+		origins []string
+		origin  string
+		ok      bool
+	}{
+		{"no origin", nil, "", true},
+		{"same origin", nil, "same", true},
+		{"allowed origin", []string{"https://inbox.example.com"}, "https://inbox.example.com", true},
+		{"any origin", []string{"*"}, "https://other.example.com", true},
+		{"other origin", []string{"https://inbox.example.com"}, "https://evil.example.com", false},
+		{"no origins allowed", nil, "https://evil.example.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newFakeListener()
+			ts := newWSServer(t, l, tt.origins...)
+			header := http.Header{}
+			if tt.origin == "same" {
+				header.Set("Origin", ts.URL)
+			} else if tt.origin != "" {
+				header.Set("Origin", tt.origin)
+			}
+			var conn *websocket.Conn
+			var res *http.Response
+			var err error
+			// Subscribing waits on pending notifications being taken.
+			go l.deliverPending()
+			within(t, "dial", func() { conn, res, err = dialWS(ts, websocket.DefaultDialer, header) })
+			if !tt.ok {
+				if err == nil {
+					conn.Close()
+					t.Fatal("upgraded")
+				}
+				if res == nil || res.StatusCode != http.StatusForbidden {
+					t.Errorf("response %v, want a 403", res)
+				}
+				if l.Listening(NotifyChannel("user@example.com")) {
+					t.Error("listening for a rejected page")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+		})
+	}
+}
+
+func TestWebSocketNotUpgrade(t *testing.T) {
+	l := newFakeListener()
+	ts := newWSServer(t, l)
+	go l.deliverPending()
+	var status int
+	var body string
+	within(t, "GET", func() { status, body = get(t, ts, "/ws/user", nil) })
+	if status != http.StatusBadRequest || !strings.Contains(body, "WebSocket upgrade required") {
+		t.Errorf("status %d: %s", status, body)
+	}
+}
+
+func TestWebSocketMessages(t *testing.T) {
+	channel := NotifyChannel("user@example.com")
+	tests := []struct {
+		name string
+		// send is what the client sends before the notification; closed
+		// is the close code it should then get instead, or 0.
+		send   func(conn *websocket.Conn) error
+		closed int
+		// writeBuffer is the client's write buffer size, which is how
+		// large each frame of a message it sends may be.
+		writeBuffer int
+	}{
+		{"nothing", func(conn *websocket.Conn) error { return nil }, 0, 256},
+		{"ping", func(conn *websocket.Conn) error {
+			return conn.WriteControl(websocket.PingMessage, []byte("hi"), time.Now().Add(time.Second))
+		}, 0, 256},
+		{"fragmented message", func(conn *websocket.Conn) error {
+			// With a small write buffer, the message goes in many frames.
+			w, err := conn.NextWriter(websocket.TextMessage)
+			if err != nil {
+				return err
+			}
+			if _, err = w.Write([]byte(strings.Repeat("x", 4096))); err != nil {
+				return err
+			}
+			return w.Close()
+		}, 0, 256},
+		{"oversized message", func(conn *websocket.Conn) error {
+			return conn.WriteMessage(websocket.BinaryMessage, make([]byte, wsMaxMessage+1))
+		}, websocket.CloseMessageTooBig, 2 * int(wsMaxMessage)},
+		{"oversized fragmented message", func(conn *websocket.Conn) error {
+			return conn.WriteMessage(websocket.BinaryMessage, make([]byte, wsMaxMessage+1))
+		}, websocket.CloseMessageTooBig, 256},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newFakeListener()
+			ts := newWSServer(t, l)
+			dialer := &websocket.Dialer{WriteBufferSize: tt.writeBuffer}
+			var conn *websocket.Conn
+			var err error
+			go l.deliverPending()
+			within(t, "dial", func() { conn, _, err = dialWS(ts, dialer, nil) })
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			pongs := make(chan string, 1)
+			conn.SetPongHandler(func(data string) error {
+				pongs <- data
+				return nil
+			})
+
+			if err = tt.send(conn); err != nil {
+				t.Fatal(err)
+			}
+			if tt.closed == 0 {
+				within(t, "notify", func() {
+					l.notify <- &pq.Notification{Channel: channel, Extra: `{"id":42}`}
+				})
+			}
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			for {
+				kind, msg, err := conn.ReadMessage()
+				if tt.closed != 0 {
+					if !websocket.IsCloseError(err, tt.closed) {
+						t.Errorf("error %v, want close %d", err, tt.closed)
+					}
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(msg) == "pending" {
+					continue
+				}
+				if kind != websocket.TextMessage || string(msg) != `{"id":42}` {
+					t.Errorf("got %d %q", kind, msg)
+				}
+				break
+			}
+			if tt.name == "ping" {
+				// The pong may follow the message; reading until the
+				// deadline handles it.
+				conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+				conn.ReadMessage()
+				select {
+				case data := <-pongs:
+					if data != "hi" {
+						t.Errorf("pong %q", data)
+					}
+				default:
+					t.Error("ping wasn't answered")
+				}
+			}
+		})
+	}
+}
+
+func TestWebSocketClose(t *testing.T) {
+	channel := NotifyChannel("user@example.com")
+	l := newFakeListener()
+	ts := newWSServer(t, l)
+	var conn *websocket.Conn
+	var err error
+	go l.deliverPending()
+	within(t, "dial", func() { conn, _, err = dialWS(ts, websocket.DefaultDialer, nil) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !l.Listening(channel) {
+		t.Fatal("not listening")
+	}
+
+	// Closing unsubscribes, which waits on pending notifications.
+	err = conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("error %v, want the close echoed", err)
+	}
+	conn.Close()
+	go l.deliverPending()
+	for deadline := time.Now().Add(5 * time.Second); l.Listening(channel); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("still listening after the client went away")
+		}
+	}
+}